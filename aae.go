@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// AAE policies for AAEPolicy. iOS saves the edits made to a photo in the
+// Photos app as an .AAE file next to it when exporting the original, named
+// after the photo (IMG_1234.AAE, and IMG_O1234.AAE for the adjustments of
+// the original of an edited photo, IMG_E1234.JPG).
+const (
+	// aaePair renames (or copies or moves) AAE files along with their
+	// photos.
+	aaePair = "pair"
+	// aaeIgnore leaves AAE files where they are.
+	aaeIgnore = "ignore"
+	// aaeDrop deletes the AAE files of photos once they are renamed or moved,
+	// for keeping only the originals. In copy mode they are not copied.
+	aaeDrop = "drop"
+)
+
+// parseAAEPolicy validates an -aae value.
+func parseAAEPolicy(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case aaePair:
+		return aaePair, nil
+	case aaeIgnore:
+		return aaeIgnore, nil
+	case aaeDrop:
+		return aaeDrop, nil
+	}
+	return "", fmt.Errorf("unknown AAE policy %q (want pair, ignore or drop)", value)
+}
+
+// Sidecar is a file that belongs to a renamed file, such as an AAE file or
+// the video of a Live Photo, and its new path. NewFilePath is empty if it
+// was deleted.
+type Sidecar struct {
+	FilePath    string
+	NewFilePath string
+}
+
+// iosNameRegexp matches the names iOS gives photos, capturing the number.
+var iosNameRegexp = regexp.MustCompile(`^IMG_(\d+)$`)
+
+// findAAE returns the AAE files of the photo filePath.
+func findAAE(filePath string) []Sidecar {
+	dir, name := filepath.Split(filePath)
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	candidates := []sidecarCandidate{{stem + ".AAE", ".AAE"}, {stem + ".aae", ".aae"}}
+	if match := iosNameRegexp.FindStringSubmatch(stem); match != nil {
+		candidates = append(candidates, sidecarCandidate{"IMG_O" + match[1] + ".AAE", "_O.AAE"}, sidecarCandidate{"IMG_O" + match[1] + ".aae", "_O.aae"})
+	}
+	return findSidecars(dir, candidates)
+}
+
+// sidecarCandidate is the name of a file that may belong to another, and
+// what is appended to the new name of that file (without extension) for its
+// own new name, so that the sidecars of a file don't collide.
+type sidecarCandidate struct {
+	name   string
+	suffix string
+}
+
+// findSidecars returns the candidates that exist in dir as regular files,
+// with the suffix of their new name as NewFilePath.
+func findSidecars(dir string, candidates []sidecarCandidate) []Sidecar {
+	var sidecars []Sidecar
+	var found []fs.FileInfo
+	for _, candidate := range candidates {
+		sidecarPath := filepath.Join(dir, candidate.name)
+		fileInfo, err := os.Lstat(sidecarPath)
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		duplicate := false
+		for _, other := range found {
+			// Names that differ only in case are the same file on
+			// case-insensitive file systems.
+			duplicate = duplicate || os.SameFile(fileInfo, other)
+		}
+		if duplicate {
+			continue
+		}
+		found = append(found, fileInfo)
+		sidecars = append(sidecars, Sidecar{FilePath: sidecarPath, NewFilePath: candidate.suffix})
+	}
+	return sidecars
+}
+
+// moveSidecars applies AAEPolicy to the AAE files of a renamed photo, whose
+// new path is result.NewFilePath, moves its companions (see findCompanions)
+// along with it and records them all in result.Sidecars. move puts a file at
+// its new path, as for collisionResolver. Sidecars are not replaced if their
+// new name is taken; problems are reported as warnings, as the photo itself
+// has been renamed.
+func (jpegidCmd *JpegIDCmd) moveSidecars(result *RenameResult, move func(oldPath, newPath string) error) {
+	var sidecars []Sidecar
+	if jpegidCmd.AAEPolicy != aaeIgnore {
+		sidecars = findAAE(result.FilePath)
+	}
+	// The first drop sidecars are AAE files to delete.
+	drop := 0
+	if jpegidCmd.AAEPolicy == aaeDrop {
+		drop = len(sidecars)
+	}
+	sidecars = append(sidecars, jpegidCmd.findCompanions(result.FilePath)...)
+	if len(sidecars) == 0 {
+		return
+	}
+	newStem := strings.TrimSuffix(result.NewFilePath, filepath.Ext(result.NewFilePath))
+	for i, sidecar := range sidecars {
+		if i < drop {
+			sidecar.NewFilePath = ""
+			if !jpegidCmd.DryRun && jpegidCmd.CopyTo == "" {
+				err := os.Remove(sidecar.FilePath)
+				if err != nil {
+					result.Warning = strings.TrimPrefix(result.Warning+"; unable to delete "+sidecar.FilePath+": "+err.Error(), "; ")
+					continue
+				}
+			}
+			result.Sidecars = append(result.Sidecars, sidecar)
+			continue
+		}
+		sidecar.NewFilePath = newStem + sidecar.NewFilePath
+		if !jpegidCmd.DryRun {
+			_, err := os.Lstat(sidecar.NewFilePath)
+			if err == nil {
+				err = fmt.Errorf("%w: %s", ErrCollision, sidecar.NewFilePath)
+			} else if errors.Is(err, fs.ErrNotExist) {
+				err = move(sidecar.FilePath, sidecar.NewFilePath)
+			}
+			if err != nil {
+				result.Warning = strings.TrimPrefix(result.Warning+"; unable to move "+sidecar.FilePath+": "+err.Error(), "; ")
+				continue
+			}
+		}
+		result.Sidecars = append(result.Sidecars, sidecar)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ApplyCmd struct {
+	// PlanFile is the -output json plan of a dry run to carry out, or - for
+	// stdin.
+	PlanFile string
+	// Verify only checks that the files of the plan are still the ones it
+	// was made for, renaming nothing.
+	Verify bool
+	// OnCollision is the collision policy of the files whose entry in the
+	// plan records none. Those that record one follow it.
+	OnCollision string
+	JournalDir  string
+	// Recover is how runs in JournalDir that crashed in the middle of a
+	// rename are dealt with first, as with JpegIDCmd.Recover.
+	Recover string
+	// DirMode is the mode of the directories created for new paths, as
+	// with JpegIDCmd.DirMode.
+	DirMode fs.FileMode
+	// Roots are where the roots of a Relative plan are now, in the order
+	// of its roots, for a tree mounted elsewhere since the plan was made.
+	// Roots not given are where the plan says.
+	Roots  []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ApplyCommand parses the arguments of
+//
+//	jpegid apply [flags] <plan.json>
+func ApplyCommand(args []string) (*ApplyCmd, error) {
+	applyCmd := &ApplyCmd{
+		OnCollision: collisionSkip,
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+	}
+	flagset := flag.NewFlagSet("apply", flag.ContinueOnError)
+	flagset.BoolVar(&applyCmd.Verify, "verify", false, "Only check that the files of the plan have not changed since it was made, without renaming anything.")
+	flagset.Func("on-collision", "What to do if the new name of a file is taken, for files the plan records no policy for: skip (default), replace, suffix or ask.", func(value string) error {
+		var err error
+		applyCmd.OnCollision, err = parseCollisionPolicy(value)
+		return err
+	})
+	flagset.StringVar(&applyCmd.JournalDir, "journal-dir", "", "Directory to record the renames in, for recovering from a crash (default: jpegid/journal in the user cache directory).")
+	flagset.Func("recover", "What to do with a previous run that crashed in the middle of renaming files: forward (finish its renames) or back (undo it). Asked on stdin if not set, so it is required when the plan is read from stdin.", func(value string) error {
+		var err error
+		applyCmd.Recover, err = parseRecoverAction(value)
+		return err
+	})
+	flagset.Func("dir-mode", "Create the directories of new paths with this octal mode (e.g. 2775 for directories shared by a group) instead of 777 less the umask.", func(value string) error {
+		var err error
+		applyCmd.DirMode, err = parseDirMode(value)
+		return err
+	})
+	flagset.Func("root", "Where a root of a plan made with -relative-paths is now, if it was mounted elsewhere since the plan was made. Repeat for each root, in the order of the roots of the plan.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		applyCmd.Roots = append(applyCmd.Roots, root)
+		return nil
+	})
+	err := flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 1 {
+		return nil, fmt.Errorf("usage: jpegid apply [flags] <plan.json>")
+	}
+	applyCmd.PlanFile = flagset.Arg(0)
+	if applyCmd.JournalDir == "" {
+		applyCmd.JournalDir, err = defaultJournalDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return applyCmd, nil
+}
+
+// Run renames the files of the plan that are still the files it was made
+// for, skipping those that changed since with ErrChanged, so that a plan
+// reviewed a while ago never renames a file after metadata that has since
+// been edited. The sidecars of a file are renamed or deleted along with it
+// as the plan says.
+func (applyCmd *ApplyCmd) Run(ctx context.Context) error {
+	plan, err := applyCmd.readPlan()
+	if err != nil {
+		return err
+	}
+	roots, err := applyCmd.planRoots(plan)
+	if err != nil {
+		return err
+	}
+	summary := newRunSummary(roots, applyCmd.Verify)
+	var journalWriter *journalWriter
+	resolver := newCollisionResolver(applyCmd.OnCollision, applyCmd.Stdin, applyCmd.Stderr)
+	if !applyCmd.Verify {
+		recovery := &journalRecovery{
+			action:  applyCmd.Recover,
+			roots:   roots,
+			dirMode: applyCmd.DirMode,
+			stdin:   applyCmd.Stdin,
+			stderr:  applyCmd.Stderr,
+			now:     time.Now,
+		}
+		if applyCmd.PlanFile == "-" {
+			recovery.stdin = nil
+		}
+		err := recovery.recoverJournals(ctx, applyCmd.JournalDir)
+		if err != nil {
+			return err
+		}
+		journalWriter = newJournalWriter(applyCmd.JournalDir, time.Now(), roots, append([]string{"apply"}, applyCmd.PlanFile))
+		// The intent is recorded once the collision policy has settled on
+		// the path the file is renamed to, followed by its outcome.
+		move := resolver.move
+		resolver.move = func(oldPath, newPath string) error {
+			err := journalWriter.intend(time.Now(), oldPath, newPath)
+			if err != nil {
+				return fmt.Errorf("journal: %w", err)
+			}
+			err = move(oldPath, newPath)
+			var journalErr error
+			if err != nil {
+				journalErr = journalWriter.fail(time.Now(), oldPath, newPath)
+			} else {
+				journalErr = journalWriter.rename(time.Now(), oldPath, newPath)
+			}
+			if journalErr != nil {
+				fmt.Fprintf(applyCmd.Stderr, "warning: journal: %v\n", journalErr)
+			}
+			return err
+		}
+	}
+	for i := range plan.Files {
+		if ctx.Err() != nil {
+			break
+		}
+		entry := &plan.Files[i]
+		if entry.Action != "rename" {
+			continue
+		}
+		filePath, newFilePath, err := entry.resolve(roots)
+		if err != nil {
+			return err
+		}
+		root := ""
+		if entry.Root != nil {
+			root = roots[*entry.Root]
+		} else if rootIndex, _, ok := innermostRoot(roots, filePath); ok {
+			root = roots[rootIndex]
+		}
+		err = verifyPlanEntry(entry, filePath)
+		if applyCmd.Verify {
+			summary.add(root, err)
+			if err != nil {
+				fmt.Fprintf(applyCmd.Stdout, "%-7s %s: %v\n", "changed", filePath, err)
+			} else {
+				fmt.Fprintf(applyCmd.Stdout, "%-7s %s\n", "ok", filePath)
+			}
+			continue
+		}
+		plannedPath := newFilePath
+		if err == nil {
+			newFilePath, err = applyCmd.rename(ctx, resolver, filePath, newFilePath, entry.collisionPolicy())
+		}
+		summary.add(root, err)
+		if err != nil {
+			fmt.Fprintf(applyCmd.Stderr, "%s: %v\n", filePath, err)
+			continue
+		}
+		fmt.Fprintf(applyCmd.Stdout, "%s => %s\n", filePath, newFilePath)
+		applyCmd.moveSidecars(entry, roots, plannedPath, newFilePath, resolver.move)
+	}
+	if journalWriter != nil {
+		err := journalWriter.close(time.Now(), summary, ctx.Err() == nil)
+		if err != nil {
+			fmt.Fprintf(applyCmd.Stderr, "warning: journal: %v\n", err)
+		}
+	}
+	_ = summary.writeText(applyCmd.Stderr, func(path string) string { return path })
+	if applyCmd.Verify && (summary.Skipped > 0 || summary.Errors > 0) {
+		return fmt.Errorf("%d of %d files changed since the plan was made", summary.Skipped+summary.Errors, summary.Skipped+summary.Errors+summary.Renamed)
+	}
+	return ctx.Err()
+}
+
+// readPlan reads the plan in PlanFile, which must be of a dry run.
+func (applyCmd *ApplyCmd) readPlan() (*renamePlan, error) {
+	var b []byte
+	var err error
+	if applyCmd.PlanFile == "-" {
+		b, err = io.ReadAll(applyCmd.Stdin)
+	} else {
+		b, err = os.ReadFile(applyCmd.PlanFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var plan renamePlan
+	err = json.Unmarshal(b, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", applyCmd.PlanFile, err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("%s: unsupported plan version %d (want %d)", applyCmd.PlanFile, plan.Version, planVersion)
+	}
+	if !plan.DryRun {
+		return nil, fmt.Errorf("%s: not the plan of a dry run, its files are already renamed", applyCmd.PlanFile)
+	}
+	if plan.Mode != "" && plan.Mode != planModeRename {
+		// Copies and merges are made by jpegid itself, along with the
+		// checks for duplicates of a merge.
+		return nil, fmt.Errorf("%s: plan of a %s, which can only be carried out by running it again without -dry-run", applyCmd.PlanFile, plan.Mode)
+	}
+	for i := range plan.Files {
+		policy := plan.Files[i].collisionPolicy()
+		if policy == "" {
+			continue
+		}
+		_, err := parseCollisionPolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", applyCmd.PlanFile, plan.Files[i].Path, err)
+		}
+	}
+	return &plan, nil
+}
+
+// moveSidecars renames the sidecars of entry after its file, planned to be
+// renamed to plannedPath, was renamed to newFilePath, keeping them next to
+// it if the collision policy gave it another name, and deletes those the plan
+// deletes. Like the renames of sidecars in a run, problems are warnings, as
+// the file has been renamed by then.
+func (applyCmd *ApplyCmd) moveSidecars(entry *planEntry, roots []string, plannedPath, newFilePath string, move func(oldPath, newPath string) error) {
+	plannedStem := strings.TrimSuffix(plannedPath, filepath.Ext(plannedPath))
+	newStem := strings.TrimSuffix(newFilePath, filepath.Ext(newFilePath))
+	for _, sidecar := range entry.Sidecars {
+		sidecarPath, sidecarNewPath := entry.resolvePath(roots, sidecar.Path), entry.resolvePath(roots, sidecar.NewPath)
+		var err error
+		action := "move"
+		if sidecarNewPath == "" {
+			action = "delete"
+			err = os.Remove(sidecarPath)
+		} else {
+			if suffix, ok := strings.CutPrefix(sidecarNewPath, plannedStem); ok {
+				sidecarNewPath = newStem + suffix
+			}
+			_, err = os.Lstat(sidecarNewPath)
+			if err == nil {
+				err = fmt.Errorf("%w: %s", ErrCollision, sidecarNewPath)
+			} else if errors.Is(err, fs.ErrNotExist) {
+				err = move(sidecarPath, sidecarNewPath)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(applyCmd.Stderr, "warning: %s: unable to %s %s: %v\n", newFilePath, action, sidecarPath, err)
+			continue
+		}
+		fmt.Fprintf(applyCmd.Stdout, "%s => %s\n", sidecarPath, cmp.Or(sidecarNewPath, "(deleted)"))
+	}
+}
+
+// planRoots returns the roots of plan, with those given by Roots in place of
+// the ones recorded. It fails if a root no longer exists, which otherwise
+// shows up as every file in it having vanished.
+func (applyCmd *ApplyCmd) planRoots(plan *renamePlan) ([]string, error) {
+	if len(applyCmd.Roots) > 0 && !plan.Relative {
+		return nil, fmt.Errorf("%s: -root needs a plan made with -relative-paths, the paths of this one are absolute", applyCmd.PlanFile)
+	}
+	if len(applyCmd.Roots) > len(plan.Roots) {
+		return nil, fmt.Errorf("%s: %d roots given with -root, but the plan has only %d", applyCmd.PlanFile, len(applyCmd.Roots), len(plan.Roots))
+	}
+	roots := make([]string, len(plan.Roots))
+	for i, root := range plan.Roots {
+		roots[i] = decodePath(root)
+		if i < len(applyCmd.Roots) {
+			roots[i] = applyCmd.Roots[i]
+		}
+		_, err := os.Stat(roots[i])
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && plan.Relative && i >= len(applyCmd.Roots) {
+				return nil, fmt.Errorf("root %s of the plan no longer exists (use -root to give where it is now)", roots[i])
+			}
+			return nil, fmt.Errorf("root %d of the plan: %w", i, err)
+		}
+	}
+	return roots, nil
+}
+
+// verifyPlanEntry checks that filePath is still the file entry was planned
+// for, with the size, modification time and, if recorded, contents it had
+// then. It returns an ErrChanged or ErrVanished error if it is not.
+func verifyPlanEntry(entry *planEntry, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %w", ErrVanished, err)
+		}
+		return err
+	}
+	if entry.ModTime.IsZero() {
+		return fmt.Errorf("%w: the plan has no size and modification time to check", ErrChanged)
+	}
+	if info.Size() != entry.Size {
+		return fmt.Errorf("%w: size is %d, was %d", ErrChanged, info.Size(), entry.Size)
+	}
+	if !info.ModTime().Equal(entry.ModTime) {
+		return fmt.Errorf("%w: modified %s, was %s", ErrChanged, info.ModTime().Format(time.RFC3339Nano), entry.ModTime.Format(time.RFC3339Nano))
+	}
+	if entry.SHA256 != "" {
+		sum, err := hashFile(filePath)
+		if err != nil {
+			return err
+		}
+		if sum != entry.SHA256 {
+			return fmt.Errorf("%w: contents differ", ErrChanged)
+		}
+	}
+	return nil
+}
+
+// rename renames filePath to newFilePath according to the collision policy,
+// or OnCollision if it is empty, and returns the path the file ended up at.
+// It is recorded in the journal by resolver.move.
+func (applyCmd *ApplyCmd) rename(ctx context.Context, resolver *collisionResolver, filePath, newFilePath, policy string) (string, error) {
+	err := makeDirs(filepath.Dir(newFilePath), applyCmd.DirMode)
+	if err != nil {
+		return "", err
+	}
+	newFilePath, err = resolver.rename(ctx, filePath, newFilePath, policy)
+	if err != nil {
+		return "", err
+	}
+	return newFilePath, nil
+}
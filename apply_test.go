@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestApplyCmd parses args as the arguments of jpegid apply, with the
+// output discarded.
+func newTestApplyCmd(t *testing.T, args ...string) *ApplyCmd {
+	t.Helper()
+	applyCmd, err := ApplyCommand(append([]string{"apply", "-journal-dir", t.TempDir()}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyCmd.Stdin, applyCmd.Stdout, applyCmd.Stderr = nil, io.Discard, io.Discard
+	return applyCmd
+}
+
+// writeTestPlan creates filePath and writes the -relative-paths plan of a
+// dry run renaming it to newFilePath.
+func writeTestPlan(t *testing.T, root, filePath, newFilePath string) string {
+	t.Helper()
+	writeFiles(t, filePath)
+	plan := &renamePlan{Version: planVersion, DryRun: true, Relative: true, Roots: []string{root}}
+	plan.Files = append(plan.Files, newPlanEntry(RenameResult{
+		Root:        root,
+		FilePath:    filePath,
+		NewFilePath: newFilePath,
+	}, nil, true, collisionSkip))
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	file, err := os.Create(planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = plan.write(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return planFile
+}
+
+func TestApplyMovedTree(t *testing.T) {
+	dir := t.TempDir()
+	oldRoot, newRoot := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	err := os.Mkdir(oldRoot, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planFile := writeTestPlan(t, oldRoot, filepath.Join(oldRoot, "a.jpg"), filepath.Join(oldRoot, "2023-09-14T101530.123+0200.jpg"))
+	err = os.Rename(oldRoot, newRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newTestApplyCmd(t, planFile).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no longer exists") {
+		t.Fatalf("Run() with the root moved = %v, want an error about the root", err)
+	}
+	err = newTestApplyCmd(t, "-root", newRoot, planFile).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(newRoot, "2023-09-14T101530.123+0200.jpg"))
+	if err != nil {
+		t.Fatalf("file not renamed in the new root: %v", err)
+	}
+}
+
+func TestApplyDirMode(t *testing.T) {
+	root := t.TempDir()
+	newDir := filepath.Join(root, "2023", "09")
+	planFile := writeTestPlan(t, root, filepath.Join(root, "a.jpg"), filepath.Join(newDir, "a.jpg"))
+	err := newTestApplyCmd(t, "-dir-mode", "750", planFile).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{filepath.Dir(newDir), newDir} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Fatalf("%s has mode %v, want -dir-mode 750", dir, info.Mode().Perm())
+		}
+	}
+}
+
+func TestApplySidecars(t *testing.T) {
+	root := t.TempDir()
+	filePath, sidecarPath := filepath.Join(root, "IMG_0001.HEIC"), filepath.Join(root, "IMG_0001.MOV")
+	newFilePath := filepath.Join(root, "2023-09-14T101530.123+0200.HEIC")
+	writeFiles(t, filePath, sidecarPath, newFilePath)
+	plan := &renamePlan{Version: planVersion, DryRun: true, Mode: planModeRename, Relative: true, Roots: []string{root}}
+	plan.Files = append(plan.Files, newPlanEntry(RenameResult{
+		Root:        root,
+		FilePath:    filePath,
+		NewFilePath: newFilePath,
+		Sidecars:    []Sidecar{{FilePath: sidecarPath, NewFilePath: filepath.Join(root, "2023-09-14T101530.123+0200.MOV")}},
+	}, nil, true, collisionSuffix))
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	file, err := os.Create(planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = plan.write(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new name is taken, so the sidecar follows the suffixed name.
+	err = newTestApplyCmd(t, "-on-collision", "suffix", planFile).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"2023-09-14T101530.123+0200-1.HEIC", "2023-09-14T101530.123+0200-1.MOV"} {
+		_, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("%s not renamed: %v", name, err)
+		}
+	}
+}
+
+func TestApplyCopyPlan(t *testing.T) {
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	err := os.WriteFile(planFile, []byte(`{"version":1,"dryRun":true,"mode":"copy","roots":[],"files":[]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newTestApplyCmd(t, planFile).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "plan of a copy") {
+		t.Fatalf("Run() with a copy plan = %v, want it refused", err)
+	}
+}
+
+func TestApplyPlanCollisionPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		args     []string
+		wantName string
+	}{
+		{"recorded policy", collisionSuffix, nil, "2023-09-14T101530.123+0200-1.jpg"},
+		{"recorded policy over -on-collision", collisionSuffix, []string{"-on-collision", "skip"}, "2023-09-14T101530.123+0200-1.jpg"},
+		{"no recorded policy", "", []string{"-on-collision", "suffix"}, "2023-09-14T101530.123+0200-1.jpg"},
+		{"no recorded policy, default", "", nil, "a.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			filePath, newFilePath := filepath.Join(root, "a.jpg"), filepath.Join(root, "2023-09-14T101530.123+0200.jpg")
+			writeFiles(t, filePath, newFilePath)
+			plan := &renamePlan{Version: planVersion, DryRun: true, Mode: planModeRename, Relative: true, Roots: []string{root}}
+			plan.Files = append(plan.Files, newPlanEntry(RenameResult{
+				Root:        root,
+				FilePath:    filePath,
+				NewFilePath: newFilePath,
+			}, nil, true, tt.policy))
+			planFile := filepath.Join(t.TempDir(), "plan.json")
+			file, err := os.Create(planFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			err = plan.write(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = newTestApplyCmd(t, append(tt.args, planFile)...).Run(context.Background())
+			_, err = os.Stat(filepath.Join(root, tt.wantName))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.wantName, err)
+			}
+		})
+	}
+}
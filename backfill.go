@@ -0,0 +1,449 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BackfillCmd struct {
+	// Suggest writes suggested dates for the files under Roots that have
+	// none or an implausible one to Output, instead of applying the
+	// suggestions in SuggestionsFile.
+	Suggest   bool
+	Roots     []string
+	Recursive bool
+	// MaxGap is the longest time apart the files either side of a file can
+	// be for it to be suggested the time between them.
+	MaxGap time.Duration
+	// Output is the file suggestions are written to, or - for stdout.
+	Output          string
+	SuggestionsFile string
+	NumWorkers      int
+	DryRun          bool
+	// KeepBackup keeps the copy of each file before it was changed that
+	// exiftool makes, named with an _original suffix.
+	KeepBackup bool
+	// Rename renames the files after their new dates once written.
+	Rename bool
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// BackfillCommand parses the arguments of
+//
+//	jpegid backfill suggest [flags]
+//	jpegid backfill [flags] <suggestions.json>
+func BackfillCommand(args []string) (*BackfillCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	backfillCmd := &BackfillCmd{
+		Roots:  []string{cwd},
+		MaxGap: 10 * time.Minute,
+		Output: "-",
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	args = args[1:]
+	backfillCmd.Suggest = len(args) > 0 && args[0] == "suggest"
+	if backfillCmd.Suggest {
+		args = args[1:]
+	}
+	flagset := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	if backfillCmd.Suggest {
+		flagset.Func("root", "Specify an additional root directory. Can be repeated.", func(value string) error {
+			root, err := filepath.Abs(value)
+			if err != nil {
+				return err
+			}
+			backfillCmd.Roots = append(backfillCmd.Roots, root)
+			return nil
+		})
+		flagset.BoolVar(&backfillCmd.Recursive, "recursive", false, "Walk the roots recursively.")
+		flagset.DurationVar(&backfillCmd.MaxGap, "max-gap", backfillCmd.MaxGap, "Suggest the time between the files either side of a file in its folder if they are at most this far apart.")
+		flagset.StringVar(&backfillCmd.Output, "o", backfillCmd.Output, "File to write the suggestions to, or - for stdout.")
+	} else {
+		flagset.IntVar(&backfillCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers renaming the files.")
+		flagset.BoolVar(&backfillCmd.DryRun, "dry-run", false, "Print the dates that would be written without changing the files.")
+		flagset.BoolVar(&backfillCmd.KeepBackup, "keep-backup", false, "Keep the original of each file next to it, with an _original suffix.")
+		flagset.BoolVar(&backfillCmd.Rename, "rename", true, "Rename the files after their new dates.")
+	}
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if backfillCmd.Suggest {
+		if flagset.NArg() > 0 {
+			return nil, fmt.Errorf("unexpected argument %q", flagset.Arg(0))
+		}
+		return backfillCmd, nil
+	}
+	if flagset.NArg() != 1 {
+		return nil, fmt.Errorf("usage: jpegid backfill suggest [flags] or jpegid backfill [flags] <suggestions.json>")
+	}
+	backfillCmd.SuggestionsFile = flagset.Arg(0)
+	return backfillCmd, nil
+}
+
+// suggestionsVersion is the version of the suggestions file schema, bumped
+// on incompatible changes.
+const suggestionsVersion = 1
+
+// dateSuggestions is the file written by backfill suggest, to be reviewed
+// and edited before being applied with backfill. Paths are encoded with
+// encodePath.
+type dateSuggestions struct {
+	Version     int              `json:"version"`
+	Suggestions []dateSuggestion `json:"suggestions"`
+}
+
+// dateSuggestion is the date suggested for a single file.
+type dateSuggestion struct {
+	Path string `json:"path"`
+	// Problem is the skipReasons key of why the file was not renamed,
+	// noMetadata or implausibleDate, and Error the details.
+	Problem string `json:"problem"`
+	Error   string `json:"error,omitempty"`
+	// DateTime is the suggested date in the format exiftool writes EXIF
+	// dates in, 2006:01:02 15:04:05, and Offset its UTC offset, such as
+	// +02:00, if known. DateTime is empty if nothing could be suggested,
+	// for filling in by hand.
+	DateTime string `json:"dateTime"`
+	Offset   string `json:"offset,omitempty"`
+	// Source is what the suggestion is based on: "sidecar", "fileName" or
+	// "neighbors", Evidence the details and Confidence how far it can be
+	// trusted: "high", "medium" or "low".
+	Source     string `json:"source,omitempty"`
+	Evidence   string `json:"evidence,omitempty"`
+	Confidence string `json:"confidence,omitempty"`
+	// Apply is whether backfill writes the suggestion, which it does by
+	// default for high and medium confidence ones.
+	Apply bool `json:"apply"`
+}
+
+// exifDateLayout is the layout of EXIF dates.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+func (backfillCmd *BackfillCmd) Run(ctx context.Context) error {
+	if backfillCmd.Suggest {
+		return backfillCmd.suggest(ctx)
+	}
+	return backfillCmd.apply(ctx)
+}
+
+// suggest finds the files that would be skipped for having no date or an
+// implausible one in a dry run, and suggests a date for each from the
+// evidence around it: its XMP or Google Takeout sidecar, a date in its name
+// or the files next to it in its folder.
+func (backfillCmd *BackfillCmd) suggest(ctx context.Context) error {
+	args := []string{"jpegid", "-dry-run"}
+	if backfillCmd.Recursive {
+		args = append(args, "-recursive")
+	}
+	jpegidCmd, err := JpegIDCommand(args)
+	if err != nil {
+		return err
+	}
+	jpegidCmd.Roots = backfillCmd.Roots
+	jpegidCmd.Stdout = io.Discard
+	jpegidCmd.Stderr = backfillCmd.Stderr
+	// known are the creation times of the files whose dates are fine, and
+	// dirs the files of each folder, for finding the neighbors of a file.
+	known := make(map[string]time.Time)
+	dirs := make(map[string][]string)
+	var suggestions []dateSuggestion
+	for result, err := range jpegidCmd.Renames(ctx) {
+		if err != nil && result.FilePath == "" {
+			return err
+		}
+		if errors.Is(err, ErrExcluded) {
+			continue
+		}
+		dir := filepath.Dir(result.FilePath)
+		dirs[dir] = append(dirs[dir], result.FilePath)
+		if errors.Is(err, ErrNoMetadata) || errors.Is(err, ErrImplausibleDate) {
+			problem, _ := skipReason(err)
+			suggestions = append(suggestions, dateSuggestion{Path: result.FilePath, Problem: problem, Error: err.Error()})
+			continue
+		}
+		if !result.CreationTime.IsZero() && (err == nil || errors.Is(err, ErrAlreadyNamed)) {
+			known[result.FilePath] = result.CreationTime
+		} else if creationTime, ok := parseFileName(filepath.Base(result.FilePath)); ok {
+			known[result.FilePath] = creationTime
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, files := range dirs {
+		slices.Sort(files)
+	}
+	for i := range suggestions {
+		suggestion := &suggestions[i]
+		ok := suggestFromSidecar(suggestion) || suggestFromFileName(suggestion) ||
+			suggestFromNeighbors(suggestion, dirs[filepath.Dir(suggestion.Path)], known, backfillCmd.MaxGap)
+		suggestion.Apply = ok && suggestion.Confidence != "low"
+		suggestion.Path = encodePath(suggestion.Path)
+	}
+	slices.SortFunc(suggestions, func(a, b dateSuggestion) int { return strings.Compare(a.Path, b.Path) })
+	if suggestions == nil {
+		suggestions = []dateSuggestion{}
+	}
+	b, err := json.MarshalIndent(dateSuggestions{Version: suggestionsVersion, Suggestions: suggestions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	suggested := 0
+	for _, suggestion := range suggestions {
+		if suggestion.DateTime != "" {
+			suggested++
+		}
+	}
+	fmt.Fprintf(backfillCmd.Stderr, "%d files without a usable date, %d with a suggestion\n", len(suggestions), suggested)
+	if backfillCmd.Output == "-" {
+		_, err = backfillCmd.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(backfillCmd.Output, b, 0644)
+}
+
+// xmpDateRegexp matches the dates of an XMP sidecar, written either as
+// attributes or as elements.
+var xmpDateRegexp = regexp.MustCompile(`(exif:DateTimeOriginal|photoshop:DateCreated|xmp:CreateDate)(?:="([^"]+)"|>([^<]+)<)`)
+
+// suggestFromSidecar suggests the date in the XMP or Google Takeout JSON
+// sidecar of a file, if it has one.
+func suggestFromSidecar(suggestion *dateSuggestion) bool {
+	filePath := suggestion.Path
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	for _, name := range []string{filePath + ".xmp", base + ".xmp", filePath + ".XMP", base + ".XMP"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		for _, match := range xmpDateRegexp.FindAllStringSubmatch(string(b), -1) {
+			value := cmp.Or(match[2], match[3])
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+				date, err := time.Parse(layout, value)
+				if err != nil {
+					continue
+				}
+				suggestion.DateTime = date.Format(exifDateLayout)
+				if layout == time.RFC3339Nano {
+					suggestion.Offset = date.Format("-07:00")
+				}
+				suggestion.Source, suggestion.Evidence, suggestion.Confidence = "sidecar", filepath.Base(name)+": "+match[1]+" "+value, "high"
+				return true
+			}
+		}
+	}
+	for _, name := range []string{filePath + ".json", filePath + ".supplemental-metadata.json"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var takeout struct {
+			PhotoTakenTime struct {
+				Timestamp string `json:"timestamp"`
+			} `json:"photoTakenTime"`
+		}
+		if json.Unmarshal(b, &takeout) != nil {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(takeout.PhotoTakenTime.Timestamp, 10, 64)
+		if err != nil || timestamp <= 0 {
+			continue
+		}
+		// Takeout only records the instant, not the time zone it was
+		// taken in.
+		date := time.Unix(timestamp, 0).UTC()
+		suggestion.DateTime, suggestion.Offset = date.Format(exifDateLayout), "+00:00"
+		suggestion.Source, suggestion.Evidence, suggestion.Confidence = "sidecar", filepath.Base(name)+": photoTakenTime "+takeout.PhotoTakenTime.Timestamp, "high"
+		return true
+	}
+	return false
+}
+
+// fileNameDateRegexp matches a date in a file name, optionally followed by
+// a time, as phones, cameras and messaging apps name files, e.g.
+// IMG_20230914_101530.jpg, PXL_20230914_101530123.jpg,
+// Screenshot_2023-09-14-10-15-30.png or IMG-20230914-WA0001.jpg.
+var fileNameDateRegexp = regexp.MustCompile(`(?:^|[^0-9])((?:19|20)[0-9]{2})[-_.]?(0[1-9]|1[0-2])[-_.]?(0[1-9]|[12][0-9]|3[01])(?:[-_ T.]?([01][0-9]|2[0-3])[-_.:]?([0-5][0-9])[-_.:]?([0-5][0-9]))?(?:[^0-9]|$)`)
+
+// suggestFromFileName suggests the date in the name of a file.
+func suggestFromFileName(suggestion *dateSuggestion) bool {
+	name := filepath.Base(suggestion.Path)
+	if creationTime, ok := parseFileName(name); ok {
+		suggestion.DateTime, suggestion.Offset = creationTime.Format(exifDateLayout), creationTime.Format("-07:00")
+		suggestion.Source, suggestion.Evidence, suggestion.Confidence = "fileName", name, "high"
+		return true
+	}
+	match := fileNameDateRegexp.FindStringSubmatch(strings.TrimSuffix(name, filepath.Ext(name)))
+	if match == nil {
+		return false
+	}
+	confidence := "high"
+	if match[4] == "" {
+		// Only the day is known.
+		match[4], match[5], match[6] = "00", "00", "00"
+		confidence = "medium"
+	}
+	date, err := time.Parse("20060102150405", strings.Join(match[1:7], ""))
+	if err != nil {
+		// Such as February 30.
+		return false
+	}
+	suggestion.DateTime = date.Format(exifDateLayout)
+	suggestion.Source, suggestion.Evidence, suggestion.Confidence = "fileName", name, confidence
+	return true
+}
+
+// suggestFromNeighbors suggests the time between the files before and
+// after a file in files, the files of its folder in name order, if they have
+// dates at most maxGap apart, as for the frames of a burst. Failing that it
+// suggests the date of the nearest of them, with low confidence.
+func suggestFromNeighbors(suggestion *dateSuggestion, files []string, known map[string]time.Time, maxGap time.Duration) bool {
+	i := slices.Index(files, suggestion.Path)
+	if i < 0 {
+		return false
+	}
+	var before, after string
+	for j := i - 1; j >= 0 && before == ""; j-- {
+		if _, ok := known[files[j]]; ok {
+			before = files[j]
+		}
+	}
+	for j := i + 1; j < len(files) && after == ""; j++ {
+		if _, ok := known[files[j]]; ok {
+			after = files[j]
+		}
+	}
+	// The offset of a neighbor is only known if it was read from its
+	// metadata or name rather than assumed to be local.
+	offset := func(date time.Time) string {
+		if date.Location() == time.Local {
+			return ""
+		}
+		return date.Format("-07:00")
+	}
+	describe := func(filePath string) string {
+		return filepath.Base(filePath) + " (" + known[filePath].Format(time.DateTime) + ")"
+	}
+	switch {
+	case before != "" && after != "" && known[after].Sub(known[before]) >= 0 && known[after].Sub(known[before]) <= maxGap:
+		date := known[before].Add(known[after].Sub(known[before]) / 2)
+		suggestion.DateTime, suggestion.Offset = date.Format(exifDateLayout), offset(date)
+		suggestion.Source, suggestion.Evidence, suggestion.Confidence = "neighbors", "between "+describe(before)+" and "+describe(after), "medium"
+	case before != "":
+		suggestion.DateTime, suggestion.Offset = known[before].Format(exifDateLayout), offset(known[before])
+		suggestion.Source, suggestion.Evidence, suggestion.Confidence = "neighbors", "after "+describe(before), "low"
+	case after != "":
+		suggestion.DateTime, suggestion.Offset = known[after].Format(exifDateLayout), offset(known[after])
+		suggestion.Source, suggestion.Evidence, suggestion.Confidence = "neighbors", "before "+describe(after), "low"
+	default:
+		return false
+	}
+	return true
+}
+
+// offsetRegexp matches an EXIF UTC offset.
+var offsetRegexp = regexp.MustCompile(`^[+-](0[0-9]|1[0-4]):[0-5][0-9]$`)
+
+// apply writes the dates of the suggestions to apply into their files, as
+// DateTimeOriginal and CreateDate (and their offsets if known), and renames
+// them after them.
+func (backfillCmd *BackfillCmd) apply(ctx context.Context) error {
+	b, err := os.ReadFile(backfillCmd.SuggestionsFile)
+	if err != nil {
+		return err
+	}
+	var suggestions dateSuggestions
+	err = json.Unmarshal(b, &suggestions)
+	if err != nil {
+		return fmt.Errorf("%s: %w", backfillCmd.SuggestionsFile, err)
+	}
+	if suggestions.Version != suggestionsVersion {
+		return fmt.Errorf("%s: unsupported suggestions version %d (want %d)", backfillCmd.SuggestionsFile, suggestions.Version, suggestionsVersion)
+	}
+	var client ExifToolClient
+	if !backfillCmd.DryRun {
+		version, err := GetExifToolVersion()
+		if err != nil {
+			return err
+		}
+		client, err = NewExifToolClient(backfillCmd.Stderr, version.CommonArgs()...)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+	var written []string
+	failed := 0
+	for _, suggestion := range suggestions.Suggestions {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !suggestion.Apply {
+			continue
+		}
+		filePath := decodePath(suggestion.Path)
+		_, err := time.Parse(exifDateLayout, suggestion.DateTime)
+		if err != nil {
+			fmt.Fprintf(backfillCmd.Stderr, "%s: invalid dateTime %q (want YYYY:MM:DD hh:mm:ss)\n", filePath, suggestion.DateTime)
+			failed++
+			continue
+		}
+		if suggestion.Offset != "" && !offsetRegexp.MatchString(suggestion.Offset) {
+			fmt.Fprintf(backfillCmd.Stderr, "%s: invalid offset %q (want e.g. +02:00)\n", filePath, suggestion.Offset)
+			failed++
+			continue
+		}
+		if backfillCmd.DryRun {
+			fmt.Fprintf(backfillCmd.Stdout, "%s: DateTimeOriginal => %s%s\n", filePath, suggestion.DateTime, suggestion.Offset)
+			continue
+		}
+		args := []string{"-DateTimeOriginal=" + suggestion.DateTime, "-CreateDate=" + suggestion.DateTime}
+		if suggestion.Offset != "" {
+			args = append(args, "-OffsetTimeOriginal="+suggestion.Offset, "-OffsetTimeDigitized="+suggestion.Offset)
+		}
+		// -P keeps the modification time of the files.
+		args = append(args, "-P")
+		if !backfillCmd.KeepBackup {
+			args = append(args, "-overwrite_original")
+		}
+		err = writeTags(client, filePath, args)
+		if err != nil {
+			fmt.Fprintf(backfillCmd.Stderr, "%s: %v\n", filePath, err)
+			failed++
+			continue
+		}
+		written = append(written, filePath)
+	}
+	if !backfillCmd.DryRun {
+		fmt.Fprintf(backfillCmd.Stderr, "%d files backfilled, %d errors\n", len(written), failed)
+	}
+	if backfillCmd.Rename && len(written) > 0 {
+		err := renameFiles(ctx, written, backfillCmd.NumWorkers, "", backfillCmd.Stdout, backfillCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be backfilled", failed)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const birthtimeSupported = true
+
+// setBirthtime sets the creation time of a file. APFS and HFS+ move the
+// birthtime back whenever the modification time is set to something
+// earlier, so the modification time is set to t and then restored.
+func setBirthtime(name string, t time.Time) error {
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: unable to read birthtime", name)
+	}
+	birthtime := time.Unix(stat.Birthtimespec.Unix())
+	if !t.Before(birthtime) {
+		return fmt.Errorf("%s: cannot move birthtime forward from %s to %s", name, birthtime, t)
+	}
+	atime := time.Unix(stat.Atimespec.Unix())
+	err = os.Chtimes(name, atime, t)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(name, atime, fileInfo.ModTime())
+}
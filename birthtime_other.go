@@ -0,0 +1,16 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Linux can read a file's birthtime through statx, but provides no way to
+// set it.
+const birthtimeSupported = false
+
+func setBirthtime(name string, t time.Time) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const birthtimeSupported = true
+
+// setBirthtime sets the creation time of a file.
+func setBirthtime(name string, t time.Time) error {
+	pathp, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	const fileWriteAttributes = 0x0100
+	handle, err := syscall.CreateFile(pathp, fileWriteAttributes, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "CreateFile", Path: name, Err: err}
+	}
+	defer syscall.CloseHandle(handle)
+	creationTime := syscall.NsecToFiletime(t.UnixNano())
+	err = syscall.SetFileTime(handle, &creationTime, nil, nil)
+	if err != nil {
+		return &os.PathError{Op: "SetFileTime", Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultBurstGap is the longest time between two frames of a burst.
+const defaultBurstGap = time.Second
+
+// findBursts returns the runs of at least size renamed files in the same
+// directory taken at most gap apart, in order of creation time.
+func findBursts(results []RenameResult, size int, gap time.Duration) [][]RenameResult {
+	byDir := make(map[string][]RenameResult)
+	for _, result := range results {
+		if result.CreationTime.IsZero() {
+			continue
+		}
+		dir := filepath.Dir(result.NewFilePath)
+		byDir[dir] = append(byDir[dir], result)
+	}
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	var bursts [][]RenameResult
+	for _, dir := range dirs {
+		frames := byDir[dir]
+		slices.SortStableFunc(frames, func(a, b RenameResult) int {
+			return a.CreationTime.Compare(b.CreationTime)
+		})
+		for start := 0; start < len(frames); {
+			end := start + 1
+			for end < len(frames) && frames[end].CreationTime.Sub(frames[end-1].CreationTime) <= gap {
+				end++
+			}
+			if end-start >= max(size, 2) {
+				bursts = append(bursts, frames[start:end])
+			}
+			start = end
+		}
+	}
+	return bursts
+}
+
+// moveBursts moves each burst, along with the sidecars of its frames, into a
+// subfolder of its directory named after its first frame, calling moved with
+// the old and new path of every file. Files are not replaced if their path
+// in the subfolder is taken; problems are reported as warnings, as the files
+// have been renamed by then.
+func (jpegidCmd *JpegIDCmd) moveBursts(bursts [][]RenameResult, moved func(oldPath, newPath string)) {
+	for _, burst := range bursts {
+		first := burst[0].NewFilePath
+		subfolder := strings.TrimSuffix(first, filepath.Ext(first))
+		if !jpegidCmd.DryRun {
+			err := makeDirs(subfolder, jpegidCmd.DirMode)
+			if err != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: burst: %v\n", err)
+				continue
+			}
+		}
+		for _, frame := range burst {
+			filePaths := []string{frame.NewFilePath}
+			for _, sidecar := range frame.Sidecars {
+				if sidecar.NewFilePath != "" {
+					filePaths = append(filePaths, sidecar.NewFilePath)
+				}
+			}
+			for _, filePath := range filePaths {
+				newFilePath := filepath.Join(subfolder, filepath.Base(filePath))
+				if !jpegidCmd.DryRun {
+					_, err := os.Lstat(newFilePath)
+					if err == nil {
+						err = fmt.Errorf("%w: %s", ErrCollision, newFilePath)
+					} else if errors.Is(err, fs.ErrNotExist) {
+						err = nil
+						if jpegidCmd.journal != nil {
+							err = jpegidCmd.journal.intend(jpegidCmd.Now(), filePath, newFilePath)
+						}
+						if err == nil {
+							err = os.Rename(filePath, newFilePath)
+							if err != nil && jpegidCmd.journal != nil {
+								_ = jpegidCmd.journal.fail(jpegidCmd.Now(), filePath, newFilePath)
+							}
+						}
+					}
+					if err != nil {
+						fmt.Fprintf(jpegidCmd.Stderr, "warning: burst: unable to move %s: %v\n", filePath, err)
+						continue
+					}
+				}
+				moved(filePath, newFilePath)
+			}
+		}
+	}
+}
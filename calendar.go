@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// calendarEvent is an event of a -calendar, whose name is the Event field
+// of -name-template for the files created during it.
+type calendarEvent struct {
+	Name string
+	// Start and End (exclusive) bound the event. Floating events, such as
+	// all-day ones, happen at the same wall clock time in every timezone,
+	// so their bounds hold wall clock times in UTC.
+	Start    time.Time
+	End      time.Time
+	Floating bool
+}
+
+// loadCalendar reads the events of an iCalendar (.ics) file or a CSV file of
+// start,end,name lines.
+func loadCalendar(name string) ([]calendarEvent, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var events []calendarEvent
+	if strings.EqualFold(filepath.Ext(name), ".ics") {
+		events, err = parseICS(file)
+	} else {
+		events, err = parseCalendarCSV(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return events, nil
+}
+
+// parseICS parses the VEVENTs of an iCalendar file (RFC 5545), using their
+// DTSTART, DTEND and SUMMARY. Events without a DTEND last a day if they
+// start on a date, and no time at all otherwise.
+func parseICS(r io.Reader) ([]calendarEvent, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// Long lines are folded onto lines starting with whitespace.
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var events []calendarEvent
+	var event *calendarEvent
+	var endSet, allDay bool
+	for i, line := range lines {
+		property, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(property, ";")
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				event, endSet, allDay = &calendarEvent{}, false, false
+			}
+		case "END":
+			if strings.EqualFold(value, "VEVENT") && event != nil {
+				if event.Start.IsZero() {
+					return nil, fmt.Errorf("line %d: event %q has no DTSTART", i+1, event.Name)
+				}
+				if !endSet {
+					event.End = event.Start
+					if allDay {
+						event.End = event.Start.AddDate(0, 0, 1)
+					}
+				}
+				events = append(events, *event)
+				event = nil
+			}
+		case "SUMMARY":
+			if event != nil {
+				event.Name = icsUnescaper.Replace(value)
+			}
+		case "DTSTART", "DTEND":
+			if event == nil {
+				continue
+			}
+			t, floating, date, err := parseICSTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			if strings.EqualFold(name, "DTSTART") {
+				event.Start, event.Floating, allDay = t, floating, date
+			} else {
+				event.End, endSet = t, true
+			}
+		}
+	}
+	return events, nil
+}
+
+var icsUnescaper = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`)
+
+// parseICSTime parses an iCalendar DATE or DATE-TIME value. Times in UTC or
+// with a known TZID are absolute; dates and other times are floating.
+func parseICSTime(value, params string) (t time.Time, floating, date bool, err error) {
+	var location *time.Location
+	for _, param := range strings.Split(params, ";") {
+		key, tzid, ok := strings.Cut(param, "=")
+		if ok && strings.EqualFold(key, "TZID") {
+			location, err = time.LoadLocation(strings.Trim(tzid, `"`))
+			if err != nil {
+				location = nil
+			}
+		}
+	}
+	switch {
+	case len(value) == len("20060102"):
+		t, err = time.Parse("20060102", value)
+		return t, true, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, false, err
+	case location != nil:
+		t, err = time.ParseInLocation("20060102T150405", value, location)
+		return t, false, false, err
+	}
+	t, err = time.Parse("20060102T150405", value)
+	return t, true, false, err
+}
+
+// parseCalendarCSV parses lines of start,end,name. start and end are dates,
+// both included, or RFC 3339 times; dates are floating. A header line is
+// skipped.
+func parseCalendarCSV(r io.Reader) ([]calendarEvent, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	var events []calendarEvent
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		event := calendarEvent{Name: record[2]}
+		var startErr, endErr error
+		event.Start, event.Floating, startErr = parseCalendarCSVTime(record[0], false)
+		event.End, _, endErr = parseCalendarCSVTime(record[1], true)
+		if startErr != nil || endErr != nil {
+			if line == 1 {
+				// A header.
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", line, errors.Join(startErr, endErr))
+		}
+		events = append(events, event)
+	}
+}
+
+// parseCalendarCSVTime parses a date or RFC 3339 time of a CSV calendar.
+// End dates are the end of the day.
+func parseCalendarCSVTime(value string, end bool) (t time.Time, floating bool, err error) {
+	t, err = time.Parse(time.DateOnly, value)
+	if err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// findEvent returns the name of the shortest event creationTime falls in, as
+// a file name with spaces turned into dashes ("Berlin Trip" becomes
+// "Berlin-Trip"), or "" if there is none.
+func findEvent(events []calendarEvent, creationTime time.Time) string {
+	// The wall clock time, for floating events.
+	wallClock := time.Date(creationTime.Year(), creationTime.Month(), creationTime.Day(), creationTime.Hour(), creationTime.Minute(), creationTime.Second(), creationTime.Nanosecond(), time.UTC)
+	var found *calendarEvent
+	for i, event := range events {
+		t := creationTime
+		if event.Floating {
+			t = wallClock
+		}
+		if t.Before(event.Start) || !t.Before(event.End) {
+			continue
+		}
+		if found == nil || event.End.Sub(event.Start) < found.End.Sub(found.Start) {
+			found = &events[i]
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(sanitizeFileName(found.Name)), "-")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+type CheckCmd struct {
+	Roots       []string
+	FileRegexps []*regexp.Regexp
+	NumWorkers  int
+	Recursive   bool
+	Decode      bool
+	// Format is the format the results are printed in: checkFormatTable,
+	// checkFormatJSON, checkFormatCSV or checkFormatSARIF.
+	Format string
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// defaultCheckRegexp matches the files checked when no -file is given.
+var defaultCheckRegexp = regexp.MustCompile(`(?i)\.(jpe?g|jpe)$`)
+
+func CheckCommand(args []string) (*CheckCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	checkCmd := &CheckCmd{
+		Roots:  []string{cwd},
+		Format: checkFormatTable,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	flagset := flag.NewFlagSet("check", flag.ContinueOnError)
+	flagset.IntVar(&checkCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.BoolVar(&checkCmd.Recursive, "recursive", false, "Walk the roots recursively.")
+	flagset.BoolVar(&checkCmd.Decode, "decode", false, "Fully decode each image instead of only checking its segment structure. Slower, but catches corrupt image data.")
+	flagset.Func("format", "Format to print the status of each file in: table (default), json, csv or sarif (only the files that failed).", func(value string) error {
+		var err error
+		checkCmd.Format, err = parseCheckFormat(value)
+		return err
+	})
+	flagset.BoolFunc("json", "Deprecated: use -format json.", func(value string) error {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			checkCmd.Format = checkFormatJSON
+		}
+		return nil
+	})
+	flagset.Func("root", "Specify an additional root directory. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		checkCmd.Roots = append(checkCmd.Roots, root)
+		return nil
+	})
+	var filePatterns []string
+	flagset.Func("file", "Include file regex. Can be repeated. If omitted, JPEGs are included.", func(value string) error {
+		_, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		filePatterns = append(filePatterns, value)
+		return nil
+	})
+	ignoreCase := flagset.Bool("ignore-case", false, "Match -file patterns case-insensitively.")
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	checkCmd.FileRegexps, err = compileRegexps(filePatterns, *ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	if len(checkCmd.FileRegexps) == 0 {
+		checkCmd.FileRegexps = []*regexp.Regexp{defaultCheckRegexp}
+	}
+	return checkCmd, nil
+}
+
+// CheckResult is the status of a single checked file.
+type CheckResult struct {
+	Path string `json:"path"`
+	// Status is "ok", "corrupt" or "error" (the file couldn't be read).
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (checkCmd *CheckCmd) Run(ctx context.Context) error {
+	var filePaths []string
+	for _, root := range checkCmd.Roots {
+		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dirEntry.IsDir() {
+				if path != "." && (!checkCmd.Recursive || isNASMetadataDir(dirEntry.Name())) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !dirEntry.Type().IsRegular() || !slices.ContainsFunc(checkCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+				return fileRegexp.MatchString(dirEntry.Name())
+			}) {
+				return nil
+			}
+			filePath := filepath.Join(root, path)
+			if !slices.Contains(filePaths, filePath) {
+				filePaths = append(filePaths, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	slices.Sort(filePaths)
+	results := make([]CheckResult, len(filePaths))
+	var waitGroup sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < max(checkCmd.NumWorkers, 1); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				results[i] = checkCmd.check(filePaths[i])
+			}
+		}()
+	}
+	for i := range filePaths {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	err := writeCheckResults(checkCmd.Stdout, checkCmd.Format, results)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(checkCmd.Stderr, "%d ok, %d corrupt, %d errors\n", counts["ok"], counts["corrupt"], counts["error"])
+	if counts["corrupt"] > 0 || counts["error"] > 0 {
+		return fmt.Errorf("%d of %d files failed the check", counts["corrupt"]+counts["error"], len(results))
+	}
+	return nil
+}
+
+// check checks a single file.
+func (checkCmd *CheckCmd) check(filePath string) CheckResult {
+	result := CheckResult{Path: filePath, Status: "ok"}
+	file, err := os.Open(filePath)
+	if err != nil {
+		result.Status, result.Error = "error", err.Error()
+		return result
+	}
+	defer file.Close()
+	if checkCmd.Decode {
+		_, err = jpeg.Decode(bufio.NewReader(file))
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+	} else {
+		err = scanJPEG(bufio.NewReader(file))
+	}
+	if err != nil {
+		result.Status, result.Error = "corrupt", err.Error()
+		if !errors.Is(err, ErrCorrupt) {
+			result.Status = "error"
+		}
+	}
+	return result
+}
+
+// jpegScanner reads a JPEG a byte at a time, keeping track of the offset for
+// error messages.
+type jpegScanner struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (scanner *jpegScanner) readByte() (byte, error) {
+	b, err := scanner.r.ReadByte()
+	if err == nil {
+		scanner.offset++
+	}
+	return b, err
+}
+
+func (scanner *jpegScanner) corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format+" at offset %d", append(append([]any{ErrCorrupt}, args...), scanner.offset)...)
+}
+
+// scanJPEG walks the segment structure of a JPEG from its start of image
+// marker to its end of image marker, including the entropy-coded data after
+// each start of scan marker. It returns an ErrCorrupt error for anything
+// that doesn't look like a JPEG, such as a truncated file or a segment
+// overwritten by bit rot, and other errors for read failures.
+func scanJPEG(r *bufio.Reader) error {
+	scanner := &jpegScanner{r: r}
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(r, soi)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return fmt.Errorf("%w: no start of image marker", ErrCorrupt)
+	}
+	scanner.offset = 2
+	var marker byte
+	for {
+		if marker == 0 {
+			b, err := scanner.readByte()
+			if err != nil {
+				if err == io.EOF {
+					return scanner.corrupt("no end of image marker")
+				}
+				return err
+			}
+			if b != 0xFF {
+				return scanner.corrupt("expected a marker, found 0x%02X", b)
+			}
+			for b == 0xFF {
+				b, err = scanner.readByte()
+				if err != nil {
+					if err == io.EOF {
+						return scanner.corrupt("no end of image marker")
+					}
+					return err
+				}
+			}
+			marker = b
+		}
+		switch {
+		case marker == 0xD9:
+			return nil
+		case marker == 0x01, marker >= 0xD0 && marker <= 0xD7:
+			// Markers without a length.
+			marker = 0
+			continue
+		case marker == 0x00:
+			return scanner.corrupt("invalid marker 0xFF00")
+		}
+		length := make([]byte, 2)
+		_, err := io.ReadFull(r, length)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return scanner.corrupt("truncated segment 0xFF%02X", marker)
+			}
+			return err
+		}
+		scanner.offset += 2
+		n := int64(length[0])<<8 | int64(length[1])
+		if n < 2 {
+			return scanner.corrupt("invalid length %d of segment 0xFF%02X", n, marker)
+		}
+		skipped, err := io.CopyN(io.Discard, r, n-2)
+		scanner.offset += skipped
+		if err != nil {
+			if err == io.EOF {
+				return scanner.corrupt("truncated segment 0xFF%02X", marker)
+			}
+			return err
+		}
+		if marker != 0xDA {
+			marker = 0
+			continue
+		}
+		// Entropy-coded data runs until the next marker other than a
+		// stuffed 0xFF00 or a restart marker.
+		marker = 0
+		for marker == 0 {
+			b, err := scanner.readByte()
+			if err != nil {
+				if err == io.EOF {
+					return scanner.corrupt("truncated scan data")
+				}
+				return err
+			}
+			if b != 0xFF {
+				continue
+			}
+			for b == 0xFF {
+				b, err = scanner.readByte()
+				if err != nil {
+					if err == io.EOF {
+						return scanner.corrupt("truncated scan data")
+					}
+					return err
+				}
+			}
+			if b != 0x00 && (b < 0xD0 || b > 0xD7) {
+				marker = b
+			}
+		}
+	}
+}
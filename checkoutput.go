@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Output formats for CheckCmd.Format.
+const (
+	checkFormatTable = "table"
+	checkFormatJSON  = "json"
+	checkFormatCSV   = "csv"
+	checkFormatSARIF = "sarif"
+)
+
+// parseCheckFormat validates a check -format value.
+func parseCheckFormat(value string) (string, error) {
+	switch value {
+	case checkFormatTable, checkFormatJSON, checkFormatCSV, checkFormatSARIF:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (want table, json, csv or sarif)", value)
+}
+
+// writeCheckResults writes results to w in format.
+func writeCheckResults(w io.Writer, format string, results []CheckResult) error {
+	switch format {
+	case checkFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	case checkFormatCSV:
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"path", "status", "error"})
+		for _, result := range results {
+			_ = writer.Write([]string{result.Path, result.Status, result.Error})
+		}
+		writer.Flush()
+		return writer.Error()
+	case checkFormatSARIF:
+		return writeCheckSARIF(w, results)
+	}
+	for _, result := range results {
+		var err error
+		if result.Error != "" {
+			_, err = fmt.Fprintf(w, "%-7s %s: %s\n", result.Status, result.Path, result.Error)
+		} else {
+			_, err = fmt.Fprintf(w, "%-7s %s\n", result.Status, result.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sarifLog is the subset of a SARIF 2.1.0 log written by check -format
+// sarif, enough for code scanning dashboards to list the failed files.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+// writeCheckSARIF writes the files of results that failed the check as a
+// SARIF log, one result per file with its status as the rule.
+func writeCheckSARIF(w io.Writer, results []CheckResult) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name: "jpegid check",
+			Rules: []sarifRule{
+				{ID: "corrupt", ShortDescription: sarifMessage{Text: "The file is not a valid JPEG."}},
+				{ID: "error", ShortDescription: sarifMessage{Text: "The file could not be read."}},
+			},
+		}},
+		Results: []sarifResult{},
+	}
+	for _, result := range results {
+		if result.Status == "ok" {
+			continue
+		}
+		sarifResult := sarifResult{RuleID: result.Status, Level: "error", Message: sarifMessage{Text: result.Error}}
+		var location sarifLocation
+		path := filepath.ToSlash(result.Path)
+		if !strings.HasPrefix(path, "/") {
+			// A Windows path, such as C:/Photos/a.jpg.
+			path = "/" + path
+		}
+		location.PhysicalLocation.ArtifactLocation.URI = (&url.URL{Scheme: "file", Path: path}).String()
+		sarifResult.Locations = []sarifLocation{location}
+		run.Results = append(run.Results, sarifResult)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
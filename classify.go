@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// File classes, the Class field of -name-template and the keys of -route.
+const (
+	// classPhoto is a photo or video taken with a camera.
+	classPhoto = "photo"
+	// classScreenshot is a capture of a screen.
+	classScreenshot = "screenshot"
+	// classScan is an image made by a scanner.
+	classScan = "scan"
+	// classDocument is a page, such as a PDF or an image of a document.
+	classDocument = "document"
+	// classOther is anything else.
+	classOther = "other"
+)
+
+var fileClasses = []string{classPhoto, classScreenshot, classScan, classDocument, classOther}
+
+// screenshotNameRegexp matches the names operating systems give screenshots
+// in a few languages.
+var screenshotNameRegexp = regexp.MustCompile(`(?i)screen[ _-]?shot|bildschirmfoto|capture d.écran|captura de pantalla|schermata`)
+
+// pageRatios are the aspect ratios of A4 (and every A size), US letter and
+// US legal paper.
+var pageRatios = []float64{math.Sqrt2, 11 / 8.5, 14 / 8.5}
+
+// classifyFile tells photos, screenshots, scans and documents apart from
+// their name and metadata:
+//
+//   - exposure settings (ExposureTime, FNumber, ISO) make a photo;
+//   - a screenshot name, an iOS "Screenshot" UserComment, or a PNG without
+//     camera fields make a screenshot;
+//   - a resolution of 150 dpi or more without exposure settings make a scan,
+//     as cameras don't record how large their pixels are on paper;
+//   - a PDF, or an image with the aspect ratio of a page, make a document;
+//   - camera fields (Make, Model) alone make a photo, as in most videos.
+func classifyFile(filePath string, exif Exif) string {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if ext == ".pdf" {
+		return classDocument
+	}
+	camera := exif.Tag("Make") != "" || exif.Tag("Model") != ""
+	exposure := exif.Tag("ExposureTime") != "" || exif.Tag("FNumber") != "" || exif.Tag("ISO") != ""
+	if exposure {
+		return classPhoto
+	}
+	if screenshotNameRegexp.MatchString(filepath.Base(filePath)) || strings.EqualFold(exif.Tag("UserComment"), "Screenshot") || (ext == ".png" && !camera) {
+		return classScreenshot
+	}
+	if dpi, ok := imageDPI(exif); ok && dpi >= 150 {
+		return classScan
+	}
+	if width, height, ok := imageSize(exif); ok {
+		ratio := float64(max(width, height)) / float64(min(width, height))
+		for _, pageRatio := range pageRatios {
+			if math.Abs(ratio-pageRatio)/pageRatio < 0.02 {
+				return classDocument
+			}
+		}
+	}
+	if camera {
+		return classPhoto
+	}
+	return classOther
+}
+
+// imageDPI returns the horizontal resolution of an image in dots per inch.
+func imageDPI(exif Exif) (float64, bool) {
+	resolution, err := strconv.ParseFloat(exif.Tag("XResolution"), 64)
+	if err != nil || resolution <= 0 {
+		return 0, false
+	}
+	switch strings.ToLower(exif.Tag("ResolutionUnit")) {
+	case "inches", "2":
+		return resolution, true
+	case "cm", "3":
+		return resolution * 2.54, true
+	}
+	return 0, false
+}
+
+// imageSize returns the dimensions of an image.
+func imageSize(exif Exif) (width, height int, ok bool) {
+	for _, tags := range [][2]string{{"ImageWidth", "ImageHeight"}, {"ExifImageWidth", "ExifImageHeight"}} {
+		width, widthErr := strconv.Atoi(exif.Tag(tags[0]))
+		height, heightErr := strconv.Atoi(exif.Tag(tags[1]))
+		if widthErr == nil && heightErr == nil && width > 0 && height > 0 {
+			return width, height, true
+		}
+	}
+	return 0, 0, false
+}
+
+// parseRoute parses a -route value, CLASS=TEMPLATE.
+func parseRoute(value string) (string, string, error) {
+	class, text, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid route %q (want CLASS=TEMPLATE)", value)
+	}
+	class = strings.ToLower(strings.TrimSpace(class))
+	for _, fileClass := range fileClasses {
+		if class == fileClass {
+			return class, text, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown class %q (want photo, screenshot, scan, document or other)", class)
+}
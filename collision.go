@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Collision policies for OnCollision.
+const (
+	collisionSkip    = "skip"
+	collisionReplace = "replace"
+	collisionSuffix  = "suffix"
+	collisionAsk     = "ask"
+)
+
+// collisionResolver decides what happens when the new name of a file is
+// already taken. Workers share a single collisionResolver, which reserves the
+// path each file is moved to until the move returns, so that two files are
+// never moved to the same path while checking for collisions doesn't wait
+// for the copies of other files, and so that only one ask prompt is shown at
+// a time.
+type collisionResolver struct {
+	// mutex guards reserved and the ask prompt.
+	mutex  sync.Mutex
+	policy string
+	stdin  *bufio.Reader
+	stderr io.Writer
+	// move puts a file at its new path: os.Rename, or copyFile in copy
+	// mode.
+	move func(oldPath, newPath string) error
+	// lstat is os.Lstat, which Renames gives the deadline of a file
+	// operation.
+	lstat func(path string) (fs.FileInfo, error)
+	// always is the answer chosen with "all" in ask mode.
+	always string
+	// reserved are the paths files are being moved to. A reservation is
+	// held by rename until move returns, and by moveWithin until the move
+	// itself does, as a move given up on carries on in the background and
+	// may yet take the path.
+	reserved map[string]*reservation
+}
+
+// reservation is a path reserved by a move under way, released once its
+// holders are done.
+type reservation struct {
+	holders  int
+	released chan struct{}
+}
+
+func newCollisionResolver(policy string, stdin io.Reader, stderr io.Writer) *collisionResolver {
+	return &collisionResolver{
+		policy:   policy,
+		stdin:    bufio.NewReader(stdin),
+		stderr:   stderr,
+		move:     os.Rename,
+		lstat:    os.Lstat,
+		reserved: make(map[string]*reservation),
+	}
+}
+
+// parseCollisionPolicy validates an -on-collision value.
+func parseCollisionPolicy(value string) (string, error) {
+	switch value {
+	case collisionSkip, collisionReplace, collisionSuffix, collisionAsk:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown collision policy %q (want skip, replace, suffix or ask)", value)
+}
+
+// rename moves oldPath to newPath according to policy, or the policy of the
+// resolver if it is empty, and returns the path the file ended up at. It
+// returns ErrCollision if the file was skipped, or the cause of ctx if ctx is
+// done while waiting for another move to the same path to return.
+func (resolver *collisionResolver) rename(ctx context.Context, oldPath, newPath, policy string) (string, error) {
+	if oldPath == newPath {
+		// Already named correctly; renaming it to a suffixed name would
+		// make every run rename it again.
+		return "", ErrAlreadyNamed
+	}
+	newPath, move, err := resolver.reserve(ctx, oldPath, newPath, policy)
+	if err != nil || !move {
+		return newPath, err
+	}
+	defer resolver.release(newPath)
+	return newPath, resolver.move(oldPath, newPath)
+}
+
+// reserve works out the path oldPath is to be moved to and, if it is to be
+// moved, reserves it for the caller to release.
+func (resolver *collisionResolver) reserve(ctx context.Context, oldPath, newPath, policy string) (path string, move bool, err error) {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	for {
+		reservation, ok := resolver.reserved[newPath]
+		if !ok {
+			break
+		}
+		// Whether the file being moved there collides is only known
+		// once its move returns.
+		resolver.mutex.Unlock()
+		select {
+		case <-reservation.released:
+		case <-ctx.Done():
+			resolver.mutex.Lock()
+			return "", false, context.Cause(ctx)
+		}
+		resolver.mutex.Lock()
+	}
+	newInfo, err := resolver.lstat(newPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", false, err
+		}
+		resolver.hold(newPath, true)
+		return newPath, true, nil
+	}
+	if oldInfo, err := resolver.lstat(oldPath); err == nil && os.SameFile(oldInfo, newInfo) {
+		// newPath is the file itself rather than a collision.
+		if sameName(oldPath, newPath) {
+			// newPath only differs from oldPath in case or Unicode
+			// normalization, on a filesystem that ignores the
+			// difference.
+			resolver.hold(newPath, true)
+			return newPath, true, nil
+		}
+		// newPath is oldPath through a symlinked directory, or another
+		// hard link to the file, which keeps both its names as with
+		// rename(2).
+		return newPath, false, nil
+	}
+	if policy == "" {
+		policy = resolver.policy
+	}
+	if policy == collisionAsk {
+		policy, err = resolver.ask(oldPath, newPath)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	switch policy {
+	case collisionReplace:
+	case collisionSuffix:
+		newPath, err = availablePath(newPath, oldPath, func(path string) (fs.FileInfo, error) {
+			if _, ok := resolver.reserved[path]; ok {
+				return nil, fs.ErrExist
+			}
+			return resolver.lstat(path)
+		})
+		if err != nil {
+			return "", false, err
+		}
+		if newPath == oldPath {
+			return "", false, ErrAlreadyNamed
+		}
+	default:
+		return "", false, ErrCollision
+	}
+	resolver.hold(newPath, true)
+	return newPath, true, nil
+}
+
+// hold adds a holder to the reservation of path, creating it if create is
+// true. It reports whether path is reserved. The caller must hold mutex.
+func (resolver *collisionResolver) hold(path string, create bool) bool {
+	r, ok := resolver.reserved[path]
+	if !ok {
+		if !create {
+			return false
+		}
+		r = &reservation{released: make(chan struct{})}
+		resolver.reserved[path] = r
+	}
+	r.holders++
+	return true
+}
+
+// release drops a holder of the reservation of path, releasing the path
+// once it has none left.
+func (resolver *collisionResolver) release(path string) {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	r, ok := resolver.reserved[path]
+	if !ok {
+		return
+	}
+	r.holders--
+	if r.holders == 0 {
+		close(r.released)
+		delete(resolver.reserved, path)
+	}
+}
+
+// moveWithin runs move, which puts a file at newPath, giving up with the
+// cause of ctx once ctx is done or timeout has passed. Like runContext, a
+// move given up on carries on in the background, but newPath stays
+// reserved until it returns.
+func (resolver *collisionResolver) moveWithin(ctx context.Context, timeout time.Duration, newPath string, move func() error) error {
+	ctx, cancel := opContext(ctx, timeout)
+	defer cancel()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	resolver.mutex.Lock()
+	held := resolver.hold(newPath, false)
+	resolver.mutex.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		if held {
+			defer resolver.release(newPath)
+		}
+		done <- move()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// ask prompts on stdin for what to do about a single collision. End of input
+// is taken to mean skip.
+func (resolver *collisionResolver) ask(oldPath, newPath string) (string, error) {
+	if resolver.always != "" {
+		return resolver.always, nil
+	}
+	for {
+		fmt.Fprintf(resolver.stderr, "%s => %s already exists. [s]kip, [r]eplace, s[u]ffix (add \"all\" to apply to every collision)? ", oldPath, newPath)
+		line, err := resolver.stdin.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				fmt.Fprintln(resolver.stderr)
+				return collisionSkip, nil
+			}
+			return "", err
+		}
+		answer, all := strings.CutSuffix(strings.ToLower(strings.TrimSpace(line)), " all")
+		policy := ""
+		switch answer {
+		case "s", "skip":
+			policy = collisionSkip
+		case "r", "replace":
+			policy = collisionReplace
+		case "u", "suffix":
+			policy = collisionSuffix
+		default:
+			continue
+		}
+		if all {
+			resolver.always = policy
+		}
+		return policy, nil
+	}
+}
+
+// availablePath returns the first of path-1.ext, path-2.ext, ... that does
+// not exist or is oldPath, so that a file already given a suffixed name by a
+// previous run keeps it. Whether a path exists is found out with lstat.
+func availablePath(path, oldPath string, lstat func(string) (fs.FileInfo, error)) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := base + "-" + strconv.Itoa(i) + ext
+		if candidate == oldPath {
+			return candidate, nil
+		}
+		_, err := lstat(candidate)
+		if errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// sameName reports whether two paths only differ in case or Unicode
+// normalization. Paths that aren't valid UTF-8 must match byte for byte, as
+// their invalid bytes would otherwise all compare equal.
+func sameName(a, b string) bool {
+	if !utf8.ValidString(a) || !utf8.ValidString(b) {
+		return a == b
+	}
+	return strings.EqualFold(normalize(a, normalizeNFC), normalize(b, normalizeNFC))
+}
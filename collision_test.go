@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollisionResolverTimedOutMove(t *testing.T) {
+	dir := t.TempDir()
+	first, second, newPath := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg"), filepath.Join(dir, "c.jpg")
+	for _, filePath := range []string{first, second} {
+		err := os.WriteFile(filePath, []byte(filePath), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolver := newCollisionResolver(collisionSkip, strings.NewReader(""), io.Discard)
+	stuck := make(chan struct{})
+	resolver.move = func(oldPath, newPath string) error {
+		return resolver.moveWithin(context.Background(), 10*time.Millisecond, newPath, func() error {
+			if oldPath == first {
+				// A rename on an unresponsive filesystem.
+				<-stuck
+			}
+			return os.Rename(oldPath, newPath)
+		})
+	}
+
+	_, err := resolver.rename(context.Background(), first, newPath, "")
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatalf("rename(%q) = %v, want ErrTimedOut", first, err)
+	}
+	renamed := make(chan error, 1)
+	go func() {
+		_, err := resolver.rename(context.Background(), second, newPath, "")
+		renamed <- err
+	}()
+	select {
+	case err := <-renamed:
+		t.Fatalf("rename(%q) = %v while the timed-out rename was still going", second, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stuck)
+	err = <-renamed
+	if !errors.Is(err, ErrCollision) {
+		t.Fatalf("rename(%q) = %v, want ErrCollision", second, err)
+	}
+	b, err := os.ReadFile(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != first {
+		t.Fatalf("%s has the contents of %s, want those of %s", newPath, b, first)
+	}
+}
+
+func TestCollisionResolverCancelledWhileMoveIsStuck(t *testing.T) {
+	dir := t.TempDir()
+	first, second, newPath := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg"), filepath.Join(dir, "c.jpg")
+	resolver := newCollisionResolver(collisionSkip, strings.NewReader(""), io.Discard)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	resolver.move = func(oldPath, newPath string) error {
+		return resolver.moveWithin(context.Background(), 10*time.Millisecond, newPath, func() error {
+			<-stuck
+			return nil
+		})
+	}
+	_, err := resolver.rename(context.Background(), first, newPath, "")
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatalf("rename(%q) = %v, want ErrTimedOut", first, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	renamed := make(chan error, 1)
+	go func() {
+		_, err := resolver.rename(ctx, second, newPath, "")
+		renamed <- err
+	}()
+	cancel()
+	select {
+	case err := <-renamed:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("rename(%q) = %v, want context.Canceled", second, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("rename(%q) still waiting for the stuck rename after cancel", second)
+	}
+}
+
+func TestCollisionResolverHardLink(t *testing.T) {
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")
+	writeFiles(t, oldPath)
+	err := os.Link(oldPath, newPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	resolver := newCollisionResolver(collisionSkip, strings.NewReader(""), io.Discard)
+	got, err := resolver.rename(context.Background(), oldPath, newPath, "")
+	if err != nil || got != newPath {
+		t.Fatalf("rename() = %q, %v, want %q", got, err, newPath)
+	}
+	for _, filePath := range []string{oldPath, newPath} {
+		_, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatalf("a link to the file was removed: %v", err)
+		}
+	}
+}
+
+func TestCollisionResolverConcurrentMoves(t *testing.T) {
+	dir := t.TempDir()
+	resolver := newCollisionResolver(collisionSkip, strings.NewReader(""), io.Discard)
+	// Each copy only finishes once both have started.
+	var started sync.WaitGroup
+	started.Add(2)
+	resolver.move = func(oldPath, newPath string) error {
+		started.Done()
+		both := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(both)
+		}()
+		select {
+		case <-both:
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("moves ran one at a time")
+		}
+	}
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		go func() {
+			_, err := resolver.rename(context.Background(), filepath.Join(dir, name), filepath.Join(dir, "new-"+name), "")
+			errs <- err
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+type CompareCmd struct {
+	DirA        string
+	DirB        string
+	FileRegexps []*regexp.Regexp
+	NumWorkers  int
+	Recursive   bool
+	// Dates matches files whose contents differ by their creation time,
+	// read from their jpegid name or with exiftool, so that copies whose
+	// metadata was edited or that were recompressed are not reported as
+	// missing.
+	Dates bool
+	// MetadataCache reads creation times through the metadata cache shared
+	// with the other subcommands.
+	MetadataCache bool
+	JSON          bool
+	Stdout        io.Writer
+	Stderr        io.Writer
+}
+
+func CompareCommand(args []string) (*CompareCmd, error) {
+	compareCmd := &CompareCmd{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	flagset := flag.NewFlagSet("compare", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: jpegid compare [flags] dirA dirB")
+		flagset.PrintDefaults()
+	}
+	flagset.IntVar(&compareCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.BoolVar(&compareCmd.Recursive, "recursive", true, "Walk the directories recursively.")
+	flagset.BoolVar(&compareCmd.Dates, "dates", true, "Match files with different contents by their creation time.")
+	flagset.BoolVar(&compareCmd.MetadataCache, "metadata-cache", false, "Reuse the metadata read from unchanged files by earlier runs of any subcommand, and cache what is read.")
+	flagset.BoolVar(&compareCmd.JSON, "json", false, "Print the comparison as JSON.")
+	var filePatterns []string
+	flagset.Func("file", "Include file regex. Can be repeated. If omitted, every file is included.", func(value string) error {
+		_, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		filePatterns = append(filePatterns, value)
+		return nil
+	})
+	ignoreCase := flagset.Bool("ignore-case", false, "Match -file patterns case-insensitively.")
+	err := flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 2 {
+		flagset.Usage()
+		return nil, errors.New("compare needs two directories")
+	}
+	compareCmd.DirA, err = filepath.Abs(flagset.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	compareCmd.DirB, err = filepath.Abs(flagset.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	compareCmd.FileRegexps, err = compileRegexps(filePatterns, *ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	return compareCmd, nil
+}
+
+// Comparison is the result of comparing two trees. Paths are relative to
+// their tree.
+type Comparison struct {
+	// Matched is the number of files with the same contents in both trees.
+	Matched int `json:"matched"`
+	// Differ are files with different contents but the same creation time.
+	Differ []ComparePair `json:"differ"`
+	OnlyA  []string      `json:"onlyA"`
+	OnlyB  []string      `json:"onlyB"`
+}
+
+// ComparePair is a file in each tree taken to be the same photo.
+type ComparePair struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+// compareFile is a file in one of the trees, or in the library for the
+// timeline.
+type compareFile struct {
+	path         string
+	size         int64
+	hash         string
+	creationTime time.Time
+}
+
+func (compareCmd *CompareCmd) Run(ctx context.Context) error {
+	filesA, err := compareCmd.walk(ctx, compareCmd.DirA)
+	if err != nil {
+		return err
+	}
+	filesB, err := compareCmd.walk(ctx, compareCmd.DirB)
+	if err != nil {
+		return err
+	}
+	// Only files of a size found in both trees can have the same contents,
+	// so hash just those.
+	sizesA := make(map[int64]bool)
+	for _, file := range filesA {
+		sizesA[file.size] = true
+	}
+	sizesB := make(map[int64]bool)
+	for _, file := range filesB {
+		sizesB[file.size] = true
+	}
+	var candidates []*compareFile
+	for _, file := range filesA {
+		if sizesB[file.size] {
+			candidates = append(candidates, file)
+		}
+	}
+	for _, file := range filesB {
+		if sizesA[file.size] {
+			candidates = append(candidates, file)
+		}
+	}
+	compareCmd.parallel(ctx, candidates, func(file *compareFile) {
+		hash, err := hashFile(file.path)
+		if err != nil {
+			fmt.Fprintln(compareCmd.Stderr, err)
+			return
+		}
+		file.hash = hash
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	comparison := Comparison{Differ: []ComparePair{}, OnlyA: []string{}, OnlyB: []string{}}
+	hashesB := make(map[string][]*compareFile)
+	for _, file := range filesB {
+		if file.hash != "" {
+			hashesB[file.hash] = append(hashesB[file.hash], file)
+		}
+	}
+	var restA, restB []*compareFile
+	matchedB := make(map[*compareFile]bool)
+	for _, file := range filesA {
+		if matches := hashesB[file.hash]; file.hash != "" && len(matches) > 0 {
+			comparison.Matched++
+			matchedB[matches[0]] = true
+			hashesB[file.hash] = matches[1:]
+			continue
+		}
+		restA = append(restA, file)
+	}
+	for _, file := range filesB {
+		if !matchedB[file] {
+			restB = append(restB, file)
+		}
+	}
+	if compareCmd.Dates && len(restA) > 0 && len(restB) > 0 {
+		var cache *metadataCache
+		if compareCmd.MetadataCache {
+			var err error
+			cache, err = openMetadataCache("")
+			if err != nil {
+				return err
+			}
+		}
+		err := readCreationTimes(ctx, append(slices.Clone(restA), restB...), compareCmd.NumWorkers, cache, compareCmd.Stderr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			fmt.Fprintf(compareCmd.Stderr, "warning: files are only matched by contents: %v\n", err)
+		}
+		timesB := make(map[int64][]*compareFile)
+		for _, file := range restB {
+			if !file.creationTime.IsZero() {
+				timesB[file.creationTime.Unix()] = append(timesB[file.creationTime.Unix()], file)
+			}
+		}
+		unmatchedA := restA[:0]
+		for _, file := range restA {
+			key := file.creationTime.Unix()
+			if matches := timesB[key]; !file.creationTime.IsZero() && len(matches) > 0 {
+				comparison.Differ = append(comparison.Differ, ComparePair{A: comparePath(compareCmd.DirA, file.path), B: comparePath(compareCmd.DirB, matches[0].path)})
+				matchedB[matches[0]] = true
+				timesB[key] = matches[1:]
+				continue
+			}
+			unmatchedA = append(unmatchedA, file)
+		}
+		restA = unmatchedA
+	}
+	for _, file := range restA {
+		comparison.OnlyA = append(comparison.OnlyA, comparePath(compareCmd.DirA, file.path))
+	}
+	for _, file := range restB {
+		if !matchedB[file] {
+			comparison.OnlyB = append(comparison.OnlyB, comparePath(compareCmd.DirB, file.path))
+		}
+	}
+	if compareCmd.JSON {
+		encoder := json.NewEncoder(compareCmd.Stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(comparison)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, path := range comparison.OnlyA {
+			fmt.Fprintf(compareCmd.Stdout, "only in %s: %s\n", compareCmd.DirA, path)
+		}
+		for _, path := range comparison.OnlyB {
+			fmt.Fprintf(compareCmd.Stdout, "only in %s: %s\n", compareCmd.DirB, path)
+		}
+		for _, pair := range comparison.Differ {
+			fmt.Fprintf(compareCmd.Stdout, "differ: %s <> %s\n", pair.A, pair.B)
+		}
+	}
+	fmt.Fprintf(compareCmd.Stderr, "%d matched, %d differ, %d only in %s, %d only in %s\n", comparison.Matched, len(comparison.Differ), len(comparison.OnlyA), compareCmd.DirA, len(comparison.OnlyB), compareCmd.DirB)
+	if len(comparison.OnlyA) > 0 {
+		return fmt.Errorf("%d files in %s are missing from %s", len(comparison.OnlyA), compareCmd.DirA, compareCmd.DirB)
+	}
+	return nil
+}
+
+// walk lists the files in dir, sorted by path.
+func (compareCmd *CompareCmd) walk(ctx context.Context, dir string) ([]*compareFile, error) {
+	var files []*compareFile
+	err := fs.WalkDir(os.DirFS(dir), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if dirEntry.IsDir() {
+			if path != "." && (!compareCmd.Recursive || isNASMetadataDir(dirEntry.Name())) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !dirEntry.Type().IsRegular() {
+			return nil
+		}
+		if len(compareCmd.FileRegexps) > 0 && !slices.ContainsFunc(compareCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+			return fileRegexp.MatchString(dirEntry.Name())
+		}) {
+			return nil
+		}
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, &compareFile{path: filepath.Join(dir, path), size: fileInfo.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// parallel calls fn with each of files on NumWorkers goroutines.
+func (compareCmd *CompareCmd) parallel(ctx context.Context, files []*compareFile, fn func(file *compareFile)) {
+	var waitGroup sync.WaitGroup
+	jobs := make(chan *compareFile)
+	for i := 0; i < max(compareCmd.NumWorkers, 1); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for file := range jobs {
+				fn(file)
+			}
+		}()
+	}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- file
+	}
+	close(jobs)
+	waitGroup.Wait()
+}
+
+// compareDateTags are the tags the creation time of files is read from by
+// readCreationTimes, as by default when renaming.
+var compareDateTags = []string{"SubSecDateTimeOriginal", "CreateDate"}
+
+// readCreationTimes sets the creation time of files, from their name if
+// jpegid named them and with exiftool otherwise. Dates without an offset
+// are read as UTC, which keeps their wall clock time and is the same in both
+// trees of a comparison. exiftool is only started if a file needs it, with
+// numWorkers processes, and metadata is read through cache if it is not nil.
+func readCreationTimes(ctx context.Context, files []*compareFile, numWorkers int, cache *metadataCache, stderr io.Writer) error {
+	var unnamed []*compareFile
+	for _, file := range files {
+		if creationTime, ok := parseFileName(filepath.Base(file.path)); ok {
+			file.creationTime = creationTime
+			continue
+		}
+		unnamed = append(unnamed, file)
+	}
+	if len(unnamed) == 0 {
+		return nil
+	}
+	version, err := GetExifToolVersion()
+	if err != nil {
+		return err
+	}
+	commonArgs := version.CommonArgs()
+	extractors := make(chan MetadataExtractor, max(numWorkers, 1))
+	for range cap(extractors) {
+		extractor, err := NewExifToolExtractor(func() (ExifToolClient, error) {
+			return NewExifToolClient(stderr, commonArgs...)
+		})
+		if err != nil {
+			close(extractors)
+			for extractor := range extractors {
+				_ = extractor.Close()
+			}
+			return err
+		}
+		if cache != nil {
+			extractor = &cachedExtractor{cache: cache, backend: "exiftool", extractor: extractor}
+		}
+		extractors <- extractor
+	}
+	close(extractors)
+	var waitGroup sync.WaitGroup
+	jobs := make(chan *compareFile)
+	for extractor := range extractors {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer extractor.Close()
+			for file := range jobs {
+				exif, err := extractor.Extract(file.path)
+				if err != nil {
+					continue
+				}
+				for _, tag := range compareDateTags {
+					date, err := dateFromTag(exif, tag, time.UTC, dstEarlier, false)
+					if err == nil {
+						file.creationTime = date.Time
+						break
+					}
+				}
+			}
+		}()
+	}
+	for _, file := range unnamed {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- file
+	}
+	close(jobs)
+	waitGroup.Wait()
+	return ctx.Err()
+}
+
+// comparePath returns filePath relative to dir.
+func comparePath(dir, filePath string) string {
+	relPath, err := filepath.Rel(dir, filePath)
+	if err != nil {
+		return filePath
+	}
+	return relPath
+}
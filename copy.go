@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// destDir returns the directory files are copied (CopyTo) or moved
+// (MergeInto) to, or "" if they are renamed in place.
+func (jpegidCmd *JpegIDCmd) destDir() string {
+	if jpegidCmd.CopyTo != "" {
+		return jpegidCmd.CopyTo
+	}
+	return jpegidCmd.MergeInto
+}
+
+// destPath returns where newFilePath, the new path of a file in root, is
+// copied or moved to: the same path relative to destDir.
+func (jpegidCmd *JpegIDCmd) destPath(root, newFilePath string) string {
+	relPath, err := filepath.Rel(root, newFilePath)
+	if err != nil {
+		return filepath.Join(jpegidCmd.destDir(), filepath.Base(newFilePath))
+	}
+	return filepath.Join(jpegidCmd.destDir(), relPath)
+}
+
+// copyOptions are the attributes of the original that copyFile keeps in
+// addition to its modification time, as with cp --preserve.
+type copyOptions struct {
+	// mode keeps the permission bits (including setuid, setgid and sticky)
+	// instead of those of a new file.
+	mode bool
+	// ownership keeps the owner and group. Only root can change the owner
+	// of a file, so this is ignored for other users.
+	ownership bool
+	// limiter, if not nil, limits how fast files are read.
+	limiter *rateLimiter
+}
+
+// parsePreserve parses a -preserve list.
+func parsePreserve(value string) (copyOptions, error) {
+	var options copyOptions
+	for _, attribute := range strings.Split(value, ",") {
+		switch strings.TrimSpace(attribute) {
+		case "mode":
+			options.mode = true
+		case "ownership":
+			options.ownership = true
+		case "all":
+			options.mode, options.ownership = true, true
+		case "timestamps":
+			// Always kept.
+		default:
+			return copyOptions{}, fmt.Errorf("unknown attribute %q (want mode, ownership, timestamps or all)", attribute)
+		}
+	}
+	return options, nil
+}
+
+// copyFile copies oldPath to newPath, keeping its modification time and the
+// attributes in options. The copy is written to a temporary file next to
+// newPath and renamed into place once complete, so that a failed copy never
+// leaves a truncated file behind. The copy stops, and fails, once ctx is
+// done.
+func copyFile(ctx context.Context, oldPath, newPath string, options copyOptions) error {
+	src, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := createCopy(filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	var r io.Reader = &contextReader{ctx: ctx, r: src}
+	if options.limiter != nil {
+		r = &limitedReader{r: r, limiter: options.limiter}
+	}
+	_, err = io.Copy(dst, r)
+	if err == nil {
+		err = dst.Sync()
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && options.ownership {
+		// Before the mode, as changing the owner clears the setuid and
+		// setgid bits.
+		err = copyOwnership(dst.Name(), srcInfo)
+	}
+	if err == nil && options.mode {
+		err = os.Chmod(dst.Name(), srcInfo.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), srcInfo.ModTime(), srcInfo.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), newPath)
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	return nil
+}
+
+// rateLimiter paces reads so that together they don't go faster than rate
+// bytes per second. Every worker shares the one rateLimiter of a run.
+type rateLimiter struct {
+	mutex sync.Mutex
+	rate  float64
+	// next is when the bytes reserved so far have been paid for.
+	next time.Time
+}
+
+// wait blocks until n more bytes may be read.
+func (limiter *rateLimiter) wait(n int) {
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	limiter.next = limiter.next.Add(time.Duration(float64(n) / limiter.rate * float64(time.Second)))
+	delay := limiter.next.Sub(now)
+	limiter.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedReader reads from r no faster than its limiter allows.
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+// limitedReadSize is the most read at a time by a limitedReader, so that
+// low rates are paced smoothly instead of in bursts of a whole buffer.
+const limitedReadSize = 32 * 1024
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitedReadSize {
+		p = p[:limitedReadSize]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+// parseByteRate parses a -bwlimit rate in bytes per second, optionally with
+// a K, M or G suffix (powers of 1024).
+func parseByteRate(value string) (int64, error) {
+	number, multiplier := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+	number = strings.TrimSuffix(number, "B")
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q (want bytes per second, e.g. 500K or 20M)", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// createCopy creates a new file for a copy in dir. Unlike os.CreateTemp the
+// file gets the usual permissions of a new file (0666 less the umask).
+func createCopy(dir string) (*os.File, error) {
+	for {
+		name := filepath.Join(dir, ".jpegid-copy-"+strconv.FormatUint(uint64(rand.Uint32()), 36))
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return file, err
+	}
+}
+
+// copySpace returns how many bytes the files to be copied from the roots
+// take up, and how many are free where they are copied to. Files in a
+// -files-from list are not counted.
+func (jpegidCmd *JpegIDCmd) copySpace(ctx context.Context, state *scanState) (needed, free uint64, err error) {
+	if jpegidCmd.FilesFrom == "" {
+		for _, root := range jpegidCmd.Roots {
+			err := jpegidCmd.walkRoot(ctx, root, state, nil, func(filePath string, dirEntry fs.DirEntry, skip error) error {
+				if skip != nil {
+					return nil
+				}
+				fileInfo, err := dirEntry.Info()
+				if err == nil {
+					needed += uint64(fileInfo.Size())
+				}
+				return nil
+			})
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	// CopyTo doesn't exist yet in a dry run.
+	dir := jpegidCmd.CopyTo
+	for {
+		_, err := os.Stat(dir)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err = freeSpace(dir)
+	if err != nil {
+		return needed, 0, err
+	}
+	return needed, free, nil
+}
+
+// checkCopySpace returns an ErrInsufficientSpace error if the files to be
+// copied don't fit where they are copied to. In a dry run, or if the free
+// space can't be found out, a warning is printed instead.
+func (jpegidCmd *JpegIDCmd) checkCopySpace(ctx context.Context, state *scanState) error {
+	needed, free, err := jpegidCmd.copySpace(ctx, state)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(jpegidCmd.Stderr, "warning: unable to check free space in %s: %v\n", jpegidCmd.CopyTo, err)
+		return nil
+	}
+	jpegidCmd.logger.Info("checked free space", slog.String("dir", jpegidCmd.CopyTo), slog.Uint64("needed", needed), slog.Uint64("free", free))
+	if needed <= free {
+		return nil
+	}
+	err = fmt.Errorf("%w: copying needs %s but %s has %s free", ErrInsufficientSpace, formatBytes(needed), jpegidCmd.CopyTo, formatBytes(free))
+	if jpegidCmd.DryRun {
+		fmt.Fprintf(jpegidCmd.Stderr, "warning: %v\n", err)
+		return nil
+	}
+	return err
+}
+
+// formatBytes formats n as a number of bytes with a binary prefix.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultDateTags are the metadata tags tried for the creation time of a
+// file when DateTags is empty.
+var defaultDateTags = []string{"SubSecDateTimeOriginal", "CreateDate"}
+
+// offsetTags are the tags holding the timezone offset of date tags that
+// don't include one. TimeZone is tried after these for every tag.
+var offsetTags = map[string]string{
+	"DateTimeOriginal": "OffsetTimeOriginal",
+	"CreateDate":       "OffsetTimeDigitized",
+	"ModifyDate":       "OffsetTime",
+}
+
+// Tag returns the value of the named metadata tag, or "" if the file doesn't
+// have it.
+func (exif Exif) Tag(name string) string {
+	if value, ok := exif.Tags[name]; ok {
+		return value
+	}
+	switch name {
+	case "FileSize":
+		return exif.FileSize
+	case "SubSecDateTimeOriginal":
+		return exif.SubSecDateTimeOriginal
+	case "CreateDate":
+		return exif.CreateDate
+	case "TimeZone":
+		return exif.TimeZone
+	}
+	return ""
+}
+
+// Policies for OffsetPolicy.
+const (
+	offsetRequire = "require"
+	offsetLocal   = "local"
+	offsetUTC     = "utc"
+)
+
+// offsetLocation returns the location offset-less dates are assumed to be
+// in under policy, or nil if they are rejected.
+func offsetLocation(policy string) *time.Location {
+	switch policy {
+	case offsetLocal:
+		return time.Local
+	case offsetUTC:
+		return time.UTC
+	}
+	return nil
+}
+
+// Policies for DSTPolicy.
+const (
+	dstEarlier = "earlier"
+	dstLater   = "later"
+	dstError   = "error"
+)
+
+// parseDSTPolicy validates a -dst value.
+func parseDSTPolicy(value string) (string, error) {
+	switch value {
+	case dstEarlier, dstLater, dstError:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown DST policy %q (want earlier, later or error)", value)
+}
+
+// parsedDate is a date read from a metadata tag.
+type parsedDate struct {
+	Time time.Time
+
+	// HasSubsec reports whether the date had sub-second precision.
+	HasSubsec bool
+
+	// Warning describes how a date that was ambiguous was resolved.
+	Warning string
+}
+
+// exifDateLayouts are the layouts exiftool prints dates in. Fractional
+// seconds are accepted by time.Parse without being in the layout.
+var exifDateLayouts = []string{
+	"2006:01:02 15:04:05-07:00",
+	"2006:01:02 15:04:05Z07:00",
+}
+
+// exifLocalDateLayout is the layout of dates without a timezone offset.
+const exifLocalDateLayout = "2006:01:02 15:04:05"
+
+// dateFromTag parses the date in the named tag. Dates without an offset take
+// it from the matching offset tag or TimeZone, or if fromGPS is true, from
+// the GPS time (see gpsOffset). Otherwise they are taken to be in location,
+// with DST transitions resolved by dstPolicy. A nil location rejects them.
+func dateFromTag(exif Exif, tag string, location *time.Location, dstPolicy string, fromGPS bool) (date parsedDate, err error) {
+	value := strings.TrimSpace(exif.Tag(tag))
+	date.HasSubsec = strings.Contains(value, ".")
+	for _, layout := range exifDateLayouts {
+		date.Time, err = time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return date, nil
+		}
+	}
+	wallClock, err := time.Parse(exifLocalDateLayout, value)
+	if err == nil {
+		offset := ""
+		if offsetTag, ok := offsetTags[tag]; ok {
+			offset = exif.Tag(offsetTag)
+		}
+		if offset == "" {
+			offset = exif.Tag("TimeZone")
+		}
+		if offset == "" && fromGPS {
+			offset = gpsOffset(exif, wallClock)
+		}
+		if offset == "" {
+			if location == nil {
+				return parsedDate{}, fmt.Errorf("%q has no timezone offset (use -assume-local or -assume-utc)", value)
+			}
+			date.Time, date.Warning, err = resolveWallClock(wallClock, location, dstPolicy)
+			if err != nil {
+				return parsedDate{}, err
+			}
+			return date, nil
+		}
+		date.Time, err = time.ParseInLocation(exifLocalDateLayout+"-07:00", value+offset, time.UTC)
+		if err != nil {
+			return parsedDate{}, err
+		}
+		return date, nil
+	}
+	return parsedDate{}, fmt.Errorf("unrecognized date %q", value)
+}
+
+// resolveWallClock returns the time in location showing the wall clock time
+// held in the UTC time wallClock. Around a DST transition the wall clock
+// time happens twice (when clocks go back) or not at all (when they go
+// forward); dstPolicy picks the earlier or later of the two candidate times
+// or makes it an error, and warning says which was picked.
+func resolveWallClock(wallClock time.Time, location *time.Location, dstPolicy string) (t time.Time, warning string, err error) {
+	// DST transitions are far more than a day apart, so the offsets a day
+	// either side are the only ones the wall clock time can be in.
+	_, offsetBefore := wallClock.Add(-24 * time.Hour).In(location).Zone()
+	_, offsetAfter := wallClock.Add(24 * time.Hour).In(location).Zone()
+	if offsetBefore == offsetAfter {
+		return time.Date(wallClock.Year(), wallClock.Month(), wallClock.Day(), wallClock.Hour(), wallClock.Minute(), wallClock.Second(), wallClock.Nanosecond(), location), "", nil
+	}
+	earlier := wallClock.Add(-time.Duration(max(offsetBefore, offsetAfter)) * time.Second).In(location)
+	later := wallClock.Add(-time.Duration(min(offsetBefore, offsetAfter)) * time.Second).In(location)
+	var valid []time.Time
+	for _, candidate := range []time.Time{earlier, later} {
+		if candidate.Format(exifLocalDateLayout) == wallClock.Format(exifLocalDateLayout) {
+			valid = append(valid, candidate)
+		}
+	}
+	if len(valid) == 1 {
+		return valid[0], "", nil
+	}
+	problem := "happens twice"
+	if len(valid) == 0 {
+		problem = "does not exist"
+	}
+	switch dstPolicy {
+	case dstLater:
+		return later, fmt.Sprintf("%s %s in %s because of a DST transition, took the later time %s", wallClock.Format(exifLocalDateLayout), problem, location, later.Format(time.RFC3339)), nil
+	case dstError:
+		return time.Time{}, "", fmt.Errorf("%s %s in %s because of a DST transition (use -dst=earlier or -dst=later)", wallClock.Format(exifLocalDateLayout), problem, location)
+	default:
+		return earlier, fmt.Sprintf("%s %s in %s because of a DST transition, took the earlier time %s", wallClock.Format(exifLocalDateLayout), problem, location, earlier.Format(time.RFC3339)), nil
+	}
+}
+
+// minPlausibleDate is the earliest creation time taken at face value. Older
+// dates in digital photos and videos are almost always a camera whose clock
+// was never set.
+var minPlausibleDate = time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// implausibleDate returns why t is unlikely to be a real creation time, or
+// "" if it is plausible. Dates up to a day ahead of now are allowed for
+// clocks set to a timezone east of the local one.
+func implausibleDate(t, now time.Time) string {
+	switch {
+	case t.Before(minPlausibleDate):
+		return "before " + minPlausibleDate.Format("2006")
+	case t.After(now.Add(24 * time.Hour)):
+		return "in the future"
+	}
+	// Cameras with a reset clock typically start at midnight on New Year's
+	// Day of some year, such as 2000-01-01 00:00:00.
+	if t.Month() == time.January && t.Day() == 1 && t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return "a camera's default date"
+	}
+	return ""
+}
+
+// gpsDateTag is the tag with the time of the GPS fix, in UTC, which is set
+// by the satellites rather than the camera clock.
+const gpsDateTag = "GPSDateTime"
+
+// gpsOffset works out the timezone offset of wallClock, a wall clock time
+// held in UTC, from the GPS time of the file, as the difference between the
+// two rounded to the quarter hour. It returns "" if the file has no GPS time
+// or the difference is too far from a real offset, as when the camera clock
+// is wrong.
+func gpsOffset(exif Exif, wallClock time.Time) string {
+	if exif.Tag(gpsDateTag) == "" {
+		return ""
+	}
+	gpsDate, err := dateFromTag(exif, gpsDateTag, time.UTC, dstEarlier, false)
+	if err != nil {
+		return ""
+	}
+	difference := wallClock.Sub(gpsDate.Time)
+	offset := difference.Round(15 * time.Minute)
+	if (difference-offset).Abs() > 2*time.Minute || offset.Abs() > 14*time.Hour {
+		return ""
+	}
+	return time.Date(0, 1, 1, 0, 0, 0, 0, time.FixedZone("", int(offset/time.Second))).Format("-07:00")
+}
+
+// defaultGPSThreshold is the default GPSThreshold. GPS fixes can be a few
+// minutes stale when a photo is taken.
+const defaultGPSThreshold = 5 * time.Minute
+
+// needsOffset reports whether WriteOffset writes OffsetTimeOriginal into a
+// file: one with a DateTimeOriginal but no offset for it.
+func needsOffset(exif Exif) bool {
+	return exif.Tag("DateTimeOriginal") != "" && exif.Tag("OffsetTimeOriginal") == ""
+}
+
+// offsetWriter writes OffsetTimeOriginal into files with its own exiftool
+// process, started on first use. Each worker has its own.
+type offsetWriter struct {
+	client    ExifToolClient
+	newClient func() (ExifToolClient, error)
+}
+
+// write sets OffsetTimeOriginal in a file to the offset of creationTime,
+// keeping its modification time.
+func (writer *offsetWriter) write(filePath string, creationTime time.Time) error {
+	if writer.client == nil {
+		client, err := writer.newClient()
+		if err != nil {
+			return err
+		}
+		writer.client = client
+	}
+	err := writeTags(writer.client, filePath, []string{"-OffsetTimeOriginal=" + creationTime.Format("-07:00"), "-P", "-overwrite_original"})
+	if err != nil && !strings.HasPrefix(err.Error(), "not updated") {
+		// The exiftool instance is no longer usable.
+		_ = writer.client.Close()
+		writer.client = nil
+	}
+	return err
+}
+
+func (writer *offsetWriter) Close() error {
+	if writer.client == nil {
+		return nil
+	}
+	return writer.client.Close()
+}
+
+// tripZone is a date range whose photos are named in a single timezone, such
+// as that of the destination of a trip, so that photos from cameras and
+// phones set to different timezones sort in the order they were taken.
+type tripZone struct {
+	// From and To are the start and (exclusive) end of the range.
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+}
+
+// parseTripZone parses a -trip value, FROM..TO=ZONE. FROM and TO are dates,
+// both included, in ZONE, which is a timezone name or an offset.
+func parseTripZone(value string) (tripZone, error) {
+	invalid := fmt.Errorf("invalid trip %q (want FROM..TO=ZONE, e.g. 2023-09-10..2023-09-20=Asia/Tokyo)", value)
+	dates, zone, ok := strings.Cut(value, "=")
+	if !ok {
+		return tripZone{}, invalid
+	}
+	from, to, ok := strings.Cut(dates, "..")
+	if !ok {
+		return tripZone{}, invalid
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		offset, offsetErr := time.Parse("-07:00", zone)
+		if offsetErr != nil {
+			return tripZone{}, fmt.Errorf("%w: %w", invalid, err)
+		}
+		_, seconds := offset.Zone()
+		location = time.FixedZone(zone, seconds)
+	}
+	var trip tripZone
+	trip.Location = location
+	trip.From, err = time.ParseInLocation(time.DateOnly, from, location)
+	if err != nil {
+		return tripZone{}, invalid
+	}
+	trip.To, err = time.ParseInLocation(time.DateOnly, to, location)
+	if err != nil || trip.To.Before(trip.From) {
+		return tripZone{}, invalid
+	}
+	trip.To = trip.To.AddDate(0, 0, 1)
+	return trip, nil
+}
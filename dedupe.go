@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+type DedupeCmd struct {
+	Roots          []string
+	FileRegexps    []*regexp.Regexp
+	NumWorkers     int
+	Recursive      bool
+	DryRun         bool
+	LinkDuplicates bool
+	// HashMode is how files are compared, hashModeContents or
+	// hashModePixels.
+	HashMode string
+	Stdout   io.Writer
+	Stderr   io.Writer
+}
+
+func DedupeCommand(args []string) (*DedupeCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	dedupeCmd := &DedupeCmd{
+		Roots:    []string{cwd},
+		HashMode: hashModeContents,
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+	}
+	flagset := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	flagset.IntVar(&dedupeCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.BoolVar(&dedupeCmd.Recursive, "recursive", false, "Walk the roots recursively.")
+	flagset.BoolVar(&dedupeCmd.DryRun, "dry-run", false, "Print link operations without executing.")
+	flagset.BoolVar(&dedupeCmd.LinkDuplicates, "link-duplicates", false, "Replace duplicates with hardlinks to a canonical copy (same device only).")
+	flagset.Func("hash", "How files are compared: contents (the whole file) or pixels (only the image data of JPEGs, so that copies with different metadata are duplicates).", func(value string) error {
+		mode, err := parseHashMode(value)
+		if err != nil {
+			return err
+		}
+		dedupeCmd.HashMode = mode
+		return nil
+	})
+	flagset.Func("root", "Specify an additional root directory. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		dedupeCmd.Roots = append(dedupeCmd.Roots, root)
+		return nil
+	})
+	var filePatterns []string
+	flagset.Func("file", "Include file regex. Can be repeated. If omitted, every file is included.", func(value string) error {
+		_, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		filePatterns = append(filePatterns, value)
+		return nil
+	})
+	ignoreCase := flagset.Bool("ignore-case", false, "Match -file patterns case-insensitively.")
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	dedupeCmd.FileRegexps, err = compileRegexps(filePatterns, *ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	if dedupeCmd.LinkDuplicates && dedupeCmd.HashMode == hashModePixels {
+		return nil, errors.New("-link-duplicates can't be used with -hash pixels, as the metadata of the duplicates would be lost")
+	}
+	return dedupeCmd, nil
+}
+
+func (dedupeCmd *DedupeCmd) Run(ctx context.Context) error {
+	// Only files of the same size can be duplicates, so hash just those.
+	// Comparing pixels, files of any size can be, so they are all put under
+	// size 0.
+	filePathsBySize := make(map[int64][]string)
+	seen := make(map[string]bool)
+	for _, root := range dedupeCmd.Roots {
+		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dirEntry.IsDir() {
+				if path != "." && (!dedupeCmd.Recursive || isNASMetadataDir(dirEntry.Name())) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !dirEntry.Type().IsRegular() {
+				return nil
+			}
+			if len(dedupeCmd.FileRegexps) > 0 && !slices.ContainsFunc(dedupeCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+				return fileRegexp.MatchString(dirEntry.Name())
+			}) {
+				return nil
+			}
+			fileInfo, err := dirEntry.Info()
+			if err != nil {
+				return err
+			}
+			filePath := filepath.Join(root, path)
+			size := fileInfo.Size()
+			if dedupeCmd.HashMode == hashModePixels {
+				size = 0
+			}
+			if seen[filePath] {
+				// Overlapping roots.
+				return nil
+			}
+			seen[filePath] = true
+			filePathsBySize[size] = append(filePathsBySize[size], filePath)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var candidates []string
+	for _, filePaths := range filePathsBySize {
+		if len(filePaths) > 1 {
+			candidates = append(candidates, filePaths...)
+		}
+	}
+	hashes := make(map[string]string)
+	// hashed are the files as they were when they were hashed, so that
+	// files changed since are not linked.
+	hashed := make(map[string]fs.FileInfo)
+	var mutex sync.Mutex
+	hash := hashFunc(dedupeCmd.HashMode)
+	var waitGroup sync.WaitGroup
+	filePaths := make(chan string)
+	for i := 0; i < max(dedupeCmd.NumWorkers, 1); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for filePath := range filePaths {
+				fileInfo, err := os.Lstat(filePath)
+				if err != nil {
+					fmt.Fprintln(dedupeCmd.Stderr, err)
+					continue
+				}
+				sum, err := hash(filePath)
+				if err != nil {
+					fmt.Fprintln(dedupeCmd.Stderr, err)
+					continue
+				}
+				mutex.Lock()
+				hashes[filePath] = sum
+				hashed[filePath] = fileInfo
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, filePath := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		filePaths <- filePath
+	}
+	close(filePaths)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	filePathsByHash := make(map[string][]string)
+	for filePath, hash := range hashes {
+		filePathsByHash[hash] = append(filePathsByHash[hash], filePath)
+	}
+	var groups [][]string
+	for _, filePaths := range filePathsByHash {
+		if len(filePaths) > 1 {
+			slices.Sort(filePaths)
+			groups = append(groups, filePaths)
+		}
+	}
+	slices.SortFunc(groups, func(a, b []string) int {
+		return slices.Compare(a, b)
+	})
+	for _, group := range groups {
+		// The first file (in path order) is the canonical copy.
+		canonical := group[0]
+		fmt.Fprintln(dedupeCmd.Stdout, canonical)
+		for _, duplicate := range group[1:] {
+			if !dedupeCmd.LinkDuplicates {
+				fmt.Fprintf(dedupeCmd.Stdout, "  %s\n", duplicate)
+				continue
+			}
+			if dedupeCmd.DryRun {
+				fmt.Fprintf(dedupeCmd.Stdout, "  %s => hardlink\n", duplicate)
+				continue
+			}
+			err := linkDuplicate(canonical, duplicate, hashed[canonical], hashed[duplicate])
+			if err != nil {
+				fmt.Fprintf(dedupeCmd.Stdout, "  %s (not linked: %v)\n", duplicate, err)
+				continue
+			}
+			fmt.Fprintf(dedupeCmd.Stdout, "  %s => hardlinked\n", duplicate)
+		}
+	}
+	return nil
+}
+
+// hashFile returns the hex-encoded SHA-256 of the contents of a file.
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// linkDuplicate replaces duplicate with a hardlink to canonical. The link is
+// created next to duplicate and renamed over it, so duplicate is never
+// missing if something goes wrong. Neither is linked if it no longer has the
+// size and modification time of canonicalHashed or duplicateHashed, as it
+// was when it was hashed.
+func linkDuplicate(canonical, duplicate string, canonicalHashed, duplicateHashed fs.FileInfo) error {
+	canonicalInfo, err := os.Lstat(canonical)
+	if err != nil {
+		return err
+	}
+	if changedSince(canonicalInfo, canonicalHashed) {
+		return fmt.Errorf("%s changed since it was hashed", canonical)
+	}
+	duplicateInfo, err := os.Lstat(duplicate)
+	if err != nil {
+		return err
+	}
+	if changedSince(duplicateInfo, duplicateHashed) {
+		return errors.New("changed since it was hashed")
+	}
+	if os.SameFile(canonicalInfo, duplicateInfo) {
+		return errors.New("already hardlinked")
+	}
+	canonicalDevice, err := deviceID(canonical)
+	if err != nil {
+		return err
+	}
+	duplicateDevice, err := deviceID(duplicate)
+	if err != nil {
+		return err
+	}
+	if canonicalDevice != duplicateDevice {
+		return errors.New("on a different device")
+	}
+	tempName := filepath.Join(filepath.Dir(duplicate), ".jpegid-link-"+filepath.Base(duplicate))
+	err = os.Link(canonical, tempName)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempName, duplicate)
+	if err != nil {
+		_ = os.Remove(tempName)
+		return err
+	}
+	return nil
+}
+
+// changedSince reports whether fileInfo, of a file as it is now, differs in
+// type, size or modification time from hashed, of the file as it was hashed.
+func changedSince(fileInfo, hashed fs.FileInfo) bool {
+	return fileInfo.Mode().Type() != hashed.Mode().Type() || fileInfo.Size() != hashed.Size() || !fileInfo.ModTime().Equal(hashed.ModTime())
+}
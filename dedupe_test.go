@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLinkDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	canonical, duplicate := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")
+	for _, filePath := range []string{canonical, duplicate} {
+		err := os.WriteFile(filePath, []byte("jpeg"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	canonicalHashed, err := os.Lstat(canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicateHashed, err := os.Lstat(duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The duplicate is edited after it was hashed.
+	err = os.WriteFile(duplicate, []byte("edit"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(duplicate, time.Time{}, duplicateHashed.ModTime().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = linkDuplicate(canonical, duplicate, canonicalHashed, duplicateHashed)
+	if err == nil {
+		t.Fatal("a duplicate changed since it was hashed was linked")
+	}
+	b, err := os.ReadFile(duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "edit" {
+		t.Fatalf("%s = %q, want the edit kept", duplicate, b)
+	}
+
+	duplicateHashed, err = os.Lstat(duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = linkDuplicate(canonical, duplicate, canonicalHashed, duplicateHashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonicalInfo, err := os.Stat(canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicateInfo, err := os.Stat(duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(canonicalInfo, duplicateInfo) {
+		t.Fatalf("%s is not a hardlink to %s", duplicate, canonical)
+	}
+}
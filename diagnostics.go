@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime/trace"
+)
+
+// startDiagnostics serves net/http/pprof on pprofAddr and writes an
+// execution trace to traceFile, if they are not empty, so that long runs can
+// be profiled with go tool pprof and go tool trace. The returned function
+// stops both.
+func startDiagnostics(stderr io.Writer, pprofAddr, traceFile string) (stop func() error, err error) {
+	var listener net.Listener
+	if pprofAddr != "" {
+		listener, err = net.Listen("tcp", pprofAddr)
+		if err != nil {
+			return nil, fmt.Errorf("pprof: %w", err)
+		}
+		fmt.Fprintf(stderr, "serving pprof on http://%s/debug/pprof/\n", listener.Addr())
+		go func() {
+			// Handlers are registered on the default mux by net/http/pprof.
+			err := http.Serve(listener, nil)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(stderr, "warning: pprof: %v\n", err)
+			}
+		}()
+	}
+	var file *os.File
+	if traceFile != "" {
+		file, err = os.Create(traceFile)
+		if err == nil {
+			err = trace.Start(file)
+			if err != nil {
+				_ = file.Close()
+			}
+		}
+		if err != nil {
+			if listener != nil {
+				_ = listener.Close()
+			}
+			return nil, fmt.Errorf("trace: %w", err)
+		}
+	}
+	return func() error {
+		if listener != nil {
+			_ = listener.Close()
+		}
+		if file == nil {
+			return nil
+		}
+		trace.Stop()
+		return file.Close()
+	}, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emailConfig are the SMTP settings -email-summary sends mail with, read
+// from a JSON file such as
+//
+//	{"host": "smtp.example.com", "port": 587, "username": "nas", "password": "...", "from": "nas@example.com"}
+//
+// Port defaults to 587, with STARTTLS if the server offers it, or 465 with
+// TLS set, for servers that only speak TLS from the start.
+type emailConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	TLS      bool   `json:"tls"`
+}
+
+// loadEmailConfig reads the SMTP settings in name, or in jpegid/email.json
+// in the user config directory if name is empty.
+func loadEmailConfig(name string) (emailConfig, error) {
+	var config emailConfig
+	if name == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return config, err
+		}
+		name = filepath.Join(configDir, "jpegid", "email.json")
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return config, fmt.Errorf("email settings: %w", err)
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return config, fmt.Errorf("email settings: %s: %w", name, err)
+	}
+	if config.Host == "" || config.From == "" {
+		return config, fmt.Errorf("email settings: %s: host and from are required", name)
+	}
+	if config.Port == 0 {
+		config.Port = 587
+		if config.TLS {
+			config.Port = 465
+		}
+	}
+	return config, nil
+}
+
+// emailTimeout bounds connecting to the SMTP server and the whole exchange
+// with it.
+const emailTimeout = 30 * time.Second
+
+// send sends a plain text mail to every address of to.
+func (config emailConfig) send(to []string, subject, body string, now time.Time) error {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	var conn net.Conn
+	var err error
+	if config.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: emailTimeout}, "tcp", addr, &tls.Config{ServerName: config.Host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, emailTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	// A stalled server would otherwise hang the end of the run.
+	err = conn.SetDeadline(time.Now().Add(emailTimeout))
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+	if !config.TLS {
+		// As smtp.SendMail does, upgrade to TLS when the server offers it.
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			err = client.StartTLS(&tls.Config{ServerName: config.Host})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(config.From)
+	if err != nil {
+		return err
+	}
+	for _, address := range to {
+		err = client.Rcpt(address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(message.Bytes())
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// maxEmailFailures is how many failed files are listed in a summary mail.
+const maxEmailFailures = 200
+
+// emailSummary mails the summary of the run, along with the files that
+// failed and the error that ended it if any, to EmailSummary.
+func (jpegidCmd *JpegIDCmd) emailSummary(summary *runSummary, failures []string, fatalErr error) error {
+	config, err := loadEmailConfig(jpegidCmd.EmailConfig)
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	host, _ := os.Hostname()
+	fmt.Fprintf(&body, "jpegid %s on %s\n\n", strings.Join(jpegidCmd.args, " "), cmp.Or(host, "unknown host"))
+	_ = summary.writeText(&body, jpegidCmd.displayPath)
+	if fatalErr != nil {
+		fmt.Fprintf(&body, "\nThe run failed: %v\n", fatalErr)
+	}
+	if len(failures) > 0 {
+		body.WriteString("\nErrors:\n")
+		for _, failure := range failures[:min(len(failures), maxEmailFailures)] {
+			fmt.Fprintf(&body, "  %s\n", failure)
+		}
+		if len(failures) > maxEmailFailures {
+			fmt.Fprintf(&body, "  ... and %d more\n", len(failures)-maxEmailFailures)
+		}
+	}
+	subject := fmt.Sprintf("jpegid: %d renamed, %d skipped, %d errors", summary.Renamed, summary.Skipped, summary.Errors)
+	if summary.DryRun {
+		subject = fmt.Sprintf("jpegid: %d to rename, %d skipped, %d errors", summary.Renamed, summary.Skipped, summary.Errors)
+	}
+	if fatalErr != nil {
+		subject = "jpegid: run failed"
+	}
+	if host != "" {
+		subject += " on " + host
+	}
+	return config.send(jpegidCmd.EmailSummary, subject, body.String(), jpegidCmd.Now())
+}
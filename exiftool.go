@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExifToolClient sends commands to a single exiftool instance.
+type ExifToolClient interface {
+	// Execute runs exiftool with the given arguments and returns its output.
+	// The returned slice is only valid until the next call to Execute.
+	Execute(args ...string) ([]byte, error)
+
+	// Stream is Execute with the output returned as it is read instead of
+	// all at once. The output must be closed before the next command, which
+	// discards whatever is left of it; Close reports whether exiftool is
+	// still usable.
+	Stream(args ...string) (io.ReadCloser, error)
+
+	// Close shuts down the exiftool instance.
+	Close() error
+}
+
+// stayOpenClient speaks the exiftool -stay_open protocol: arguments are
+// written one per line followed by -execute, and the output for that
+// command is terminated by a {ready} line. Arguments containing a newline
+// cannot be sent that way, so they are run by a separate exiftool process
+// instead.
+type stayOpenClient struct {
+	stdin  io.Writer
+	stdout *bufio.Reader
+	// args and buf are reused by every command to save allocations, which
+	// is why the output of Execute is only valid until the next call.
+	args       bytes.Buffer
+	buf        bytes.Buffer
+	output     commandOutput
+	close      func() error
+	stderr     io.Writer
+	commonArgs []string
+}
+
+// maxExifToolOutput is the most output of a single command that is read.
+// Some tags, such as embedded previews and maker notes extracted with -b,
+// can be huge. Extract decodes the output as it is read, but the decoder
+// still holds all the tags of a file at once, so it is bounded too.
+const maxExifToolOutput = 32 << 20
+
+func (client *stayOpenClient) Execute(args ...string) ([]byte, error) {
+	if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, "\n") }) {
+		cmd := exec.Command("exiftool", append(slices.Clone(args), client.commonArgs...)...)
+		cmd.Stderr = client.stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		client.buf.Reset()
+		_, err = client.buf.ReadFrom(io.LimitReader(stdout, maxExifToolOutput+1))
+		if err == nil && client.buf.Len() > maxExifToolOutput {
+			_, _ = io.Copy(io.Discard, stdout)
+			_ = cmd.Wait()
+			return nil, ErrOutputTooLarge
+		}
+		waitErr := cmd.Wait()
+		if err != nil {
+			return client.buf.Bytes(), err
+		}
+		if waitErr != nil {
+			var exitErr *exec.ExitError
+			if errors.As(waitErr, &exitErr) && client.buf.Len() > 0 {
+				// exiftool exits with status 1 when a file has an error,
+				// which is reported in the output like any other.
+				return client.buf.Bytes(), nil
+			}
+			return client.buf.Bytes(), waitErr
+		}
+		return client.buf.Bytes(), nil
+	}
+	output := client.stream(args)
+	client.buf.Reset()
+	_, err := client.buf.ReadFrom(output)
+	closeErr := output.Close()
+	if errors.Is(err, ErrOutputTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return client.buf.Bytes(), err
+	}
+	return client.buf.Bytes(), closeErr
+}
+
+func (client *stayOpenClient) Stream(args ...string) (io.ReadCloser, error) {
+	if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, "\n") }) {
+		output, err := client.Execute(args...)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(output)), nil
+	}
+	return client.stream(args), nil
+}
+
+// stream sends a command to exiftool and returns its output, which is
+// reused by every command.
+func (client *stayOpenClient) stream(args []string) *commandOutput {
+	client.args.Reset()
+	for _, arg := range args {
+		client.args.WriteString(arg)
+		client.args.WriteByte('\n')
+	}
+	client.args.WriteString("-execute\n")
+	client.output = commandOutput{stdout: client.stdout, lineStart: true}
+	_, err := client.stdin.Write(client.args.Bytes())
+	if err != nil {
+		client.output.err, client.output.broken, client.output.done = err, err, true
+	}
+	return &client.output
+}
+
+// commandOutput reads the output of a single -stay_open command, up to the
+// {ready} line that terminates it. Reads fail with ErrOutputTooLarge once
+// more than maxExifToolOutput bytes have been read, and with
+// io.ErrUnexpectedEOF if exiftool exits before the {ready} line.
+type commandOutput struct {
+	stdout *bufio.Reader
+	// pending is what is left of the last piece of output read from stdout,
+	// a view into the buffer of stdout.
+	pending []byte
+	// lineStart is whether the next piece starts a line. ReadSlice returns
+	// lines longer than the buffer in several pieces, so only a piece
+	// starting a line can be the {ready} line.
+	lineStart bool
+	n         int
+	// err is returned by Read once pending is used up: io.EOF after the
+	// {ready} line.
+	err error
+	// broken is the error that left exiftool unusable, if any, and done is
+	// whether there is nothing left of the output to read.
+	broken error
+	done   bool
+}
+
+// next reads the next piece of output, returning io.EOF at the {ready} line.
+func (output *commandOutput) next() ([]byte, error) {
+	line, err := output.stdout.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		output.broken, output.done = err, true
+		return line, err
+	}
+	if output.lineStart && bytes.Equal(line, readyLine) {
+		output.done = true
+		return nil, io.EOF
+	}
+	output.lineStart = err == nil
+	return line, nil
+}
+
+func (output *commandOutput) Read(p []byte) (int, error) {
+	if len(output.pending) == 0 && output.err == nil {
+		line, err := output.next()
+		output.n += len(line)
+		if output.n > maxExifToolOutput && err == nil {
+			err, line = ErrOutputTooLarge, nil
+		}
+		output.pending, output.err = line, err
+	}
+	if len(output.pending) > 0 {
+		n := copy(p, output.pending)
+		output.pending = output.pending[n:]
+		return n, nil
+	}
+	return 0, output.err
+}
+
+// Close reads what is left of the output, so that the next command gets its
+// own, and returns the error that left exiftool unusable, if any.
+func (output *commandOutput) Close() error {
+	output.pending = nil
+	for !output.done {
+		_, _ = output.next()
+	}
+	return output.broken
+}
+
+// readyLine terminates the output of each command in -stay_open mode.
+var readyLine = []byte("{ready}\n")
+
+func (client *stayOpenClient) Close() error {
+	return client.close()
+}
+
+// NewExifToolClient starts an exiftool process in -stay_open mode. The
+// process's stderr is copied to stderr. commonArgs are added to every
+// command executed.
+func NewExifToolClient(stderr io.Writer, commonArgs ...string) (ExifToolClient, error) {
+	return startExifToolClient(stderr, nil, commonArgs...)
+}
+
+// startExifToolClient is NewExifToolClient with the protocol traced to tracer,
+// if not nil.
+func startExifToolClient(stderr io.Writer, tracer *protocolTracer, commonArgs ...string) (ExifToolClient, error) {
+	args := []string{"-stay_open", "True", "-@", "-"}
+	if len(commonArgs) > 0 {
+		args = append(args, "-common_args")
+		args = append(args, commonArgs...)
+	}
+	exifToolCmd := exec.Command("exiftool", args...)
+	setpgid(exifToolCmd)
+	exifToolStdin, err := exifToolCmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	exifToolStdout, err := exifToolCmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	exifToolStderr, err := exifToolCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stdin io.Writer = exifToolStdin
+	var stdout io.Reader = exifToolStdout
+	var stderrReader io.Reader = exifToolStderr
+	var id int
+	if tracer != nil {
+		id = tracer.nextWorker()
+		stdin = io.MultiWriter(&traceWriter{tracer: tracer, id: id, direction: ">"}, stdin)
+		stdout = &traceReader{r: stdout, trace: &traceWriter{tracer: tracer, id: id, direction: "<"}}
+		stderrReader = &traceReader{r: stderrReader, trace: &traceWriter{tracer: tracer, id: id, direction: "!"}}
+	}
+	go func() {
+		_, _ = io.Copy(stderr, stderrReader)
+	}()
+	err = exifToolCmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", exifToolCmd.String(), err)
+	}
+	if tracer != nil {
+		tracer.event(id, "started pid %d: %s", exifToolCmd.Process.Pid, exifToolCmd.String())
+	}
+	client := &stayOpenClient{
+		stdin:      stdin,
+		stdout:     bufio.NewReader(stdout),
+		stderr:     stderr,
+		commonArgs: commonArgs,
+		close: func() error {
+			_, err := io.WriteString(stdin, "-stay_open\n"+
+				"False\n")
+			if tracer != nil {
+				tracer.event(id, "stopping pid %d", exifToolCmd.Process.Pid)
+			}
+			stop(exifToolCmd)
+			return err
+		},
+	}
+	return client, nil
+}
+
+// writeTags runs an exiftool command that writes tags into a file, with the
+// writing options in args.
+func writeTags(client ExifToolClient, filePath string, args []string) error {
+	output, err := client.Execute(slices.Concat(args, []string{filePath})...)
+	if err != nil {
+		return err
+	}
+	// exiftool reports "1 image files updated", or "1 image files
+	// unchanged" (with the reason on stderr) if there was nothing to write.
+	if !bytes.Contains(output, []byte("1 image files updated")) {
+		return fmt.Errorf("not updated: %s", strings.Join(strings.Fields(string(output)), " "))
+	}
+	return nil
+}
+
+// tagsPool holds the maps exiftool output is decoded into. The maps are
+// cleared rather than dropped after use so that decoding the next file
+// reuses them.
+var tagsPool = sync.Pool{
+	New: func() any { return make(map[string]any) },
+}
+
+// maxErrorOutput is the most output kept for the Output of an ExifToolError.
+const maxErrorOutput = 64 << 10
+
+// headBuffer keeps the first maxErrorOutput bytes written to it.
+type headBuffer struct {
+	bytes.Buffer
+}
+
+func (head *headBuffer) Write(p []byte) (int, error) {
+	if room := maxErrorOutput - head.Len(); room > 0 {
+		head.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// exifToolExtractor is a MetadataExtractor backed by an ExifToolClient.
+type exifToolExtractor struct {
+	client    ExifToolClient
+	newClient func() (ExifToolClient, error)
+	// head is the start of the output of the last file, for errors.
+	head headBuffer
+}
+
+// NewExifToolExtractor returns a MetadataExtractor that uses exiftool. If the
+// ExifToolClient becomes unusable it is replaced using newClient.
+func NewExifToolExtractor(newClient func() (ExifToolClient, error)) (MetadataExtractor, error) {
+	client, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	return &exifToolExtractor{client: client, newClient: newClient}, nil
+}
+
+func (extractor *exifToolExtractor) Extract(filePath string) (Exif, error) {
+	if extractor.client == nil {
+		client, err := extractor.newClient()
+		if err != nil {
+			return Exif{}, err
+		}
+		extractor.client = client
+	}
+	output, err := extractor.client.Stream("-json", filePath)
+	if err != nil {
+		_ = extractor.client.Close()
+		extractor.client = nil
+		return Exif{}, &ExifToolError{FilePath: filePath, Err: err}
+	}
+	// Every tag is kept, for -date-tags and the like, and the fixed fields
+	// of Exif are filled in from them. The output is an array with an
+	// object per file, which is decoded as it is read.
+	tags := tagsPool.Get().(map[string]any)
+	defer func() {
+		clear(tags)
+		tagsPool.Put(tags)
+	}()
+	extractor.head.Reset()
+	decoder := json.NewDecoder(io.TeeReader(output, &extractor.head))
+	decoder.UseNumber()
+	found := false
+	token, err := decoder.Token()
+	if err == nil && token != json.Delim('[') {
+		err = fmt.Errorf("output is not a JSON array")
+	}
+	if err == nil && decoder.More() {
+		found = true
+		err = decoder.Decode(&tags)
+	}
+	for err == nil && decoder.More() {
+		// Only the first file was asked for.
+		var skip struct{}
+		err = decoder.Decode(&skip)
+	}
+	if err == nil {
+		_, err = decoder.Token()
+	}
+	brokenErr := output.Close()
+	if brokenErr != nil {
+		// The exiftool instance is no longer usable, replace it on the next
+		// call.
+		_ = extractor.client.Close()
+		extractor.client = nil
+		return Exif{}, &ExifToolError{FilePath: filePath, Output: extractor.head.String(), Err: brokenErr}
+	}
+	if errors.Is(err, ErrOutputTooLarge) {
+		return Exif{}, &ExifToolError{FilePath: filePath, Err: err}
+	}
+	if err != nil {
+		return Exif{}, &ExifToolError{FilePath: filePath, Output: extractor.head.String(), Err: err}
+	}
+	if !found {
+		return Exif{}, &ExifToolError{FilePath: filePath, Output: extractor.head.String(), Err: ErrNoMetadata}
+	}
+	var exif Exif
+	exif.Tags = make(map[string]string, len(tags))
+	for name, value := range tags {
+		switch value := value.(type) {
+		case string:
+			exif.Tags[name] = value
+		case json.Number:
+			exif.Tags[name] = value.String()
+		case bool:
+			exif.Tags[name] = strconv.FormatBool(value)
+		}
+	}
+	exif.FileSize = exif.Tags["FileSize"]
+	exif.SubSecDateTimeOriginal = exif.Tags["SubSecDateTimeOriginal"]
+	exif.CreateDate = exif.Tags["CreateDate"]
+	exif.TimeZone = exif.Tags["TimeZone"]
+	exif.Error = exif.Tags["Error"]
+	if exif.Error != "" {
+		if strings.Contains(exif.Error, "Unknown file type") || strings.Contains(exif.Error, "file format") {
+			return exif, &ExifToolError{FilePath: filePath, Output: extractor.head.String(), Err: fmt.Errorf("%w: %s", ErrUnsupportedFormat, exif.Error)}
+		}
+		return exif, &ExifToolError{FilePath: filePath, Output: extractor.head.String(), Err: errors.New(exif.Error)}
+	}
+	return exif, nil
+}
+
+func (extractor *exifToolExtractor) Close() error {
+	if extractor.client == nil {
+		return nil
+	}
+	return extractor.client.Close()
+}
+
+// ExifToolVersion is an exiftool version number such as 12.76.
+type ExifToolVersion struct {
+	Major int
+	Minor int
+}
+
+// MinExifToolVersion is the oldest exiftool version that is known to report
+// every tag jpegid relies on.
+var MinExifToolVersion = ExifToolVersion{Major: 10, Minor: 0}
+
+// largeFileSupportVersion is the version from which -api LargeFileSupport
+// is passed to exiftool, so that videos over 2GB are readable.
+var largeFileSupportVersion = ExifToolVersion{Major: 12, Minor: 0}
+
+// GetExifToolVersion returns the version of the exiftool found in PATH.
+func GetExifToolVersion() (ExifToolVersion, error) {
+	output, err := exec.Command("exiftool", "-ver").Output()
+	if err != nil {
+		return ExifToolVersion{}, fmt.Errorf("exiftool -ver: %w", err)
+	}
+	return ParseExifToolVersion(strings.TrimSpace(string(output)))
+}
+
+// ParseExifToolVersion parses the output of exiftool -ver.
+func ParseExifToolVersion(s string) (ExifToolVersion, error) {
+	major, minor, _ := strings.Cut(s, ".")
+	// Development versions may have a suffix like "12.77-beta".
+	minor, _, _ = strings.Cut(minor, "-")
+	var version ExifToolVersion
+	var err error
+	version.Major, err = strconv.Atoi(major)
+	if err != nil {
+		return ExifToolVersion{}, fmt.Errorf("invalid exiftool version %q", s)
+	}
+	if minor != "" {
+		version.Minor, err = strconv.Atoi(minor)
+		if err != nil {
+			return ExifToolVersion{}, fmt.Errorf("invalid exiftool version %q", s)
+		}
+	}
+	return version, nil
+}
+
+func (version ExifToolVersion) String() string {
+	return fmt.Sprintf("%d.%02d", version.Major, version.Minor)
+}
+
+// Less reports whether version is older than other.
+func (version ExifToolVersion) Less(other ExifToolVersion) bool {
+	if version.Major != other.Major {
+		return version.Major < other.Major
+	}
+	return version.Minor < other.Minor
+}
+
+// CommonArgs returns the arguments that should be added to every command
+// for this version of exiftool.
+func (version ExifToolVersion) CommonArgs() []string {
+	var args []string
+	if !version.Less(largeFileSupportVersion) {
+		args = append(args, "-api", "LargeFileSupport=1")
+	}
+	if runtime.GOOS == "windows" {
+		// File names are passed to exiftool as UTF-8, which it only
+		// converts to the wide characters Windows wants when told to.
+		// Elsewhere file names are bytes that exiftool passes through
+		// untouched, whether or not they are valid UTF-8.
+		args = append(args, "-charset", "filename=utf8")
+	}
+	return args
+}
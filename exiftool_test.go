@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newFakeExifToolClient returns an ExifToolClient that speaks the same
+// -stay_open protocol as the real one, but whose responses come from
+// respond instead of an exiftool process. The output returned by respond is
+// written verbatim and so must include the terminating "{ready}\n" line. If
+// respond returns an error, stdout is closed with that error (use io.EOF to
+// simulate exiftool exiting prematurely).
+func newFakeExifToolClient(respond func(args []string) (output string, err error)) ExifToolClient {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		var args []string
+		scanner := bufio.NewScanner(stdinReader)
+		for scanner.Scan() {
+			arg := scanner.Text()
+			if arg != "-execute" {
+				args = append(args, arg)
+				continue
+			}
+			output, err := respond(args)
+			args = args[:0]
+			if output != "" {
+				_, writeErr := io.WriteString(stdoutWriter, output)
+				if writeErr != nil {
+					return
+				}
+			}
+			if err != nil {
+				stdoutWriter.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	client := &stayOpenClient{
+		stdin:  stdinWriter,
+		stdout: bufio.NewReader(stdoutReader),
+		close: func() error {
+			stdinWriter.Close()
+			stdoutReader.Close()
+			waitGroup.Wait()
+			return nil
+		},
+	}
+	return client
+}
+
+func TestStayOpenClientExecute(t *testing.T) {
+	// A line longer than the buffer of the reader, so that it is read in
+	// pieces and its last piece is a {ready} that doesn't start a line.
+	longLine := strings.Repeat("a", 4096) + "{ready}\n"
+	tests := []struct {
+		name    string
+		output  string
+		err     error
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "ready",
+			output: "[{\"SourceFile\": \"a.jpg\"}]\n{ready}\n",
+			want:   "[{\"SourceFile\": \"a.jpg\"}]\n",
+		},
+		{
+			name:   "no output",
+			output: "{ready}\n",
+			want:   "",
+		},
+		{
+			name:    "premature EOF",
+			output:  "[{\"SourceFile\": \"a.jpg\"",
+			err:     io.EOF,
+			want:    "[{\"SourceFile\": \"a.jpg\"",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "missing ready",
+			output:  "[{\"SourceFile\": \"a.jpg\"}]\n",
+			err:     io.EOF,
+			want:    "[{\"SourceFile\": \"a.jpg\"}]\n",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "ready without a newline",
+			output:  "[]\n{ready}",
+			err:     io.EOF,
+			want:    "[]\n{ready}",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "ready in the middle of a line",
+			output: "\"{ready}\"\n{ready}\n",
+			want:   "\"{ready}\"\n",
+		},
+		{
+			name:   "ready at the end of a long line",
+			output: longLine + "{ready}\n",
+			want:   longLine,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeExifToolClient(func(args []string) (string, error) {
+				return tt.output, tt.err
+			})
+			defer client.Close()
+			output, err := client.Execute("-json", "a.jpg")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Execute() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(output) != tt.want {
+				t.Fatalf("Execute() = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestStayOpenClientOutputTooLarge(t *testing.T) {
+	var calls int
+	client := newFakeExifToolClient(func(args []string) (string, error) {
+		calls++
+		if calls == 1 {
+			return "[{\"ThumbnailImage\": \"" + strings.Repeat("A", maxExifToolOutput) + "\"}]\n{ready}\n", nil
+		}
+		return "[]\n{ready}\n", nil
+	})
+	defer client.Close()
+	output, err := client.Stream("-json", "a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(io.Discard, output)
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("reading the output = %v, want ErrOutputTooLarge", err)
+	}
+	err = output.Close()
+	if err != nil {
+		t.Fatalf("Close() = %v, want exiftool still usable", err)
+	}
+	// The rest of the output was skipped, so the next file gets its own.
+	b, err := client.Execute("-json", "b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "[]\n" {
+		t.Fatalf("Execute() = %q, want the output of b.jpg", b)
+	}
+}
+
+func TestStayOpenClientSendsArgs(t *testing.T) {
+	var got [][]string
+	client := newFakeExifToolClient(func(args []string) (string, error) {
+		got = append(got, append([]string(nil), args...))
+		return "{ready}\n", nil
+	})
+	defer client.Close()
+	for _, filePath := range []string{"a.jpg", "b.jpg"} {
+		_, err := client.Execute("-json", filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]string{{"-json", "a.jpg"}, {"-json", "b.jpg"}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestExifToolExtractor(t *testing.T) {
+	tests := []struct {
+		name string
+		// output and err are the response to every command.
+		output string
+		err    error
+		// want is the SubSecDateTimeOriginal extracted.
+		want    string
+		wantErr error
+		// wantRestart is whether the client must be replaced.
+		wantRestart bool
+	}{
+		{
+			name:   "tags",
+			output: "[{\"SourceFile\": \"a.jpg\", \"SubSecDateTimeOriginal\": \"2023:09:14 10:15:30.123+02:00\"}]\n{ready}\n",
+			want:   "2023:09:14 10:15:30.123+02:00",
+		},
+		{
+			name:    "malformed JSON",
+			output:  "[{\"SourceFile\": \"a.jpg\",]\n{ready}\n",
+			wantErr: errors.New("invalid character"),
+		},
+		{
+			name:    "no metadata",
+			output:  "[]\n{ready}\n",
+			wantErr: ErrNoMetadata,
+		},
+		{
+			name:    "unsupported format",
+			output:  "[{\"SourceFile\": \"a.txt\", \"Error\": \"Unknown file type\"}]\n{ready}\n",
+			wantErr: ErrUnsupportedFormat,
+		},
+		{
+			name:        "premature EOF",
+			output:      "[{\"SourceFile\": \"a.jpg\"",
+			err:         io.EOF,
+			wantErr:     io.ErrUnexpectedEOF,
+			wantRestart: true,
+		},
+		{
+			name:        "missing ready",
+			output:      "[{\"SourceFile\": \"a.jpg\"}]\n",
+			err:         io.EOF,
+			wantErr:     io.ErrUnexpectedEOF,
+			wantRestart: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clients int
+			extractor, err := NewExifToolExtractor(func() (ExifToolClient, error) {
+				clients++
+				return newFakeExifToolClient(func(args []string) (string, error) {
+					return tt.output, tt.err
+				}), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer extractor.Close()
+			for range 2 {
+				exif, err := extractor.Extract("a.jpg")
+				var exifToolErr *ExifToolError
+				switch {
+				case tt.wantErr == nil && err != nil:
+					t.Fatalf("Extract() error = %v", err)
+				case tt.wantErr != nil && !errors.As(err, &exifToolErr):
+					t.Fatalf("Extract() error = %v, want an *ExifToolError", err)
+				case tt.wantErr != nil && !errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error()):
+					t.Fatalf("Extract() error = %v, want %v", err, tt.wantErr)
+				}
+				if exif.SubSecDateTimeOriginal != tt.want {
+					t.Fatalf("SubSecDateTimeOriginal = %q, want %q", exif.SubSecDateTimeOriginal, tt.want)
+				}
+			}
+			wantClients := 1
+			if tt.wantRestart {
+				wantClients = 2
+			}
+			if clients != wantClients {
+				t.Fatalf("%d clients started, want %d", clients, wantClients)
+			}
+		})
+	}
+}
+
+// benchmarkOutput is the exiftool -json output of a typical camera JPEG,
+// trimmed to the groups jpegid looks at.
+var benchmarkOutput = `[{
+  "SourceFile": "DSC01234.JPG",
+  "ExifToolVersion": 12.76,
+  "FileName": "DSC01234.JPG",
+  "FileSize": "6.2 MB",
+  "FileType": "JPEG",
+  "MIMEType": "image/jpeg",
+  "Make": "SONY",
+  "Model": "ILCE-7M3",
+  "Orientation": "Horizontal (normal)",
+  "ImageWidth": 6000,
+  "ImageHeight": 4000,
+  "ExposureTime": "1/250",
+  "FNumber": 5.6,
+  "ISO": 100,
+  "LensModel": "FE 24-105mm F4 G OSS",
+  "DateTimeOriginal": "2023:09:14 10:15:30",
+  "CreateDate": "2023:09:14 10:15:30",
+  "OffsetTimeOriginal": "+02:00",
+  "SubSecTimeOriginal": 123,
+  "SubSecDateTimeOriginal": "2023:09:14 10:15:30.123+02:00",
+  "GPSLatitude": "48 deg 51' 29.60\" N",
+  "GPSLongitude": "2 deg 17' 40.20\" E",
+  "Flash": "Off, Did not fire"
+}]
+{ready}
+`
+
+func benchmarkExtract(b *testing.B, output string) {
+	extractor, err := NewExifToolExtractor(func() (ExifToolClient, error) {
+		return newFakeExifToolClient(func(args []string) (string, error) {
+			return output, nil
+		}), nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer extractor.Close()
+	b.SetBytes(int64(len(output)))
+	b.ReportAllocs()
+	for b.Loop() {
+		_, err := extractor.Extract("DSC01234.JPG")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	benchmarkExtract(b, benchmarkOutput)
+}
+
+// BenchmarkExtractLongLines is BenchmarkExtract with a tag longer than the
+// buffer the output is read with, such as a base64 thumbnail.
+func BenchmarkExtractLongLines(b *testing.B) {
+	output := strings.Replace(benchmarkOutput, `"Flash": "Off, Did not fire"`, `"ThumbnailImage": "base64:`+strings.Repeat("A", 64<<10)+`"`, 1)
+	benchmarkExtract(b, output)
+}
+
+func BenchmarkExtractParallel(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkOutput)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		extractor, err := NewExifToolExtractor(func() (ExifToolClient, error) {
+			return newFakeExifToolClient(func(args []string) (string, error) {
+				return benchmarkOutput, nil
+			}), nil
+		})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer extractor.Close()
+		for pb.Next() {
+			_, err := extractor.Extract("DSC01234.JPG")
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// spotlightExtractor is a MetadataExtractor that queries the Spotlight index
+// with mdls. Spotlight often knows the capture date of imported media even
+// when the file itself has no EXIF.
+type spotlightExtractor struct{}
+
+// newPlatformExtractor returns the MetadataExtractor used for
+// -platform-fallback.
+func newPlatformExtractor() (MetadataExtractor, error) {
+	return spotlightExtractor{}, nil
+}
+
+func (spotlightExtractor) Extract(filePath string) (Exif, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("mdls", "-raw", "-name", "kMDItemContentCreationDate", filePath)
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	if err != nil {
+		return Exif{}, fmt.Errorf("mdls: %w", err)
+	}
+	value := strings.TrimSpace(stdout.String())
+	if value == "" || value == "(null)" {
+		return Exif{}, ErrNoMetadata
+	}
+	creationTime, err := time.Parse("2006-01-02 15:04:05 -0700", value)
+	if err != nil {
+		return Exif{}, fmt.Errorf("mdls: kMDItemContentCreationDate: %w", err)
+	}
+	// Spotlight stores dates in UTC.
+	creationTime = creationTime.In(time.Local)
+	return Exif{
+		CreateDate: creationTime.Format("2006:01:02 15:04:05"),
+		TimeZone:   creationTime.Format("-07:00"),
+	}, nil
+}
+
+func (spotlightExtractor) Close() error {
+	return nil
+}
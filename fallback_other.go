@@ -0,0 +1,14 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// newPlatformExtractor returns the MetadataExtractor used for
+// -platform-fallback.
+func newPlatformExtractor() (MetadataExtractor, error) {
+	return nil, errors.New("-platform-fallback is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shellExtractor is a MetadataExtractor that reads the Shell "Date taken"
+// property (System.Photo.DateTaken), which is what Explorer displays.
+type shellExtractor struct{}
+
+// newPlatformExtractor returns the MetadataExtractor used for
+// -platform-fallback.
+func newPlatformExtractor() (MetadataExtractor, error) {
+	_, err := exec.LookPath("powershell.exe")
+	if err != nil {
+		return nil, err
+	}
+	return shellExtractor{}, nil
+}
+
+func (shellExtractor) Extract(filePath string) (Exif, error) {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	script := "$folder = (New-Object -ComObject Shell.Application).Namespace(" + quote(filepath.Dir(filePath)) + ")\n" +
+		"$dateTaken = $folder.ParseName(" + quote(filepath.Base(filePath)) + ").ExtendedProperty('System.Photo.DateTaken')\n" +
+		"if ($dateTaken) { $dateTaken.ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ssZ') }\n"
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return Exif{}, fmt.Errorf("powershell: %s", message)
+		}
+		return Exif{}, fmt.Errorf("powershell: %w", err)
+	}
+	value := strings.TrimSpace(stdout.String())
+	if value == "" {
+		return Exif{}, ErrNoMetadata
+	}
+	creationTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return Exif{}, fmt.Errorf("System.Photo.DateTaken: %w", err)
+	}
+	creationTime = creationTime.In(time.Local)
+	return Exif{
+		CreateDate: creationTime.Format("2006:01:02 15:04:05"),
+		TimeZone:   creationTime.Format("-07:00"),
+	}, nil
+}
+
+func (shellExtractor) Close() error {
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ffprobeExtractor is a MetadataExtractor that shells out to ffprobe. It only
+// understands the container-level creation time of video files.
+type ffprobeExtractor struct{}
+
+// NewFFprobeExtractor returns a MetadataExtractor that uses ffprobe.
+func NewFFprobeExtractor() (MetadataExtractor, error) {
+	_, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return nil, err
+	}
+	return ffprobeExtractor{}, nil
+}
+
+func (ffprobeExtractor) Extract(filePath string) (Exif, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_entries", "format=size:format_tags", filePath)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "Invalid data found when processing input") {
+			return Exif{}, fmt.Errorf("ffprobe: %w: %s", ErrUnsupportedFormat, message)
+		}
+		if message != "" {
+			return Exif{}, fmt.Errorf("ffprobe: %s", message)
+		}
+		return Exif{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	var output struct {
+		Format struct {
+			Size string            `json:"size"`
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &output)
+	if err != nil {
+		return Exif{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	exif := Exif{
+		FileSize: output.Format.Size + " bytes",
+	}
+	// Apple devices record the local capture time with its offset, which is
+	// more useful than the UTC-only creation_time.
+	if value := output.Format.Tags["com.apple.quicktime.creationdate"]; value != "" {
+		creationTime, err := time.Parse("2006-01-02T15:04:05-0700", value)
+		if err == nil {
+			exif.SubSecDateTimeOriginal = creationTime.Format("2006:01:02 15:04:05.000-07:00")
+			return exif, nil
+		}
+	}
+	if value := output.Format.Tags["creation_time"]; value != "" {
+		creationTime, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return exif, fmt.Errorf("ffprobe: creation_time: %w", err)
+		}
+		exif.SubSecDateTimeOriginal = creationTime.UTC().Format("2006:01:02 15:04:05.000-07:00")
+	}
+	return exif, nil
+}
+
+func (ffprobeExtractor) Close() error {
+	return nil
+}
+
+// extensionExtractor dispatches to a different MetadataExtractor depending
+// on the file extension.
+type extensionExtractor struct {
+	extractors map[string]MetadataExtractor
+	fallback   MetadataExtractor
+}
+
+func (extractor *extensionExtractor) Extract(filePath string) (Exif, error) {
+	if ext, ok := extractor.extractors[strings.ToLower(filepath.Ext(filePath))]; ok {
+		return ext.Extract(filePath)
+	}
+	return extractor.fallback.Extract(filePath)
+}
+
+func (extractor *extensionExtractor) Close() error {
+	err := extractor.fallback.Close()
+	for _, ext := range extractor.extractors {
+		closeErr := ext.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// fallbackExtractor uses fallback for files where primary found no creation
+// time.
+type fallbackExtractor struct {
+	primary  MetadataExtractor
+	fallback MetadataExtractor
+	dateTags []string
+}
+
+func (extractor *fallbackExtractor) Extract(filePath string) (Exif, error) {
+	exif, err := extractor.primary.Extract(filePath)
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return exif, err
+	}
+	if err == nil && slices.ContainsFunc(extractor.dateTags, func(tag string) bool { return exif.Tag(tag) != "" }) {
+		return exif, nil
+	}
+	fallbackExif, fallbackErr := extractor.fallback.Extract(filePath)
+	if fallbackErr != nil {
+		if err != nil {
+			return exif, err
+		}
+		return exif, fallbackErr
+	}
+	if fallbackExif.FileSize == "" {
+		fallbackExif.FileSize = exif.FileSize
+	}
+	return fallbackExif, nil
+}
+
+func (extractor *fallbackExtractor) Close() error {
+	err := extractor.primary.Close()
+	fallbackErr := extractor.fallback.Close()
+	if err != nil {
+		return err
+	}
+	return fallbackErr
+}
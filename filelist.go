@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// scanNUL is a bufio.SplitFunc that splits its input on NUL bytes, the way
+// find -print0 terminates paths.
+func scanNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// walkFileList calls fn with every file listed in FilesFrom, as walkRoot
+// does for the files under a root. Paths are separated by newlines, or by
+// NUL bytes if NullSeparated is set. Each file is taken to be in the root
+// containing it, or in its own directory if no root does. Empty entries are
+// skipped without a result, so -print-new-name prints nothing for them. The
+// include patterns are not applied to listed files, but MinAge and state
+// are, except that files outside the roots have no state.
+func (jpegidCmd *JpegIDCmd) walkFileList(ctx context.Context, state *scanState, fn func(root, filePath string, skip error) error) error {
+	var r io.Reader = jpegidCmd.Stdin
+	if jpegidCmd.FilesFrom != "-" {
+		file, err := os.Open(jpegidCmd.FilesFrom)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if jpegidCmd.NullSeparated {
+		scanner.Split(scanNUL)
+	}
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line := scanner.Text()
+		if !jpegidCmd.NullSeparated {
+			line = strings.TrimSuffix(line, "\r")
+		}
+		if line == "" {
+			continue
+		}
+		filePath, err := filepath.Abs(line)
+		if err != nil {
+			return err
+		}
+		root := ""
+		for _, r := range jpegidCmd.Roots {
+			if strings.HasPrefix(filePath, strings.TrimSuffix(r, string(filepath.Separator))+string(filepath.Separator)) && len(r) > len(root) {
+				root = r
+			}
+		}
+		if root == "" {
+			root = filepath.Dir(filePath)
+		}
+		fileInfo, err := os.Stat(filePath)
+		switch {
+		case err != nil:
+			err = fn(root, filePath, err)
+		case !fileInfo.Mode().IsRegular():
+			err = fn(root, filePath, fmt.Errorf("%s is not a regular file", filePath))
+		default:
+			err = fn(root, filePath, jpegidCmd.checkFile(state, root, filePath, fileInfo))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
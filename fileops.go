@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// opContext returns the context of a single file operation: ctx, with a
+// deadline timeout from now if timeout is positive, after which the
+// operation fails with ErrTimedOut.
+func opContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w after %s", ErrTimedOut, timeout))
+}
+
+// runContext runs op, returning early with the cause of ctx if ctx is done
+// first. Blocking system calls, such as a stat or rename on an unresponsive
+// network filesystem, can't be interrupted, so an operation that is given up
+// on carries on in the background and its outcome is dropped.
+func runContext[T any](ctx context.Context, op func() (T, error)) (T, error) {
+	type outcome struct {
+		value T
+		err   error
+	}
+	if ctx.Err() != nil {
+		var zero T
+		return zero, context.Cause(ctx)
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		value, err := op()
+		done <- outcome{value, err}
+	}()
+	select {
+	case outcome := <-done:
+		return outcome.value, outcome.err
+	case <-ctx.Done():
+		var zero T
+		return zero, context.Cause(ctx)
+	}
+}
+
+// runOp is runContext for an operation with its own timeout and no result.
+func runOp(ctx context.Context, timeout time.Duration, op func() error) error {
+	ctx, cancel := opContext(ctx, timeout)
+	defer cancel()
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, op()
+	})
+	return err
+}
+
+// contextReader fails reads once ctx is done, so that a long copy stops
+// between two reads.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.r.Read(p)
+}
+
+// parseDirMode parses a -dir-mode value, an octal mode such as 2775 with
+// optional setgid (2000) and sticky (1000) bits.
+func parseDirMode(value string) (fs.FileMode, error) {
+	bits, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || bits&^03777 != 0 || bits&0777 == 0 {
+		return 0, fmt.Errorf("invalid directory mode %q (want octal permissions, e.g. 755 or 2775)", value)
+	}
+	mode := fs.FileMode(bits & 0777)
+	if bits&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode, nil
+}
+
+// makeDirs creates dir along with any missing parents, like os.MkdirAll.
+// New directories get mode exactly if it is not zero, and otherwise 0777
+// less the umask. New directories in a setgid directory get its group and
+// setgid bit, so that archives shared by a group stay shared.
+func makeDirs(dir string, mode fs.FileMode) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		err := makeDirs(parent, mode)
+		if err != nil {
+			return err
+		}
+	}
+	perm := fs.FileMode(0777)
+	if mode != 0 {
+		perm = mode.Perm()
+	}
+	err = os.Mkdir(dir, perm)
+	if err != nil {
+		// Created in the meantime, such as by another worker.
+		if info, statErr := os.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	if mode != 0 {
+		// Mkdir applies the umask and, on most systems, drops the setgid
+		// and sticky bits.
+		err = os.Chmod(dir, mode)
+		if err != nil {
+			return err
+		}
+	}
+	parentInfo, err := os.Stat(parent)
+	if err != nil {
+		return err
+	}
+	return inheritGroup(dir, parentInfo)
+}
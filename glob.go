@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// globRegexp translates a glob pattern into an equivalent anchored regular
+// expression. It supports *, ?, [...] character classes (negated with ! or
+// ^), {a,b} alternatives, backslash escapes and, for patterns matched
+// against paths, ** to match any number of directories.
+func globRegexp(pattern string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	braces := 0
+	for i := 0; i < len(pattern); i++ {
+		char := pattern[i]
+		switch char {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := i + 1
+			if j < len(pattern) && (pattern[j] == '!' || pattern[j] == '^') {
+				j++
+			}
+			if j < len(pattern) && pattern[j] == ']' {
+				// A ] straight after the [ is part of the class.
+				j++
+			}
+			end := strings.IndexByte(pattern[j:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("glob %q: unterminated [", pattern)
+			}
+			class := pattern[i+1 : j+end]
+			i = j + end
+			b.WriteString("[")
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			b.WriteString(strings.ReplaceAll(class, `\`, `\\`))
+			b.WriteString("]")
+		case '{':
+			braces++
+			b.WriteString("(?:")
+		case '}':
+			if braces == 0 {
+				b.WriteString(`\}`)
+				continue
+			}
+			braces--
+			b.WriteString(")")
+		case ',':
+			if braces == 0 {
+				b.WriteString(",")
+				continue
+			}
+			b.WriteString("|")
+		case '\\':
+			if i+1 >= len(pattern) {
+				return "", fmt.Errorf("glob %q: trailing backslash", pattern)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	if braces > 0 {
+		return "", fmt.Errorf("glob %q: unterminated {", pattern)
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// compileGlobs compiles glob patterns into regexps. Patterns containing a
+// slash are matched against the slash-separated path relative to the root
+// and are returned in pathRegexps, the rest are matched against file names.
+func compileGlobs(patterns []string, ignoreCase bool) (nameRegexps, pathRegexps []*regexp.Regexp, err error) {
+	for _, pattern := range patterns {
+		expr, err := globRegexp(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ignoreCase {
+			expr = "(?i)" + expr
+		}
+		r, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("glob %q: %w", pattern, err)
+		}
+		if strings.Contains(pattern, "/") {
+			pathRegexps = append(pathRegexps, r)
+		} else {
+			nameRegexps = append(nameRegexps, r)
+		}
+	}
+	return nameRegexps, pathRegexps, nil
+}
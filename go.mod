@@ -1,3 +1,5 @@
 module github.com/bokwoon95/jpegid
 
 go 1.25.0
+
+require golang.org/x/text v0.31.0
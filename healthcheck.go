@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pingHealthcheck tells the monitoring endpoint at rawURL how a run ended,
+// for cron jobs watched by healthchecks.io, Uptime Kuma and the like. A run
+// that failed, with runErr, pings the /fail variant of the URL, or for push
+// URLs with a query string (as Uptime Kuma has) the URL with status=down.
+// body, such as the summary of the run, goes along with the ping, which is
+// sent even if the run was cancelled.
+func pingHealthcheck(rawURL string, runErr error, body string) error {
+	pingURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	method := http.MethodPost
+	if pingURL.RawQuery != "" {
+		query := pingURL.Query()
+		query.Set("status", "up")
+		query.Set("msg", "OK")
+		if runErr != nil {
+			query.Set("status", "down")
+			query.Set("msg", runErr.Error())
+		}
+		pingURL.RawQuery = query.Encode()
+		method, body = http.MethodGet, ""
+	} else if runErr != nil {
+		pingURL = pingURL.JoinPath("fail")
+		body = strings.TrimPrefix(body+"\n"+runErr.Error(), "\n")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, method, pingURL.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", pingURL.Redacted(), response.Status)
+	}
+	return nil
+}
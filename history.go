@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type HistoryCmd struct {
+	JournalDir string
+	// ID is the run to show the details of, if not empty.
+	ID     string
+	JSON   bool
+	Stdout io.Writer
+}
+
+// HistoryCommand parses the arguments of
+//
+//	jpegid history [flags]
+//	jpegid history show [flags] <id>
+func HistoryCommand(args []string) (*HistoryCmd, error) {
+	historyCmd := &HistoryCmd{
+		Stdout: os.Stdout,
+	}
+	args = args[1:]
+	show := len(args) > 0 && args[0] == "show"
+	if show {
+		args = args[1:]
+	}
+	flagset := flag.NewFlagSet("history", flag.ContinueOnError)
+	flagset.StringVar(&historyCmd.JournalDir, "journal-dir", "", "Directory the journals of past runs are stored in (default: jpegid/journal in the user cache directory).")
+	flagset.BoolVar(&historyCmd.JSON, "json", false, "Print the history as JSON.")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if show {
+		if flagset.NArg() != 1 {
+			return nil, fmt.Errorf("usage: jpegid history show [flags] <id>")
+		}
+		historyCmd.ID = flagset.Arg(0)
+	} else if flagset.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flagset.Arg(0))
+	}
+	if historyCmd.JournalDir == "" {
+		historyCmd.JournalDir, err = defaultJournalDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return historyCmd, nil
+}
+
+func (historyCmd *HistoryCmd) Run(ctx context.Context) error {
+	if historyCmd.ID != "" {
+		return historyCmd.show()
+	}
+	journals, err := readJournals(historyCmd.JournalDir, false)
+	if err != nil {
+		return err
+	}
+	if historyCmd.JSON {
+		runs := make([]journalRecord, 0, len(journals))
+		for _, runJournal := range journals {
+			run := runJournal.Run
+			run.Renamed = len(runJournal.Renames)
+			runs = append(runs, run)
+		}
+		encoder := json.NewEncoder(historyCmd.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runs)
+	}
+	if len(journals) == 0 {
+		fmt.Fprintln(historyCmd.Stdout, "no runs recorded in", historyCmd.JournalDir)
+		return nil
+	}
+	w := tabwriter.NewWriter(historyCmd.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tRENAMED\tROOTS\tFLAGS")
+	for _, runJournal := range journals {
+		renamed := strconv.Itoa(len(runJournal.Renames))
+		if runJournal.Recovered != nil {
+			renamed += " (interrupted, rolled " + runJournal.Recovered.Action + ")"
+		} else if runJournal.End == nil {
+			renamed += " (interrupted)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", runJournal.Run.ID, runJournal.Run.Time.Format("2006-01-02 15:04:05"), renamed, strings.Join(runJournal.Run.Roots, ", "), formatArgs(runJournal.Run.Args))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	// Roots synced with other machines may have been renamed from them
+	// since, in runs that are in their history rather than this one.
+	host, _ := os.Hostname()
+	seen := make(map[string]bool)
+	for _, runJournal := range journals {
+		for _, root := range runJournal.Run.Roots {
+			if seen[root] {
+				continue
+			}
+			seen[root] = true
+			marker, err := readLibraryMarker(root)
+			if err != nil {
+				continue
+			}
+			if warning := foreignRun(root, marker, host); warning != "" {
+				fmt.Fprintf(historyCmd.Stdout, "warning: %s\n", warning)
+			}
+		}
+	}
+	return nil
+}
+
+// show prints the details of a single run.
+func (historyCmd *HistoryCmd) show() error {
+	runJournal, err := readJournal(filepath.Join(historyCmd.JournalDir, filepath.Base(historyCmd.ID)+".jsonl"))
+	if err != nil {
+		return err
+	}
+	if historyCmd.JSON {
+		encoder := json.NewEncoder(historyCmd.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runJournal)
+	}
+	fmt.Fprintf(historyCmd.Stdout, "run %s\n", runJournal.Run.ID)
+	fmt.Fprintf(historyCmd.Stdout, "started: %s\n", runJournal.Run.Time.Format("2006-01-02 15:04:05 -0700"))
+	if runJournal.End != nil {
+		fmt.Fprintf(historyCmd.Stdout, "finished: %s (%d renamed, %d skipped, %d errors)\n", runJournal.End.Time.Format("2006-01-02 15:04:05 -0700"), runJournal.End.Renamed, runJournal.End.Skipped, runJournal.End.Errors)
+	} else {
+		fmt.Fprintln(historyCmd.Stdout, "finished: never (interrupted)")
+		if checkpoint := runJournal.Checkpoint; checkpoint != nil {
+			fmt.Fprintf(historyCmd.Stdout, "last chunk: %s (%d renamed, %d skipped, %d errors)\n", checkpoint.Time.Format("2006-01-02 15:04:05 -0700"), checkpoint.Renamed, checkpoint.Skipped, checkpoint.Errors)
+		}
+	}
+	if recovered := runJournal.Recovered; recovered != nil {
+		fmt.Fprintf(historyCmd.Stdout, "recovered: %s (rolled %s, %d files)\n", recovered.Time.Format("2006-01-02 15:04:05 -0700"), recovered.Action, recovered.Renamed)
+	}
+	fmt.Fprintf(historyCmd.Stdout, "roots: %s\n", strings.Join(runJournal.Run.Roots, ", "))
+	if runJournal.Run.Host != "" {
+		fmt.Fprintf(historyCmd.Stdout, "host: %s\n", runJournal.Run.Host)
+	}
+	fmt.Fprintf(historyCmd.Stdout, "flags: %s\n", formatArgs(runJournal.Run.Args))
+	fmt.Fprintln(historyCmd.Stdout)
+	for _, rename := range runJournal.Renames {
+		fmt.Fprintf(historyCmd.Stdout, "%s => %s\n", rename.Old, rename.New)
+	}
+	return nil
+}
+
+// formatArgs joins args for display, quoting those that need it in a shell.
+func formatArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$*?[]{}|&;<>()`#~") {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		} else {
+			quoted[i] = arg
+		}
+	}
+	return strings.Join(quoted, " ")
+}
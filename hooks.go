@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// splitCommand splits a command line into arguments roughly the way a POSIX
+// shell would, honouring single quotes, double quotes and backslash escapes.
+// No other shell features (variables, globbing, pipes) are supported.
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, char := range s {
+		switch {
+		case escaped:
+			b.WriteRune(char)
+			escaped = false
+		case quote == '\'':
+			if char == '\'' {
+				quote = 0
+			} else {
+				b.WriteRune(char)
+			}
+		case char == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if char == '"' {
+				quote = 0
+			} else {
+				b.WriteRune(char)
+			}
+		case char == '\'' || char == '"':
+			quote = char
+			inArg = true
+		case char == ' ' || char == '\t' || char == '\n':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteRune(char)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// expandCommand replaces the {old} and {new} placeholders in each argument.
+// The command is executed without a shell, so the file names never need
+// quoting.
+func expandCommand(args []string, oldFilePath, newFilePath string) []string {
+	replacer := strings.NewReplacer("{old}", oldFilePath, "{new}", newFilePath)
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = replacer.Replace(arg)
+	}
+	return expanded
+}
+
+// runHook runs a hook command for a file, holding a slot in semaphore for
+// the duration. It returns the combined stdout and stderr of the command.
+func runHook(ctx context.Context, semaphore chan struct{}, args []string, oldFilePath, newFilePath string) (output []byte, err error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case semaphore <- struct{}{}:
+	}
+	defer func() { <-semaphore }()
+	args = expandCommand(args, oldFilePath, newFilePath)
+	output, err = exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s: %w", strings.Join(args, " "), err)
+	}
+	return output, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type IndexCmd struct {
+	Roots      []string
+	Output     string
+	Format     string
+	Thumbnails bool
+	NumWorkers int
+	Stdout     io.Writer
+}
+
+func IndexCommand(args []string) (*IndexCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	indexCmd := &IndexCmd{
+		Roots:  []string{cwd},
+		Stdout: os.Stdout,
+	}
+	flagset := flag.NewFlagSet("index", flag.ContinueOnError)
+	flagset.StringVar(&indexCmd.Output, "o", "index.html", "Output file. Use - for stdout.")
+	flagset.StringVar(&indexCmd.Format, "format", "", "Output format: html or json (default: inferred from the output file extension).")
+	flagset.BoolVar(&indexCmd.Thumbnails, "thumbnails", true, "Embed thumbnails in the HTML index.")
+	flagset.IntVar(&indexCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers generating thumbnails.")
+	flagset.Func("root", "Specify an additional root directory. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		indexCmd.Roots = append(indexCmd.Roots, root)
+		return nil
+	})
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if indexCmd.Format == "" {
+		if strings.EqualFold(filepath.Ext(indexCmd.Output), ".json") {
+			indexCmd.Format = "json"
+		} else {
+			indexCmd.Format = "html"
+		}
+	}
+	if indexCmd.Format != "html" && indexCmd.Format != "json" {
+		return nil, fmt.Errorf("unknown format %q", indexCmd.Format)
+	}
+	return indexCmd, nil
+}
+
+// IndexFile is a file in the index.
+type IndexFile struct {
+	Path      string       `json:"path"`
+	Time      time.Time    `json:"time,omitzero"`
+	Thumbnail template.URL `json:"-"`
+	filePath  string
+}
+
+// IndexDay is all the files in the index taken on the same day.
+type IndexDay struct {
+	Date  string      `json:"date"`
+	Count int         `json:"count"`
+	Files []IndexFile `json:"files"`
+}
+
+// Index is a chronological index of the files named by jpegid.
+type Index struct {
+	Total   int         `json:"total"`
+	Days    []IndexDay  `json:"days"`
+	Undated []IndexFile `json:"undated,omitempty"`
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Photo index</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+nav a { margin-right: 0.5em; }
+.files { display: flex; flex-wrap: wrap; gap: 0.5em; }
+.files a { display: block; width: 160px; font-size: 0.75em; word-break: break-all; text-decoration: none; }
+.files img { display: block; max-width: 160px; max-height: 160px; }
+</style>
+</head>
+<body>
+<h1>Photo index</h1>
+<p>{{ .Total }} files across {{ len .Days }} days.</p>
+<nav>{{ range .Days }}<a href="#{{ .Date }}">{{ .Date }} ({{ .Count }})</a> {{ end }}</nav>
+{{- range .Days }}
+<h2 id="{{ .Date }}">{{ .Date }} <small>({{ .Count }})</small></h2>
+<div class="files">
+{{- range .Files }}
+<a href="{{ .Path }}">{{ if .Thumbnail }}<img src="{{ .Thumbnail }}" alt="" loading="lazy">{{ end }}{{ .Time.Format "15:04:05" }}</a>
+{{- end }}
+</div>
+{{- end }}
+{{- if .Undated }}
+<h2 id="undated">Undated <small>({{ len .Undated }})</small></h2>
+<div class="files">
+{{- range .Undated }}
+<a href="{{ .Path }}">{{ .Path }}</a>
+{{- end }}
+</div>
+{{- end }}
+</body>
+</html>
+`))
+
+func (indexCmd *IndexCmd) Run(ctx context.Context) error {
+	// Paths in the index are relative to the directory of the output file,
+	// so that the links keep working if the tree is moved.
+	baseDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if indexCmd.Output != "-" {
+		outputPath, err := filepath.Abs(indexCmd.Output)
+		if err != nil {
+			return err
+		}
+		baseDir = filepath.Dir(outputPath)
+	}
+	var index Index
+	days := make(map[string]*IndexDay)
+	for _, root := range indexCmd.Roots {
+		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dirEntry.IsDir() {
+				if path != "." && (strings.HasPrefix(dirEntry.Name(), ".") || isNASMetadataDir(dirEntry.Name())) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			filePath := filepath.Join(root, path)
+			relPath, err := filepath.Rel(baseDir, filePath)
+			if err != nil {
+				relPath = filePath
+			}
+			creationTime, ok := parseFileName(dirEntry.Name())
+			if !ok {
+				if !strings.HasPrefix(dirEntry.Name(), ".") && !strings.HasPrefix(dirEntry.Name(), "index.") {
+					index.Undated = append(index.Undated, IndexFile{Path: filepath.ToSlash(relPath)})
+				}
+				return nil
+			}
+			date := creationTime.Format("2006-01-02")
+			day := days[date]
+			if day == nil {
+				day = &IndexDay{Date: date}
+				days[date] = day
+			}
+			day.Files = append(day.Files, IndexFile{Path: filepath.ToSlash(relPath), Time: creationTime, filePath: filePath})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, day := range days {
+		slices.SortFunc(day.Files, func(a, b IndexFile) int {
+			return a.Time.Compare(b.Time)
+		})
+		day.Count = len(day.Files)
+		index.Total += day.Count
+		index.Days = append(index.Days, *day)
+	}
+	slices.SortFunc(index.Days, func(a, b IndexDay) int {
+		return strings.Compare(a.Date, b.Date)
+	})
+	var buf bytes.Buffer
+	switch indexCmd.Format {
+	case "json":
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(index)
+		if err != nil {
+			return err
+		}
+	case "html":
+		if indexCmd.Thumbnails {
+			indexCmd.addThumbnails(ctx, &index)
+		}
+		err = indexTemplate.Execute(&buf, index)
+		if err != nil {
+			return err
+		}
+	}
+	if indexCmd.Output == "-" {
+		_, err = buf.WriteTo(indexCmd.Stdout)
+		return err
+	}
+	return os.WriteFile(indexCmd.Output, buf.Bytes(), 0644)
+}
+
+func (indexCmd *IndexCmd) addThumbnails(ctx context.Context, index *Index) {
+	var waitGroup sync.WaitGroup
+	files := make(chan *IndexFile)
+	for i := 0; i < max(indexCmd.NumWorkers, 1); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for file := range files {
+				thumbnail, err := makeThumbnail(file.filePath, 160)
+				if err == nil {
+					file.Thumbnail = thumbnail
+				}
+			}
+		}()
+	}
+	for i := range index.Days {
+		for j := range index.Days[i].Files {
+			if ctx.Err() != nil {
+				break
+			}
+			files <- &index.Days[i].Files[j]
+		}
+	}
+	close(files)
+	waitGroup.Wait()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalRecord is a single line of a journal. The first line of a journal
+// describes the run ("run"), followed by a line per renamed file ("rename")
+// and, if the run finished, a line with its summary ("end"). Every rename is
+// preceded by a line recording that it is about to happen ("intent"), so
+// that a rename a crash left without its "rename" line can be found, and a
+// journal recovered that way ends with a line saying how ("recover"). An
+// intent whose rename failed is followed by a "fail" line instead. Runs
+// with -chunk-size add a line with the counts so far after each chunk
+// ("checkpoint"). Paths are encoded with encodePath.
+type journalRecord struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Run.
+	ID    string   `json:"id,omitempty"`
+	Roots []string `json:"roots,omitempty"`
+	Args  []string `json:"args,omitempty"`
+	// Host is the machine the run was made on, and Libraries the IDs of the
+	// library markers of its roots, if they have them, or of the -into
+	// library of a merge.
+	Host      string   `json:"host,omitempty"`
+	Libraries []string `json:"libraries,omitempty"`
+
+	// Rename.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+
+	// End, or the chunks committed so far (Checkpoint).
+	Renamed int `json:"renamed,omitempty"`
+	Skipped int `json:"skipped,omitempty"`
+	Errors  int `json:"errors,omitempty"`
+
+	// Recover. Action is recoverForward or recoverBack, and Renamed the
+	// number of renames finished or undone.
+	Action string `json:"action,omitempty"`
+}
+
+// journal is the record of a past run, as read back from its journal file.
+type journal struct {
+	Run     journalRecord   `json:"run"`
+	Renames []journalRecord `json:"renames"`
+	// End is nil if the run was interrupted before it could finish.
+	End *journalRecord `json:"end"`
+	// Checkpoint is the last chunk of the run committed with -chunk-size,
+	// with the counts of the files handled up to it, or nil.
+	Checkpoint *journalRecord `json:"checkpoint,omitempty"`
+	// Intents are the renames that were about to happen, each of which is
+	// followed by its record in Renames or Failures unless the run crashed.
+	Intents []journalRecord `json:"intents,omitempty"`
+	// Failures are the intents whose rename failed, leaving the file as it
+	// was.
+	Failures []journalRecord `json:"failures,omitempty"`
+	// Recovered is how the renames a crash interrupted were dealt with, or
+	// nil.
+	Recovered *journalRecord `json:"recovered,omitempty"`
+}
+
+// uncommitted returns the intents of runJournal without a rename or fail
+// record.
+func (runJournal journal) uncommitted() []journalRecord {
+	committed := make(map[[2]string]int)
+	for _, rename := range slices.Concat(runJournal.Renames, runJournal.Failures) {
+		committed[[2]string{rename.Old, rename.New}]++
+	}
+	var uncommitted []journalRecord
+	for _, intent := range runJournal.Intents {
+		key := [2]string{intent.Old, intent.New}
+		if committed[key] > 0 {
+			committed[key]--
+			continue
+		}
+		uncommitted = append(uncommitted, intent)
+	}
+	return uncommitted
+}
+
+// defaultJournalDir returns the directory where journals are stored when
+// JournalDir is empty.
+func defaultJournalDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "jpegid", "journal"), nil
+}
+
+// journalWriter appends the renames of a run to its journal. The journal
+// file is only created on the first rename, so that runs which rename
+// nothing don't leave empty journals behind. Every record is written
+// straight to the file so that the journal survives a crash, and the file
+// is locked until it is closed.
+type journalWriter struct {
+	mutex sync.Mutex
+	dir   string
+	run   journalRecord
+	file  *os.File
+	// pending is the number of intents without a rename or fail record.
+	pending int
+}
+
+func newJournalWriter(dir string, now time.Time, roots, args []string) *journalWriter {
+	return &journalWriter{
+		dir: dir,
+		run: journalRecord{Type: "run", Time: now, Roots: encodePaths(roots), Args: args},
+	}
+}
+
+// open creates the journal file, named after the start time of the run.
+func (journalWriter *journalWriter) open() error {
+	err := os.MkdirAll(journalWriter.dir, 0755)
+	if err != nil {
+		return err
+	}
+	id := journalWriter.run.Time.Format("20060102T150405")
+	for i := 2; ; i++ {
+		file, err := os.OpenFile(filepath.Join(journalWriter.dir, id+".jsonl"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			id = journalWriter.run.Time.Format("20060102T150405") + "-" + strconv.Itoa(i)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// The lock tells recovery that the run is still going. Filesystems
+		// without locks, such as some network mounts, leave it unlocked.
+		_, _ = tryLockFile(file)
+		journalWriter.file = file
+		journalWriter.run.ID = id
+		return journalWriter.write(journalWriter.run)
+	}
+}
+
+func (journalWriter *journalWriter) write(record journalRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = journalWriter.file.Write(append(b, '\n'))
+	return err
+}
+
+// intend records that oldPath is about to be renamed to newPath. The record
+// is synced to disk before intend returns, so that it survives a power loss
+// that the rename itself does.
+func (journalWriter *journalWriter) intend(now time.Time, oldPath, newPath string) error {
+	journalWriter.mutex.Lock()
+	defer journalWriter.mutex.Unlock()
+	if journalWriter.file == nil {
+		err := journalWriter.open()
+		if err != nil {
+			return err
+		}
+	}
+	err := journalWriter.write(journalRecord{Type: "intent", Time: now, Old: encodePath(oldPath), New: encodePath(newPath)})
+	if err != nil {
+		return err
+	}
+	journalWriter.pending++
+	return journalWriter.file.Sync()
+}
+
+// rename records that oldPath was renamed to newPath.
+func (journalWriter *journalWriter) rename(now time.Time, oldPath, newPath string) error {
+	return journalWriter.outcome(journalRecord{Type: "rename", Time: now, Old: encodePath(oldPath), New: encodePath(newPath)})
+}
+
+// fail records that the rename of oldPath to newPath that was intended
+// failed without moving the file.
+func (journalWriter *journalWriter) fail(now time.Time, oldPath, newPath string) error {
+	return journalWriter.outcome(journalRecord{Type: "fail", Time: now, Old: encodePath(oldPath), New: encodePath(newPath)})
+}
+
+// outcome writes the rename or fail record of an intent.
+func (journalWriter *journalWriter) outcome(record journalRecord) error {
+	journalWriter.mutex.Lock()
+	defer journalWriter.mutex.Unlock()
+	if journalWriter.file == nil {
+		err := journalWriter.open()
+		if err != nil {
+			return err
+		}
+	}
+	err := journalWriter.write(record)
+	if err != nil {
+		return err
+	}
+	journalWriter.pending = max(journalWriter.pending-1, 0)
+	return nil
+}
+
+// checkpoint records the counts of the files handled so far at the end of a
+// chunk of the run, and syncs the journal so that every rename of the chunk
+// survives a crash. Nothing is recorded before the first rename.
+func (journalWriter *journalWriter) checkpoint(now time.Time, summary *runSummary) error {
+	journalWriter.mutex.Lock()
+	defer journalWriter.mutex.Unlock()
+	if journalWriter.file == nil {
+		return nil
+	}
+	err := journalWriter.write(journalRecord{Type: "checkpoint", Time: now, Renamed: summary.Renamed, Skipped: summary.Skipped, Errors: summary.Errors})
+	if err != nil {
+		return err
+	}
+	return journalWriter.file.Sync()
+}
+
+// close records the summary of the run, if anything was renamed, the run
+// finished and every intent has its rename or fail record, and closes the
+// journal. Journals of interrupted runs are left without a summary, for
+// recovery to finish.
+func (journalWriter *journalWriter) close(now time.Time, summary *runSummary, finished bool) error {
+	journalWriter.mutex.Lock()
+	defer journalWriter.mutex.Unlock()
+	if journalWriter.file == nil {
+		return nil
+	}
+	var err error
+	if finished && journalWriter.pending == 0 {
+		err = journalWriter.write(journalRecord{Type: "end", Time: now, Renamed: summary.Renamed, Skipped: summary.Skipped, Errors: summary.Errors})
+	}
+	if err == nil {
+		// An interrupted run may be followed by a shutdown.
+		err = journalWriter.file.Sync()
+	}
+	if err != nil {
+		_ = journalWriter.file.Close()
+		return err
+	}
+	return journalWriter.file.Close()
+}
+
+// readJournal reads the journal file name.
+func readJournal(name string) (journal, error) {
+	var runJournal journal
+	file, err := os.Open(name)
+	if err != nil {
+		return runJournal, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record journalRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// A partially written last line from a crash.
+			continue
+		}
+		switch record.Type {
+		case "run":
+			for i, root := range record.Roots {
+				record.Roots[i] = decodePath(root)
+			}
+			runJournal.Run = record
+		case "rename":
+			record.Old, record.New = decodePath(record.Old), decodePath(record.New)
+			runJournal.Renames = append(runJournal.Renames, record)
+		case "fail":
+			record.Old, record.New = decodePath(record.Old), decodePath(record.New)
+			runJournal.Failures = append(runJournal.Failures, record)
+		case "end":
+			runJournal.End = &record
+		case "checkpoint":
+			runJournal.Checkpoint = &record
+		case "intent":
+			record.Old, record.New = decodePath(record.Old), decodePath(record.New)
+			runJournal.Intents = append(runJournal.Intents, record)
+		case "recover":
+			runJournal.Recovered = &record
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return runJournal, err
+	}
+	if runJournal.Run.ID == "" {
+		runJournal.Run.ID = strings.TrimSuffix(filepath.Base(name), ".jsonl")
+	}
+	return runJournal, nil
+}
+
+// appendJournal appends records to the journal of the run id in dir.
+func appendJournal(dir, id string, records ...journalRecord) error {
+	file, err := os.OpenFile(filepath.Join(dir, id+".jsonl"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		record.Old, record.New = encodePath(record.Old), encodePath(record.New)
+		b, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		_, err = file.Write(append(b, '\n'))
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// journalFinished reports whether the last record of the journal file name
+// is an "end" or "recover" record, after which a run is never recovered. It
+// reads only the end of the file, as journals of big runs are long.
+func journalFinished(name string) (bool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	// The last records are far shorter than this.
+	const tailSize = 4096
+	offset := max(fileInfo.Size()-tailSize, 0)
+	b := make([]byte, fileInfo.Size()-offset)
+	_, err = file.ReadAt(b, offset)
+	if err != nil {
+		return false, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	var record journalRecord
+	err = json.Unmarshal(b[bytes.LastIndexByte(b, '\n')+1:], &record)
+	if err != nil {
+		// A partially written last line from a crash, or a last line
+		// longer than the tail.
+		return false, nil
+	}
+	return record.Type == "end" || record.Type == "recover", nil
+}
+
+// readJournals reads every journal in dir, oldest first. With unfinished,
+// only the journals of runs that neither ended nor were recovered are read,
+// which are told apart from the rest by their last record alone.
+func readJournals(dir string, unfinished bool) ([]journal, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	journals := make([]journal, 0, len(names))
+	for _, name := range names {
+		if unfinished {
+			finished, err := journalFinished(name)
+			if err != nil {
+				return nil, err
+			}
+			if finished {
+				continue
+			}
+		}
+		runJournal, err := readJournal(name)
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, runJournal)
+	}
+	slices.SortStableFunc(journals, func(a, b journal) int {
+		return a.Run.Time.Compare(b.Run.Time)
+	})
+	return journals, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// libraryMarkerName is the file in each root, or in the -into library of a
+// merge, that identifies it, so that a library synced between machines is
+// recognized as the same library on each of them even though every machine
+// keeps its own journals.
+const libraryMarkerName = ".jpegid-library.json"
+
+// libraryMarker is the contents of a libraryMarkerName file.
+type libraryMarker struct {
+	ID string `json:"id"`
+	// LastRun is the last run that renamed files in the root, from
+	// whichever machine.
+	LastRun *markerRun `json:"lastRun,omitempty"`
+}
+
+// markerRun is a run recorded in a libraryMarker.
+type markerRun struct {
+	Host    string    `json:"host"`
+	Journal string    `json:"journal"`
+	Time    time.Time `json:"time"`
+}
+
+// newLibraryID returns a random (version 4) UUID.
+func newLibraryID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// readLibraryMarker reads the marker of root. It returns an error wrapping
+// fs.ErrNotExist if root has none.
+func readLibraryMarker(root string) (libraryMarker, error) {
+	var marker libraryMarker
+	b, err := os.ReadFile(filepath.Join(root, libraryMarkerName))
+	if err != nil {
+		return marker, err
+	}
+	err = json.Unmarshal(b, &marker)
+	if err != nil {
+		return marker, fmt.Errorf("%s: %w", filepath.Join(root, libraryMarkerName), err)
+	}
+	if marker.ID == "" {
+		return marker, fmt.Errorf("%s: no id", filepath.Join(root, libraryMarkerName))
+	}
+	return marker, nil
+}
+
+// writeLibraryMarker replaces the marker of root, through a temporary file
+// so that a sync client never sees it half written.
+func writeLibraryMarker(root string, marker libraryMarker) error {
+	b, err := json.MarshalIndent(marker, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(root, libraryMarkerName)
+	err = os.WriteFile(name+".tmp", append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// openLibraryMarker returns the marker of root, creating one with a new ID
+// if root has none.
+func openLibraryMarker(root string) (libraryMarker, error) {
+	marker, err := readLibraryMarker(root)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return marker, err
+	}
+	marker = libraryMarker{ID: newLibraryID()}
+	return marker, writeLibraryMarker(root, marker)
+}
+
+// foreignRun returns a warning if the last run recorded in marker was made
+// on a machine other than host, whose journals (and so the history of the
+// renames it made) are not on this one.
+func foreignRun(root string, marker libraryMarker, host string) string {
+	if marker.LastRun == nil || marker.LastRun.Host == host {
+		return ""
+	}
+	return fmt.Sprintf("%s (library %s) was last renamed from %s at %s (run %s), which is not in the history of this machine", root, marker.ID, marker.LastRun.Host, marker.LastRun.Time.Format("2006-01-02 15:04:05"), marker.LastRun.Journal)
+}
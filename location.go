@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// coordinateRegexp matches a GPS coordinate as exiftool prints it, e.g.
+// 52 deg 31' 12.00" N, or as a decimal number of degrees, e.g. -33.8568.
+var coordinateRegexp = regexp.MustCompile(`^(-?\d+(?:\.\d+)?)(?:\s*deg\s*(\d+(?:\.\d+)?)'\s*(?:(\d+(?:\.\d+)?)")?)?\s*([NSEW])?$`)
+
+// parseCoordinate parses a GPS latitude or longitude in degrees, negative to
+// the south and west. ref is the GPSLatitudeRef or GPSLongitudeRef, used if
+// value has no direction of its own.
+func parseCoordinate(value, ref string) (float64, bool) {
+	match := coordinateRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, false
+	}
+	degrees, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	for i, unit := range []float64{60, 3600} {
+		if match[2+i] != "" {
+			n, err := strconv.ParseFloat(match[2+i], 64)
+			if err != nil {
+				return 0, false
+			}
+			degrees += n / unit
+		}
+	}
+	direction := match[4]
+	if direction == "" && ref != "" {
+		// e.g. North, South.
+		direction = strings.ToUpper(ref[:1])
+	}
+	if direction == "S" || direction == "W" {
+		degrees = -math.Abs(degrees)
+	}
+	return degrees, true
+}
+
+// gpsCoordinates returns where a file was taken, from GPSLatitude and
+// GPSLongitude.
+func gpsCoordinates(exif Exif) (latitude, longitude float64, ok bool) {
+	latitude, latitudeOK := parseCoordinate(exif.Tag("GPSLatitude"), exif.Tag("GPSLatitudeRef"))
+	longitude, longitudeOK := parseCoordinate(exif.Tag("GPSLongitude"), exif.Tag("GPSLongitudeRef"))
+	if !latitudeOK || !longitudeOK || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
+
+// geohashAlphabet is the base 32 alphabet of geohashes, which leaves out a,
+// i, l and o.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash returns the geohash of a location with precision characters.
+// Every character narrows the cell down by 5 bits, alternating between
+// longitude and latitude, so that nearby places share a prefix.
+func geohash(latitude, longitude float64, precision int) string {
+	latitudeRange, longitudeRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	var b strings.Builder
+	even := true
+	bit, index := 0, 0
+	for b.Len() < precision {
+		value, bounds := latitude, &latitudeRange
+		if even {
+			value, bounds = longitude, &longitudeRange
+		}
+		mid := (bounds[0] + bounds[1]) / 2
+		index <<= 1
+		if value >= mid {
+			index |= 1
+			bounds[0] = mid
+		} else {
+			bounds[1] = mid
+		}
+		even = !even
+		bit++
+		if bit == 5 {
+			b.WriteByte(geohashAlphabet[index])
+			bit, index = 0, 0
+		}
+	}
+	return b.String()
+}
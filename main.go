@@ -1,8 +1,7 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,17 +9,24 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
 	"log"
 	"log/slog"
+	"maps"
 	"math/rand/v2"
+	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 	"unicode/utf8"
 )
@@ -36,7 +42,40 @@ func main() {
 		<-userInterrupt // Hard interrupt.
 		os.Exit(1)
 	}()
-	cmd, err := JpegIDCommand(os.Args)
+	var cmd interface {
+		Run(ctx context.Context) error
+	}
+	var err error
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dedupe":
+			cmd, err = DedupeCommand(os.Args[1:])
+		case "index":
+			cmd, err = IndexCommand(os.Args[1:])
+		case "check":
+			cmd, err = CheckCommand(os.Args[1:])
+		case "apply":
+			cmd, err = ApplyCommand(os.Args[1:])
+		case "history":
+			cmd, err = HistoryCommand(os.Args[1:])
+		case "compare":
+			cmd, err = CompareCommand(os.Args[1:])
+		case "shift-exif":
+			cmd, err = ShiftExifCommand(os.Args[1:])
+		case "backfill":
+			cmd, err = BackfillCommand(os.Args[1:])
+		case "timeline":
+			cmd, err = TimelineCommand(os.Args[1:])
+		case "similar":
+			cmd, err = SimilarCommand(os.Args[1:])
+		case "merge":
+			cmd, err = JpegIDCommand(os.Args[1:])
+		default:
+			cmd, err = JpegIDCommand(os.Args)
+		}
+	} else {
+		cmd, err = JpegIDCommand(os.Args)
+	}
 	if err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return
@@ -45,24 +84,426 @@ func main() {
 	}
 	err = cmd.Run(ctx)
 	if err != nil {
+		// Stdout may be a JSON plan or a list of names.
+		if errors.Is(err, ErrNothingMatched) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	}
 }
 
 type JpegIDCmd struct {
-	Roots           []string
-	FileRegexps     []*regexp.Regexp
-	NumWorkers      int
-	Recursive       bool
-	Verbose         bool
-	DryRun          bool
-	ReplaceIfExists bool
-	Stdout          io.Writer
-	Stderr          io.Writer
-	logger          *slog.Logger
+	Roots       []string
+	FileRegexps []*regexp.Regexp
+	NumWorkers  int
+	Recursive   bool
+	Verbose     bool
+	DryRun      bool
+	OnCollision string
+	Backend     string
+	Stdin       io.Reader
+	Stdout      io.Writer
+	Stderr      io.Writer
+	logger      *slog.Logger
+
+	// args are the command line arguments the command was created with,
+	// recorded in the journal.
+	args []string
+
+	// namedRegexp matches the paths of files already named by the active
+	// naming scheme. It is set by Renames.
+	namedRegexp *regexp.Regexp
+
+	// journal, if not nil, is the journal of the run, set by Run. Every
+	// file is recorded in it as about to be renamed before it is.
+	journal *journalWriter
+
+	// workers, if not nil, collects the statistics of the pipeline workers
+	// of the run, set by Run.
+	workers *workerMonitor
+	// tracer records the spans of the run if OTLPEndpoint is set.
+	tracer *tracer
+
+	// IgnoreCase records that FileRegexps and PathRegexps were compiled to
+	// match case-insensitively.
+	IgnoreCase bool
+
+	// FilesFrom, if set, is a file listing the files to rename instead of
+	// walking the roots. "-" means Stdin. Empty entries are ignored.
+	FilesFrom string
+
+	// NullSeparated makes FilesFrom separated by NUL bytes instead of
+	// newlines, and prints the new path of each renamed file (or the old and
+	// new paths in a dry run) to Stdout terminated by a NUL byte.
+	NullSeparated bool
+
+	// PrintNewName only prints the new path of each file listed in
+	// FilesFrom (Stdin by default), one per line, without renaming it.
+	// Empty lines of the input are dropped rather than echoed, so the
+	// output only lines up with input that has none.
+	PrintNewName bool
+
+	// PathRegexps include files whose slash-separated path relative to their
+	// root matches, in addition to files whose name matches FileRegexps.
+	PathRegexps []*regexp.Regexp
+
+	// FFprobeExtensions are the file extensions (such as ".mp4") whose
+	// metadata is read with ffprobe instead of Backend.
+	FFprobeExtensions []string
+
+	// PlatformFallback enables falling back to the operating system's own
+	// metadata (Spotlight on macOS, the Shell "Date taken" property on
+	// Windows) for files without a usable creation time.
+	PlatformFallback bool
+
+	// SetBirthtime sets the creation time of each renamed file to its
+	// metadata creation time, on platforms that support it (macOS and
+	// Windows).
+	SetBirthtime bool
+
+	// PreserveDirModTimes restores the modification times of directories
+	// after files in them have been renamed, so that backup tools don't see
+	// them as modified.
+	PreserveDirModTimes bool
+
+	// DeviceWorkers maps a path to the number of workers dedicated to the
+	// roots on the same device as that path, so that a slow device doesn't
+	// hold up the others.
+	DeviceWorkers map[string]int
+
+	// AutoWorkers gives the roots on each device (other than those in
+	// DeviceWorkers) a pool of workers sized for the kind of storage it is
+	// found to be by probeStorage, instead of sharing NumWorkers. It is set
+	// unless -num-workers is given.
+	AutoWorkers bool
+
+	// PlanWorkers and RenameWorkers are the number of workers of the plan
+	// and execute stages of each root group (see renamePipeline), which
+	// default to the number of workers extracting metadata. StageBuffer is
+	// how many files may wait between one stage and the next.
+	PlanWorkers   int
+	RenameWorkers int
+	StageBuffer   int
+
+	// ChunkSize, if positive, commits the results of the run every
+	// ChunkSize files: the journal records the counts so far and is
+	// synced, and the Incremental state, SummaryJSON (if a file) and
+	// ReportHTML are written, so that a long run leaves results that can
+	// be inspected as it goes and an interrupted one loses little. The
+	// -output json plan is still only written at the end.
+	ChunkSize int
+
+	// OpTimeout, if positive, is how long reading the metadata of a file,
+	// or a stat or rename, may take before it is given up on with
+	// ErrTimedOut, as a file on an unresponsive network filesystem can
+	// block forever. Operations are given up on when the run is cancelled
+	// regardless.
+	OpTimeout time.Duration
+
+	// Incremental skips files that were processed by a previous run and have
+	// not changed (in size or modification time) since.
+	Incremental bool
+
+	// StateDir is where the scan state used by Incremental is stored. It
+	// defaults to a directory in the user's cache directory.
+	StateDir string
+
+	// RootAliases are the names given to roots with -root name=path, by
+	// root. Paths inside them are shown as name:relPath in logs, warnings,
+	// dry runs and reports (see displayPath).
+	RootAliases map[string]string
+
+	// RelativePaths shows paths relative to their root in dry runs, logs
+	// and reports, and writes them relative to their root in -output json
+	// plans, so that plans stay valid if the roots are mounted elsewhere.
+	RelativePaths bool
+
+	// PlanHash records the SHA-256 of each file to rename in -output json
+	// plans of dry runs, for apply to check that the contents of a file
+	// are still what was planned for, and not only its size and
+	// modification time.
+	PlanHash bool
+
+	// MetadataCache reads the metadata of files from the metadata cache,
+	// shared with the other subcommands that read metadata, if they haven't
+	// changed since it was cached there, and caches the metadata it reads.
+	MetadataCache bool
+
+	// MetadataCacheDir is where the metadata cache is stored. It defaults
+	// to a directory in the user's cache directory.
+	MetadataCacheDir string
+
+	// JournalDir is where the journal of every run that renames files is
+	// written, listed by jpegid history. It defaults to a directory in the
+	// user's cache directory.
+	JournalDir string
+
+	// Recover is how runs in JournalDir that crashed in the middle of a
+	// rename are dealt with before renaming anything: recoverForward or
+	// recoverBack, or asked on Stdin if empty. It must be set if Stdin is
+	// the list of files of FilesFrom.
+	Recover string
+
+	// CheckCorrupt checks that JPEGs have the markers a JPEG starts and ends
+	// with before reading their metadata, and skips those that don't with
+	// ErrCorrupt.
+	CheckCorrupt bool
+
+	// QuarantineDir, if not empty, is where corrupt JPEGs are moved to
+	// (keeping their path relative to their root), with a record of each in
+	// quarantine.jsonl. It implies CheckCorrupt.
+	QuarantineDir string
+
+	// CopyTo, if not empty, puts copies of files with their new names in
+	// this directory (at the same path relative to it as they would have
+	// relative to their root) instead of renaming them, leaving the
+	// originals as they are. Nothing is written to the journal.
+	CopyTo string
+
+	// MergeInto, if not empty, moves files into this library directory with
+	// their new names (at the same path relative to it as they would have
+	// relative to their root), skipping files whose contents are already in
+	// it with ErrDuplicate. Files that are already named are moved too.
+	MergeInto string
+
+	// AAEPolicy is what is done with the AAE files of renamed photos:
+	// aaePair, aaeIgnore or aaeDrop.
+	AAEPolicy string
+
+	// SidecarExts are the extensions (with the dot) of sidecar files, such
+	// as .xmp, that are renamed along with the file of the same name.
+	SidecarExts []string
+
+	// LivePhotos renames the video of a Live Photo (IMG_1234.MOV) along
+	// with its photo (IMG_1234.HEIC) instead of on its own, so that they
+	// keep the same name. PairEdits does the same for the edited variants
+	// iOS exports next to an original (IMG_E1234.JPG), which keep an _E
+	// suffix.
+	LivePhotos bool
+	PairEdits  bool
+
+	// HashMode is how files are compared with those in the MergeInto
+	// library, hashModeContents or hashModePixels.
+	HashMode string
+
+	// PreserveMode and PreserveOwnership keep the permission bits and (when
+	// running as root) the owner and group of the originals in copy mode.
+	PreserveMode      bool
+	PreserveOwnership bool
+
+	// DirMode, if not zero, is the mode of the directories created for new
+	// paths, whatever the umask. Otherwise they get 0777 less the umask.
+	// Either way directories created in a setgid directory inherit its
+	// group and setgid bit.
+	DirMode fs.FileMode
+
+	// BandwidthLimit, if not zero, is the most bytes per second read by all
+	// copies together in copy mode.
+	BandwidthLimit int64
+
+	// ReportHTML is the name of a self-contained HTML report of the run to
+	// write, if not empty.
+	ReportHTML string
+
+	// SummaryJSON, if set, is the file the run summary is written to as
+	// JSON. "-" means Stdout.
+	SummaryJSON string
+
+	// Pprof, if not empty, is the address net/http/pprof is served on for
+	// the duration of the run, along with expvar and the "workers" metric.
+	Pprof string
+
+	// TraceExifTool, if not empty, is the file every command sent to and
+	// all output received from each exiftool process is logged to, with
+	// the ID of the process. "-" means Stderr.
+	TraceExifTool string
+
+	// Trace, if not empty, is the file a runtime execution trace of the run
+	// is written to.
+	Trace string
+
+	// Output is the format of what is printed to Stdout: "text" (the
+	// default) prints a line per renamed file, "json" prints a plan of every
+	// file at the end of the run.
+	Output string
+
+	// ExecAfter is a command (split into arguments) that is run after each
+	// successful rename. The placeholders {old} and {new} in its arguments
+	// are replaced with the old and new file paths. Its output is written to
+	// Stderr.
+	ExecAfter []string
+
+	// ExecBefore is a command that is run before each rename, with the same
+	// placeholders as ExecAfter. If it exits with a non-zero status the file
+	// is not renamed. It is also run during a dry run.
+	ExecBefore []string
+
+	// SnapshotCmd is a command (split into arguments) that takes a
+	// filesystem snapshot before anything is renamed, such as a btrfs or
+	// ZFS snapshot (see fsSnapshot). The placeholders {root} and {name} in
+	// its arguments are replaced with the directory to snapshot and the
+	// name of the snapshot. The run fails if the snapshot cannot be taken.
+	SnapshotCmd []string
+
+	// RollbackCmd is a command, with the same placeholders as SnapshotCmd,
+	// that rolls the filesystem back to the snapshot if the run fails or
+	// is interrupted. This also undoes any other change made to it since
+	// the snapshot was taken. Without it the snapshot is left for rolling
+	// back by hand.
+	RollbackCmd []string
+
+	// ExecWorkers limits how many hook commands may run at the same time.
+	ExecWorkers int
+
+	// Order is the order files are processed and results yielded in: path
+	// (the default), mtime or size.
+	Order string
+
+	// Limit stops the run after Limit files have been processed.
+	Limit int
+
+	// Sample processes only Sample files picked at random from the roots.
+	Sample int
+
+	// DateTags are the metadata tags tried, in order, for the creation time
+	// of a file. Defaults to defaultDateTags.
+	DateTags []string
+
+	// NameFromTag, if set, names files after the value of this metadata tag
+	// instead of their creation time.
+	NameFromTag string
+
+	// OffsetPolicy is how dates without a timezone offset, in either the date
+	// tag or an offset tag, are interpreted: "require" (the default) rejects
+	// them, "local" takes them to be in the local timezone and "utc" in UTC.
+	OffsetPolicy string
+
+	// Reprocess looks into files whose names already match the naming scheme
+	// instead of skipping them with ErrAlreadyNamed.
+	Reprocess bool
+
+	// Normalize is the Unicode normalization form ("nfc" or "nfd") new names
+	// are put in, if not empty, so that names that look the same are the
+	// same on every filesystem.
+	Normalize string
+
+	// Precision is the precision of the creation time in new names:
+	// "millis" (the default) or "seconds". Names with second precision are
+	// not padded, so files taken in the same second collide.
+	Precision string
+
+	// GPSThreshold is how far the creation time may be from the GPS time of
+	// a file (GPSDateTime, which is in UTC) before a warning is given, as
+	// that means the camera clock was wrong. It defaults to
+	// defaultGPSThreshold.
+	GPSThreshold time.Duration
+
+	// Trips name the files taken in each of their date ranges in the
+	// timezone of the trip instead of the offset of their creation time. The
+	// first trip containing a creation time is used.
+	Trips []tripZone
+
+	// BurstSize is the fewest files taken at most BurstGap apart that are
+	// moved into a subfolder of their own, named after the first of them,
+	// once every file has been renamed. 0 leaves bursts in place.
+	BurstSize int
+	BurstGap  time.Duration
+
+	// Calendar holds events whose names are the Event field of NameTemplate
+	// for the files created during them.
+	Calendar []calendarEvent
+
+	// OffsetFromGPS takes the timezone offset of dates without one from the
+	// difference to their GPS time where possible, before OffsetPolicy.
+	OffsetFromGPS bool
+
+	// WriteOffset writes the timezone offset of the creation time into
+	// renamed files that have a DateTimeOriginal but no OffsetTimeOriginal,
+	// so that other programs read their dates right too. The offset comes
+	// from TimeZone, OffsetFromGPS or OffsetPolicy. It needs exiftool.
+	WriteOffset bool
+
+	// PreferGPS takes the GPS time as the creation time of files whose
+	// creation time is further than GPSThreshold from it.
+	PreferGPS bool
+
+	// Force renames files after the first of their date tags even if its
+	// date is implausible, instead of falling back to the next date tag or
+	// skipping them with ErrImplausibleDate.
+	Force bool
+
+	// DSTPolicy is which time an offset-less date is taken to be when the
+	// local timezone makes it ambiguous: "earlier" (the default), "later" or
+	// "error".
+	DSTPolicy string
+
+	// MinAge skips files modified less than MinAge ago, such as files still
+	// being synced into a root.
+	MinAge time.Duration
+
+	// Simulate is a DryRun that carries out the renames against an
+	// in-memory model of the roots, reporting the collisions between files
+	// of the run that a plain DryRun can't see.
+	Simulate bool
+
+	// NameTemplate, if set, is executed with a nameData to produce the new
+	// name of each file relative to its root. Directories in the name are
+	// created as needed.
+	NameTemplate *template.Template
+
+	// Routes are the templates files of each class (see classifyFile) are
+	// named with instead of NameTemplate, keyed by class.
+	Routes map[string]*template.Template
+
+	// ExtRules are the naming schemes and collision policies of files with
+	// particular extensions, which take precedence over Routes,
+	// NameTemplate and OnCollision. Later rules take precedence over
+	// earlier ones.
+	ExtRules []extRule
+
+	// Locale is the language of MonthName and Weekday in NameTemplate.
+	Locale string
+
+	// EmailSummary, if not empty, are the addresses the summary of the run
+	// and the files that failed are mailed to at the end of the run, with
+	// the SMTP settings in EmailConfig (see emailConfig), which defaults to
+	// jpegid/email.json in the user's config directory.
+	EmailSummary []string
+	EmailConfig  string
+
+	// HealthcheckURL, if not empty, is pinged at the end of the run, or its
+	// failure variant if the run fails, for monitoring cron jobs (see
+	// pingHealthcheck).
+	HealthcheckURL string
+
+	// OTLPEndpoint, if not empty, is the OTLP/HTTP collector the
+	// OpenTelemetry spans of the run, of each stage and of each batch of
+	// files, are exported to at the end of the run (see tracer).
+	OTLPEndpoint string
+
+	// PluginsDir is the directory external plugins are discovered in. It
+	// defaults to a directory in the user's config directory.
+	PluginsDir string
+
+	// Namer is the name of a namer plugin that chooses new file names.
+	Namer string
+
+	// NewExifToolClient returns a new ExifToolClient for each worker. It
+	// defaults to starting an exiftool process.
+	NewExifToolClient func() (ExifToolClient, error)
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	// Rand is the entropy source used to pad timestamps that lack
+	// sub-second precision. Padding is drawn in walk order, so a seeded
+	// Rand produces the same names on every run regardless of NumWorkers.
+	// It defaults to a randomly seeded source.
+	Rand *rand.Rand
 }
 
 func JpegIDCommand(args []string) (*JpegIDCmd, error) {
@@ -71,231 +512,2281 @@ func JpegIDCommand(args []string) (*JpegIDCmd, error) {
 		return nil, err
 	}
 	jpegidCmd := &JpegIDCmd{
-		Roots:  []string{cwd},
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		Roots:       []string{cwd},
+		OnCollision: collisionSkip,
+		AAEPolicy:   aaePair,
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+		Now:         time.Now,
+		Rand:        rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
 	}
 	flagset := flag.NewFlagSet("", flag.ContinueOnError)
-	flagset.IntVar(&jpegidCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.IntVar(&jpegidCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers. If omitted, it is chosen for each device from probing whether it is an SSD, a spinning disk or network storage.")
 	flagset.BoolVar(&jpegidCmd.Recursive, "recursive", false, "Walk the roots recursively.")
 	flagset.BoolVar(&jpegidCmd.Verbose, "verbose", false, "Verbose output.")
 	flagset.BoolVar(&jpegidCmd.DryRun, "dry-run", false, "Print rename operations without executing.")
-	flagset.BoolVar(&jpegidCmd.ReplaceIfExists, "replace-if-exists", false, "If a file with the new name already exists, replace it.")
-	flagset.Func("root", "Specify an additional root directory to watch. Can be repeated.", func(value string) error {
-		root, err := filepath.Abs(value)
+	flagset.BoolVar(&jpegidCmd.Simulate, "simulate", false, "Like -dry-run, but carry out the renames against an in-memory model of the roots, to catch files that would collide with each other or with files renamed later in the run.")
+	flagset.Func("on-collision", "What to do if a file with the new name already exists: skip (default), replace, suffix (append -1, -2, ...) or ask.", func(value string) error {
+		policy, err := parseCollisionPolicy(value)
 		if err != nil {
 			return err
 		}
-		jpegidCmd.Roots = append(jpegidCmd.Roots, root)
+		jpegidCmd.OnCollision = policy
 		return nil
 	})
-	flagset.Func("file", "Include file regex. Can be repeated.", func(value string) error {
-		r, err := compileRegexp(value)
+	flagset.BoolFunc("replace-if-exists", "Deprecated: use -on-collision=replace.", func(value string) error {
+		replace, err := strconv.ParseBool(value)
 		if err != nil {
 			return err
 		}
-		jpegidCmd.FileRegexps = append(jpegidCmd.FileRegexps, r)
+		if replace {
+			jpegidCmd.OnCollision = collisionReplace
+		}
 		return nil
 	})
-	err = flagset.Parse(args[1:])
-	if err != nil {
-		return nil, err
-	}
-	logLevel := slog.LevelError
-	if jpegidCmd.Verbose {
-		logLevel = slog.LevelInfo
-	}
-	jpegidCmd.logger = slog.New(slog.NewTextHandler(jpegidCmd.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-		Level:     logLevel,
-		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
-			switch attr.Key {
-			case slog.TimeKey:
-				return slog.Attr{}
-			case slog.SourceKey:
-				source := attr.Value.Any().(*slog.Source)
-				return slog.Any(slog.SourceKey, &slog.Source{
-					Function: source.Function,
-					File:     filepath.Base(source.File),
-					Line:     source.Line,
-				})
-			default:
-				return attr
+	for _, offsetFlag := range []struct{ name, policy, usage string }{
+		{"assume-local", offsetLocal, "Take dates without a timezone offset to be in the local timezone."},
+		{"assume-utc", offsetUTC, "Take dates without a timezone offset to be in UTC."},
+		{"require-offset", offsetRequire, "Report dates without a timezone offset as errors (default)."},
+	} {
+		flagset.BoolFunc(offsetFlag.name, offsetFlag.usage, func(value string) error {
+			set, err := strconv.ParseBool(value)
+			if err != nil || !set {
+				return err
 			}
-		},
-	}))
-	return jpegidCmd, nil
-}
-
-func (jpegidCmd *JpegIDCmd) Run(ctx context.Context) error {
-	type Exif struct {
-		FileSize               string
-		SubSecDateTimeOriginal string
-		CreateDate             string
-		TimeZone               string
+			if jpegidCmd.OffsetPolicy != "" && jpegidCmd.OffsetPolicy != offsetFlag.policy {
+				return errors.New("only one of -assume-local, -assume-utc and -require-offset can be given")
+			}
+			jpegidCmd.OffsetPolicy = offsetFlag.policy
+			return nil
+		})
 	}
-	var waitGroup sync.WaitGroup
-	defer waitGroup.Wait()
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	filePaths := make(chan string)
-	for i := 0; i < jpegidCmd.NumWorkers; i++ {
-		exifToolCmd := exec.Command("exiftool", "-stay_open", "True", "-@", "-")
-		setpgid(exifToolCmd)
-		exifToolStdin, err := exifToolCmd.StdinPipe()
+	flagset.BoolVar(&jpegidCmd.Reprocess, "reprocess", false, "Read the metadata of files whose names already match the naming scheme instead of skipping them.")
+	flagset.Func("normalize", "Unicode normalization form of new names: nfc (Linux, Windows) or nfd (older macOS filesystems).", func(value string) error {
+		form, err := parseNormalization(value)
 		if err != nil {
 			return err
 		}
-		exifToolStdout, err := exifToolCmd.StdoutPipe()
+		jpegidCmd.Normalize = form
+		return nil
+	})
+	flagset.Func("precision", "Precision of the creation time in new names: millis (default) or seconds. With seconds, -on-collision defaults to suffix.", func(value string) error {
+		switch value {
+		case precisionMillis, precisionSeconds:
+			jpegidCmd.Precision = value
+			return nil
+		}
+		return fmt.Errorf("unknown precision %q (want millis or seconds)", value)
+	})
+	flagset.DurationVar(&jpegidCmd.GPSThreshold, "gps-threshold", defaultGPSThreshold, "Warn when the creation time of a file differs from its GPS time by more than this.")
+	flagset.Func("trip", "Name files taken from FROM to TO (dates, inclusive) in timezone ZONE whatever their own offset, as FROM..TO=ZONE, e.g. 2023-09-10..2023-09-20=Asia/Tokyo or =+09:00. Can be repeated.", func(value string) error {
+		trip, err := parseTripZone(value)
 		if err != nil {
 			return err
 		}
-		exifToolStderr, err := exifToolCmd.StderrPipe()
+		jpegidCmd.Trips = append(jpegidCmd.Trips, trip)
+		return nil
+	})
+	flagset.IntVar(&jpegidCmd.BurstSize, "burst-size", 0, "Move runs of at least this many files taken at most -burst-gap apart (bursts) into a subfolder named after the first of them.")
+	flagset.DurationVar(&jpegidCmd.BurstGap, "burst-gap", defaultBurstGap, "Longest time between two frames of a burst.")
+	flagset.Func("calendar", "Read events from an iCalendar (.ics) file or a CSV file of start,end,name lines (dates, inclusive) for the {{.Event}} field of -name-template.", func(value string) error {
+		events, err := loadCalendar(value)
 		if err != nil {
 			return err
 		}
-		go func() {
-			_, _ = io.Copy(jpegidCmd.Stderr, exifToolStderr)
-		}()
-		err = exifToolCmd.Start()
+		jpegidCmd.Calendar = append(jpegidCmd.Calendar, events...)
+		return nil
+	})
+	flagset.BoolVar(&jpegidCmd.OffsetFromGPS, "offset-from-gps", false, "Work out the timezone offset of dates without one from their GPS time where possible.")
+	flagset.BoolVar(&jpegidCmd.WriteOffset, "write-offset", false, "Write OffsetTimeOriginal into renamed files that lack it, with the offset that was assumed or worked out.")
+	flagset.BoolVar(&jpegidCmd.PreferGPS, "prefer-gps", false, "Name files after their GPS time when their creation time differs from it by more than -gps-threshold.")
+	flagset.BoolVar(&jpegidCmd.Force, "force", false, "Rename files with implausible dates (before 1990, in the future or a camera's default like 2000-01-01 00:00:00) instead of skipping them.")
+	flagset.Func("dst", "Which time to take when a date without an offset is ambiguous because of a DST transition: earlier (default), later or error.", func(value string) error {
+		policy, err := parseDSTPolicy(value)
 		if err != nil {
-			return fmt.Errorf("%s: %w", exifToolCmd.String(), err)
+			return err
 		}
-		waitGroup.Add(1)
-		go func() {
-			defer waitGroup.Done()
-			defer func() {
-				_, err := io.WriteString(exifToolStdin, "-stay_open\n"+
-					"False\n")
-				if err != nil {
-					jpegidCmd.logger.Warn(err.Error())
-				}
-				stop(exifToolCmd)
-			}()
-			var buf bytes.Buffer
-			reader := bufio.NewReader(exifToolStdout)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case filePath := <-filePaths:
-					logger := jpegidCmd.logger.With(slog.String("filePath", filePath))
-					_, err := io.WriteString(exifToolStdin, "-json\n"+
-						filePath+"\n"+
-						"-execute\n")
-					if err != nil {
-						logger.Error(err.Error())
-						break
-					}
-					buf.Reset()
-					for {
-						line, err := reader.ReadBytes('\n')
-						if err != nil {
-							if err == io.EOF {
-								logger.Error("exiftool returned EOF prematurely")
-								return
-							}
-							logger.Error(err.Error())
-							return
-						}
-						if string(line) != "{ready}\n" {
-							buf.Write(line)
-							continue
-						}
-						break
-					}
-					var exifs []Exif
-					err = json.Unmarshal(buf.Bytes(), &exifs)
-					if err != nil {
-						jpegidCmd.logger.Error(err.Error(), slog.String("data", buf.String()))
-						break
-					}
-					exif := exifs[0]
-					var creationTime time.Time
-					if exif.SubSecDateTimeOriginal != "" {
-						creationTime, err = time.ParseInLocation("2006:01:02 15:04:05.000-07:00", exif.SubSecDateTimeOriginal, time.UTC)
-						if err != nil {
-							logger.Error(err.Error(), slog.String("SubSecDateTimeOriginal", exif.SubSecDateTimeOriginal))
-							break
-						}
-					} else if exif.CreateDate != "" {
-						creationTime, err = time.ParseInLocation("2006:01:02 15:04:05-07:00", exif.CreateDate+exif.TimeZone, time.UTC)
-						if err != nil {
-							logger.Error(err.Error(), slog.String("SubSecDateTimeOriginal", exif.SubSecDateTimeOriginal))
-							break
-						}
-						creationTime = creationTime.Add(time.Duration(rand.IntN(1000)) * time.Millisecond)
-					} else {
-						logger.Error("unable to fetch file creation time", slog.String("data", buf.String()))
-						break
-					}
-					newFilePath := filepath.Join(filepath.Dir(filePath), creationTime.Format("2006-01-02T150405.000-0700") + filepath.Ext(filePath))
-					if jpegidCmd.DryRun {
-						b, err := json.Marshal(exif)
-						if err != nil {
-							logger.Warn(err.Error())
-						}
-						fmt.Fprintf(jpegidCmd.Stdout, "%s => %s %s\n", filePath, newFilePath, string(b))
-						break
-					}
-					if jpegidCmd.ReplaceIfExists {
-						err := os.Rename(filePath, newFilePath)
-						if err != nil {
-							logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
-							break
-						}
-						logger.Info("renamed file", slog.String("newFilePath", newFilePath))
-						break
-					}
-					_, err = os.Stat(newFilePath)
-					if err != nil {
-						if !errors.Is(err, fs.ErrNotExist) {
-							jpegidCmd.logger.Error(err.Error(), slog.String("name", newFilePath))
-							break
-						}
-						err := os.Rename(filePath, newFilePath)
-						if err != nil {
-							logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
-							break
-						}
-						logger.Info("renamed file", slog.String("newFilePath", newFilePath))
-					} else {
-						logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("newFilePath", newFilePath))
-					}
-				}
-			}
-		}()
-	}
-	for _, root := range jpegidCmd.Roots {
-		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if dirEntry.IsDir() {
-				if path != "." && !jpegidCmd.Recursive {
-					return fs.SkipDir
-				}
-				return nil
+		jpegidCmd.DSTPolicy = policy
+		return nil
+	})
+	flagset.Func("backend", "Metadata backend to use: exiftool (default) or exiv2.", func(value string) error {
+		switch value {
+		case "exiftool", "exiv2":
+			jpegidCmd.Backend = value
+			return nil
+		default:
+			return fmt.Errorf("unknown backend %q", value)
+		}
+	})
+	flagset.BoolVar(&jpegidCmd.MetadataCache, "metadata-cache", false, "Reuse the metadata read from unchanged files by earlier runs of any subcommand, and cache what is read (in jpegid/metadata in the user cache directory).")
+	flagset.BoolVar(&jpegidCmd.PlatformFallback, "platform-fallback", false, "Fall back to operating system metadata (Spotlight on macOS, Shell properties on Windows) for files without a creation time.")
+	flagset.BoolVar(&jpegidCmd.SetBirthtime, "set-birthtime", false, "Set the file creation time of renamed files to their metadata creation time (macOS and Windows only).")
+	flagset.BoolVar(&jpegidCmd.PreserveDirModTimes, "preserve-dir-mtimes", false, "Restore the modification times of directories after renaming files in them.")
+	flagset.BoolVar(&jpegidCmd.Incremental, "incremental", false, "Skip files that have not changed since they were processed by a previous run.")
+	flagset.StringVar(&jpegidCmd.ReportHTML, "report-html", "", "Write an HTML report of the run (with thumbnails) to this file.")
+	flagset.StringVar(&jpegidCmd.SummaryJSON, "summary-json", "", "Write the run summary, with counts per skip reason, as JSON to this file. Use - for stdout.")
+	flagset.Func("exec-after", "Command to run after each successful rename, e.g. 'cmd {old} {new}'.", func(value string) error {
+		args, err := splitCommand(value)
+		if err != nil {
+			return fmt.Errorf("-exec-after: %w", err)
+		}
+		jpegidCmd.ExecAfter = args
+		return nil
+	})
+	flagset.Func("exec-before", "Command to run before each rename, e.g. 'cmd {old} {new}'. A non-zero exit status skips the file.", func(value string) error {
+		args, err := splitCommand(value)
+		if err != nil {
+			return fmt.Errorf("-exec-before: %w", err)
+		}
+		jpegidCmd.ExecBefore = args
+		return nil
+	})
+	flagset.Func("snapshot-cmd", "Command to take a filesystem snapshot with before renaming, e.g. 'btrfs subvolume snapshot -r {root} {root}/.snapshots/{name}'. Run once per root if it has {root}, else once.", func(value string) error {
+		args, err := splitCommand(value)
+		if err != nil {
+			return fmt.Errorf("-snapshot-cmd: %w", err)
+		}
+		jpegidCmd.SnapshotCmd = args
+		return nil
+	})
+	flagset.Func("rollback-cmd", "Command to roll back to the -snapshot-cmd snapshot with if the run fails, e.g. 'zfs rollback tank/photos@{name}'.", func(value string) error {
+		args, err := splitCommand(value)
+		if err != nil {
+			return fmt.Errorf("-rollback-cmd: %w", err)
+		}
+		jpegidCmd.RollbackCmd = args
+		return nil
+	})
+	flagset.IntVar(&jpegidCmd.PlanWorkers, "plan-workers", 0, "Number of workers working out new names (and running -namer and -exec-before) per device. Defaults to the number of workers reading metadata.")
+	flagset.IntVar(&jpegidCmd.RenameWorkers, "rename-workers", 0, "Number of workers renaming files (and running -exec-after) per device. Defaults to the number of workers reading metadata.")
+	flagset.DurationVar(&jpegidCmd.OpTimeout, "op-timeout", 0, "Give up on reading the metadata of a file, or renaming it, after this long (e.g. 30s), for unresponsive network filesystems. No limit if 0.")
+	flagset.IntVar(&jpegidCmd.StageBuffer, "stage-buffer", defaultStageBuffer, "Number of files that may wait between reading metadata, working out new names and renaming.")
+	flagset.IntVar(&jpegidCmd.ChunkSize, "chunk-size", 0, "Commit the journal and write the incremental state, -summary-json and -report-html every this many files, so that long runs leave results as they go.")
+	flagset.IntVar(&jpegidCmd.ExecWorkers, "exec-workers", 4, "Maximum number of -exec-before and -exec-after commands running at the same time.")
+	flagset.StringVar(&jpegidCmd.FilesFrom, "files-from", "", "Rename the files listed in this file, one per line, instead of walking the roots. Use - for stdin.")
+	flagset.BoolVar(&jpegidCmd.NullSeparated, "0", false, "Read -files-from paths separated by NUL, and print each new path (old and new path in a dry run) terminated by NUL, for use with find -print0 and xargs -0.")
+	flagset.BoolVar(&jpegidCmd.PrintNewName, "print-new-name", false, "Read paths from -files-from (default stdin) and print only the new path of each, without renaming anything. Failures print an empty line; empty input lines are dropped.")
+	flagset.Func("order", "Order to process files in: path (default), mtime or size.", func(value string) error {
+		switch value {
+		case "path", "mtime", "size":
+			jpegidCmd.Order = value
+			return nil
+		}
+		return fmt.Errorf("unknown order %q", value)
+	})
+	flagset.IntVar(&jpegidCmd.Limit, "limit", 0, "Process at most this many files.")
+	flagset.IntVar(&jpegidCmd.Sample, "sample", 0, "Process only this many files picked at random (reproducible with -seed).")
+	flagset.Func("date-tags", "Comma-separated metadata tags to take the creation time from, in order of preference (default SubSecDateTimeOriginal,CreateDate).", func(value string) error {
+		jpegidCmd.DateTags = nil
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" {
+				jpegidCmd.DateTags = append(jpegidCmd.DateTags, tag)
 			}
-			name := dirEntry.Name()
-			for _, fileRegexp := range jpegidCmd.FileRegexps {
-				if fileRegexp.MatchString(name) {
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					case filePaths <- filepath.Join(root, path):
-						break
-					}
-					return nil
-				}
+		}
+		if len(jpegidCmd.DateTags) == 0 {
+			return fmt.Errorf("no tags in %q", value)
+		}
+		return nil
+	})
+	flagset.StringVar(&jpegidCmd.NameFromTag, "name-from-tag", "", "Name files after the value of this metadata tag (e.g. ImageUniqueID) instead of their creation time.")
+	flagset.DurationVar(&jpegidCmd.MinAge, "min-age", 0, "Skip files modified less than this long ago (e.g. 5m).")
+	flagset.Func("name-template", "Name files with a Go text/template relative to the root, e.g. '{{.Year}}/{{.Month}}-{{.MonthName}}/{{.Default}}'. The functions lower, upper, slugify, substr, padseq and replace are available, e.g. '{{.Default}}-{{.Name | padseq 5}}'.", func(value string) error {
+		tmpl, err := newNameTemplate(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.NameTemplate = tmpl
+		return nil
+	})
+	flagset.Func("route", "Name files of a class (photo, screenshot, scan, document or other) with their own -name-template, as CLASS=TEMPLATE, e.g. 'screenshot=Screenshots/{{.Default}}'. Can be repeated.", func(value string) error {
+		class, text, err := parseRoute(value)
+		if err != nil {
+			return err
+		}
+		tmpl, err := newNameTemplate(text)
+		if err != nil {
+			return err
+		}
+		if jpegidCmd.Routes == nil {
+			jpegidCmd.Routes = make(map[string]*template.Template)
+		}
+		jpegidCmd.Routes[class] = tmpl
+		return nil
+	})
+	flagset.Func("ext-rule", "Name files with these extensions with their own -name-template and -on-collision policy, as EXTS[:POLICY]=TEMPLATE, where EXTS is a comma-separated list of extensions, video or image, e.g. 'video=Videos/VID_{{.Default}}' or '.png:suffix='. Can be repeated.", func(value string) error {
+		rule, err := parseExtRule(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.ExtRules = append(jpegidCmd.ExtRules, rule)
+		return nil
+	})
+	flagset.StringVar(&jpegidCmd.Locale, "locale", defaultLocale(), "Language of month and weekday names in -name-template (en, de, es, fr, it, nl, pt).")
+	flagset.Func("email-summary", "Mail the summary of the run, with the files that failed, to these comma-separated addresses, with the SMTP settings in -email-config.", func(value string) error {
+		for address := range strings.SplitSeq(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				jpegidCmd.EmailSummary = append(jpegidCmd.EmailSummary, address)
 			}
-			return nil
-		})
+		}
+		return nil
+	})
+	flagset.Func("healthcheck-url", "Ping this healthchecks.io or Uptime Kuma style URL at the end of the run, or its /fail variant (status=down for push URLs with a query) if the run fails.", func(value string) error {
+		pingURL, err := url.Parse(value)
+		if err != nil || (pingURL.Scheme != "http" && pingURL.Scheme != "https") || pingURL.Host == "" {
+			return fmt.Errorf("invalid healthcheck URL %q (want an http or https URL)", value)
+		}
+		jpegidCmd.HealthcheckURL = value
+		return nil
+	})
+	flagset.Func("otlp-endpoint", "Export OpenTelemetry spans of the run, its stages and batches of files to this OTLP/HTTP collector, e.g. http://localhost:4318. The run joins the trace in TRACEPARENT if set.", func(value string) error {
+		endpoint, err := url.Parse(value)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint %q (want an http or https URL)", value)
+		}
+		jpegidCmd.OTLPEndpoint = value
+		return nil
+	})
+	flagset.StringVar(&jpegidCmd.EmailConfig, "email-config", "", `JSON file of SMTP settings for -email-summary: {"host", "port", "username", "password", "from", "tls"} (default: jpegid/email.json in the user config directory).`)
+	flagset.StringVar(&jpegidCmd.PluginsDir, "plugins-dir", "", "Directory to discover plugins in (default: jpegid/plugins in the user config directory).")
+	flagset.StringVar(&jpegidCmd.Namer, "namer", "", "Name of a namer plugin that chooses new file names.")
+	flagset.Func("device-workers", "Dedicate a number of workers to the roots on the same device as a path, given as PATH=N. Can be repeated.", func(value string) error {
+		path, n, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("%q is not of the form PATH=N", value)
+		}
+		numWorkers, err := strconv.Atoi(n)
+		if err != nil || numWorkers < 1 {
+			return fmt.Errorf("%q: invalid number of workers", value)
+		}
+		path, err = filepath.Abs(path)
 		if err != nil {
 			return err
 		}
-	}
-	return nil
+		if jpegidCmd.DeviceWorkers == nil {
+			jpegidCmd.DeviceWorkers = make(map[string]int)
+		}
+		jpegidCmd.DeviceWorkers[path] = numWorkers
+		return nil
+	})
+	flagset.Func("ffprobe-ext", "Use ffprobe for files with this extension (e.g. .mp4). Can be repeated.", func(value string) error {
+		ext := strings.ToLower(value)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		jpegidCmd.FFprobeExtensions = append(jpegidCmd.FFprobeExtensions, ext)
+		return nil
+	})
+	flagset.Func("seed", "Seed the random sub-second padding so that output names are reproducible.", func(value string) error {
+		seed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.Rand = rand.New(rand.NewPCG(seed, seed))
+		return nil
+	})
+	flagset.BoolVar(&jpegidCmd.PlanHash, "plan-hash", false, "Record the SHA-256 of each file to rename in -output json plans of dry runs, for apply to check contents as well as size and modification time.")
+	flagset.BoolVar(&jpegidCmd.RelativePaths, "relative-paths", false, "Show paths relative to their root in dry runs, logs and reports, and write them relative to their root in -output json, so that plans stay valid if the roots are mounted elsewhere (given to apply with -root).")
+	flagset.Func("root", "Specify an additional root directory to watch, optionally as name=path to show its files as name:relPath in logs, dry runs and reports. Can be repeated.", func(value string) error {
+		root, alias, err := parseRoot(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.Roots = append(jpegidCmd.Roots, root)
+		if alias != "" {
+			if jpegidCmd.RootAliases == nil {
+				jpegidCmd.RootAliases = make(map[string]string)
+			}
+			jpegidCmd.RootAliases[root] = alias
+		}
+		return nil
+	})
+	var filePatterns []string
+	flagset.Func("file", "Include file regex. Can be repeated. If neither -file nor -glob is given, common photo and video extensions are included.", func(value string) error {
+		_, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		filePatterns = append(filePatterns, value)
+		return nil
+	})
+	var globPatterns []string
+	flagset.Func("glob", "Include file glob, e.g. '*.jpg' or '**/DCIM/*.{jpg,heic}'. Globs containing a / are matched against the path relative to the root. Can be repeated.", func(value string) error {
+		_, err := globRegexp(value)
+		if err != nil {
+			return err
+		}
+		globPatterns = append(globPatterns, value)
+		return nil
+	})
+	flagset.BoolVar(&jpegidCmd.IgnoreCase, "ignore-case", false, "Match -file and -glob patterns case-insensitively.")
+	flagset.BoolVar(&jpegidCmd.CheckCorrupt, "check-corrupt", false, "Skip JPEGs that are missing their start or end of image marker, such as truncated files.")
+	flagset.Func("quarantine", "Move corrupt JPEGs to this directory instead of leaving them in place. Implies -check-corrupt.", func(value string) error {
+		dir, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.QuarantineDir = dir
+		jpegidCmd.CheckCorrupt = true
+		return nil
+	})
+	flagset.Func("copy-to", "Copy files with their new names to this directory instead of renaming them. The run is aborted if the directory doesn't have room for every file.", func(value string) error {
+		dir, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.CopyTo = dir
+		return nil
+	})
+	flagset.Func("into", "Move files into this library directory with their new names, skipping files whose contents are already in it.", func(value string) error {
+		dir, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.MergeInto = dir
+		return nil
+	})
+	flagset.Func("aae", "What to do with the iOS .AAE edit files of photos: pair (rename them with their photos), ignore or drop (delete them, keeping only the originals).", func(value string) error {
+		policy, err := parseAAEPolicy(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.AAEPolicy = policy
+		return nil
+	})
+	flagset.Func("sidecar-ext", "Rename files with this extension (e.g. .xmp) along with the file of the same name. Can be repeated.", func(value string) error {
+		ext := strings.ToLower(value)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		jpegidCmd.SidecarExts = append(jpegidCmd.SidecarExts, ext)
+		return nil
+	})
+	flagset.BoolVar(&jpegidCmd.LivePhotos, "live-photos", false, "Rename the video of a Live Photo (IMG_1234.MOV) with its photo (IMG_1234.HEIC).")
+	flagset.BoolVar(&jpegidCmd.PairEdits, "pair-edits", false, "Rename the edited variants of iOS photos (IMG_E1234.JPG) with their originals, with an _E suffix.")
+	flagset.Func("preset", "Set the flags suited to a kind of export: "+strings.Join(presetNames(), ", ")+". Flags after it override it.", func(value string) error {
+		preset, err := lookupPreset(value)
+		if err != nil {
+			return err
+		}
+		for _, f := range preset {
+			err := flagset.Set(f[0], f[1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	flagset.Func("hash", "How files are compared with those in the -into library: contents (the whole file) or pixels (only the image data of JPEGs, so that copies with different metadata are duplicates).", func(value string) error {
+		mode, err := parseHashMode(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.HashMode = mode
+		return nil
+	})
+	flagset.Func("dir-mode", "Create the directories of new paths with this octal mode (e.g. 2775 for directories shared by a group) instead of 777 less the umask.", func(value string) error {
+		var err error
+		jpegidCmd.DirMode, err = parseDirMode(value)
+		return err
+	})
+	flagset.Func("preserve", "Comma-separated attributes of the originals to keep in copies, as with cp --preserve: mode, ownership (only as root), timestamps (always kept) or all.", func(value string) error {
+		options, err := parsePreserve(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.PreserveMode = jpegidCmd.PreserveMode || options.mode
+		jpegidCmd.PreserveOwnership = jpegidCmd.PreserveOwnership || options.ownership
+		return nil
+	})
+	flagset.Func("bwlimit", "Limit copying to this many bytes per second across all workers, with an optional K, M or G suffix (e.g. 20M).", func(value string) error {
+		rate, err := parseByteRate(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.BandwidthLimit = rate
+		return nil
+	})
+	flagset.BoolFunc("p", "Same as -preserve mode,ownership,timestamps.", func(value string) error {
+		preserve, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if preserve {
+			jpegidCmd.PreserveMode, jpegidCmd.PreserveOwnership = true, true
+		}
+		return nil
+	})
+	flagset.Func("output", "Output format: text (default) or json, a plan with the action, reason, metadata and collisions of every file.", func(value string) error {
+		format, err := parseOutputFormat(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.Output = format
+		return nil
+	})
+	flagset.StringVar(&jpegidCmd.Pprof, "pprof", "", "Serve net/http/pprof, and worker metrics on /debug/vars, on this address (e.g. :6060) while running.")
+	flagset.StringVar(&jpegidCmd.Trace, "trace", "", "Write a runtime execution trace to this file, for go tool trace.")
+	flagset.StringVar(&jpegidCmd.TraceExifTool, "trace-exiftool", "", "Log every command sent to and all output received from exiftool, per worker, to this file. Use - for stderr.")
+	flagset.StringVar(&jpegidCmd.JournalDir, "journal-dir", "", "Directory to write the journal of each run to (default: jpegid/journal in the user cache directory).")
+	flagset.Func("recover", "What to do with a previous run that crashed in the middle of renaming files: forward (finish its renames) or back (undo it). Asked on stdin if not set, so it is required when stdin is the list of files.", func(value string) error {
+		action, err := parseRecoverAction(value)
+		if err != nil {
+			return err
+		}
+		jpegidCmd.Recover = action
+		return nil
+	})
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	jpegidCmd.args = args[1:]
+	if args[0] == "merge" {
+		// jpegid merge -into libraryDir importDir
+		if jpegidCmd.MergeInto == "" || flagset.NArg() != 1 {
+			return nil, errors.New("usage: jpegid merge -into libraryDir [flags] importDir")
+		}
+		jpegidCmd.Roots[0], err = filepath.Abs(flagset.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		recursiveSet := false
+		flagset.Visit(func(f *flag.Flag) {
+			recursiveSet = recursiveSet || f.Name == "recursive"
+		})
+		if !recursiveSet {
+			jpegidCmd.Recursive = true
+		}
+	}
+	jpegidCmd.FileRegexps, err = compileRegexps(filePatterns, jpegidCmd.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+	globRegexps, pathRegexps, err := compileGlobs(globPatterns, jpegidCmd.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+	jpegidCmd.FileRegexps = append(jpegidCmd.FileRegexps, globRegexps...)
+	jpegidCmd.PathRegexps = pathRegexps
+	if len(filePatterns) == 0 && len(globPatterns) == 0 {
+		jpegidCmd.FileRegexps = []*regexp.Regexp{defaultFileRegexp}
+	}
+	logLevel := slog.LevelError
+	if jpegidCmd.Verbose {
+		logLevel = slog.LevelInfo
+	}
+	jpegidCmd.AutoWorkers = true
+	flagset.Visit(func(f *flag.Flag) {
+		if f.Name == "num-workers" {
+			jpegidCmd.AutoWorkers = false
+		}
+	})
+	if jpegidCmd.Precision == precisionSeconds {
+		collisionSet := false
+		flagset.Visit(func(f *flag.Flag) {
+			if f.Name == "on-collision" || f.Name == "replace-if-exists" {
+				collisionSet = true
+			}
+		})
+		if !collisionSet {
+			jpegidCmd.OnCollision = collisionSuffix
+		}
+	}
+	if jpegidCmd.NameFromTag != "" && (jpegidCmd.templated() || jpegidCmd.Namer != "") {
+		return nil, errors.New("-name-from-tag cannot be combined with -name-template, -route, -ext-rule or -namer")
+	}
+	if jpegidCmd.CopyTo != "" && jpegidCmd.MergeInto != "" {
+		return nil, errors.New("-copy-to cannot be combined with -into")
+	}
+	if jpegidCmd.RollbackCmd != nil && jpegidCmd.SnapshotCmd == nil {
+		return nil, errors.New("-rollback-cmd requires -snapshot-cmd")
+	}
+	if jpegidCmd.HashMode != "" && jpegidCmd.MergeInto == "" {
+		return nil, errors.New("-hash only applies to merge")
+	}
+	if (jpegidCmd.PreserveMode || jpegidCmd.PreserveOwnership || jpegidCmd.BandwidthLimit > 0) && jpegidCmd.CopyTo == "" {
+		return nil, errors.New("-preserve, -p and -bwlimit only apply to -copy-to")
+	}
+	if jpegidCmd.Output == "json" && (jpegidCmd.NullSeparated || jpegidCmd.PrintNewName || jpegidCmd.SummaryJSON == "-") {
+		return nil, errors.New("-output json cannot be combined with -0, -print-new-name or -summary-json -")
+	}
+	if jpegidCmd.PlanWorkers < 0 || jpegidCmd.RenameWorkers < 0 || jpegidCmd.StageBuffer < 0 || jpegidCmd.ChunkSize < 0 {
+		return nil, errors.New("-plan-workers, -rename-workers, -stage-buffer and -chunk-size cannot be negative")
+	}
+	if jpegidCmd.BurstSize > 0 && (jpegidCmd.NullSeparated || jpegidCmd.PrintNewName) {
+		return nil, errors.New("-burst-size cannot be combined with -0 or -print-new-name")
+	}
+	if jpegidCmd.Simulate {
+		jpegidCmd.DryRun = true
+	}
+	if jpegidCmd.PrintNewName {
+		jpegidCmd.DryRun = true
+		if jpegidCmd.FilesFrom == "" {
+			jpegidCmd.FilesFrom = "-"
+		}
+	}
+	// With -0, -print-new-name or -output json, Stdout is reserved for
+	// machine-readable output.
+	logOutput := jpegidCmd.Stdout
+	if jpegidCmd.NullSeparated || jpegidCmd.PrintNewName || jpegidCmd.Output == "json" {
+		logOutput = jpegidCmd.Stderr
+	}
+	jpegidCmd.logger = slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     logLevel,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			switch attr.Key {
+			case slog.TimeKey:
+				return slog.Attr{}
+			case "root", "filePath", "newFilePath":
+				if attr.Value.Kind() == slog.KindString {
+					return slog.String(attr.Key, jpegidCmd.displayPath(attr.Value.String()))
+				}
+				return attr
+			case slog.SourceKey:
+				source := attr.Value.Any().(*slog.Source)
+				return slog.Any(slog.SourceKey, &slog.Source{
+					Function: source.Function,
+					File:     filepath.Base(source.File),
+					Line:     source.Line,
+				})
+			default:
+				return attr
+			}
+		},
+	}))
+	return jpegidCmd, nil
+}
+
+func (jpegidCmd *JpegIDCmd) Run(ctx context.Context) (err error) {
+	stopDiagnostics, err := startDiagnostics(jpegidCmd.Stderr, jpegidCmd.Pprof, jpegidCmd.Trace)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := stopDiagnostics()
+		if err != nil {
+			fmt.Fprintf(jpegidCmd.Stderr, "warning: trace: %v\n", err)
+		}
+	}()
+	var fatalErr error
+	var reportEntries []reportEntry
+	roots := jpegidCmd.Roots
+	if jpegidCmd.FilesFrom != "" {
+		// Only the roots files are found in are of interest.
+		roots = nil
+	}
+	summary := newRunSummary(roots, jpegidCmd.DryRun)
+	if jpegidCmd.HealthcheckURL != "" {
+		defer func() {
+			var body strings.Builder
+			_ = summary.writeText(&body, jpegidCmd.displayPath)
+			pingErr := pingHealthcheck(jpegidCmd.HealthcheckURL, err, body.String())
+			if pingErr != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: healthcheck: %v\n", pingErr)
+			}
+		}()
+	}
+	if jpegidCmd.OTLPEndpoint != "" {
+		jpegidCmd.tracer = newTracer(jpegidCmd.OTLPEndpoint,
+			stringAttribute("jpegid.roots", strings.Join(jpegidCmd.Roots, string(os.PathListSeparator))),
+			boolAttribute("jpegid.dry_run", jpegidCmd.DryRun),
+		)
+		defer func() {
+			exportErr := jpegidCmd.tracer.finish(err,
+				intAttribute("jpegid.renamed", int64(summary.Renamed)),
+				intAttribute("jpegid.skipped", int64(summary.Skipped)),
+				intAttribute("jpegid.errors", int64(summary.Errors)),
+			)
+			if exportErr != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: otlp: %v\n", exportErr)
+			}
+		}()
+	}
+	var plan *renamePlan
+	if jpegidCmd.Output == "json" {
+		plan = &renamePlan{Version: planVersion, DryRun: jpegidCmd.DryRun, Mode: planModeRename, Relative: jpegidCmd.RelativePaths, Roots: jpegidCmd.Roots, Summary: summary}
+		switch {
+		case jpegidCmd.CopyTo != "":
+			plan.Mode = planModeCopy
+		case jpegidCmd.MergeInto != "":
+			plan.Mode = planModeMerge
+		}
+	}
+	// renamed are the files renamed so far, for finding bursts in.
+	var renamed []RenameResult
+	// failures are the files that failed, for -email-summary.
+	var failures []string
+	var journalWriter *journalWriter
+	if !jpegidCmd.DryRun && jpegidCmd.CopyTo == "" {
+		journalDir := jpegidCmd.JournalDir
+		if journalDir == "" {
+			var err error
+			journalDir, err = defaultJournalDir()
+			if err != nil {
+				return err
+			}
+		}
+		recovery := &journalRecovery{
+			action:  jpegidCmd.Recover,
+			roots:   jpegidCmd.Roots,
+			dirMode: jpegidCmd.DirMode,
+			stdin:   jpegidCmd.Stdin,
+			stderr:  jpegidCmd.Stderr,
+			now:     jpegidCmd.Now,
+		}
+		if jpegidCmd.MergeInto != "" {
+			recovery.roots = append(slices.Clone(jpegidCmd.Roots), jpegidCmd.MergeInto)
+		}
+		if jpegidCmd.FilesFrom == "-" {
+			recovery.stdin = nil
+		}
+		err := recovery.recoverJournals(ctx, journalDir)
+		if err != nil {
+			return err
+		}
+		journalWriter = newJournalWriter(journalDir, jpegidCmd.Now(), jpegidCmd.Roots, jpegidCmd.args)
+		jpegidCmd.journal = journalWriter
+	}
+	// markers are the library markers of the roots, or of the MergeInto
+	// library of a merge, whose roots are only imported from, recording the
+	// last run in each so that runs from other machines can be noticed.
+	var markers map[string]libraryMarker
+	host, _ := os.Hostname()
+	if journalWriter != nil && jpegidCmd.FilesFrom == "" {
+		markers = make(map[string]libraryMarker)
+		libraryDirs := jpegidCmd.Roots
+		if jpegidCmd.MergeInto != "" {
+			libraryDirs = []string{jpegidCmd.MergeInto}
+		}
+		libraries := make([]string, len(libraryDirs))
+		for i, root := range libraryDirs {
+			if jpegidCmd.MergeInto != "" {
+				err := makeDirs(root, jpegidCmd.DirMode)
+				if err != nil {
+					fmt.Fprintf(jpegidCmd.Stderr, "warning: library marker: %v\n", err)
+					continue
+				}
+			}
+			marker, err := openLibraryMarker(root)
+			if err != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: library marker: %v\n", err)
+				continue
+			}
+			markers[root], libraries[i] = marker, marker.ID
+			if warning := foreignRun(root, marker, host); warning != "" {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: %s\n", warning)
+			}
+		}
+		journalWriter.run.Host, journalWriter.run.Libraries = host, libraries
+	}
+	if jpegidCmd.SnapshotCmd != nil && !jpegidCmd.DryRun {
+		var snapshot *fsSnapshot
+		snapshot, err = jpegidCmd.takeSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(jpegidCmd.Stderr, "took snapshot %s\n", snapshot.name)
+		defer func() {
+			if err == nil || errors.Is(err, ErrNothingMatched) {
+				return
+			}
+			if jpegidCmd.RollbackCmd == nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "the run failed: snapshot %s was taken before it\n", snapshot.name)
+				return
+			}
+			rollbackErr := jpegidCmd.rollback(snapshot)
+			if rollbackErr != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: %v\n", rollbackErr)
+				return
+			}
+			fmt.Fprintf(jpegidCmd.Stderr, "the run failed: rolled back to snapshot %s\n", snapshot.name)
+			if journalWriter != nil && journalWriter.run.ID != "" {
+				// The renames of the run no longer need undoing.
+				err := appendJournal(journalWriter.dir, journalWriter.run.ID, journalRecord{Type: "recover", Time: jpegidCmd.Now(), Action: recoverBack, Renamed: summary.Renamed})
+				if err != nil {
+					fmt.Fprintf(jpegidCmd.Stderr, "warning: journal: %v\n", err)
+				}
+			}
+		}()
+	}
+	jpegidCmd.workers = &workerMonitor{}
+	publishedWorkers.Store(jpegidCmd.workers)
+	if len(statusSignals) > 0 {
+		// A status signal dumps the state of the workers, to tell a
+		// stuck worker from a run that is merely slow.
+		status := make(chan os.Signal, 1)
+		signal.Notify(status, statusSignals...)
+		defer signal.Stop(status)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-status:
+					_ = jpegidCmd.workers.writeText(jpegidCmd.Stderr, jpegidCmd.displayPath)
+				}
+			}
+		}()
+	}
+	renames := jpegidCmd.Renames(ctx)
+	if jpegidCmd.Simulate {
+		renames = jpegidCmd.simulate(renames)
+	}
+	// commitChunk commits the results of the files handled so far, every
+	// ChunkSize files.
+	commitChunk := func() {
+		if journalWriter != nil {
+			err := journalWriter.checkpoint(jpegidCmd.Now(), summary)
+			if err != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: journal: %v\n", err)
+				journalWriter = nil
+			}
+		}
+		if jpegidCmd.SummaryJSON != "" && jpegidCmd.SummaryJSON != "-" {
+			err := summary.writeJSON(jpegidCmd.SummaryJSON, jpegidCmd.Stdout)
+			if err != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: summary: %v\n", err)
+			}
+		}
+		if jpegidCmd.ReportHTML != "" {
+			err := writeHTMLReport(jpegidCmd.ReportHTML, reportEntries, jpegidCmd.DryRun, jpegidCmd.NumWorkers, jpegidCmd.Now(), jpegidCmd.displayPath)
+			if err != nil {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: report: %v\n", err)
+			}
+		}
+	}
+	handled := 0
+	for result, err := range renames {
+		if err != nil && result.FilePath == "" {
+			fatalErr = err
+			break
+		}
+		if jpegidCmd.ChunkSize > 0 && handled > 0 && handled%jpegidCmd.ChunkSize == 0 {
+			commitChunk()
+		}
+		handled++
+		summary.add(result.Root, err)
+		if plan != nil {
+			entry := newPlanEntry(result, err, jpegidCmd.DryRun, jpegidCmd.collisionPolicy(result.FilePath))
+			if jpegidCmd.PlanHash && jpegidCmd.DryRun && entry.Action == "rename" {
+				var hashErr error
+				entry.SHA256, hashErr = hashFile(result.FilePath)
+				if hashErr != nil {
+					fmt.Fprintf(jpegidCmd.Stderr, "warning: plan: %v\n", hashErr)
+				}
+			}
+			plan.Files = append(plan.Files, entry)
+		}
+		if result.Warning != "" {
+			fmt.Fprintf(jpegidCmd.Stderr, "warning: %s: %s\n", jpegidCmd.displayPath(result.FilePath), result.Warning)
+		}
+		if jpegidCmd.PrintNewName {
+			// One line per input path, empty if no name could be worked
+			// out, so that the output lines up with the input.
+			newFilePath := result.NewFilePath
+			if err != nil && !errors.Is(err, ErrAlreadyNamed) {
+				newFilePath = ""
+				jpegidCmd.logger.Error(err.Error(), slog.String("filePath", result.FilePath))
+			}
+			if jpegidCmd.NullSeparated {
+				fmt.Fprintf(jpegidCmd.Stdout, "%s\x00", newFilePath)
+			} else {
+				fmt.Fprintln(jpegidCmd.Stdout, newFilePath)
+			}
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, ErrExcluded) || errors.Is(err, ErrUnchanged) {
+				continue
+			}
+			logger := jpegidCmd.logger.With(slog.String("filePath", result.FilePath))
+			var exifToolErr *ExifToolError
+			status := "error"
+			if _, ok := skipReason(err); ok {
+				status = "skipped"
+			}
+			switch {
+			case errors.Is(err, ErrCollision):
+				logger.Info("file already exists, skipping (use -on-collision to change this)", slog.String("newFilePath", result.NewFilePath))
+			case errors.Is(err, ErrVanished):
+				logger.Info(err.Error())
+			case errors.Is(err, ErrVetoed), errors.Is(err, ErrTooNew), errors.Is(err, ErrAlreadyNamed), errors.Is(err, ErrDuplicate), errors.Is(err, ErrPaired):
+				logger.Info(err.Error(), slog.String("newFilePath", result.NewFilePath))
+			case errors.As(err, &exifToolErr):
+				logger.Error(err.Error(), slog.String("data", exifToolErr.Output))
+			case result.NewFilePath == "":
+				logger.Error(err.Error())
+			default:
+				logger.Error(err.Error(), slog.String("newFilePath", result.NewFilePath))
+			}
+			if jpegidCmd.ReportHTML != "" {
+				reportEntries = append(reportEntries, reportEntry{FilePath: result.FilePath, NewFilePath: result.NewFilePath, Status: status, Error: err.Error(), Warning: result.Warning})
+			}
+			if len(jpegidCmd.EmailSummary) > 0 && status == "error" {
+				failures = append(failures, jpegidCmd.displayPath(result.FilePath)+": "+err.Error())
+			}
+			continue
+		}
+		if jpegidCmd.ReportHTML != "" {
+			reportEntries = append(reportEntries, reportEntry{FilePath: result.FilePath, NewFilePath: result.NewFilePath, Status: "renamed", Warning: result.Warning})
+		}
+		if jpegidCmd.BurstSize > 0 {
+			renamed = append(renamed, result)
+		}
+		if jpegidCmd.NullSeparated {
+			// Old and new paths for a dry run, like find -print0 does
+			// for a single path, so that xargs -0 -n 2 can consume them.
+			if jpegidCmd.DryRun {
+				fmt.Fprintf(jpegidCmd.Stdout, "%s\x00%s\x00", result.FilePath, result.NewFilePath)
+			} else {
+				fmt.Fprintf(jpegidCmd.Stdout, "%s\x00", result.NewFilePath)
+			}
+		}
+		if jpegidCmd.DryRun {
+			if !jpegidCmd.NullSeparated && plan == nil {
+				b, err := json.Marshal(result.Exif)
+				if err != nil {
+					jpegidCmd.logger.Warn(err.Error())
+				}
+				fmt.Fprintf(jpegidCmd.Stdout, "%s => %s %s\n", jpegidCmd.displayPath(result.FilePath), jpegidCmd.displayPath(result.NewFilePath), string(b))
+				for _, sidecar := range result.Sidecars {
+					fmt.Fprintf(jpegidCmd.Stdout, "%s => %s\n", jpegidCmd.displayPath(sidecar.FilePath), cmp.Or(jpegidCmd.displayPath(sidecar.NewFilePath), "(deleted)"))
+				}
+			}
+			continue
+		}
+		// The rename is already in the journal, recorded by Renames.
+		jpegidCmd.logger.Info("renamed file", slog.String("filePath", result.FilePath), slog.String("newFilePath", result.NewFilePath))
+	}
+	if len(renamed) > 0 && fatalErr == nil && ctx.Err() == nil {
+		// The new paths of the files moved into burst subfolders, for
+		// the plan and the report.
+		newPaths := make(map[string]string)
+		jpegidCmd.moveBursts(findBursts(renamed, jpegidCmd.BurstSize, jpegidCmd.BurstGap), func(oldPath, newPath string) {
+			newPaths[oldPath] = newPath
+			if jpegidCmd.DryRun {
+				if plan == nil {
+					fmt.Fprintf(jpegidCmd.Stdout, "%s => %s\n", jpegidCmd.displayPath(oldPath), jpegidCmd.displayPath(newPath))
+				}
+				return
+			}
+			jpegidCmd.logger.Info("moved burst frame", slog.String("filePath", oldPath), slog.String("newFilePath", newPath))
+			if journalWriter != nil {
+				err := journalWriter.rename(jpegidCmd.Now(), oldPath, newPath)
+				if err != nil {
+					fmt.Fprintf(jpegidCmd.Stderr, "warning: journal: %v\n", err)
+					journalWriter = nil
+				}
+			}
+		})
+		if plan != nil {
+			for i, entry := range plan.Files {
+				if newPath, ok := newPaths[decodePath(entry.NewPath)]; ok && entry.Action != "skip" && entry.Action != "error" {
+					plan.Files[i].NewPath = encodePath(newPath)
+				}
+			}
+		}
+		for i, entry := range reportEntries {
+			if newPath, ok := newPaths[entry.NewFilePath]; ok {
+				reportEntries[i].NewFilePath = newPath
+			}
+		}
+	}
+	if journalWriter != nil {
+		err := journalWriter.close(jpegidCmd.Now(), summary, ctx.Err() == nil)
+		if err != nil {
+			fmt.Fprintf(jpegidCmd.Stderr, "warning: journal: %v\n", err)
+		}
+		if run := journalWriter.run; run.ID != "" {
+			for root, marker := range markers {
+				marker.LastRun = &markerRun{Host: host, Journal: run.ID, Time: run.Time}
+				err := writeLibraryMarker(root, marker)
+				if err != nil {
+					fmt.Fprintf(jpegidCmd.Stderr, "warning: library marker: %v\n", err)
+				}
+			}
+		}
+	}
+	if !jpegidCmd.PrintNewName && (fatalErr == nil || !errors.Is(fatalErr, ErrNothingMatched)) {
+		_ = summary.writeText(jpegidCmd.Stderr, jpegidCmd.displayPath)
+		if jpegidCmd.Verbose {
+			_ = jpegidCmd.workers.writeText(jpegidCmd.Stderr, jpegidCmd.displayPath)
+		}
+	}
+	if plan != nil && (fatalErr == nil || errors.Is(fatalErr, ErrNothingMatched)) {
+		err := plan.write(jpegidCmd.Stdout)
+		if err != nil && fatalErr == nil {
+			fatalErr = err
+		}
+	}
+	if jpegidCmd.SummaryJSON != "" {
+		err := summary.writeJSON(jpegidCmd.SummaryJSON, jpegidCmd.Stdout)
+		if err != nil && fatalErr == nil {
+			fatalErr = err
+		}
+	}
+	if len(jpegidCmd.EmailSummary) > 0 {
+		err := jpegidCmd.emailSummary(summary, failures, fatalErr)
+		if err != nil {
+			fmt.Fprintf(jpegidCmd.Stderr, "warning: email summary: %v\n", err)
+		}
+	}
+	if jpegidCmd.ReportHTML != "" {
+		err := writeHTMLReport(jpegidCmd.ReportHTML, reportEntries, jpegidCmd.DryRun, jpegidCmd.NumWorkers, jpegidCmd.Now(), jpegidCmd.displayPath)
+		if err != nil && fatalErr == nil {
+			return err
+		}
+	}
+	if fatalErr != nil {
+		return fatalErr
+	}
+	if ctx.Err() != nil && !jpegidCmd.DryRun {
+		if jpegidCmd.Incremental {
+			fmt.Fprintln(jpegidCmd.Stderr, "interrupted, progress has been saved: run again to continue where this run stopped")
+		} else {
+			fmt.Fprintln(jpegidCmd.Stderr, "interrupted, the renames made so far are in the journal (see jpegid history)")
+		}
+	}
+	return ctx.Err()
+}
+
+// RenameResult is the outcome of processing a single file.
+type RenameResult struct {
+	Root         string
+	FilePath     string
+	NewFilePath  string
+	CreationTime time.Time
+	Exif         Exif
+	// Metadata is decoded from Exif.
+	Metadata Metadata
+
+	// DateTag is the metadata tag CreationTime was read from.
+	DateTag string
+
+	// Warning describes anything doubtful about CreationTime, such as a
+	// wall clock time made ambiguous by a DST transition.
+	Warning string
+
+	// Sidecars are the AAE files renamed or deleted along with the file.
+	Sidecars []Sidecar
+}
+
+// Renames walks the roots and renames every matching file, yielding the
+// results in Order with roots on the same device grouped together. Files
+// that are skipped without being looked at, such as those excluded by the
+// include patterns or already named by the naming scheme, are yielded with
+// ErrExcluded, ErrAlreadyNamed, ErrTooNew or ErrUnchanged. Errors that are
+// not tied to a particular file (such as failing to start exiftool or walk a
+// root) are yielded with an empty RenameResult and end the iteration.
+// Breaking out of the loop stops all outstanding work.
+func (jpegidCmd *JpegIDCmd) Renames(ctx context.Context) iter.Seq2[RenameResult, error] {
+	return func(yield func(RenameResult, error) bool) {
+		var waitGroup sync.WaitGroup
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan renameResult)
+		send := func(result renameResult) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case results <- result:
+				return true
+			}
+		}
+		err := jpegidCmd.preflight()
+		if err != nil {
+			yield(RenameResult{}, err)
+			return
+		}
+		jpegidCmd.namedRegexp = nil
+		// Copies are made whether or not the originals are already named.
+		if !jpegidCmd.Reprocess && jpegidCmd.destDir() == "" {
+			jpegidCmd.namedRegexp = jpegidCmd.newNamedRegexp()
+			if jpegidCmd.namedRegexp == nil && jpegidCmd.templated() {
+				jpegidCmd.logger.Info("files named by -name-template or -route can't be recognized, so every file will be looked into")
+			}
+		}
+		if jpegidCmd.NameFromTag == "" {
+			offsetPolicy := cmp.Or(jpegidCmd.OffsetPolicy, offsetRequire)
+			if location := offsetLocation(offsetPolicy); location != nil {
+				jpegidCmd.logger.Info("dates without a timezone offset are assumed to be in "+location.String(), slog.String("policy", offsetPolicy))
+			} else {
+				jpegidCmd.logger.Info("dates without a timezone offset are reported as errors", slog.String("policy", offsetPolicy))
+			}
+		}
+		pluginsDir := jpegidCmd.PluginsDir
+		if pluginsDir == "" {
+			pluginsDir, err = defaultPluginsDir()
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		plugins, err := discoverPlugins(pluginsDir, jpegidCmd.Stderr)
+		if err != nil {
+			yield(RenameResult{}, err)
+			return
+		}
+		var namerPlugin pluginInfo
+		if jpegidCmd.Namer != "" {
+			namerPlugin, err = findPlugin(plugins, jpegidCmd.Namer, "namer")
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		var tracer *protocolTracer
+		switch jpegidCmd.TraceExifTool {
+		case "":
+		case "-":
+			tracer = &protocolTracer{w: jpegidCmd.Stderr}
+		default:
+			traceFile, err := os.Create(jpegidCmd.TraceExifTool)
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+			defer traceFile.Close()
+			tracer = &protocolTracer{w: traceFile}
+		}
+		newExtractor, err := jpegidCmd.extractorFunc(plugins, tracer)
+		if err != nil {
+			yield(RenameResult{}, err)
+			return
+		}
+		var newOffsetClient func() (ExifToolClient, error)
+		if jpegidCmd.WriteOffset && !jpegidCmd.DryRun {
+			newOffsetClient = jpegidCmd.NewExifToolClient
+			if newOffsetClient == nil {
+				version, err := GetExifToolVersion()
+				if err != nil {
+					yield(RenameResult{}, err)
+					return
+				}
+				commonArgs := version.CommonArgs()
+				newOffsetClient = func() (ExifToolClient, error) {
+					return startExifToolClient(jpegidCmd.Stderr, tracer, commonArgs...)
+				}
+			}
+		}
+		rootGroups, err := jpegidCmd.rootGroups(ctx)
+		if err != nil {
+			yield(RenameResult{}, err)
+			return
+		}
+		var state *scanState
+		if jpegidCmd.Incremental {
+			stateDir := jpegidCmd.StateDir
+			if stateDir == "" {
+				stateDir, err = defaultStateDir()
+				if err != nil {
+					yield(RenameResult{}, err)
+					return
+				}
+			}
+			state, err = loadScanState(stateDir, jpegidCmd.Roots)
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		hookSemaphore := make(chan struct{}, max(jpegidCmd.ExecWorkers, 1))
+		var dirTimes *dirModTimes
+		if jpegidCmd.PreserveDirModTimes && !jpegidCmd.DryRun {
+			dirTimes = &dirModTimes{modTimes: make(map[string]time.Time)}
+		}
+		var quarantine *fileQuarantine
+		if jpegidCmd.QuarantineDir != "" {
+			quarantine = &fileQuarantine{dir: jpegidCmd.QuarantineDir}
+		}
+		resolver := newCollisionResolver(jpegidCmd.OnCollision, jpegidCmd.Stdin, jpegidCmd.Stderr)
+		// Renames and stats are given up on once the run is cancelled or
+		// they take longer than OpTimeout. Copies, which take as long as
+		// the file is large, stop once the run is cancelled.
+		resolver.move = func(oldPath, newPath string) error {
+			return resolver.moveWithin(ctx, jpegidCmd.OpTimeout, newPath, func() error {
+				return os.Rename(oldPath, newPath)
+			})
+		}
+		resolver.lstat = func(path string) (fs.FileInfo, error) {
+			ctx, cancel := opContext(ctx, jpegidCmd.OpTimeout)
+			defer cancel()
+			return runContext(ctx, func() (fs.FileInfo, error) {
+				return os.Lstat(path)
+			})
+		}
+		if jpegidCmd.CopyTo != "" {
+			options := copyOptions{mode: jpegidCmd.PreserveMode, ownership: jpegidCmd.PreserveOwnership}
+			if jpegidCmd.BandwidthLimit > 0 {
+				options.limiter = &rateLimiter{rate: float64(jpegidCmd.BandwidthLimit)}
+			}
+			resolver.move = func(oldPath, newPath string) error {
+				return copyFile(ctx, oldPath, newPath, options)
+			}
+			err = jpegidCmd.checkCopySpace(ctx, state)
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		var library *libraryIndex
+		if jpegidCmd.MergeInto != "" {
+			resolver.move = func(oldPath, newPath string) error {
+				return moveFile(ctx, oldPath, newPath)
+			}
+			library, err = loadLibraryIndex(ctx, jpegidCmd.MergeInto, jpegidCmd.HashMode)
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		if journal := jpegidCmd.journal; journal != nil {
+			// Every intent is followed by its outcome as soon as it is
+			// known, whether or not its result is yielded, so that a
+			// cancelled run leaves a journal recovery can skip.
+			move := resolver.move
+			resolver.move = func(oldPath, newPath string) error {
+				if ctx.Err() != nil {
+					return context.Cause(ctx)
+				}
+				err := journal.intend(jpegidCmd.Now(), oldPath, newPath)
+				if err != nil {
+					return fmt.Errorf("journal: %w", err)
+				}
+				err = move(oldPath, newPath)
+				var journalErr error
+				switch {
+				case err == nil:
+					journalErr = journal.rename(jpegidCmd.Now(), oldPath, newPath)
+				case errors.Is(err, ErrTimedOut) || ctx.Err() != nil:
+					// Given up on, the rename may yet happen: left to
+					// recovery.
+				default:
+					journalErr = journal.fail(jpegidCmd.Now(), oldPath, newPath)
+				}
+				if journalErr != nil {
+					fmt.Fprintf(jpegidCmd.Stderr, "warning: journal: %v\n", journalErr)
+				}
+				return err
+			}
+		}
+		var sampled map[string]bool
+		if jpegidCmd.Sample > 0 {
+			sampled, err = jpegidCmd.sample(ctx, state)
+			if err != nil {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		var pairs *pairIndex
+		if jpegidCmd.LivePhotos || jpegidCmd.PairEdits {
+			pairs = &pairIndex{dirs: make(map[string]map[string]bool)}
+		}
+		var remaining atomic.Int64
+		remaining.Store(int64(jpegidCmd.Limit))
+		matched := make(map[string]*atomic.Int64, len(jpegidCmd.Roots))
+		for _, root := range jpegidCmd.Roots {
+			matched[root] = new(atomic.Int64)
+		}
+		pipeline := &renamePipeline{
+			jpegidCmd: jpegidCmd,
+			// The outcome of a file that was worked on is never dropped,
+			// as it may have been renamed already: report drains results
+			// until every worker is done.
+			send: func(result renameResult) bool {
+				results <- result
+				return true
+			},
+			newExtractor:  newExtractor,
+			resolver:      resolver,
+			library:       library,
+			quarantine:    quarantine,
+			dirTimes:      dirTimes,
+			hookSemaphore: hookSemaphore,
+		}
+		monitor := jpegidCmd.workers
+		if monitor == nil {
+			monitor = &workerMonitor{}
+		}
+		stageBuffer := cmp.Or(jpegidCmd.StageBuffer, defaultStageBuffer)
+		for groupIndex, rootGroup := range rootGroups {
+			renameJobs := make(chan renameJob, stageBuffer)
+			extracted := make(chan stageItem, stageBuffer)
+			planned := make(chan stageItem, stageBuffer)
+			// The resources of the workers are started up front, so that
+			// failing to start one fails the run before any file is
+			// renamed.
+			extractors := make([]MetadataExtractor, 0, rootGroup.numWorkers)
+			namers := make([]*pluginNamer, cmp.Or(jpegidCmd.PlanWorkers, rootGroup.numWorkers))
+			writers := make([]*offsetWriter, cmp.Or(jpegidCmd.RenameWorkers, rootGroup.numWorkers))
+			closeExtractors := func() {
+				for _, extractor := range extractors {
+					err := extractor.Close()
+					if err != nil {
+						jpegidCmd.logger.Warn(err.Error())
+					}
+				}
+			}
+			closeNamers := func() {
+				for _, namer := range namers {
+					if namer != nil {
+						_ = namer.client.Close()
+					}
+				}
+			}
+			closeWriters := func() {
+				for _, writer := range writers {
+					if writer != nil {
+						_ = writer.Close()
+					}
+				}
+			}
+			closeWorkers := func() {
+				closeExtractors()
+				closeNamers()
+				closeWriters()
+			}
+			for range rootGroup.numWorkers {
+				extractor, err := newExtractor()
+				if err != nil {
+					closeWorkers()
+					cancel()
+					waitGroup.Wait()
+					yield(RenameResult{}, err)
+					return
+				}
+				extractors = append(extractors, extractor)
+			}
+			if jpegidCmd.Namer != "" {
+				for i := range namers {
+					client, _, err := startPlugin(namerPlugin.Path, jpegidCmd.Stderr)
+					if err != nil {
+						closeWorkers()
+						cancel()
+						waitGroup.Wait()
+						yield(RenameResult{}, err)
+						return
+					}
+					namers[i] = &pluginNamer{client: client}
+				}
+			}
+			if newOffsetClient != nil {
+				for i := range writers {
+					writers[i] = &offsetWriter{newClient: newOffsetClient}
+				}
+			}
+			// The time an extract or plan worker is blocked on the next
+			// stage is not counted against it.
+			extractTrace := jpegidCmd.tracer.stage("extract", groupIndex)
+			extractWorkers := make([]func(renameJob) bool, len(extractors))
+			for i := range extractors {
+				stats := monitor.add("extract", groupIndex, i)
+				stats.batch = extractTrace.batch()
+				extractWorkers[i] = func(job renameJob) bool {
+					end := stats.begin(job.filePath)
+					item, ok := pipeline.extract(ctx, &extractors[i], stats, job)
+					end()
+					return !ok || forward(ctx, extracted, item)
+				}
+			}
+			planTrace := jpegidCmd.tracer.stage("plan", groupIndex)
+			planWorkers := make([]func(stageItem) bool, len(namers))
+			for i, namer := range namers {
+				stats := monitor.add("plan", groupIndex, i)
+				stats.batch = planTrace.batch()
+				planWorkers[i] = func(item stageItem) bool {
+					end := stats.begin(item.job.filePath)
+					item, ok := pipeline.plan(ctx, namer, item)
+					end()
+					return !ok || forward(ctx, planned, item)
+				}
+			}
+			executeTrace := jpegidCmd.tracer.stage("execute", groupIndex)
+			executeWorkers := make([]func(stageItem) bool, len(writers))
+			for i, writer := range writers {
+				stats := monitor.add("execute", groupIndex, i)
+				stats.batch = executeTrace.batch()
+				executeWorkers[i] = func(item stageItem) bool {
+					defer stats.begin(item.job.filePath)()
+					return pipeline.execute(ctx, writer, item)
+				}
+			}
+			runStage(ctx, &waitGroup, extractWorkers, renameJobs, func() {
+				closeExtractors()
+				extractTrace.end()
+				close(extracted)
+			})
+			runStage(ctx, &waitGroup, planWorkers, extracted, func() {
+				closeNamers()
+				planTrace.end()
+				close(planned)
+			})
+			runStage(ctx, &waitGroup, executeWorkers, planned, func() {
+				closeWriters()
+				executeTrace.end()
+			})
+			// Each group is walked concurrently, so give each its own
+			// source of padding to keep names reproducible.
+			random := jpegidCmd.Rand
+			if len(rootGroups) > 1 {
+				random = rand.New(rand.NewPCG(jpegidCmd.Rand.Uint64(), jpegidCmd.Rand.Uint64()))
+			}
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				defer close(renameJobs)
+				seq := 0
+				walk := func(fn func(root, filePath string, skip error) error) error {
+					return jpegidCmd.walkGroup(ctx, rootGroup.roots, state, matched, fn)
+				}
+				if jpegidCmd.FilesFrom != "" {
+					walk = func(fn func(root, filePath string, skip error) error) error {
+						return jpegidCmd.walkFileList(ctx, state, fn)
+					}
+				}
+				err := walk(func(root, filePath string, skip error) error {
+					if skip != nil {
+						result := RenameResult{Root: root, FilePath: filePath}
+						if errors.Is(skip, ErrAlreadyNamed) {
+							result.NewFilePath = filePath
+						}
+						if !send(renameResult{result: result, err: skip, group: groupIndex, seq: seq}) {
+							return ctx.Err()
+						}
+						seq++
+						return nil
+					}
+					if sampled != nil && !sampled[filePath] {
+						return nil
+					}
+					if pairs != nil {
+						if primary := jpegidCmd.primaryOf(pairs, filePath); primary != "" {
+							if !send(renameResult{result: RenameResult{Root: root, FilePath: filePath}, err: fmt.Errorf("%w: %s", ErrPaired, primary), group: groupIndex, seq: seq}) {
+								return ctx.Err()
+							}
+							seq++
+							return nil
+						}
+					}
+					if jpegidCmd.Limit > 0 && remaining.Add(-1) < 0 {
+						return fs.SkipAll
+					}
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case renameJobs <- renameJob{root: root, filePath: filePath, padding: time.Duration(random.IntN(1000)) * time.Millisecond, group: groupIndex, seq: seq}:
+					}
+					seq++
+					return nil
+				})
+				if err != nil {
+					if !errors.Is(err, context.Canceled) {
+						send(renameResult{err: err, seq: -1})
+					}
+					return
+				}
+				send(renameResult{group: groupIndex, seq: seq, end: true})
+			}()
+		}
+		go func() {
+			waitGroup.Wait()
+			if dirTimes != nil {
+				for _, err := range dirTimes.restore() {
+					jpegidCmd.logger.Error(err.Error())
+				}
+			}
+			close(results)
+		}()
+		stopped, failed := false, false
+		// recorded is the number of files recorded in state, which is
+		// saved every ChunkSize of them.
+		recorded := 0
+		deliver := func(result renameResult) {
+			if stopped || failed {
+				return
+			}
+			if !yield(result.result, result.err) {
+				stopped = true
+				cancel()
+				return
+			}
+			if result.err != nil && result.result.FilePath == "" {
+				failed = true
+				cancel()
+			}
+		}
+		// Results are held back until every result before them in walk
+		// order has been yielded. Groups are yielded one after another.
+		pending := make(map[[2]int]renameResult)
+		groupEnds := make(map[int]int)
+		currentGroup, nextSeq := 0, 0
+		for result := range results {
+			if result.seq < 0 {
+				deliver(result)
+				continue
+			}
+			if result.end {
+				groupEnds[result.group] = result.seq
+			} else {
+				if state != nil {
+					state.record(result.result, result.err)
+					recorded++
+					if jpegidCmd.ChunkSize > 0 && recorded%jpegidCmd.ChunkSize == 0 && !jpegidCmd.DryRun {
+						err := state.save(false)
+						if err != nil {
+							fmt.Fprintf(jpegidCmd.Stderr, "warning: state: %v\n", err)
+						}
+					}
+				}
+				pending[[2]int{result.group, result.seq}] = result
+			}
+			for currentGroup < len(rootGroups) {
+				key := [2]int{currentGroup, nextSeq}
+				if result, ok := pending[key]; ok {
+					delete(pending, key)
+					deliver(result)
+					nextSeq++
+					continue
+				}
+				if end, ok := groupEnds[currentGroup]; ok && end == nextSeq {
+					currentGroup, nextSeq = currentGroup+1, 0
+					continue
+				}
+				break
+			}
+		}
+		// Files dropped once the run is cancelled hold back those after
+		// them, which may have been renamed, so yield them all the same.
+		for _, key := range slices.SortedFunc(maps.Keys(pending), func(a, b [2]int) int {
+			return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1]))
+		}) {
+			deliver(pending[key])
+		}
+		if state != nil && !jpegidCmd.DryRun {
+			err := state.save(ctx.Err() == nil)
+			if err != nil && !stopped {
+				yield(RenameResult{}, err)
+				return
+			}
+		}
+		if stopped || failed || ctx.Err() != nil || jpegidCmd.FilesFrom != "" {
+			return
+		}
+		var total int64
+		for _, root := range jpegidCmd.Roots {
+			n := matched[root].Load()
+			if n == 0 && len(jpegidCmd.Roots) > 1 {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: no files matched in %s\n", root)
+			}
+			total += n
+		}
+		if total == 0 {
+			var hints []string
+			defaultPatterns := len(jpegidCmd.FileRegexps) == 1 && jpegidCmd.FileRegexps[0] == defaultFileRegexp
+			if !jpegidCmd.IgnoreCase && !defaultPatterns {
+				hints = append(hints, "patterns are case-sensitive, use -ignore-case to match e.g. IMG_0001.JPG")
+			}
+			if !jpegidCmd.Recursive {
+				hints = append(hints, "subdirectories are skipped, use -recursive to include them")
+			}
+			if len(hints) == 0 {
+				yield(RenameResult{}, ErrNothingMatched)
+				return
+			}
+			yield(RenameResult{}, fmt.Errorf("%w (%s)", ErrNothingMatched, strings.Join(hints, "; ")))
+		}
+	}
+}
+
+// walkRoot calls fn in lexical order with every file under root. Files that
+// should be renamed, that is files matching FileRegexps or PathRegexps that
+// are old enough and, if state is not nil, have changed since the last run,
+// are passed with a nil skip. The rest are passed with ErrExcluded, ErrTooNew
+// or ErrUnchanged. If matched is not nil, it is incremented for every file
+// matching the patterns. fn may return fs.SkipAll to stop the walk early.
+func (jpegidCmd *JpegIDCmd) walkRoot(ctx context.Context, root string, state *scanState, matched *atomic.Int64, fn func(filePath string, dirEntry fs.DirEntry, skip error) error) error {
+	err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			if path != "." && errors.Is(err, fs.ErrNotExist) {
+				// A directory removed since it was listed.
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if dirEntry.IsDir() {
+			if path != "." && (!jpegidCmd.Recursive || isNASMetadataDir(dirEntry.Name())) {
+				return fs.SkipDir
+			}
+			if dir := filepath.Join(root, path); dir == jpegidCmd.QuarantineDir || dir == jpegidCmd.destDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		name := dirEntry.Name()
+		if path == libraryMarkerName || path == libraryMarkerName+".tmp" {
+			return nil
+		}
+		filePath := filepath.Join(root, path)
+		if !slices.ContainsFunc(jpegidCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+			return fileRegexp.MatchString(name)
+		}) && !slices.ContainsFunc(jpegidCmd.PathRegexps, func(pathRegexp *regexp.Regexp) bool {
+			return pathRegexp.MatchString(path)
+		}) {
+			return fn(filePath, dirEntry, ErrExcluded)
+		}
+		if matched != nil {
+			matched.Add(1)
+		}
+		if jpegidCmd.MinAge > 0 || state != nil || jpegidCmd.namedRegexp != nil {
+			fileInfo, err := dirEntry.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return fn(filePath, dirEntry, ErrVanished)
+				}
+				return nil
+			}
+			return fn(filePath, dirEntry, jpegidCmd.checkFile(state, root, filePath, fileInfo))
+		}
+		return fn(filePath, dirEntry, nil)
+	})
+	if errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// checkFile returns ErrAlreadyNamed, ErrTooNew or ErrUnchanged if a file
+// matching the include patterns should nonetheless be skipped.
+func (jpegidCmd *JpegIDCmd) checkFile(state *scanState, root, filePath string, fileInfo fs.FileInfo) error {
+	if jpegidCmd.namedRegexp != nil {
+		path, err := filepath.Rel(root, filePath)
+		if err == nil && jpegidCmd.namedRegexp.MatchString(filepath.ToSlash(path)) {
+			return ErrAlreadyNamed
+		}
+	}
+	if jpegidCmd.MinAge > 0 && jpegidCmd.Now().Sub(fileInfo.ModTime()) < jpegidCmd.MinAge {
+		return ErrTooNew
+	}
+	if state != nil {
+		path, err := filepath.Rel(root, filePath)
+		if err == nil && state.unchanged(root, filepath.ToSlash(path), fileInfo) {
+			return ErrUnchanged
+		}
+	}
+	return nil
+}
+
+// walkGroup calls fn with every file in roots as walkRoot does, with the
+// files to be renamed in the order given by Order. Ordering by anything other
+// than path means listing every file before the first one to be renamed is
+// passed to fn; skipped files are passed as they are found. fn may return
+// fs.SkipAll to stop the walk of every remaining root.
+func (jpegidCmd *JpegIDCmd) walkGroup(ctx context.Context, roots []string, state *scanState, matched map[string]*atomic.Int64, fn func(root, filePath string, skip error) error) error {
+	if jpegidCmd.Order == "" || jpegidCmd.Order == "path" {
+		// walkRoot ends only its own walk on fs.SkipAll, so remember it to
+		// stop before the next root.
+		stopped := false
+		for _, root := range roots {
+			err := jpegidCmd.walkRoot(ctx, root, state, matched[root], func(filePath string, dirEntry fs.DirEntry, skip error) error {
+				err := fn(root, filePath, skip)
+				if errors.Is(err, fs.SkipAll) {
+					stopped = true
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if stopped {
+				return nil
+			}
+		}
+		return nil
+	}
+	type file struct {
+		root     string
+		filePath string
+		fileInfo fs.FileInfo
+	}
+	var files []file
+	for _, root := range roots {
+		err := jpegidCmd.walkRoot(ctx, root, state, matched[root], func(filePath string, dirEntry fs.DirEntry, skip error) error {
+			if skip != nil {
+				return fn(root, filePath, skip)
+			}
+			fileInfo, err := dirEntry.Info()
+			if err != nil {
+				return nil
+			}
+			files = append(files, file{root: root, filePath: filePath, fileInfo: fileInfo})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	slices.SortStableFunc(files, func(a, b file) int {
+		switch jpegidCmd.Order {
+		case "mtime":
+			return a.fileInfo.ModTime().Compare(b.fileInfo.ModTime())
+		default:
+			return cmp.Compare(a.fileInfo.Size(), b.fileInfo.Size())
+		}
+	})
+	for _, file := range files {
+		err := fn(file.root, file.filePath, nil)
+		if err != nil {
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sample picks Sample files at random from all the roots, using reservoir
+// sampling so that the whole list never has to be held in memory.
+func (jpegidCmd *JpegIDCmd) sample(ctx context.Context, state *scanState) (map[string]bool, error) {
+	reservoir := make([]string, 0, jpegidCmd.Sample)
+	n := 0
+	for _, root := range jpegidCmd.Roots {
+		err := jpegidCmd.walkRoot(ctx, root, state, nil, func(filePath string, dirEntry fs.DirEntry, skip error) error {
+			if skip != nil {
+				return nil
+			}
+			n++
+			if len(reservoir) < jpegidCmd.Sample {
+				reservoir = append(reservoir, filePath)
+			} else if i := jpegidCmd.Rand.IntN(n); i < jpegidCmd.Sample {
+				reservoir[i] = filePath
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sampled := make(map[string]bool, len(reservoir))
+	for _, filePath := range reservoir {
+		sampled[filePath] = true
+	}
+	return sampled, nil
+}
+
+// preflight checks for problems that would make every rename fail.
+func (jpegidCmd *JpegIDCmd) preflight() error {
+	if jpegidCmd.SetBirthtime && !birthtimeSupported {
+		return fmt.Errorf("-set-birthtime is not supported on %s", runtime.GOOS)
+	}
+	if jpegidCmd.CopyTo != "" {
+		if jpegidCmd.DryRun {
+			return nil
+		}
+		err := makeDirs(jpegidCmd.CopyTo, jpegidCmd.DirMode)
+		if err == nil {
+			err = checkWritable(jpegidCmd.CopyTo)
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", jpegidCmd.CopyTo, err)
+		}
+		return nil
+	}
+	if jpegidCmd.MergeInto != "" && !jpegidCmd.DryRun {
+		err := makeDirs(jpegidCmd.MergeInto, jpegidCmd.DirMode)
+		if err == nil {
+			err = checkWritable(jpegidCmd.MergeInto)
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", jpegidCmd.MergeInto, err)
+		}
+	}
+	if !jpegidCmd.DryRun && jpegidCmd.FilesFrom == "" {
+		var errs []error
+		for _, root := range jpegidCmd.Roots {
+			err := checkWritable(root)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("root %s is not writable: %w", root, err))
+			}
+		}
+		if len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+	}
+	return nil
+}
+
+// extractorFunc returns a function that creates the MetadataExtractor for
+// each worker. Metadata plugins take precedence for the extensions they
+// handle. The exiftool protocol is traced to tracer if not nil.
+func (jpegidCmd *JpegIDCmd) extractorFunc(plugins []pluginInfo, tracer *protocolTracer) (func() (MetadataExtractor, error), error) {
+	var newExtractor func() (MetadataExtractor, error)
+	switch jpegidCmd.Backend {
+	case "", "exiftool":
+		newExifToolClient := jpegidCmd.NewExifToolClient
+		if newExifToolClient == nil {
+			version, err := GetExifToolVersion()
+			if err != nil {
+				return nil, err
+			}
+			jpegidCmd.logger.Info("detected exiftool version", slog.String("version", version.String()))
+			if version.Less(MinExifToolVersion) {
+				fmt.Fprintf(jpegidCmd.Stderr, "warning: exiftool %s is older than the minimum supported version %s, some files may be missing metadata\n", version, MinExifToolVersion)
+			}
+			commonArgs := version.CommonArgs()
+			newExifToolClient = func() (ExifToolClient, error) {
+				return startExifToolClient(jpegidCmd.Stderr, tracer, commonArgs...)
+			}
+		}
+		newExtractor = func() (MetadataExtractor, error) {
+			return NewExifToolExtractor(newExifToolClient)
+		}
+	case "exiv2":
+		newExtractor = func() (MetadataExtractor, error) {
+			return NewExiv2Extractor()
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", jpegidCmd.Backend)
+	}
+	if jpegidCmd.MetadataCache {
+		cache, err := openMetadataCache(jpegidCmd.MetadataCacheDir)
+		if err != nil {
+			return nil, err
+		}
+		backend := cmp.Or(jpegidCmd.Backend, "exiftool")
+		newBackendExtractor := newExtractor
+		newExtractor = func() (MetadataExtractor, error) {
+			extractor, err := newBackendExtractor()
+			if err != nil {
+				return nil, err
+			}
+			return &cachedExtractor{cache: cache, backend: backend, extractor: extractor}, nil
+		}
+	}
+	if len(jpegidCmd.FFprobeExtensions) > 0 {
+		newBackendExtractor := newExtractor
+		newExtractor = func() (MetadataExtractor, error) {
+			fallback, err := newBackendExtractor()
+			if err != nil {
+				return nil, err
+			}
+			ffprobe, err := NewFFprobeExtractor()
+			if err != nil {
+				_ = fallback.Close()
+				return nil, err
+			}
+			extractor := &extensionExtractor{
+				extractors: make(map[string]MetadataExtractor),
+				fallback:   fallback,
+			}
+			for _, ext := range jpegidCmd.FFprobeExtensions {
+				extractor.extractors[ext] = ffprobe
+			}
+			return extractor, nil
+		}
+	}
+	for _, plugin := range plugins {
+		if !slices.Contains(plugin.Provides, "metadata") || len(plugin.Extensions) == 0 {
+			continue
+		}
+		jpegidCmd.logger.Info("using metadata plugin", slog.String("plugin", plugin.Name), slog.Any("extensions", plugin.Extensions))
+		newNextExtractor := newExtractor
+		newExtractor = func() (MetadataExtractor, error) {
+			fallback, err := newNextExtractor()
+			if err != nil {
+				return nil, err
+			}
+			client, _, err := startPlugin(plugin.Path, jpegidCmd.Stderr)
+			if err != nil {
+				_ = fallback.Close()
+				return nil, err
+			}
+			extractor := &extensionExtractor{
+				extractors: make(map[string]MetadataExtractor),
+				fallback:   fallback,
+			}
+			pluginExtractor := &pluginExtractor{client: client}
+			for _, ext := range plugin.Extensions {
+				extractor.extractors[ext] = pluginExtractor
+			}
+			return extractor, nil
+		}
+	}
+	if jpegidCmd.PlatformFallback {
+		_, err := newPlatformExtractor()
+		if err != nil {
+			return nil, err
+		}
+		newPrimaryExtractor := newExtractor
+		newExtractor = func() (MetadataExtractor, error) {
+			primary, err := newPrimaryExtractor()
+			if err != nil {
+				return nil, err
+			}
+			fallback, err := newPlatformExtractor()
+			if err != nil {
+				_ = primary.Close()
+				return nil, err
+			}
+			return &fallbackExtractor{primary: primary, fallback: fallback, dateTags: jpegidCmd.dateTags()}, nil
+		}
+	}
+	return newExtractor, nil
+}
+
+// rootGroup is a set of roots that share a pool of workers.
+type rootGroup struct {
+	roots      []string
+	numWorkers int
+}
+
+// rootGroups splits the roots by device. Roots on a device listed in
+// DeviceWorkers get a dedicated pool of workers, as do the roots on every
+// other device with AutoWorkers, while all other roots share a pool of
+// NumWorkers.
+func (jpegidCmd *JpegIDCmd) rootGroups(ctx context.Context) ([]rootGroup, error) {
+	if (len(jpegidCmd.DeviceWorkers) == 0 && !jpegidCmd.AutoWorkers) || jpegidCmd.FilesFrom != "" {
+		return []rootGroup{{roots: jpegidCmd.Roots, numWorkers: jpegidCmd.NumWorkers}}, nil
+	}
+	deviceWorkers := make(map[string]int)
+	for path, numWorkers := range jpegidCmd.DeviceWorkers {
+		device, err := deviceID(path)
+		if err != nil {
+			return nil, err
+		}
+		deviceWorkers[device] = numWorkers
+	}
+	defaultGroup := rootGroup{numWorkers: jpegidCmd.NumWorkers}
+	var deviceGroups []rootGroup
+	deviceGroupIndex := make(map[string]int)
+	for _, root := range jpegidCmd.Roots {
+		device, err := deviceID(root)
+		if err != nil {
+			return nil, err
+		}
+		jpegidCmd.logger.Info("detected device", slog.String("root", root), slog.String("device", device))
+		numWorkers, ok := deviceWorkers[device]
+		if !ok && jpegidCmd.AutoWorkers {
+			numWorkers = jpegidCmd.NumWorkers
+			kind, latency, probed := jpegidCmd.probeStorage(ctx, root)
+			if probed {
+				numWorkers = storageWorkers(kind)
+				jpegidCmd.logger.Info("probed storage", slog.String("root", root), slog.String("kind", kind), slog.Duration("latency", latency), slog.Int("numWorkers", numWorkers))
+			} else {
+				jpegidCmd.logger.Info("unable to tell the kind of storage", slog.String("root", root), slog.Int("numWorkers", numWorkers))
+			}
+			deviceWorkers[device], ok = numWorkers, true
+		}
+		if !ok {
+			defaultGroup.roots = append(defaultGroup.roots, root)
+			continue
+		}
+		i, ok := deviceGroupIndex[device]
+		if !ok {
+			i = len(deviceGroups)
+			deviceGroupIndex[device] = i
+			deviceGroups = append(deviceGroups, rootGroup{numWorkers: numWorkers})
+		}
+		deviceGroups[i].roots = append(deviceGroups[i].roots, root)
+	}
+	if len(defaultGroup.roots) == 0 {
+		return deviceGroups, nil
+	}
+	return append([]rootGroup{defaultGroup}, deviceGroups...), nil
+}
+
+var (
+	// ErrNoMetadata is returned when a file has no metadata that can be used
+	// to determine its creation time.
+	ErrNoMetadata = errors.New("unable to fetch file creation time")
+
+	// ErrCollision is returned when a file with the new name already exists
+	// and the collision policy is to skip it.
+	ErrCollision = errors.New("file already exists")
+
+	// ErrCorrupt is returned for a JPEG that is structurally broken, with
+	// CheckCorrupt set.
+	ErrCorrupt = errors.New("corrupt JPEG")
+
+	// ErrOutputTooLarge is returned when exiftool prints more metadata for a
+	// file than is kept in memory.
+	ErrOutputTooLarge = fmt.Errorf("output larger than %d MiB", maxExifToolOutput>>20)
+
+	// ErrImplausibleDate is returned when the creation time of a file is
+	// too old, in the future or a camera's default date.
+	ErrImplausibleDate = errors.New("implausible date")
+
+	// ErrDuplicate is returned when the contents of a file are already in
+	// the MergeInto library.
+	ErrDuplicate = errors.New("already in the library")
+
+	// ErrInsufficientSpace is returned when files to be copied don't fit in
+	// the free space of the destination.
+	ErrInsufficientSpace = errors.New("not enough free space")
+
+	// ErrPathTooLong is returned when the new path of a file is longer than
+	// the platform allows.
+	ErrPathTooLong = errors.New("path too long")
+
+	// ErrAlreadyNamed is returned for a file that already has the name it
+	// would be renamed to, or a name matching the naming scheme.
+	ErrAlreadyNamed = errors.New("already named")
+
+	// ErrExcluded is returned for a file that matches none of the include
+	// patterns.
+	ErrExcluded = errors.New("excluded by pattern")
+
+	// ErrTooNew is returned for a file modified less than MinAge ago.
+	ErrTooNew = errors.New("modified too recently")
+
+	// ErrUnchanged is returned for a file that has not changed since it was
+	// processed by a previous Incremental run.
+	ErrUnchanged = errors.New("unchanged since the last run")
+
+	// ErrNothingMatched is returned at the end of a run in which no file in
+	// any root matched the include patterns.
+	ErrNothingMatched = errors.New("no files matched")
+
+	// ErrVetoed is returned when the ExecBefore command exits with a
+	// non-zero status for a file.
+	ErrVetoed = errors.New("rename vetoed by -exec-before")
+
+	// ErrPaired is returned for a file that is renamed along with another
+	// one, such as the video of a Live Photo with LivePhotos.
+	ErrPaired = errors.New("renamed along with its pair")
+
+	// ErrVanished is returned for a file that was deleted or moved away,
+	// such as by another process syncing the roots, between being found
+	// and being renamed.
+	ErrVanished = errors.New("vanished since it was found")
+
+	// ErrChanged is returned by apply for a file that is no longer the
+	// one its plan was made for.
+	ErrChanged = errors.New("changed since the plan was made")
+
+	// ErrReplacesPending is returned by Simulate for a file that would
+	// replace, under the replace collision policy, a file that is renamed
+	// later in the run.
+	ErrReplacesPending = errors.New("would replace a file renamed later in the run")
+
+	// ErrTimedOut is returned for a file operation that took longer than
+	// OpTimeout.
+	ErrTimedOut = errors.New("timed out")
+
+	// ErrUnsupportedFormat is returned when exiftool does not recognize the
+	// format of a file.
+	ErrUnsupportedFormat = errors.New("unsupported file format")
+)
+
+// ExifToolError is returned when the output of exiftool for a file could not
+// be understood. Output contains the raw output of exiftool.
+type ExifToolError struct {
+	FilePath string
+	Output   string
+	Err      error
+}
+
+func (exifToolErr *ExifToolError) Error() string {
+	return "exiftool: " + exifToolErr.Err.Error()
+}
+
+func (exifToolErr *ExifToolError) Unwrap() error {
+	return exifToolErr.Err
+}
+
+type Exif struct {
+	FileSize               string
+	SubSecDateTimeOriginal string
+	CreateDate             string
+	TimeZone               string
+	Error                  string `json:",omitempty"`
+
+	// Tags holds every tag reported by backends that can read arbitrary
+	// tags, such as exiftool.
+	Tags map[string]string `json:"-"`
+}
+
+// fileNameLayout is the time layout of the names given to files.
+const fileNameLayout = "2006-01-02T150405.000-0700"
+
+// secondsFileNameLayout is the time layout of the names given to files with
+// -precision seconds.
+const secondsFileNameLayout = "2006-01-02T150405-0700"
+
+// Precisions for Precision.
+const (
+	precisionMillis  = "millis"
+	precisionSeconds = "seconds"
+)
+
+// parseFileName returns the creation time encoded in a file name produced by
+// jpegid, with either precision.
+func parseFileName(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	for _, layout := range []string{fileNameLayout, secondsFileNameLayout} {
+		if len(name) < len(layout) {
+			continue
+		}
+		creationTime, err := time.Parse(layout, name[:len(layout)])
+		if err == nil {
+			return creationTime, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// fileNameLayout returns the time layout of new names for Precision.
+func (jpegidCmd *JpegIDCmd) fileNameLayout() string {
+	if jpegidCmd.Precision == precisionSeconds {
+		return secondsFileNameLayout
+	}
+	return fileNameLayout
+}
+
+// MetadataExtractor extracts metadata from files. A MetadataExtractor is
+// used by only one worker at a time.
+type MetadataExtractor interface {
+	Extract(filePath string) (Exif, error)
+	Close() error
+}
+
+// planRename works out the new name of filePath from the creation time in
+// the first of the date tags found in exif. Creation times without
+// sub-second precision are padded by padding.
+func (jpegidCmd *JpegIDCmd) planRename(root, filePath string, exif Exif, padding time.Duration) (result RenameResult, err error) {
+	result.Root = root
+	result.FilePath = filePath
+	result.Exif = exif
+	result.Metadata = exif.Metadata()
+	if jpegidCmd.NameFromTag != "" {
+		name := sanitizeFileName(exif.Tag(jpegidCmd.NameFromTag))
+		if name == "" {
+			return result, fmt.Errorf("%w: no %s", ErrNoMetadata, jpegidCmd.NameFromTag)
+		}
+		result.NewFilePath = filepath.Join(filepath.Dir(filePath), name+filepath.Ext(filePath))
+		return result, nil
+	}
+	// The first date tag with a plausible date is used. Implausible dates
+	// fall back to the next date tag, or are only used with Force.
+	var date parsedDate
+	var implausibleErr error
+	for _, tag := range jpegidCmd.dateTags() {
+		if exif.Tag(tag) == "" {
+			continue
+		}
+		tagDate, err := dateFromTag(exif, tag, offsetLocation(jpegidCmd.OffsetPolicy), jpegidCmd.DSTPolicy, jpegidCmd.OffsetFromGPS)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", tag, err)
+		}
+		if reason := implausibleDate(tagDate.Time, jpegidCmd.Now()); reason != "" {
+			if jpegidCmd.Force && result.DateTag == "" {
+				date, result.DateTag = tagDate, tag
+				date.Warning = strings.TrimPrefix(date.Warning+"; implausible date "+tagDate.Time.Format(time.DateTime)+" ("+reason+")", "; ")
+				break
+			}
+			if implausibleErr == nil {
+				implausibleErr = fmt.Errorf("%w: %s is %s (%s, use -force to rename anyway)", ErrImplausibleDate, tag, tagDate.Time.Format(time.DateTime), reason)
+			}
+			continue
+		}
+		date, result.DateTag = tagDate, tag
+		break
+	}
+	if result.DateTag == "" {
+		if implausibleErr != nil {
+			return result, implausibleErr
+		}
+		return result, ErrNoMetadata
+	}
+	if result.DateTag != gpsDateTag && exif.Tag(gpsDateTag) != "" {
+		gpsDate, err := dateFromTag(exif, gpsDateTag, time.UTC, jpegidCmd.DSTPolicy, false)
+		if err == nil {
+			if drift := date.Time.Sub(gpsDate.Time).Abs(); drift > cmp.Or(jpegidCmd.GPSThreshold, defaultGPSThreshold) {
+				warning := fmt.Sprintf("%s differs from %s by %s", result.DateTag, gpsDateTag, drift.Round(time.Second))
+				if jpegidCmd.PreferGPS {
+					warning += ", using " + gpsDateTag
+					// Named in the offset of the camera, which is usually
+					// right even when its clock isn't.
+					gpsDate.Time = gpsDate.Time.In(date.Time.Location())
+					gpsDate.Warning = date.Warning
+					date, result.DateTag = gpsDate, gpsDateTag
+				}
+				date.Warning = strings.TrimPrefix(date.Warning+"; "+warning, "; ")
+			}
+		}
+	}
+	for _, trip := range jpegidCmd.Trips {
+		if !date.Time.Before(trip.From) && date.Time.Before(trip.To) {
+			date.Time = date.Time.In(trip.Location)
+			break
+		}
+	}
+	result.CreationTime = date.Time
+	result.Warning = date.Warning
+	if jpegidCmd.Precision == precisionSeconds {
+		// Collisions within the same second are left to OnCollision
+		// instead of being made unlikely by padding.
+		result.CreationTime = result.CreationTime.Truncate(time.Second)
+	} else if !date.HasSubsec {
+		result.CreationTime = result.CreationTime.Add(padding)
+	}
+	tmpl := jpegidCmd.NameTemplate
+	class := classifyFile(filePath, exif)
+	if route, ok := jpegidCmd.Routes[class]; ok {
+		tmpl = route
+	}
+	if rule, ok := jpegidCmd.extRule(filePath); ok && rule.tmpl != nil {
+		tmpl = rule.tmpl
+	}
+	if tmpl != nil {
+		data := nameData{Event: findEvent(jpegidCmd.Calendar, result.CreationTime), Class: class, Metadata: result.Metadata}
+		for _, field := range []*string{&data.Metadata.Make, &data.Metadata.Model, &data.Metadata.LensModel, &data.Metadata.ExposureTime} {
+			*field = sanitizeFileName(*field)
+		}
+		if metadata := result.Metadata; metadata.HasGPS {
+			data.Latitude = strconv.FormatFloat(metadata.Latitude, 'f', 5, 64)
+			data.Longitude = strconv.FormatFloat(metadata.Longitude, 'f', 5, 64)
+			data.Geohash = geohash(metadata.Latitude, metadata.Longitude, 8)
+		}
+		result.NewFilePath, err = executeNameTemplate(tmpl, jpegidCmd.Locale, jpegidCmd.fileNameLayout(), root, filePath, result.CreationTime, data)
+		if err != nil {
+			return result, err
+		}
+		return result, nil
+	}
+	result.NewFilePath = filepath.Join(filepath.Dir(filePath), result.CreationTime.Format(jpegidCmd.fileNameLayout())+filepath.Ext(filePath))
+	return result, nil
+}
+
+// normalizePath puts the part of newFilePath chosen by the naming scheme in
+// the Normalize form: the path relative to root with a NameTemplate, or the
+// base name otherwise. Directories that already exist may be in either form
+// and so are left alone.
+func (jpegidCmd *JpegIDCmd) normalizePath(root, newFilePath string) string {
+	if jpegidCmd.templated() {
+		relPath, err := filepath.Rel(root, newFilePath)
+		if err == nil {
+			return filepath.Join(root, normalize(relPath, jpegidCmd.Normalize))
+		}
+	}
+	return filepath.Join(filepath.Dir(newFilePath), normalize(filepath.Base(newFilePath), jpegidCmd.Normalize))
+}
+
+// dateTags returns DateTags, or defaultDateTags if it is empty.
+func (jpegidCmd *JpegIDCmd) dateTags() []string {
+	if len(jpegidCmd.DateTags) == 0 {
+		return defaultDateTags
+	}
+	return jpegidCmd.DateTags
+}
+
+// applyRename carries out a rename worked out by planRename, resolving any
+// collision with resolver, and returns the path the file was renamed to. If
+// dirTimes is not nil, the modification times of the directories touched are
+// recorded in it first. Creating the directories of the new path is given up
+// on once ctx is done or it takes longer than OpTimeout.
+func (jpegidCmd *JpegIDCmd) applyRename(ctx context.Context, result RenameResult, resolver *collisionResolver, dirTimes *dirModTimes) (string, error) {
+	if dirTimes != nil {
+		dirTimes.record(filepath.Dir(result.FilePath))
+		dirTimes.record(filepath.Dir(result.NewFilePath))
+	}
+	if jpegidCmd.templated() || jpegidCmd.destDir() != "" {
+		err := runOp(ctx, jpegidCmd.OpTimeout, func() error {
+			return makeDirs(filepath.Dir(result.NewFilePath), jpegidCmd.DirMode)
+		})
+		if err != nil {
+			return result.NewFilePath, err
+		}
+	}
+	newFilePath, err := resolver.rename(ctx, result.FilePath, result.NewFilePath, jpegidCmd.collisionPolicy(result.FilePath))
+	if err != nil {
+		return result.NewFilePath, err
+	}
+	if jpegidCmd.SetBirthtime && !result.CreationTime.IsZero() {
+		err = setBirthtime(newFilePath, result.CreationTime)
+		if err != nil {
+			return newFilePath, fmt.Errorf("renamed but unable to set birthtime: %w", err)
+		}
+	}
+	return newFilePath, nil
+}
+
+// dirModTimes remembers the original modification times of directories so
+// that they can be restored after their contents have been renamed.
+type dirModTimes struct {
+	mutex    sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// record remembers the modification time of dir, unless it has already been
+// recorded.
+func (dirModTimes *dirModTimes) record(dir string) {
+	dirModTimes.mutex.Lock()
+	defer dirModTimes.mutex.Unlock()
+	if _, ok := dirModTimes.modTimes[dir]; ok {
+		return
+	}
+	fileInfo, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	dirModTimes.modTimes[dir] = fileInfo.ModTime()
+}
+
+// restore sets every recorded directory back to its original modification
+// time.
+func (dirModTimes *dirModTimes) restore() []error {
+	dirModTimes.mutex.Lock()
+	defer dirModTimes.mutex.Unlock()
+	var errs []error
+	for dir, modTime := range dirModTimes.modTimes {
+		err := os.Chtimes(dir, time.Time{}, modTime)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// defaultFileExtensions are the extensions of the files included when no
+// -file or -glob pattern is given.
+var defaultFileExtensions = []string{
+	// Photos.
+	"jpg", "jpeg", "heic", "heif", "png", "tif", "tiff", "webp",
+	// Raw photos.
+	"dng", "cr2", "cr3", "nef", "arw", "orf", "rw2", "raf", "pef", "srw",
+	// Videos.
+	"mp4", "mov", "m4v", "3gp", "avi", "mts",
+}
+
+var defaultFileRegexp = regexp.MustCompile(`(?i)\.(` + strings.Join(defaultFileExtensions, "|") + `)$`)
+
+// compileRegexps compiles each pattern with compileRegexp, making them
+// case-insensitive if ignoreCase is true.
+func compileRegexps(patterns []string, ignoreCase bool) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, pattern := range patterns {
+		r, err := compileRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ignoreCase {
+			r, err = regexp.Compile("(?i)" + r.String())
+			if err != nil {
+				return nil, err
+			}
+		}
+		regexps = append(regexps, r)
+	}
+	return regexps, nil
 }
 
 func compileRegexp(pattern string) (*regexp.Regexp, error) {
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCmd parses args as the arguments of jpegid, with the output
+// discarded.
+func newTestCmd(t *testing.T, args ...string) *JpegIDCmd {
+	t.Helper()
+	jpegidCmd, err := JpegIDCommand(append([]string{"jpegid"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpegidCmd.Stdout, jpegidCmd.Stderr = io.Discard, io.Discard
+	return jpegidCmd
+}
+
+// fakeExifTool returns a NewExifToolClient for exiftools that answer with
+// the SubSecDateTimeOriginal of each file in dates.
+func fakeExifTool(dates map[string]string) func() (ExifToolClient, error) {
+	return func() (ExifToolClient, error) {
+		return newFakeExifToolClient(func(args []string) (string, error) {
+			filePath := args[len(args)-1]
+			b, err := json.Marshal([]map[string]string{{
+				"SourceFile":             filePath,
+				"SubSecDateTimeOriginal": dates[filePath],
+			}})
+			if err != nil {
+				return "", err
+			}
+			return string(b) + "\n{ready}\n", nil
+		}), nil
+	}
+}
+
+// writeFiles creates an empty file at every path.
+func writeFiles(t *testing.T, filePaths ...string) {
+	t.Helper()
+	for _, filePath := range filePaths {
+		err := os.WriteFile(filePath, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncrementalFileListOutsideRoots(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	inRoot, outsideRoot := filepath.Join(root, "a.jpg"), filepath.Join(outside, "b.jpg")
+	writeFiles(t, inRoot, outsideRoot)
+	fileList := filepath.Join(t.TempDir(), "files.txt")
+	err := os.WriteFile(fileList, []byte(inRoot+"\n"+outsideRoot+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpegidCmd := newTestCmd(t, "-incremental", "-files-from", fileList)
+	jpegidCmd.Roots = []string{root}
+	jpegidCmd.StateDir, jpegidCmd.PluginsDir = t.TempDir(), t.TempDir()
+	jpegidCmd.NewExifToolClient = fakeExifTool(map[string]string{
+		inRoot:      "2023:09:14 10:15:30.123+02:00",
+		outsideRoot: "2023:09:14 10:15:31.456+02:00",
+	})
+	var renamed []string
+	for result, err := range jpegidCmd.Renames(context.Background()) {
+		if err != nil {
+			t.Fatalf("%s: %v", result.FilePath, err)
+		}
+		renamed = append(renamed, result.NewFilePath)
+	}
+	want := []string{
+		filepath.Join(root, "2023-09-14T101530.123+0200.jpg"),
+		filepath.Join(outside, "2023-09-14T101531.456+0200.jpg"),
+	}
+	if strings.Join(renamed, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("renamed to %q, want %q", renamed, want)
+	}
+	// Only the root has state, for the file renamed in it.
+	state, err := loadScanState(jpegidCmd.StateDir, []string{root, outside})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.previous[root]) != 1 || len(state.previous[outside]) != 0 {
+		t.Fatalf("state = %v, want only the file in %s", state.previous, root)
+	}
+}
+
+func TestSeedMakesNamesReproducible(t *testing.T) {
+	// Without sub-seconds, names are padded from Rand.
+	names := func(numWorkers string) []string {
+		root := t.TempDir()
+		dates := make(map[string]string)
+		for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+			filePath := filepath.Join(root, name)
+			writeFiles(t, filePath)
+			dates[filePath] = "2023:09:14 10:15:31+02:00"
+		}
+		jpegidCmd := newTestCmd(t, "-dry-run", "-seed", "42", "-num-workers", numWorkers)
+		jpegidCmd.Roots = []string{root}
+		jpegidCmd.StateDir, jpegidCmd.PluginsDir = t.TempDir(), t.TempDir()
+		jpegidCmd.NewExifToolClient = fakeExifTool(dates)
+		var names []string
+		for result, err := range jpegidCmd.Renames(context.Background()) {
+			if err != nil {
+				t.Fatalf("%s: %v", result.FilePath, err)
+			}
+			names = append(names, filepath.Base(result.FilePath)+" "+filepath.Base(result.NewFilePath))
+		}
+		slices.Sort(names)
+		return names
+	}
+	first, second := names("1"), names("4")
+	if strings.Join(first, "\n") != strings.Join(second, "\n") {
+		t.Fatalf("names with the same seed differ: %q and %q", first, second)
+	}
+	if len(first) != 4 {
+		t.Fatalf("names = %q, want one for each of 4 files", first)
+	}
+	if strings.Fields(first[0])[1] == strings.Fields(first[1])[1] {
+		t.Fatalf("names %q have the same padding", first)
+	}
+}
+
+func TestNowDecidesImplausibleDates(t *testing.T) {
+	dir := t.TempDir()
+	exif := Exif{SubSecDateTimeOriginal: "2023:09:14 10:15:30.123+02:00"}
+	jpegidCmd := newTestCmd(t, "-dry-run", dir)
+	jpegidCmd.Now = func() time.Time { return time.Date(2023, time.September, 13, 0, 0, 0, 0, time.UTC) }
+	_, err := jpegidCmd.planRename(dir, filepath.Join(dir, "a.jpg"), exif, 0)
+	if !errors.Is(err, ErrImplausibleDate) {
+		t.Fatalf("planRename() a day after Now = %v, want ErrImplausibleDate", err)
+	}
+	jpegidCmd.Now = func() time.Time { return time.Date(2023, time.September, 15, 0, 0, 0, 0, time.UTC) }
+	result, err := jpegidCmd.planRename(dir, filepath.Join(dir, "a.jpg"), exif, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2023-09-14T101530.123+0200.jpg"; filepath.Base(result.NewFilePath) != want {
+		t.Fatalf("new name = %q, want %q", filepath.Base(result.NewFilePath), want)
+	}
+}
+
+func TestWalkGroupSkipAllStopsEveryRoot(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writeFiles(t, filepath.Join(first, "a.jpg"), filepath.Join(first, "b.jpg"), filepath.Join(second, "c.jpg"))
+	jpegidCmd := newTestCmd(t)
+	var walked []string
+	err := jpegidCmd.walkGroup(context.Background(), []string{first, second}, nil, nil, func(root, filePath string, skip error) error {
+		walked = append(walked, filePath)
+		if len(walked) == 2 {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 2 {
+		t.Fatalf("walked %q, want the walk to stop after 2 files", walked)
+	}
+}
+
+func TestExecAfterOutputKeepsJSONPlan(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.Join(root, "a.jpg")
+	writeFiles(t, filePath)
+	jpegidCmd := newTestCmd(t, "-output", "json", "-exec-after", "echo renamed {new}")
+	jpegidCmd.Roots = []string{root}
+	jpegidCmd.StateDir, jpegidCmd.PluginsDir, jpegidCmd.JournalDir = t.TempDir(), t.TempDir(), t.TempDir()
+	jpegidCmd.NewExifToolClient = fakeExifTool(map[string]string{
+		filePath: "2023:09:14 10:15:30.123+02:00",
+	})
+	var stdout, stderr strings.Builder
+	jpegidCmd.Stdout, jpegidCmd.Stderr = &stdout, &stderr
+	err := jpegidCmd.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan renamePlan
+	err = json.Unmarshal([]byte(stdout.String()), &plan)
+	if err != nil {
+		t.Fatalf("stdout is not a JSON plan: %v\n%s", err, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "renamed "+filepath.Join(root, "2023-09-14T101530.123+0200.jpg")) {
+		t.Fatalf("stderr = %q, want the output of -exec-after", stderr.String())
+	}
+}
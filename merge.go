@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// libraryIndex finds files whose contents are already in a library. Files
+// in the library are only hashed if a file of the same size is imported,
+// and each is hashed at most once. Imported files are hashed as they are
+// claimed, as they may have been moved by the time a file of the same size
+// comes along.
+type libraryIndex struct {
+	mutex sync.Mutex
+	// hash is the hash function of the hash mode. Comparing pixels, files of
+	// any size can match, so bySize has every file under size 0.
+	hash   func(filePath string) (string, error)
+	pixels bool
+	bySize map[int64][]string
+	// hashes are the hashes of the files hashed so far, by path.
+	hashes map[string]string
+	// paths maps the hash of every file hashed so far to its path, including
+	// files claimed for moving into the library during the run.
+	paths map[string]string
+	// claimed are the sizes of the files claimed so far.
+	claimed map[string]int64
+}
+
+// loadLibraryIndex lists the files in dir, recursively, to be compared in
+// hashMode.
+func loadLibraryIndex(ctx context.Context, dir, hashMode string) (*libraryIndex, error) {
+	library := &libraryIndex{
+		hash:    hashFunc(hashMode),
+		pixels:  hashMode == hashModePixels,
+		bySize:  make(map[int64][]string),
+		hashes:  make(map[string]string),
+		paths:   make(map[string]string),
+		claimed: make(map[string]int64),
+	}
+	err := fs.WalkDir(os.DirFS(dir), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == "." && errors.Is(err, fs.ErrNotExist) {
+				// A new library.
+				return fs.SkipAll
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if dirEntry.IsDir() && path != "." && isNASMetadataDir(dirEntry.Name()) {
+			return fs.SkipDir
+		}
+		if !dirEntry.Type().IsRegular() || path == libraryMarkerName {
+			return nil
+		}
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		size := library.sizeKey(fileInfo.Size())
+		library.bySize[size] = append(library.bySize[size], filepath.Join(dir, path))
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.SkipAll) {
+		return nil, err
+	}
+	return library, nil
+}
+
+// claim returns the path of a file in the library with the same contents as
+// filePath, if there is one. Otherwise filePath is remembered as being in
+// the library, so that a second copy of it in the import is found to be a
+// duplicate; moved records where it ended up, and release forgets it again
+// if it couldn't be moved.
+func (library *libraryIndex) claim(filePath string) (duplicate string, err error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	size := library.sizeKey(fileInfo.Size())
+	hash, err := library.hash(filePath)
+	if err != nil {
+		return "", err
+	}
+	library.mutex.Lock()
+	candidates := library.bySize[size]
+	library.mutex.Unlock()
+	for _, candidate := range candidates {
+		library.mutex.Lock()
+		_, hashed := library.hashes[candidate]
+		library.mutex.Unlock()
+		if hashed || candidate == filePath {
+			continue
+		}
+		candidateHash, err := library.hash(candidate)
+		if err != nil {
+			return "", err
+		}
+		library.mutex.Lock()
+		library.hashes[candidate] = candidateHash
+		if _, ok := library.paths[candidateHash]; !ok {
+			library.paths[candidateHash] = candidate
+		}
+		library.mutex.Unlock()
+	}
+	library.mutex.Lock()
+	defer library.mutex.Unlock()
+	if duplicate, ok := library.paths[hash]; ok {
+		return duplicate, nil
+	}
+	library.paths[hash] = filePath
+	library.hashes[filePath] = hash
+	library.bySize[size] = append(library.bySize[size], filePath)
+	library.claimed[filePath] = size
+	return "", nil
+}
+
+// moved records that a file claimed by claim was moved into the library as
+// newFilePath, so that later duplicates of it are reported as duplicates of
+// newFilePath.
+func (library *libraryIndex) moved(filePath, newFilePath string) {
+	library.mutex.Lock()
+	defer library.mutex.Unlock()
+	size, ok := library.claimed[filePath]
+	if !ok {
+		return
+	}
+	delete(library.claimed, filePath)
+	// A copy, as claim reads the old slice without holding the mutex.
+	library.bySize[size] = slices.Clone(library.bySize[size])
+	for i, path := range library.bySize[size] {
+		if path == filePath {
+			library.bySize[size][i] = newFilePath
+		}
+	}
+	hash := library.hashes[filePath]
+	delete(library.hashes, filePath)
+	library.hashes[newFilePath] = hash
+	if library.paths[hash] == filePath {
+		library.paths[hash] = newFilePath
+	}
+}
+
+// sizeKey returns the key of files of a size in bySize.
+func (library *libraryIndex) sizeKey(size int64) int64 {
+	if library.pixels {
+		return 0
+	}
+	return size
+}
+
+// release forgets a file claimed by claim that didn't make it into the
+// library.
+func (library *libraryIndex) release(filePath string) {
+	library.mutex.Lock()
+	defer library.mutex.Unlock()
+	size, ok := library.claimed[filePath]
+	if !ok {
+		return
+	}
+	delete(library.claimed, filePath)
+	// A copy, as claim reads the old slice without holding the mutex.
+	library.bySize[size] = slices.DeleteFunc(slices.Clone(library.bySize[size]), func(path string) bool { return path == filePath })
+	if hash, ok := library.hashes[filePath]; ok {
+		if library.paths[hash] == filePath {
+			delete(library.paths, hash)
+		}
+		delete(library.hashes, filePath)
+	}
+}
+
+// moveFile renames oldPath to newPath, falling back to copying and removing
+// the original if they are on different devices. The copy stops once ctx is
+// done.
+func moveFile(ctx context.Context, oldPath, newPath string) error {
+	err := os.Rename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	oldDevice, oldErr := deviceID(oldPath)
+	newDevice, newErr := deviceID(filepath.Dir(newPath))
+	if oldErr != nil || newErr != nil || oldDevice == newDevice {
+		return err
+	}
+	err = copyFile(ctx, oldPath, newPath, copyOptions{mode: true})
+	if err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
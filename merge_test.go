@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLibraryIndexClaimAfterMove(t *testing.T) {
+	libraryDir, importDir := t.TempDir(), t.TempDir()
+	writeFile := func(dir, name, contents string) string {
+		filePath := filepath.Join(dir, name)
+		err := os.WriteFile(filePath, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filePath
+	}
+	first := writeFile(importDir, "a.jpg", "aaaa")
+	second := writeFile(importDir, "b.jpg", "bbbb")
+	copyOfFirst := writeFile(importDir, "c.jpg", "aaaa")
+	library, err := loadLibraryIndex(context.Background(), libraryDir, hashModeContents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first file of its size is moved into the library before the
+	// other files of the same size are claimed.
+	duplicate, err := library.claim(first)
+	if err != nil || duplicate != "" {
+		t.Fatalf("claim(%q) = %q, %v, want no duplicate", first, duplicate, err)
+	}
+	moved := filepath.Join(libraryDir, "a.jpg")
+	err = os.Rename(first, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library.moved(first, moved)
+
+	duplicate, err = library.claim(second)
+	if err != nil || duplicate != "" {
+		t.Fatalf("claim(%q) = %q, %v, want no duplicate", second, duplicate, err)
+	}
+	duplicate, err = library.claim(copyOfFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate != moved {
+		t.Fatalf("claim(%q) = %q, want %q", copyOfFirst, duplicate, moved)
+	}
+}
+
+func TestLibraryIndexRelease(t *testing.T) {
+	libraryDir, importDir := t.TempDir(), t.TempDir()
+	filePath := filepath.Join(importDir, "a.jpg")
+	err := os.WriteFile(filePath, []byte("aaaa"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, err := loadLibraryIndex(context.Background(), libraryDir, hashModeContents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = library.claim(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library.release(filePath)
+	duplicate, err := library.claim(filePath)
+	if err != nil || duplicate != "" {
+		t.Fatalf("claim(%q) after release = %q, %v, want no duplicate", filePath, duplicate, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Metadata is the metadata of a file that is useful beyond its creation
+// time, decoded from the tags of an Exif. Fields are zero if the file
+// doesn't have the tag, or its backend doesn't report it (only exiftool
+// reports every tag).
+type Metadata struct {
+	// Width and Height are the dimensions of the image or video, in pixels.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// Orientation is the EXIF orientation, 1 (upright) to 8.
+	Orientation int `json:"orientation,omitempty"`
+
+	// Latitude and Longitude are where the file was taken, in degrees,
+	// negative to the south and west, if HasGPS.
+	HasGPS    bool    `json:"hasGPS,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+
+	// Make, Model and LensModel describe the camera, e.g. "Apple",
+	// "iPhone 14 Pro" and "iPhone 14 Pro back triple camera 6.86mm f/1.78".
+	Make      string `json:"make,omitempty"`
+	Model     string `json:"model,omitempty"`
+	LensModel string `json:"lensModel,omitempty"`
+
+	// ISO, ExposureTime (as a fraction of a second, e.g. "1/120"), FNumber
+	// and FocalLength (in millimetres) are the exposure settings.
+	ISO          int     `json:"iso,omitempty"`
+	ExposureTime string  `json:"exposureTime,omitempty"`
+	FNumber      float64 `json:"fNumber,omitempty"`
+	FocalLength  float64 `json:"focalLength,omitempty"`
+}
+
+// orientations are the values of Orientation as exiftool prints them.
+var orientations = map[string]int{
+	"Horizontal (normal)":                 1,
+	"Mirror horizontal":                   2,
+	"Rotate 180":                          3,
+	"Mirror vertical":                     4,
+	"Mirror horizontal and rotate 270 CW": 5,
+	"Rotate 90 CW":                        6,
+	"Mirror horizontal and rotate 90 CW":  7,
+	"Rotate 270 CW":                       8,
+}
+
+// Metadata decodes the tags of exif.
+func (exif Exif) Metadata() Metadata {
+	var metadata Metadata
+	metadata.Width, metadata.Height, _ = imageSize(exif)
+	if orientation, ok := orientations[exif.Tag("Orientation")]; ok {
+		metadata.Orientation = orientation
+	} else if orientation, err := strconv.Atoi(exif.Tag("Orientation")); err == nil && orientation >= 1 && orientation <= 8 {
+		metadata.Orientation = orientation
+	}
+	metadata.Latitude, metadata.Longitude, metadata.HasGPS = gpsCoordinates(exif)
+	metadata.Make = strings.TrimSpace(exif.Tag("Make"))
+	metadata.Model = strings.TrimSpace(exif.Tag("Model"))
+	metadata.LensModel = strings.TrimSpace(exif.Tag("LensModel"))
+	metadata.ISO, _ = strconv.Atoi(exif.Tag("ISO"))
+	metadata.ExposureTime = exif.Tag("ExposureTime")
+	metadata.FNumber, _ = strconv.ParseFloat(exif.Tag("FNumber"), 64)
+	// e.g. "6.9 mm" or "6.9 mm (35 mm equivalent: 24.0 mm)".
+	focalLength, _, _ := strings.Cut(exif.Tag("FocalLength"), " ")
+	metadata.FocalLength, _ = strconv.ParseFloat(focalLength, 64)
+	return metadata
+}
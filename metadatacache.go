@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metadataCacheEntry is the metadata of a file as read by a backend, along
+// with what the file looked like when it was read.
+type metadataCacheEntry struct {
+	Path    string            `json:"path"`
+	Backend string            `json:"backend"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"modTime"`
+	Exif    Exif              `json:"exif"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// metadataCache stores the metadata read from files on disk, one file per
+// entry, so that every subcommand that reads metadata with the same backend
+// can reuse it for as long as the file is unchanged. Entries are written
+// atomically, so concurrent runs can share a cache.
+type metadataCache struct {
+	dir string
+}
+
+// openMetadataCache returns the metadata cache stored in dir, or in the
+// user's cache directory if dir is empty.
+func openMetadataCache(dir string) (*metadataCache, error) {
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheDir, "jpegid", "metadata")
+	}
+	return &metadataCache{dir: dir}, nil
+}
+
+// fileName returns the file the entry for filePath read by backend is
+// stored in, in one of 256 subdirectories to keep directories small.
+func (cache *metadataCache) fileName(backend, filePath string) string {
+	sum := sha256.Sum256([]byte(backend + "\x00" + filePath))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(cache.dir, name[:2], name+".json")
+}
+
+// get returns the metadata of filePath read by backend, if it is cached and
+// the file has the size and modification time it had then.
+func (cache *metadataCache) get(backend, filePath string, fileInfo os.FileInfo) (Exif, bool) {
+	b, err := os.ReadFile(cache.fileName(backend, filePath))
+	if err != nil {
+		return Exif{}, false
+	}
+	var entry metadataCacheEntry
+	err = json.Unmarshal(b, &entry)
+	if err != nil || entry.Path != filePath || entry.Backend != backend || entry.Size != fileInfo.Size() || !entry.ModTime.Equal(fileInfo.ModTime()) {
+		return Exif{}, false
+	}
+	entry.Exif.Tags = entry.Tags
+	return entry.Exif, true
+}
+
+// put caches the metadata of filePath read by backend.
+func (cache *metadataCache) put(backend, filePath string, fileInfo os.FileInfo, exif Exif) error {
+	b, err := json.Marshal(metadataCacheEntry{
+		Path:    filePath,
+		Backend: backend,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+		Exif:    exif,
+		Tags:    exif.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	fileName := cache.fileName(backend, filePath)
+	err = os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(fileName), ".entry-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(b)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fileName)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+// cachedExtractor is a MetadataExtractor that reads metadata from a
+// metadataCache, and only from the files themselves with extractor if they
+// aren't cached. Failures are not cached, so that they are retried.
+type cachedExtractor struct {
+	cache     *metadataCache
+	backend   string
+	extractor MetadataExtractor
+}
+
+func (extractor *cachedExtractor) Extract(filePath string) (Exif, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return extractor.extractor.Extract(filePath)
+	}
+	if exif, ok := extractor.cache.get(extractor.backend, filePath, fileInfo); ok {
+		return exif, nil
+	}
+	exif, err := extractor.extractor.Extract(filePath)
+	if err == nil {
+		// A cache that can't be written to only costs the next run time.
+		_ = extractor.cache.put(extractor.backend, filePath, fileInfo, exif)
+	}
+	return exif, err
+}
+
+func (extractor *cachedExtractor) Close() error {
+	return extractor.extractor.Close()
+}
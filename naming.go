@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// nameData is the data a -name-template is executed with.
+type nameData struct {
+	// Time is the creation time of the file.
+	Time time.Time
+
+	// Year, Month, Day, Hour, Minute and Second are the zero-padded
+	// components of Time, e.g. "2023", "09", "14".
+	Year, Month, Day, Hour, Minute, Second string
+
+	// MonthName and Weekday are the month and weekday names of Time in the
+	// -locale language, e.g. "September" and "Thursday".
+	MonthName, Weekday string
+
+	// Default is the name (without extension) jpegid gives files when no
+	// template is set.
+	Default string
+
+	// Name is the original name of the file without its extension.
+	Name string
+
+	// Ext is the extension of the file, including the dot.
+	Ext string
+
+	// Dir is the directory of the file relative to its root, with slashes,
+	// or "." for the root itself. {{.Dir}}/... keeps files in their
+	// directory.
+	Dir string
+
+	// Event is the name of the -calendar event the file was created during,
+	// with spaces turned into dashes, e.g. "Berlin-Trip", or empty if there
+	// is none.
+	Event string
+
+	// Class is what the file is: photo, screenshot, scan, document or
+	// other (see classifyFile).
+	Class string
+
+	// Latitude and Longitude are where the file was taken, in degrees to 5
+	// decimal places (about a metre), negative to the south and west, e.g.
+	// "52.52000" and "13.40500". Geohash is the same place as an 8
+	// character geohash (a cell of about 20 metres), which can be shortened
+	// for a coarser cell with slice. They are empty for files without GPS
+	// coordinates, e.g. {{if .Geohash}}{{slice .Geohash 0 5}}{{end}}.
+	Latitude, Longitude, Geohash string
+
+	// Metadata is the rest of the metadata of the file, e.g.
+	// {{.Metadata.Model}}. Its string fields are made usable in file names
+	// with sanitizeFileName, so an ExposureTime of 1/120 is 1_120.
+	Metadata Metadata
+}
+
+// localeNames holds the month and weekday names of a language.
+type localeNames struct {
+	months   [12]string
+	weekdays [7]string
+}
+
+// locales are the languages MonthName and Weekday can be rendered in, keyed
+// by ISO 639-1 code. Weekdays start on Sunday to match time.Weekday.
+var locales = map[string]localeNames{
+	"en": {
+		months:   [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		weekdays: [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	},
+	"de": {
+		months:   [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		weekdays: [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+	},
+	"es": {
+		months:   [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		weekdays: [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+	},
+	"fr": {
+		months:   [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		weekdays: [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+	},
+	"it": {
+		months:   [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		weekdays: [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+	},
+	"nl": {
+		months:   [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		weekdays: [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+	},
+	"pt": {
+		months:   [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		weekdays: [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+	},
+}
+
+// defaultLocale returns the language of the user's environment, following
+// the usual LC_ALL > LC_TIME > LANG precedence. Languages without names in
+// locales fall back to English.
+func defaultLocale() string {
+	for _, key := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		// e.g. de_DE.UTF-8
+		language, _, _ := strings.Cut(value, "_")
+		language, _, _ = strings.Cut(language, ".")
+		language = strings.ToLower(language)
+		if _, ok := locales[language]; ok {
+			return language
+		}
+		return "en"
+	}
+	return "en"
+}
+
+// newNameTemplate parses a -name-template.
+func newNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=error").Funcs(nameFuncs).Parse(text)
+}
+
+// executeNameTemplate returns the new path of filePath according to tmpl.
+// The result of the template is relative to root and has the original
+// extension appended. layout is the time layout of Default. data holds the
+// fields that don't come from creationTime or filePath, such as Event; the
+// rest are filled in.
+func executeNameTemplate(tmpl *template.Template, locale, layout, root, filePath string, creationTime time.Time, data nameData) (string, error) {
+	names, ok := locales[locale]
+	if !ok {
+		names = locales["en"]
+	}
+	ext := filepath.Ext(filePath)
+	data.Time = creationTime
+	data.Year = creationTime.Format("2006")
+	data.Month = creationTime.Format("01")
+	data.Day = creationTime.Format("02")
+	data.Hour = creationTime.Format("15")
+	data.Minute = creationTime.Format("04")
+	data.Second = creationTime.Format("05")
+	data.MonthName = names.months[creationTime.Month()-1]
+	data.Weekday = names.weekdays[creationTime.Weekday()]
+	data.Default = creationTime.Format(layout)
+	data.Name = strings.TrimSuffix(filepath.Base(filePath), ext)
+	data.Ext = ext
+	data.Dir = "."
+	if dir, err := filepath.Rel(root, filepath.Dir(filePath)); err == nil {
+		data.Dir = filepath.ToSlash(dir)
+	}
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(b.String())
+	if name == "" {
+		return "", fmt.Errorf("-name-template: empty name for %s", filePath)
+	}
+	newFilePath := filepath.Join(root, filepath.FromSlash(name)+ext)
+	relPath, err := filepath.Rel(root, newFilePath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("-name-template: %s is outside the root %s", newFilePath, root)
+	}
+	return newFilePath, nil
+}
+
+// sanitizeFileName makes a metadata value usable as a file name on every
+// platform by replacing path separators, characters Windows forbids and
+// control characters with underscores.
+func sanitizeFileName(value string) string {
+	// Bytes are replaced one at a time rather than with strings.Map, which
+	// would turn bytes that aren't valid UTF-8 into U+FFFD.
+	b := []byte(value)
+	for i, c := range b {
+		if c < ' ' || c == 0x7f || strings.IndexByte(`<>:"/\\|?*`, c) >= 0 {
+			b[i] = '_'
+		}
+	}
+	name := string(b)
+	// Windows also drops trailing dots and spaces.
+	return strings.TrimRight(strings.TrimSpace(name), ". ")
+}
+
+// layoutReplacer turns a regexp.QuoteMeta'd time layout in the style of
+// fileNameLayout into a pattern matching the times formatted with it.
+var layoutReplacer = strings.NewReplacer(
+	"-0700", `[+-]\d{4}`,
+	`\.000`, `\.\d{3}`,
+	"2006", `\d{4}`,
+	"01", `\d{2}`,
+	"02", `\d{2}`,
+	"15", `\d{2}`,
+	"04", `\d{2}`,
+	"05", `\d{2}`,
+)
+
+// namedPattern returns a pattern matching the names (without extension or
+// collision suffix) executing tmpl can produce, or false if tmpl uses .Time
+// or .Metadata directly, or any of nameFuncs, and so its results can't be
+// told apart from other names.
+func namedPattern(tmpl *template.Template, locale, layout string) (string, bool) {
+	// The functions would mangle the placeholders, so a clone of tmpl
+	// records whether they are called instead.
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return "", false
+	}
+	called := false
+	funcs := make(template.FuncMap)
+	for name := range nameFuncs {
+		funcs[name] = func(args ...any) string {
+			called = true
+			return ""
+		}
+	}
+	tmpl.Funcs(funcs)
+	names, ok := locales[locale]
+	if !ok {
+		names = locales["en"]
+	}
+	digits := func(n int) string { return fmt.Sprintf(`\d{%d}`, n) }
+	alternatives := func(values []string) string {
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = regexp.QuoteMeta(value)
+		}
+		return "(?:" + strings.Join(quoted, "|") + ")"
+	}
+	// Each field is set to a placeholder that survives QuoteMeta and is
+	// then replaced by the pattern of the values the field can take.
+	patterns := []string{
+		digits(4), digits(2), digits(2), digits(2), digits(2), digits(2),
+		alternatives(names.months[:]), alternatives(names.weekdays[:]),
+		layoutReplacer.Replace(regexp.QuoteMeta(layout)),
+		`[^/]*`,
+		`(?:\.[^/.]*)?`,
+		`[^/]*`,
+		alternatives(fileClasses),
+		`(?:-?\d+\.\d{5})?`, `(?:-?\d+\.\d{5})?`, "[" + geohashAlphabet + "]*",
+		`.*`,
+	}
+	placeholder := func(i int) string { return fmt.Sprintf("\x00%d\x00", i) }
+	data := nameData{
+		Year: placeholder(0), Month: placeholder(1), Day: placeholder(2),
+		Hour: placeholder(3), Minute: placeholder(4), Second: placeholder(5),
+		MonthName: placeholder(6), Weekday: placeholder(7),
+		Default: placeholder(8), Name: placeholder(9), Ext: placeholder(10),
+		Event: placeholder(11), Class: placeholder(12),
+		Latitude: placeholder(13), Longitude: placeholder(14), Geohash: placeholder(15),
+		Dir: placeholder(16),
+	}
+	// Templates using Time or Metadata give different results for the two
+	// executions, so that they are found out.
+	var results [2]string
+	for i, t := range []time.Time{time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC), time.Date(2010, 11, 12, 13, 14, 15, 0, time.UTC)} {
+		data.Time = t
+		data.Metadata = Metadata{}
+		if i == 1 {
+			data.Metadata = Metadata{Width: 1, Height: 1, Orientation: 1, HasGPS: true, Latitude: 1, Longitude: 1, Make: "x", Model: "x", LensModel: "x", ISO: 1, ExposureTime: "x", FNumber: 1, FocalLength: 1}
+		}
+		var b strings.Builder
+		err = tmpl.Execute(&b, data)
+		if err != nil {
+			return "", false
+		}
+		results[i] = strings.TrimSpace(b.String())
+	}
+	if called || results[0] != results[1] || results[0] == "" {
+		return "", false
+	}
+	pattern := regexp.QuoteMeta(filepath.ToSlash(results[0]))
+	// Files in the root have no directory before their name.
+	pattern = strings.ReplaceAll(pattern, placeholder(16)+"/", `(?:.*/)?`)
+	for i, fieldPattern := range patterns {
+		pattern = strings.ReplaceAll(pattern, placeholder(i), fieldPattern)
+	}
+	return pattern, true
+}
+
+// templated reports whether any file may be named by a template, that is
+// whether new names are relative to the root.
+func (jpegidCmd *JpegIDCmd) templated() bool {
+	if jpegidCmd.NameTemplate != nil || len(jpegidCmd.Routes) > 0 {
+		return true
+	}
+	for _, rule := range jpegidCmd.ExtRules {
+		if rule.tmpl != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// newNamedRegexp returns a regexp matching the slash-separated paths,
+// relative to their root, of files that already have a name given by the
+// active naming scheme, or nil if the scheme can't be recognized (as with
+// -namer and -name-from-tag).
+func (jpegidCmd *JpegIDCmd) newNamedRegexp() *regexp.Regexp {
+	if jpegidCmd.Namer != "" || jpegidCmd.NameFromTag != "" {
+		return nil
+	}
+	layout := jpegidCmd.fileNameLayout()
+	pattern := `(?:.*/)?` + layoutReplacer.Replace(regexp.QuoteMeta(layout))
+	if jpegidCmd.NameTemplate != nil {
+		var ok bool
+		pattern, ok = namedPattern(jpegidCmd.NameTemplate, jpegidCmd.Locale, layout)
+		if !ok {
+			return nil
+		}
+	}
+	// A file is named if any of the templates could have named it.
+	var tmpls []*template.Template
+	for _, class := range fileClasses {
+		if tmpl, ok := jpegidCmd.Routes[class]; ok {
+			tmpls = append(tmpls, tmpl)
+		}
+	}
+	for _, rule := range jpegidCmd.ExtRules {
+		if rule.tmpl != nil {
+			tmpls = append(tmpls, rule.tmpl)
+		}
+	}
+	if len(tmpls) > 0 {
+		patterns := []string{pattern}
+		for _, tmpl := range tmpls {
+			tmplPattern, ok := namedPattern(tmpl, jpegidCmd.Locale, layout)
+			if !ok {
+				return nil
+			}
+			patterns = append(patterns, tmplPattern)
+		}
+		pattern = "(?:" + strings.Join(patterns, "|") + ")"
+	}
+	// Names may have a collision suffix, and have the original extension.
+	return regexp.MustCompile("^" + pattern + `(?:-\d+)?(?:\.[^/.]*)?$`)
+}
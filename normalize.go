@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization forms for Normalize.
+const (
+	normalizeNFC = "nfc"
+	normalizeNFD = "nfd"
+)
+
+// parseNormalization validates a -normalize value.
+func parseNormalization(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case normalizeNFC:
+		return normalizeNFC, nil
+	case normalizeNFD:
+		return normalizeNFD, nil
+	}
+	return "", fmt.Errorf("unknown normalization form %q (want nfc or nfd)", value)
+}
+
+// normalize returns s in the Unicode normalization form (normalizeNFC or
+// normalizeNFD). Bytes that aren't valid UTF-8 are kept.
+func normalize(s, form string) string {
+	switch form {
+	case normalizeNFC:
+		return norm.NFC.String(s)
+	case normalizeNFD:
+		return norm.NFD.String(s)
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSameName(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Café.jpg", "Café.jpg", true},
+		{"CAFÉ.JPG", "café.jpg", true},
+		{"Ångström.jpg", "Ångström.jpg", true},
+		{"Café.jpg", "Cafe.jpg", false},
+		{"a\xff.jpg", "a\xff.jpg", true},
+		{"a\xff.jpg", "a\xfe.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := sameName(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameName(%+q, %+q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	root := filepath.Join("/photos", "Café")
+	tests := []struct {
+		name string
+		args []string
+		path string
+		want string
+	}{{
+		name: "nfc base name",
+		args: []string{"-normalize", "nfc"},
+		path: filepath.Join(root, "Café.jpg"),
+		want: filepath.Join(root, "Café.jpg"),
+	}, {
+		name: "nfd base name",
+		args: []string{"-normalize", "nfd"},
+		path: filepath.Join(root, "Café.jpg"),
+		want: filepath.Join(root, "Café.jpg"),
+	}, {
+		name: "no form",
+		path: filepath.Join(root, "Café.jpg"),
+		want: filepath.Join(root, "Café.jpg"),
+	}, {
+		name: "template leaves the root alone",
+		args: []string{"-normalize", "nfc", "-name-template", "{{.Default}}"},
+		path: filepath.Join(root, "Zürich", "Café.jpg"),
+		want: filepath.Join(root, "Zürich", "Café.jpg"),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jpegidCmd := newTestCmd(t, tt.args...)
+			if got := jpegidCmd.normalizePath(root, tt.path); got != tt.want {
+				t.Fatalf("normalizePath(%+q) = %+q, want %+q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCollisionResolverNormalizationInsensitive renames an NFD name to its
+// NFC form on a filesystem that, like APFS, takes both to be the same name.
+func TestCollisionResolverNormalizationInsensitive(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldName string
+		newName string
+		other   string
+		want    error
+	}{
+		{name: "nfd to nfc", oldName: "Café.jpg", newName: "Café.jpg"},
+		{name: "case", oldName: "img_0001.jpg", newName: "IMG_0001.JPG"},
+		{name: "another file", oldName: "Café.jpg", newName: "Cafe.jpg", other: "Cafe.jpg", want: ErrCollision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// fold gives the name the fake filesystem stores a path
+			// under.
+			fold := func(path string) string {
+				return filepath.Join(dir, strings.ToLower(normalize(filepath.Base(path), normalizeNFC)))
+			}
+			writeFiles(t, fold(tt.oldName))
+			if tt.other != "" {
+				writeFiles(t, fold(tt.other))
+			}
+			resolver := newCollisionResolver(collisionSkip, strings.NewReader(""), io.Discard)
+			resolver.lstat = func(path string) (os.FileInfo, error) {
+				return os.Lstat(fold(path))
+			}
+			var moved []string
+			resolver.move = func(oldPath, newPath string) error {
+				moved = append(moved, filepath.Base(oldPath), filepath.Base(newPath))
+				return nil
+			}
+			oldPath, newPath := filepath.Join(dir, tt.oldName), filepath.Join(dir, tt.newName)
+			got, err := resolver.rename(context.Background(), oldPath, newPath, "")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("rename() = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			if got != newPath || len(moved) != 2 || moved[0] != tt.oldName || moved[1] != tt.newName {
+				t.Fatalf("rename() = %+q moving %+q, want %+q renamed in place", got, moved, newPath)
+			}
+		})
+	}
+}
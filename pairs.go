@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// livePhotoExtensions are the extensions of photos that can be the still
+// image of a Live Photo. Its video has the same name with a .MOV extension.
+var livePhotoExtensions = []string{".heic", ".heif", ".jpg", ".jpeg"}
+
+// editExtensions are the extensions of the edited variants iOS exports next
+// to an original, IMG_E1234.JPG for IMG_1234.HEIC, including the video of an
+// edited Live Photo.
+var editExtensions = []string{".heic", ".heif", ".jpg", ".jpeg", ".png", ".mov"}
+
+// editNameRegexp matches the names iOS gives edited variants, capturing the
+// number of the original.
+var editNameRegexp = regexp.MustCompile(`^IMG_E(\d+)$`)
+
+// withCases returns exts in both lower and upper case.
+func withCases(exts []string) []string {
+	var cased []string
+	for _, ext := range exts {
+		cased = append(cased, strings.ToUpper(ext), strings.ToLower(ext))
+	}
+	return cased
+}
+
+// findCompanions returns the files renamed along with filePath: those with
+// the same name and an extension in SidecarExts (IMG_1234.xmp or
+// IMG_1234.HEIC.xmp), the video of a Live Photo with LivePhotos and the
+// edited variants of an original with PairEdits, which keep an _E suffix.
+func (jpegidCmd *JpegIDCmd) findCompanions(filePath string) []Sidecar {
+	dir, name := filepath.Split(filePath)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	var candidates []sidecarCandidate
+	for _, sidecarExt := range withCases(jpegidCmd.SidecarExts) {
+		candidates = append(candidates, sidecarCandidate{stem + sidecarExt, sidecarExt}, sidecarCandidate{name + sidecarExt, ext + sidecarExt})
+	}
+	if jpegidCmd.LivePhotos && slices.Contains(livePhotoExtensions, strings.ToLower(ext)) {
+		for _, videoExt := range []string{".MOV", ".mov"} {
+			candidates = append(candidates, sidecarCandidate{stem + videoExt, videoExt})
+		}
+	}
+	if match := iosNameRegexp.FindStringSubmatch(stem); match != nil && jpegidCmd.PairEdits {
+		for _, editExt := range withCases(editExtensions) {
+			candidates = append(candidates, sidecarCandidate{"IMG_E" + match[1] + editExt, "_E" + editExt})
+		}
+	}
+	return findSidecars(dir, candidates)
+}
+
+// pairIndex tells files that are renamed along with another one, as found
+// by findCompanions, from files to rename on their own. It goes by the
+// contents of each directory when the first of its files is looked up,
+// before any of them are renamed, so that whether a file is skipped doesn't
+// depend on how far along the other one is.
+type pairIndex struct {
+	mutex sync.Mutex
+	dirs  map[string]map[string]bool
+}
+
+// primaryOf returns the file filePath is a companion of, or "" if there is
+// none. It is called with every file of a directory, in the order they are
+// renamed.
+func (jpegidCmd *JpegIDCmd) primaryOf(pairs *pairIndex, filePath string) string {
+	dir, name := filepath.Split(filePath)
+	pairs.mutex.Lock()
+	names, ok := pairs.dirs[dir]
+	if !ok {
+		names = make(map[string]bool)
+		dirEntries, _ := os.ReadDir(dir)
+		for _, dirEntry := range dirEntries {
+			names[dirEntry.Name()] = true
+		}
+		pairs.dirs[dir] = names
+	}
+	pairs.mutex.Unlock()
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	var primaries []string
+	if jpegidCmd.LivePhotos && strings.EqualFold(ext, ".mov") {
+		for _, photoExt := range withCases(livePhotoExtensions) {
+			primaries = append(primaries, stem+photoExt)
+		}
+	}
+	if match := editNameRegexp.FindStringSubmatch(stem); match != nil && jpegidCmd.PairEdits {
+		for _, photoExt := range withCases(editExtensions) {
+			primaries = append(primaries, "IMG_"+match[1]+photoExt)
+		}
+	}
+	for _, primary := range primaries {
+		if names[primary] {
+			return filepath.Join(dir, primary)
+		}
+	}
+	return ""
+}
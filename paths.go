@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// encodePath returns path in a form that survives being written as a JSON
+// string. encoding/json replaces bytes that are not valid UTF-8 with U+FFFD,
+// which would make file names from old archives and some cameras impossible
+// to find again, so such paths are hex-encoded behind a leading NUL, which
+// can't appear in a real path.
+func encodePath(path string) string {
+	if utf8.ValidString(path) {
+		return path
+	}
+	return "\x00" + hex.EncodeToString([]byte(path))
+}
+
+// decodePath reverses encodePath.
+func decodePath(s string) string {
+	encoded, ok := strings.CutPrefix(s, "\x00")
+	if !ok {
+		return s
+	}
+	b, err := hex.DecodeString(encoded)
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// encodePaths applies encodePath to each of paths.
+func encodePaths(paths []string) []string {
+	if paths == nil {
+		return nil
+	}
+	encoded := make([]string, len(paths))
+	for i, path := range paths {
+		encoded[i] = encodePath(path)
+	}
+	return encoded
+}
+
+// truncateName shortens name to at most maxNameLength, keeping its extension
+// and cutting only between runes.
+func truncateName(name string) string {
+	if pathLength(name) <= maxNameLength {
+		return name
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for pathLength(base+ext) > maxNameLength && base != "" {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	return strings.TrimRight(base, ". ") + ext
+}
+
+// fitPath makes sure newFilePath can be renamed to. Components chosen by
+// the naming scheme (as for normalizePath) that are longer than
+// maxNameLength are truncated, and truncated reports whether any were. Paths
+// that are still longer than maxPathLength are reported with ErrPathTooLong.
+func (jpegidCmd *JpegIDCmd) fitPath(root, newFilePath string) (fitted string, truncated bool, err error) {
+	dir, relPath := filepath.Dir(newFilePath), filepath.Base(newFilePath)
+	if jpegidCmd.templated() {
+		if rel, err := filepath.Rel(root, newFilePath); err == nil {
+			dir, relPath = root, rel
+		}
+	}
+	components := strings.Split(relPath, string(filepath.Separator))
+	for i, component := range components {
+		components[i] = truncateName(component)
+		truncated = truncated || components[i] != component
+	}
+	fitted = filepath.Join(dir, filepath.Join(components...))
+	if n := pathLength(fitted); n > maxPathLength() {
+		return fitted, truncated, fmt.Errorf("%w: %s is %d long, the limit is %d", ErrPathTooLong, fitted, n, maxPathLength())
+	}
+	return fitted, truncated, nil
+}
+
+// rootAliasRegexp matches the names roots can be given with -root
+// name=path.
+var rootAliasRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// parseRoot parses a -root value, a path optionally preceded by an alias and
+// an equals sign, e.g. nas=/mnt/nas/photos. A path that itself contains an
+// equals sign can be given as ./name=value.
+func parseRoot(value string) (root, alias string, err error) {
+	if name, path, ok := strings.Cut(value, "="); ok && rootAliasRegexp.MatchString(name) {
+		if path == "" {
+			return "", "", fmt.Errorf("root alias %q has no path", name)
+		}
+		alias, value = name, path
+	}
+	root, err = filepath.Abs(value)
+	if err != nil {
+		return "", "", err
+	}
+	return root, alias, nil
+}
+
+// innermostRoot returns the index of the innermost of roots that path is
+// in, and path relative to it (empty for the root itself), or false if path
+// is in none of them.
+func innermostRoot(roots []string, path string) (index int, relPath string, ok bool) {
+	index = -1
+	for i, root := range roots {
+		if index >= 0 && len(root) <= len(roots[index]) {
+			continue
+		}
+		if path == root {
+			index, relPath = i, ""
+		} else if rest, ok := strings.CutPrefix(path, root); ok && (strings.HasPrefix(rest, string(filepath.Separator)) || strings.HasSuffix(root, string(filepath.Separator))) {
+			index, relPath = i, strings.TrimPrefix(rest, string(filepath.Separator))
+		}
+	}
+	return index, relPath, index >= 0
+}
+
+// displayPath returns path as it is shown to people. Paths in a root with an
+// alias are shown relative to it behind the alias, e.g. nas:2023/a.jpg (or
+// nas for the root itself), and with RelativePaths paths in other roots are
+// shown relative to them. Other paths, and machine-readable output, are
+// left as they are.
+func (jpegidCmd *JpegIDCmd) displayPath(path string) string {
+	i, relPath, ok := innermostRoot(jpegidCmd.Roots, path)
+	if !ok {
+		return path
+	}
+	if alias := jpegidCmd.RootAliases[jpegidCmd.Roots[i]]; alias != "" {
+		if relPath == "" {
+			return alias
+		}
+		return alias + ":" + relPath
+	}
+	if jpegidCmd.RelativePaths && relPath != "" {
+		return relPath
+	}
+	return path
+}
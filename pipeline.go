@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultStageBuffer is the capacity of the channels between the stages of
+// a renamePipeline when StageBuffer is 0.
+const defaultStageBuffer = 16
+
+// renameJob is a file found by the walk of a root group, to be renamed.
+type renameJob struct {
+	root     string
+	filePath string
+	padding  time.Duration
+	group    int
+	seq      int
+}
+
+// renameResult is the outcome of a file, sent back to Renames by the stage
+// it finished in.
+type renameResult struct {
+	result RenameResult
+	err    error
+	// group and seq are the position of the file in the walk order of its
+	// root group, so that results can be yielded in that order whichever
+	// worker finishes first. seq is -1 for errors that are not tied to a
+	// file. end marks the end of a group, with seq set to the number of
+	// files in it.
+	group int
+	seq   int
+	end   bool
+}
+
+// stageItem is a file on its way from one stage of a renamePipeline to the
+// next.
+type stageItem struct {
+	job    renameJob
+	result RenameResult
+}
+
+// renamePipeline renames the files of a root group in stages, each run by
+// its own workers and connected to the next by a bounded channel:
+//
+//   - discover walks the roots (see Renames) and sends renameJobs;
+//   - extract checks, claims and reads the metadata of each file;
+//   - plan works out the new name of each file, down to the -exec-before
+//     veto;
+//   - execute renames each file, along with its sidecars, and runs the
+//     hooks that follow;
+//   - report, back in Renames, puts the results in walk order.
+//
+// A file that fails or is skipped in a stage is sent to report from there
+// rather than passed on. Workers own the resources of their stage, such as
+// an extractor or a namer plugin, so a stage is tuned by its number of
+// workers without affecting the others.
+type renamePipeline struct {
+	jpegidCmd     *JpegIDCmd
+	send          func(renameResult) bool
+	newExtractor  func() (MetadataExtractor, error)
+	resolver      *collisionResolver
+	library       *libraryIndex
+	quarantine    *fileQuarantine
+	dirTimes      *dirModTimes
+	hookSemaphore chan struct{}
+}
+
+// runStage starts a goroutine per worker that calls it with every item
+// received from in, until in is closed, ctx is done or the worker returns
+// false. closed, if not nil, is called once every worker has returned, to
+// close the channel of the next stage and release the resources of the
+// workers.
+func runStage[In any](ctx context.Context, waitGroup *sync.WaitGroup, workers []func(In) bool, in <-chan In, closed func()) {
+	var stageGroup sync.WaitGroup
+	for _, process := range workers {
+		stageGroup.Add(1)
+		go func() {
+			defer stageGroup.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item, ok := <-in:
+					if !ok || !process(item) {
+						return
+					}
+				}
+			}
+		}()
+	}
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		stageGroup.Wait()
+		if closed != nil {
+			closed()
+		}
+	}()
+}
+
+// forward sends item to the next stage.
+func forward(ctx context.Context, out chan<- stageItem, item stageItem) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- item:
+		return true
+	}
+}
+
+// vanished returns err as ErrVanished if it is an error (rather than a
+// reason to skip) and filePath no longer exists, as happens when another
+// process deletes or renames it during the run.
+func vanished(filePath string, err error) error {
+	if _, ok := skipReason(err); err == nil || ok {
+		return err
+	}
+	if _, statErr := os.Lstat(filePath); !errors.Is(statErr, fs.ErrNotExist) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrVanished, err)
+}
+
+// finish sends the outcome of item to report.
+func (pipeline *renamePipeline) finish(item stageItem, err error) bool {
+	return pipeline.send(renameResult{result: item.result, err: err, group: item.job.group, seq: item.job.seq})
+}
+
+// extract is the extract stage for a single file: it checks, claims and
+// reads the metadata of the file of job with *extractor. It returns false if
+// the file is done with, having been sent to report. An extractor that takes
+// longer than OpTimeout is closed, to stop the process it may be waiting
+// on, and replaced, counting as a restart of the worker in stats.
+func (pipeline *renamePipeline) extract(ctx context.Context, extractor *MetadataExtractor, stats *workerStats, job renameJob) (stageItem, bool) {
+	jpegidCmd := pipeline.jpegidCmd
+	item := stageItem{job: job, result: RenameResult{Root: job.root, FilePath: job.filePath}}
+	if jpegidCmd.CheckCorrupt && isJPEG(job.filePath) {
+		err := vanished(job.filePath, checkJPEG(job.filePath))
+		if err != nil {
+			if errors.Is(err, ErrCorrupt) && pipeline.quarantine != nil && !jpegidCmd.DryRun {
+				var moveErr error
+				item.result.NewFilePath, moveErr = pipeline.quarantine.move(jpegidCmd.Now(), job.root, job.filePath, err)
+				if moveErr != nil {
+					err = fmt.Errorf("%w (quarantine: %w)", err, moveErr)
+				}
+			}
+			pipeline.finish(item, err)
+			return item, false
+		}
+	}
+	if pipeline.library != nil {
+		duplicate, err := pipeline.library.claim(job.filePath)
+		if err == nil && duplicate != "" {
+			err = fmt.Errorf("%w: %s", ErrDuplicate, duplicate)
+		}
+		err = vanished(job.filePath, err)
+		if err != nil {
+			pipeline.finish(item, err)
+			return item, false
+		}
+	}
+	opCtx, cancel := opContext(ctx, jpegidCmd.OpTimeout)
+	current := *extractor
+	exif, err := runContext(opCtx, func() (Exif, error) {
+		return current.Extract(job.filePath)
+	})
+	cancel()
+	if errors.Is(err, ErrTimedOut) {
+		replacement, newErr := pipeline.newExtractor()
+		if newErr == nil {
+			*extractor = replacement
+			stats.restarts.Add(1)
+			go func() {
+				_ = current.Close()
+			}()
+		} else {
+			err = fmt.Errorf("%w (unable to restart the extractor: %w)", err, newErr)
+		}
+	}
+	item.result.Exif = exif
+	err = vanished(job.filePath, err)
+	if err != nil {
+		if pipeline.library != nil {
+			pipeline.library.release(job.filePath)
+		}
+		pipeline.finish(item, err)
+		return item, false
+	}
+	return item, true
+}
+
+// plan is the plan stage for a single file: it works out the new path of the
+// file of item, with namer if it is not nil, and gives -exec-before the
+// chance to veto it.
+func (pipeline *renamePipeline) plan(ctx context.Context, namer *pluginNamer, item stageItem) (stageItem, bool) {
+	jpegidCmd := pipeline.jpegidCmd
+	result, err := jpegidCmd.planRename(item.job.root, item.job.filePath, item.result.Exif, item.job.padding)
+	if err == nil && namer != nil {
+		result.NewFilePath, err = namer.name(result)
+	}
+	if err == nil && jpegidCmd.Normalize != "" {
+		result.NewFilePath = jpegidCmd.normalizePath(result.Root, result.NewFilePath)
+	}
+	newRoot := result.Root
+	if err == nil && jpegidCmd.destDir() != "" {
+		result.NewFilePath = jpegidCmd.destPath(result.Root, result.NewFilePath)
+		newRoot = jpegidCmd.destDir()
+	}
+	if err == nil {
+		var truncated bool
+		result.NewFilePath, truncated, err = jpegidCmd.fitPath(newRoot, result.NewFilePath)
+		if truncated {
+			result.Warning = strings.TrimPrefix(result.Warning+"; new name truncated to fit the file name length limit", "; ")
+		}
+	}
+	if err == nil && result.NewFilePath == result.FilePath {
+		err = ErrAlreadyNamed
+	}
+	if err == nil && len(jpegidCmd.ExecBefore) > 0 {
+		output, hookErr := runHook(ctx, pipeline.hookSemaphore, jpegidCmd.ExecBefore, result.FilePath, result.NewFilePath)
+		if hookErr != nil {
+			jpegidCmd.logger.Info(hookErr.Error(), slog.String("filePath", result.FilePath), slog.String("output", string(output)))
+			err = ErrVetoed
+		}
+	}
+	item.result = result
+	err = vanished(item.job.filePath, err)
+	if err != nil {
+		if pipeline.library != nil {
+			pipeline.library.release(item.job.filePath)
+		}
+		pipeline.finish(item, err)
+		return item, false
+	}
+	return item, true
+}
+
+// execute is the execute stage for a single file: it renames the file of
+// item along with its sidecars, writes its offset with writer if it is not
+// nil and runs -exec-after, then sends it to report.
+func (pipeline *renamePipeline) execute(ctx context.Context, writer *offsetWriter, item stageItem) bool {
+	jpegidCmd := pipeline.jpegidCmd
+	result := item.result
+	var err error
+	if !jpegidCmd.DryRun {
+		result.NewFilePath, err = jpegidCmd.applyRename(ctx, result, pipeline.resolver, pipeline.dirTimes)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = vanished(item.job.filePath, err)
+		}
+	}
+	if pipeline.library != nil && !jpegidCmd.DryRun {
+		if err != nil {
+			pipeline.library.release(item.job.filePath)
+		} else {
+			pipeline.library.moved(item.job.filePath, result.NewFilePath)
+		}
+	}
+	if err == nil {
+		jpegidCmd.moveSidecars(&result, pipeline.resolver.move)
+	}
+	if err == nil && writer != nil && !result.CreationTime.IsZero() && needsOffset(result.Exif) {
+		writeErr := writer.write(result.NewFilePath, result.CreationTime)
+		if writeErr != nil {
+			result.Warning = strings.TrimPrefix(result.Warning+"; unable to write OffsetTimeOriginal: "+writeErr.Error(), "; ")
+		} else {
+			jpegidCmd.logger.Info("wrote OffsetTimeOriginal", slog.String("newFilePath", result.NewFilePath), slog.String("offset", result.CreationTime.Format("-07:00")))
+		}
+	}
+	if err == nil && len(jpegidCmd.ExecAfter) > 0 && !jpegidCmd.DryRun {
+		output, err := runHook(ctx, pipeline.hookSemaphore, jpegidCmd.ExecAfter, result.FilePath, result.NewFilePath)
+		if err != nil {
+			jpegidCmd.logger.Error(err.Error(), slog.String("filePath", result.FilePath), slog.String("output", string(output)))
+		} else if len(output) > 0 {
+			// Stdout may be a JSON plan or a list of names.
+			_, _ = jpegidCmd.Stderr.Write(output)
+		}
+	}
+	item.result = result
+	return pipeline.finish(item, err)
+}
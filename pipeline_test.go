@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunStage(t *testing.T) {
+	in := make(chan int)
+	var mutex sync.Mutex
+	var processed []int
+	workers := make([]func(int) bool, 3)
+	for i := range workers {
+		workers[i] = func(item int) bool {
+			mutex.Lock()
+			processed = append(processed, item)
+			mutex.Unlock()
+			return true
+		}
+	}
+	var closed atomic.Int32
+	var waitGroup sync.WaitGroup
+	runStage(context.Background(), &waitGroup, workers, in, func() {
+		closed.Add(1)
+	})
+	for i := range 100 {
+		in <- i
+	}
+	close(in)
+	waitGroup.Wait()
+	if closed.Load() != 1 {
+		t.Fatalf("closed called %d times, want once", closed.Load())
+	}
+	slices.Sort(processed)
+	for i, item := range processed {
+		if item != i {
+			t.Fatalf("processed %v, want every item once", processed)
+		}
+	}
+	if len(processed) != 100 {
+		t.Fatalf("processed %d items, want 100", len(processed))
+	}
+}
+
+func TestRunStageWorkerStops(t *testing.T) {
+	in := make(chan int, 10)
+	for i := range 10 {
+		in <- i
+	}
+	var processed atomic.Int32
+	workers := []func(int) bool{func(item int) bool {
+		processed.Add(1)
+		return item < 2
+	}}
+	var waitGroup sync.WaitGroup
+	runStage(context.Background(), &waitGroup, workers, in, nil)
+	waitGroup.Wait()
+	if processed.Load() != 3 {
+		t.Fatalf("processed %d items, want the worker to stop after the third", processed.Load())
+	}
+}
+
+// fakeExtractor is a MetadataExtractor with the metadata of each file given
+// up front.
+type fakeExtractor map[string]Exif
+
+func (extractor fakeExtractor) Extract(filePath string) (Exif, error) {
+	exif, ok := extractor[filePath]
+	if !ok {
+		return Exif{}, &ExifToolError{FilePath: filePath, Err: ErrNoMetadata}
+	}
+	return exif, nil
+}
+
+func (extractor fakeExtractor) Close() error {
+	return nil
+}
+
+func TestPipelineStages(t *testing.T) {
+	dir := t.TempDir()
+	dated, undated := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")
+	for _, filePath := range []string{dated, undated} {
+		err := os.WriteFile(filePath, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var extractor MetadataExtractor = fakeExtractor{
+		dated: {SubSecDateTimeOriginal: "2023:09:14 10:15:30.123+02:00"},
+	}
+	var reported []renameResult
+	pipeline := &renamePipeline{
+		jpegidCmd: newTestCmd(t, "-dry-run", dir),
+		send: func(result renameResult) bool {
+			reported = append(reported, result)
+			return true
+		},
+		resolver: newCollisionResolver(collisionSkip, nil, nil),
+	}
+	ctx := context.Background()
+
+	// A file without metadata is reported by the extract stage instead of
+	// being passed on.
+	_, ok := pipeline.extract(ctx, &extractor, &workerStats{}, renameJob{root: dir, filePath: undated, seq: 0})
+	if ok {
+		t.Fatal("extract passed on a file without metadata")
+	}
+	if len(reported) != 1 || !errors.Is(reported[0].err, ErrNoMetadata) {
+		t.Fatalf("reported %+v, want the file without metadata", reported)
+	}
+
+	item, ok := pipeline.extract(ctx, &extractor, &workerStats{}, renameJob{root: dir, filePath: dated, seq: 1})
+	if !ok {
+		t.Fatalf("extract reported %+v", reported[len(reported)-1])
+	}
+	item, ok = pipeline.plan(ctx, nil, item)
+	if !ok {
+		t.Fatalf("plan reported %+v", reported[len(reported)-1])
+	}
+	wantPath := filepath.Join(dir, "2023-09-14T101530.123+0200.jpg")
+	if item.result.NewFilePath != wantPath {
+		t.Fatalf("planned %q, want %q", item.result.NewFilePath, wantPath)
+	}
+	pipeline.execute(ctx, nil, item)
+	last := reported[len(reported)-1]
+	if last.err != nil || last.seq != 1 || last.result.NewFilePath != wantPath {
+		t.Fatalf("execute reported %+v, want %s renamed to %s", last, dated, wantPath)
+	}
+	// A dry run renames nothing.
+	if _, err := os.Stat(dated); err != nil {
+		t.Fatal(err)
+	}
+}
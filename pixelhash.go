@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Hash modes for finding files with the same contents.
+const (
+	// hashModeContents hashes the whole file.
+	hashModeContents = "contents"
+	// hashModePixels hashes only the image data of JPEGs (see hashPixels), so
+	// that copies of a photo that were re-tagged or had their GPS stripped
+	// are found to be the same. Other files are hashed whole.
+	hashModePixels = "pixels"
+)
+
+// parseHashMode validates a -hash value.
+func parseHashMode(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case hashModeContents:
+		return hashModeContents, nil
+	case hashModePixels:
+		return hashModePixels, nil
+	}
+	return "", fmt.Errorf("unknown hash mode %q (want contents or pixels)", value)
+}
+
+// hashFunc returns the function that hashes files in a hash mode.
+func hashFunc(mode string) func(filePath string) (string, error) {
+	if mode == hashModePixels {
+		return hashPixels
+	}
+	return hashFile
+}
+
+// hashPixels returns the hex-encoded SHA-256 of the segments of a JPEG that
+// make up its image: everything from the SOI marker to the EOI marker except
+// the APPn segments (EXIF, XMP, ICC profiles, MakerNotes, ...) and comments.
+// Data after EOI, such as the trailers some phones append, is left out too.
+// Files that aren't JPEGs are hashed whole, as by hashFile.
+func hashPixels(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	soi, err := r.Peek(2)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return hashFile(filePath)
+	}
+	h := sha256.New()
+	err = hashJPEGSegments(h, r)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashJPEGSegments writes the image segments of the JPEG in r to h.
+func hashJPEGSegments(h hash.Hash, r *bufio.Reader) error {
+	// marker is the marker ending the previous scan, if any.
+	var marker byte
+	for {
+		if marker == 0 {
+			b, err := r.ReadByte()
+			if err != nil {
+				return fmt.Errorf("truncated JPEG: %w", err)
+			}
+			if b != 0xFF {
+				return fmt.Errorf("invalid JPEG: expected a marker, got %#x", b)
+			}
+			marker, err = readMarker(r)
+			if err != nil {
+				return err
+			}
+		}
+		switch {
+		case marker == 0xD9: // EOI
+			h.Write([]byte{0xFF, marker})
+			return nil
+		case marker == 0xD8 || marker >= 0xD0 && marker <= 0xD7 || marker == 0x01: // SOI, RSTn, TEM
+			h.Write([]byte{0xFF, marker})
+			marker = 0
+			continue
+		}
+		var length [2]byte
+		_, err := io.ReadFull(r, length[:])
+		if err != nil {
+			return fmt.Errorf("truncated JPEG: %w", err)
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return fmt.Errorf("invalid JPEG: segment %#x has length %d", marker, n+2)
+		}
+		if marker >= 0xE0 && marker <= 0xEF || marker == 0xFE { // APPn, COM
+			_, err = r.Discard(n)
+			if err != nil {
+				return fmt.Errorf("truncated JPEG: %w", err)
+			}
+			marker = 0
+			continue
+		}
+		h.Write([]byte{0xFF, marker, length[0], length[1]})
+		_, err = io.CopyN(h, r, int64(n))
+		if err != nil {
+			return fmt.Errorf("truncated JPEG: %w", err)
+		}
+		if marker == 0xDA { // SOS
+			marker, err = hashScan(h, r)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		marker = 0
+	}
+}
+
+// readMarker reads the marker following an 0xFF byte, skipping fill bytes.
+func readMarker(r *bufio.Reader) (byte, error) {
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("truncated JPEG: %w", err)
+		}
+		if marker != 0xFF {
+			return marker, nil
+		}
+	}
+}
+
+// hashScan writes the entropy-coded data following an SOS segment to h, and
+// returns the marker that ends it. Inside the data, 0xFF is followed by a
+// stuffed zero byte or a restart marker.
+func hashScan(h hash.Hash, r *bufio.Reader) (byte, error) {
+	for {
+		data, err := r.ReadSlice(0xFF)
+		if err == bufio.ErrBufferFull {
+			h.Write(data)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("truncated JPEG: %w", err)
+		}
+		h.Write(data)
+		marker, err := readMarker(r)
+		if err != nil {
+			return 0, err
+		}
+		if marker == 0x00 || marker >= 0xD0 && marker <= 0xD7 {
+			h.Write([]byte{marker})
+			continue
+		}
+		return marker, nil
+	}
+}
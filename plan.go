@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// planVersion is the version of the plan schema, bumped on incompatible
+// changes.
+const planVersion = 1
+
+// Modes of a renamePlan.
+const (
+	planModeRename = "rename"
+	planModeCopy   = "copy"
+	planModeMerge  = "merge"
+)
+
+// renamePlan is the machine-readable record of what a run did, or would do in a
+// dry run, written by -output json. Paths are encoded with encodePath.
+type renamePlan struct {
+	Version int  `json:"version"`
+	DryRun  bool `json:"dryRun"`
+	// Mode is how files are put at their new paths: renamed in place
+	// ("rename"), copied with -copy-to ("copy") or moved into a library
+	// with -into ("merge"). Plans without a mode are renames.
+	Mode string `json:"mode,omitempty"`
+	// Relative records that the paths of files are relative to the root
+	// of their entry, if they are in one.
+	Relative bool        `json:"relative,omitempty"`
+	Roots    []string    `json:"roots"`
+	Files    []planEntry `json:"files"`
+	Summary  *runSummary `json:"summary"`
+}
+
+// planEntry is what happens to a single file.
+type planEntry struct {
+	// Root is the index in Roots of the root Path is relative to, in a
+	// Relative plan. NewPath and the path of Collision are relative to it
+	// too if they are in it, and absolute otherwise.
+	Root    *int   `json:"root,omitempty"`
+	Path    string `json:"path"`
+	NewPath string `json:"newPath,omitempty"`
+	// Action is "rename" (or "renamed" if not a dry run), "skip" or
+	// "error".
+	Action string `json:"action"`
+	// Reason is the skipReasons key of a skipped file.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Size and ModTime are the size and modification time of the file when
+	// it was planned (or renamed).
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"modTime,omitzero"`
+	// SHA256 is the hex SHA-256 of the contents of a file to rename, if
+	// the plan was made with PlanHash.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// CreationTime is the time the new name was worked out from, read from
+	// DateTag.
+	CreationTime time.Time `json:"creationTime,omitzero"`
+	DateTag      string    `json:"dateTag,omitempty"`
+	Metadata     *Exif     `json:"metadata,omitempty"`
+	Warning      string    `json:"warning,omitempty"`
+
+	// Collision is set if a different file already has the new name.
+	Collision *planCollision `json:"collision,omitempty"`
+	// OnCollision is the OnCollision policy of the file, which apply
+	// follows if its new name is taken by then.
+	OnCollision string `json:"onCollision,omitempty"`
+
+	// Sidecars are the files renamed along with the file, such as its AAE
+	// files or the video of a Live Photo, which have entries of their own
+	// only as skipped.
+	Sidecars []planSidecar `json:"sidecars,omitempty"`
+}
+
+// planSidecar is a sidecar of a file in a plan, with the same kind of paths
+// as its entry. NewPath is empty if the sidecar is deleted.
+type planSidecar struct {
+	Path    string `json:"path"`
+	NewPath string `json:"newPath,omitempty"`
+}
+
+// planCollision describes a file that already has the new name of another.
+type planCollision struct {
+	Path string `json:"path"`
+	// Policy is the OnCollision policy that applies.
+	Policy string `json:"policy"`
+}
+
+// newPlanEntry returns the plan entry of a result yielded by Renames.
+func newPlanEntry(result RenameResult, err error, dryRun bool, onCollision string) planEntry {
+	entry := planEntry{
+		Path:         encodePath(result.FilePath),
+		NewPath:      encodePath(result.NewFilePath),
+		CreationTime: result.CreationTime,
+		DateTag:      result.DateTag,
+		Warning:      result.Warning,
+	}
+	for _, sidecar := range result.Sidecars {
+		entry.Sidecars = append(entry.Sidecars, planSidecar{Path: encodePath(sidecar.FilePath), NewPath: encodePath(sidecar.NewFilePath)})
+	}
+	if !reflect.ValueOf(result.Exif).IsZero() {
+		exif := result.Exif
+		entry.Metadata = &exif
+	}
+	// Renamed files are only found at their new path.
+	statPath := result.FilePath
+	if err == nil && !dryRun {
+		statPath = result.NewFilePath
+	}
+	oldInfo, statErr := os.Stat(statPath)
+	if statErr == nil {
+		entry.Size, entry.ModTime = oldInfo.Size(), oldInfo.ModTime()
+	}
+	switch key, ok := skipReason(err); {
+	case err == nil:
+		entry.Action = "renamed"
+		if dryRun {
+			entry.Action = "rename"
+			entry.OnCollision = onCollision
+		}
+	case ok:
+		entry.Action, entry.Reason = "skip", key
+	default:
+		entry.Action, entry.Error = "error", err.Error()
+	}
+	if dryRun && result.NewFilePath != "" && result.NewFilePath != result.FilePath {
+		newInfo, err := os.Lstat(result.NewFilePath)
+		if err == nil && (statErr != nil || !os.SameFile(oldInfo, newInfo)) {
+			entry.Collision = &planCollision{Path: encodePath(result.NewFilePath), Policy: onCollision}
+		}
+	}
+	return entry
+}
+
+// collisionPolicy returns the collision policy recorded for entry, or an
+// empty string if there is none.
+func (entry *planEntry) collisionPolicy() string {
+	if entry.Collision != nil && entry.Collision.Policy != "" {
+		return entry.Collision.Policy
+	}
+	return entry.OnCollision
+}
+
+// write writes the plan as JSON to w.
+func (plan *renamePlan) write(w io.Writer) error {
+	if plan.Files == nil {
+		plan.Files = []planEntry{}
+	}
+	if plan.Relative {
+		for i := range plan.Files {
+			plan.Files[i].relativize(plan.Roots)
+		}
+	}
+	plan.Roots = encodePaths(plan.Roots)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
+
+// relativize makes the paths of entry relative to the innermost of roots
+// that its file is in, if any.
+func (entry *planEntry) relativize(roots []string) {
+	root, relPath, ok := innermostRoot(roots, decodePath(entry.Path))
+	if !ok || relPath == "" {
+		return
+	}
+	entry.Root, entry.Path = &root, encodePath(relPath)
+	relativize := func(path string) string {
+		if _, relPath, ok := innermostRoot(roots[root:root+1], decodePath(path)); ok && relPath != "" {
+			return encodePath(relPath)
+		}
+		return path
+	}
+	if entry.NewPath != "" {
+		entry.NewPath = relativize(entry.NewPath)
+	}
+	if entry.Collision != nil {
+		entry.Collision.Path = relativize(entry.Collision.Path)
+	}
+	for i, sidecar := range entry.Sidecars {
+		entry.Sidecars[i].Path = relativize(sidecar.Path)
+		if sidecar.NewPath != "" {
+			entry.Sidecars[i].NewPath = relativize(sidecar.NewPath)
+		}
+	}
+}
+
+// resolve returns the paths of entry, made absolute again with roots if
+// they are relative.
+func (entry *planEntry) resolve(roots []string) (filePath, newFilePath string, err error) {
+	filePath = decodePath(entry.Path)
+	if entry.Root != nil && (*entry.Root < 0 || *entry.Root >= len(roots)) {
+		return "", "", fmt.Errorf("%s: no root %d in the plan", filePath, *entry.Root)
+	}
+	return entry.resolvePath(roots, entry.Path), entry.resolvePath(roots, entry.NewPath), nil
+}
+
+// resolvePath decodes path, a path of entry or of one of its sidecars, and
+// makes it absolute again with roots if it is relative. The root of entry
+// must be in roots, as checked by resolve.
+func (entry *planEntry) resolvePath(roots []string, path string) string {
+	path = decodePath(path)
+	if entry.Root == nil || path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(roots[*entry.Root], path)
+}
+
+// parseOutputFormat validates an -output value.
+func parseOutputFormat(value string) (string, error) {
+	switch value {
+	case "text", "json":
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (want text or json)", value)
+}
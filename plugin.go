@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Plugins are executables in the plugins directory that talk to jpegid over
+// stdio using newline-delimited JSON. jpegid writes one pluginRequest per
+// line to the plugin's stdin and reads back exactly one pluginResponse per
+// line from its stdout. A plugin is started once per worker and stays open
+// until its stdin is closed.
+//
+// The first request is always {"type":"describe"}, to which the plugin
+// answers with its name, what it provides ("metadata" and/or "namer") and,
+// for metadata plugins, the file extensions it handles.
+//
+// A "metadata" request carries the path of a file and expects back an
+// "exif" object with the same fields as jpegid's Exif struct, or
+// "noMetadata": true if the file has no creation time.
+//
+// A "name" request carries the path, the creation time, the metadata (both
+// as an "exif" object and decoded as a Metadata "metadata" object) and the
+// new path jpegid would have chosen, and expects back a "newPath".
+//
+// Any response may set "error" to report a failure for that file.
+type pluginRequest struct {
+	Type         string    `json:"type"`
+	Path         string    `json:"path,omitempty"`
+	CreationTime time.Time `json:"creationTime,omitzero"`
+	Exif         *Exif     `json:"exif,omitempty"`
+	Metadata     *Metadata `json:"metadata,omitempty"`
+	NewPath      string    `json:"newPath,omitempty"`
+}
+
+type pluginResponse struct {
+	Name       string   `json:"name,omitempty"`
+	Provides   []string `json:"provides,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	Exif       *Exif    `json:"exif,omitempty"`
+	NoMetadata bool     `json:"noMetadata,omitempty"`
+	NewPath    string   `json:"newPath,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// pluginInfo describes a plugin found in the plugins directory.
+type pluginInfo struct {
+	Name       string
+	Path       string
+	Provides   []string
+	Extensions []string
+}
+
+// defaultPluginsDir returns the directory plugins are discovered in when
+// PluginsDir is empty.
+func defaultPluginsDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "jpegid", "plugins"), nil
+}
+
+// discoverPlugins starts every executable in dir and asks it to describe
+// itself. A missing dir means no plugins.
+func discoverPlugins(dir string, stderr io.Writer) ([]pluginInfo, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var plugins []pluginInfo
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, dirEntry.Name())
+		client, info, err := startPlugin(path, stderr)
+		if err != nil {
+			return nil, err
+		}
+		_ = client.Close()
+		plugins = append(plugins, info)
+	}
+	return plugins, nil
+}
+
+// pluginClient is a running plugin process.
+type pluginClient struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// startPlugin starts the plugin at path and performs the describe
+// handshake.
+func startPlugin(path string, stderr io.Writer) (*pluginClient, pluginInfo, error) {
+	cmd := exec.Command(path)
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, pluginInfo{}, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, pluginInfo{}, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, pluginInfo{}, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	client := &pluginClient{
+		name:   filepath.Base(path),
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}
+	response, err := client.call(pluginRequest{Type: "describe"})
+	if err != nil {
+		_ = client.Close()
+		return nil, pluginInfo{}, err
+	}
+	info := pluginInfo{
+		Name:     response.Name,
+		Path:     path,
+		Provides: response.Provides,
+	}
+	if info.Name == "" {
+		info.Name = client.name
+	}
+	client.name = info.Name
+	for _, ext := range response.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		info.Extensions = append(info.Extensions, ext)
+	}
+	return client, info, nil
+}
+
+func (client *pluginClient) call(request pluginRequest) (pluginResponse, error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return pluginResponse{}, err
+	}
+	_, err = client.stdin.Write(append(b, '\n'))
+	if err != nil {
+		return pluginResponse{}, fmt.Errorf("plugin %s: %w", client.name, err)
+	}
+	line, err := client.stdout.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return pluginResponse{}, fmt.Errorf("plugin %s: %w", client.name, err)
+	}
+	var response pluginResponse
+	err = json.Unmarshal(line, &response)
+	if err != nil {
+		return pluginResponse{}, fmt.Errorf("plugin %s: invalid response %q: %w", client.name, line, err)
+	}
+	if response.Error != "" {
+		return response, fmt.Errorf("plugin %s: %s", client.name, response.Error)
+	}
+	return response, nil
+}
+
+func (client *pluginClient) Close() error {
+	_ = client.stdin.Close()
+	return client.cmd.Wait()
+}
+
+// pluginExtractor is a MetadataExtractor backed by a metadata plugin.
+type pluginExtractor struct {
+	client *pluginClient
+}
+
+func (extractor *pluginExtractor) Extract(filePath string) (Exif, error) {
+	response, err := extractor.client.call(pluginRequest{Type: "metadata", Path: filePath})
+	if err != nil {
+		return Exif{}, err
+	}
+	if response.NoMetadata || response.Exif == nil {
+		return Exif{}, ErrNoMetadata
+	}
+	return *response.Exif, nil
+}
+
+func (extractor *pluginExtractor) Close() error {
+	return extractor.client.Close()
+}
+
+// pluginNamer chooses new file names using a namer plugin.
+type pluginNamer struct {
+	client *pluginClient
+}
+
+func (namer *pluginNamer) name(result RenameResult) (string, error) {
+	exif := result.Exif
+	response, err := namer.client.call(pluginRequest{
+		Type:         "name",
+		Path:         result.FilePath,
+		CreationTime: result.CreationTime,
+		Exif:         &exif,
+		Metadata:     &result.Metadata,
+		NewPath:      result.NewFilePath,
+	})
+	if err != nil {
+		return "", err
+	}
+	if response.NewPath == "" {
+		return "", fmt.Errorf("plugin %s: empty newPath", namer.client.name)
+	}
+	newPath := response.NewPath
+	if !filepath.IsAbs(newPath) {
+		newPath = filepath.Join(filepath.Dir(result.FilePath), newPath)
+	}
+	return newPath, nil
+}
+
+// findPlugin returns the plugin with the given name that provides
+// capability.
+func findPlugin(plugins []pluginInfo, name, capability string) (pluginInfo, error) {
+	for _, plugin := range plugins {
+		if plugin.Name == name {
+			if !slices.Contains(plugin.Provides, capability) {
+				return pluginInfo{}, fmt.Errorf("plugin %s does not provide %s", name, capability)
+			}
+			return plugin, nil
+		}
+	}
+	return pluginInfo{}, fmt.Errorf("plugin %s not found", name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// presets are the flags set by each -preset, in the order they are set.
+var presets = map[string][][2]string{
+	// Apple Photos "Export Unmodified Originals": IMG_1234.HEIC with its
+	// IMG_1234.xmp (if "Export IPTC as XMP" was ticked), IMG_1234.AAE and
+	// IMG_1234.MOV if it is a Live Photo, and IMG_E1234.JPG if it was
+	// edited.
+	"apple-photos": {
+		{"aae", aaePair},
+		{"sidecar-ext", ".xmp"},
+		{"live-photos", "true"},
+		{"pair-edits", "true"},
+	},
+	// The year and month folders Synology Photos and QNAP QuMagie back up
+	// phones into, which their timeline and folder views both expect.
+	"synology-photos": {
+		{"recursive", "true"},
+		{"name-template", "{{.Year}}/{{.Month}}/{{.Default}}"},
+	},
+	"qumagie": {
+		{"recursive", "true"},
+		{"name-template", "{{.Year}}/{{.Month}}/{{.Default}}"},
+	},
+	// The names the Dropbox and OneDrive camera uploads give photos, in
+	// their wall clock time to the second with a -1 suffix for photos
+	// taken in the same second, e.g. 2023-09-14 10.15.30.jpg.
+	"dropbox":  cameraUploadsPreset,
+	"onedrive": cameraUploadsPreset,
+}
+
+var cameraUploadsPreset = [][2]string{
+	{"precision", precisionSeconds},
+	{"on-collision", collisionSuffix},
+	{"name-template", "{{.Dir}}/{{.Year}}-{{.Month}}-{{.Day}} {{.Hour}}.{{.Minute}}.{{.Second}}"},
+}
+
+// presetNames returns the names of the presets, sorted.
+func presetNames() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// lookupPreset returns the flags of a -preset.
+func lookupPreset(name string) ([][2]string, error) {
+	preset, ok := presets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q (want %s)", name, strings.Join(presetNames(), ", "))
+	}
+	return preset, nil
+}
+
+// nasMetadataDirs are the directories NASes keep their own thumbnails,
+// indexes, recycle bins and snapshots in next to the files they index,
+// which are skipped by every walk.
+var nasMetadataDirs = []string{
+	// Synology.
+	"@eaDir", "#recycle", "#snapshot",
+	// QNAP.
+	".@__thumb", "@__thumb", "@Recycle", "@Recently-Snapshot",
+}
+
+// isNASMetadataDir reports whether name is one of nasMetadataDirs.
+func isNASMetadataDir(name string) bool {
+	return slices.Contains(nasMetadataDirs, name)
+}
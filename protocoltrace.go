@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// protocolTracer logs everything sent to and received from exiftool
+// processes, for -trace-exiftool. Each line is prefixed with the time, the
+// ID of the worker's exiftool process and the direction: > for stdin, < for
+// stdout, ! for stderr and * for events like the process starting. Data is
+// quoted so that partial lines and stray bytes are visible, which is what
+// an "unexpected EOF" from exiftool usually comes down to.
+type protocolTracer struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	nextID int
+}
+
+// nextWorker returns the ID of a new exiftool process.
+func (tracer *protocolTracer) nextWorker() int {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.nextID++
+	return tracer.nextID
+}
+
+func (tracer *protocolTracer) line(id int, direction string, data string) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	fmt.Fprintf(tracer.w, "%s exiftool[%d] %s %s\n", time.Now().Format("15:04:05.000000"), id, direction, data)
+}
+
+func (tracer *protocolTracer) event(id int, format string, args ...any) {
+	tracer.line(id, "*", fmt.Sprintf(format, args...))
+}
+
+// traceWriter writes the data written to it to a protocolTracer a line at
+// a time.
+type traceWriter struct {
+	tracer    *protocolTracer
+	id        int
+	direction string
+	partial   []byte
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.tracer.line(w.id, w.direction, fmt.Sprintf("%q", w.partial[:i+1]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes out an incomplete last line.
+func (w *traceWriter) flush() {
+	if len(w.partial) > 0 {
+		w.tracer.line(w.id, w.direction, fmt.Sprintf("%q", w.partial))
+		w.partial = nil
+	}
+}
+
+// traceReader copies what is read from r to trace, and logs how reading
+// ended.
+type traceReader struct {
+	r     io.Reader
+	trace *traceWriter
+}
+
+func (r *traceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	_, _ = r.trace.Write(p[:n])
+	if err != nil {
+		r.trace.flush()
+		r.trace.tracer.event(r.trace.id, "%s closed: %v", r.trace.direction, err)
+	}
+	return n, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isJPEG reports whether filePath has a JPEG extension.
+func isJPEG(filePath string) bool {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jpg", ".jpeg", ".jpe":
+		return true
+	}
+	return false
+}
+
+// jpegTrailerSize is how far from the end of a JPEG the EOI marker is looked
+// for, since some cameras append their own data after it.
+const jpegTrailerSize = 64 * 1024
+
+// checkJPEG returns an ErrCorrupt error if filePath doesn't start with the
+// JPEG SOI marker or is missing the EOI marker at its end, which is what
+// truncated scan data looks like.
+func checkJPEG(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 2)
+	_, err = io.ReadFull(file, head)
+	if err != nil || !bytes.Equal(head, []byte{0xFF, 0xD8}) {
+		return fmt.Errorf("%w: no start of image marker", ErrCorrupt)
+	}
+	tailSize := min(fileInfo.Size()-2, jpegTrailerSize)
+	tail := make([]byte, tailSize)
+	_, err = file.ReadAt(tail, fileInfo.Size()-tailSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(tail, []byte{0xFF, 0xD9}) {
+		return fmt.Errorf("%w: no end of image marker (truncated?)", ErrCorrupt)
+	}
+	return nil
+}
+
+// quarantineRecord is a line of the quarantine report.
+type quarantineRecord struct {
+	Time   time.Time `json:"time"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	Reason string    `json:"reason"`
+}
+
+// fileQuarantine moves corrupt files out of the roots into a directory,
+// keeping their paths relative to their root, and appends a record of each
+// to quarantine.jsonl in that directory.
+type fileQuarantine struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+// move moves filePath in root into the quarantine and returns where it ended
+// up.
+func (quarantine *fileQuarantine) move(now time.Time, root, filePath string, reason error) (string, error) {
+	relPath, err := filepath.Rel(root, filePath)
+	if err != nil {
+		relPath = filepath.Base(filePath)
+	}
+	quarantine.mutex.Lock()
+	defer quarantine.mutex.Unlock()
+	newFilePath := filepath.Join(quarantine.dir, relPath)
+	err = os.MkdirAll(filepath.Dir(newFilePath), 0755)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Lstat(newFilePath)
+	if err == nil {
+		newFilePath, err = availablePath(newFilePath, filePath, os.Lstat)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(filePath, newFilePath)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(quarantineRecord{Time: now, Old: encodePath(filePath), New: encodePath(newFilePath), Reason: reason.Error()})
+	if err != nil {
+		return newFilePath, err
+	}
+	report, err := os.OpenFile(filepath.Join(quarantine.dir, "quarantine.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return newFilePath, err
+	}
+	_, err = report.Write(append(b, '\n'))
+	if err != nil {
+		_ = report.Close()
+		return newFilePath, err
+	}
+	return newFilePath, report.Close()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Recovery actions for Recover.
+const (
+	// recoverForward finishes the renames a crash interrupted, keeping the
+	// rest of the run.
+	recoverForward = "forward"
+	// recoverBack undoes the whole run.
+	recoverBack = "back"
+)
+
+// parseRecoverAction validates a -recover value.
+func parseRecoverAction(value string) (string, error) {
+	switch value {
+	case recoverForward, recoverBack:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown recovery action %q (want forward or back)", value)
+}
+
+// journalRecovery recovers the runs in a journal directory that crashed in
+// the middle of a rename, before a run that may touch the same files.
+type journalRecovery struct {
+	// action is recoverForward or recoverBack, or empty to ask on stdin.
+	action string
+	// roots are the directories the coming run may change. Only runs with a
+	// root in or around one of them are recovered.
+	roots []string
+	// dirMode is the mode of the directories created to move files back
+	// into or forward to, as with DirMode.
+	dirMode fs.FileMode
+	// stdin is where to ask, or nil if it is taken by the input of the run,
+	// such as the list of files of -files-from - or the plan of apply.
+	stdin  io.Reader
+	stderr io.Writer
+	now    func() time.Time
+}
+
+// recoverJournals finds the runs in the journals of dir that crashed in the
+// middle of a rename, and rolls each forward or back according to action,
+// asking on stdin if it is empty, so that a run never starts from a tree
+// left half renamed. Runs that are still going hold a lock on their
+// journal, and are left alone. Files are moved as a merge moves them, so
+// that runs that moved files across devices can be rolled either way, and
+// the copies stop once ctx is done.
+func (recovery *journalRecovery) recoverJournals(ctx context.Context, dir string) error {
+	journals, err := readJournals(dir, true)
+	if err != nil {
+		return err
+	}
+	var stdin *bufio.Reader
+	for _, runJournal := range journals {
+		if runJournal.End != nil || runJournal.Recovered != nil {
+			// A run only finishes once every intent has its rename
+			// or fail record.
+			continue
+		}
+		if !rootsOverlap(runJournal.Run.Roots, recovery.roots) {
+			continue
+		}
+		uncommitted := runJournal.uncommitted()
+		if len(uncommitted) == 0 {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, runJournal.Run.ID+".jsonl"))
+		if err != nil {
+			return err
+		}
+		locked, err := tryLockFile(file)
+		if err == nil && !locked {
+			file.Close()
+			fmt.Fprintf(recovery.stderr, "warning: run %s is still renaming files in the same roots\n", runJournal.Run.ID)
+			continue
+		}
+		// Filesystems without locks, such as some network mounts, are
+		// recovered without one.
+		err = recovery.recoverJournal(ctx, dir, runJournal, uncommitted, &stdin)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverJournal rolls runJournal forward or back, asking on stdin if
+// action is empty. A roll back that could not move every file back is an
+// error, and is not recorded, so that it is tried again by the next run.
+func (recovery *journalRecovery) recoverJournal(ctx context.Context, dir string, runJournal journal, uncommitted []journalRecord, stdin **bufio.Reader) error {
+	action := recovery.action
+	if action == "" {
+		if recovery.stdin == nil {
+			return fmt.Errorf("run %s was interrupted in the middle of renaming files, use -recover forward or -recover back (stdin is the input of the run, so it can't be asked)", runJournal.Run.ID)
+		}
+		if *stdin == nil {
+			*stdin = bufio.NewReader(recovery.stdin)
+		}
+		var err error
+		action, err = recovery.askRecover(*stdin, runJournal, len(uncommitted))
+		if err != nil {
+			return err
+		}
+	}
+	var renamed int
+	var renames []journalRecord
+	if action == recoverForward {
+		renamed, renames = recovery.rollForward(ctx, uncommitted)
+	} else {
+		var err error
+		renamed, err = recovery.rollBack(ctx, runJournal, uncommitted)
+		if err != nil {
+			return fmt.Errorf("unable to roll back run %s: %w", runJournal.Run.ID, err)
+		}
+	}
+	err := appendJournal(dir, runJournal.Run.ID, append(renames, journalRecord{Type: "recover", Time: recovery.now(), Action: action, Renamed: renamed})...)
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	fmt.Fprintf(recovery.stderr, "recovered run %s: rolled %s (%d files)\n", runJournal.Run.ID, action, renamed)
+	return nil
+}
+
+// rootsOverlap reports whether any of a is in, or around, any of b.
+func rootsOverlap(a, b []string) bool {
+	for _, root := range a {
+		if _, _, ok := innermostRoot(b, root); ok {
+			return true
+		}
+	}
+	for _, root := range b {
+		if _, _, ok := innermostRoot(a, root); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// askRecover prompts on stdin for how to recover runJournal. End of input is
+// an error rather than a default, as either choice moves files.
+func (recovery *journalRecovery) askRecover(stdin *bufio.Reader, runJournal journal, uncommitted int) (string, error) {
+	for {
+		fmt.Fprintf(recovery.stderr, "run %s (%s) was interrupted with %d renames in progress. Roll [f]orward (finish them) or [b]ack (undo the run)? ", runJournal.Run.ID, runJournal.Run.Time.Format("2006-01-02 15:04:05"), uncommitted)
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				fmt.Fprintln(recovery.stderr)
+				return "", fmt.Errorf("run %s was interrupted in the middle of renaming files, use -recover forward or -recover back", runJournal.Run.ID)
+			}
+			return "", err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "f", "forward":
+			return recoverForward, nil
+		case "b", "back":
+			return recoverBack, nil
+		}
+	}
+}
+
+// exists reports whether path exists, treating errors other than
+// fs.ErrNotExist as existence so that nothing is moved onto it.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// rollForward finishes the uncommitted renames: those that happened are
+// recorded, those that didn't are carried out unless their new path has been
+// taken since. It returns how many there were and the records of them.
+func (recovery *journalRecovery) rollForward(ctx context.Context, uncommitted []journalRecord) (int, []journalRecord) {
+	var renames []journalRecord
+	for _, intent := range uncommitted {
+		oldExists, newExists := exists(intent.Old), exists(intent.New)
+		switch {
+		case !oldExists && newExists:
+		case oldExists && !newExists:
+			err := makeDirs(filepath.Dir(intent.New), recovery.dirMode)
+			if err == nil {
+				err = moveFile(ctx, intent.Old, intent.New)
+			}
+			if err != nil {
+				fmt.Fprintf(recovery.stderr, "warning: recover: %v\n", err)
+				continue
+			}
+		default:
+			fmt.Fprintf(recovery.stderr, "warning: recover: unable to finish renaming %s to %s, leaving it as it is\n", intent.Old, intent.New)
+			continue
+		}
+		renames = append(renames, journalRecord{Type: "rename", Time: recovery.now(), Old: intent.Old, New: intent.New})
+	}
+	return len(renames), renames
+}
+
+// rollBack undoes the renames of runJournal, latest first so that files
+// moved more than once (such as burst frames) end up where they started,
+// along with the uncommitted ones that happened. It returns how many files
+// were moved back, and an error if any could not be.
+func (recovery *journalRecovery) rollBack(ctx context.Context, runJournal journal, uncommitted []journalRecord) (int, error) {
+	renames := slices.Concat(runJournal.Renames, uncommitted)
+	slices.SortStableFunc(renames, func(a, b journalRecord) int {
+		return a.Time.Compare(b.Time)
+	})
+	undone := 0
+	var errs []error
+	for _, rename := range slices.Backward(renames) {
+		if exists(rename.Old) || !exists(rename.New) {
+			// Not renamed, or changed since.
+			continue
+		}
+		err := makeDirs(filepath.Dir(rename.Old), recovery.dirMode)
+		if err == nil {
+			err = moveFile(ctx, rename.New, rename.Old)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		undone++
+	}
+	return undone, errors.Join(errs...)
+}
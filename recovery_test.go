@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crashedRun journals a rename of root/a.jpg to root/b.jpg that never
+// finished, and returns the writer of the journal, still open.
+func crashedRun(t *testing.T, journalDir, root string) *journalWriter {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(root, "a.jpg"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalWriter := newJournalWriter(journalDir, time.Now(), []string{root}, nil)
+	err = journalWriter.intend(time.Now(), filepath.Join(root, "a.jpg"), filepath.Join(root, "2024", "b.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journalWriter
+}
+
+func TestRecoverJournals(t *testing.T) {
+	journalDir, root := t.TempDir(), t.TempDir()
+	journalWriter := crashedRun(t, journalDir, root)
+	recovery := &journalRecovery{
+		action: recoverForward,
+		roots:  []string{root},
+		stderr: io.Discard,
+		now:    time.Now,
+	}
+
+	// The run is still going.
+	err := recovery.recoverJournals(context.Background(), journalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.jpg")); err != nil {
+		t.Fatalf("a live run was recovered: %v", err)
+	}
+
+	// The run crashed.
+	journalWriter.file.Close()
+	recovery.roots = []string{t.TempDir()}
+	err = recovery.recoverJournals(context.Background(), journalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.jpg")); err != nil {
+		t.Fatalf("a run in other roots was recovered: %v", err)
+	}
+	recovery.roots = []string{filepath.Dir(root)}
+	err = recovery.recoverJournals(context.Background(), journalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "b.jpg")); err != nil {
+		t.Fatalf("the run was not rolled forward: %v", err)
+	}
+	runJournal, err := readJournal(filepath.Join(journalDir, journalWriter.run.ID+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runJournal.Recovered == nil || runJournal.Recovered.Action != recoverForward {
+		t.Fatalf("Recovered = %+v, want a forward recovery", runJournal.Recovered)
+	}
+}
+
+func TestRecoverJournalsWithoutStdin(t *testing.T) {
+	journalDir, root := t.TempDir(), t.TempDir()
+	crashedRun(t, journalDir, root).file.Close()
+	recovery := &journalRecovery{
+		roots:  []string{root},
+		stderr: io.Discard,
+		now:    time.Now,
+	}
+	err := recovery.recoverJournals(context.Background(), journalDir)
+	if err == nil || !strings.Contains(err.Error(), "-recover") {
+		t.Fatalf("recoverJournals without stdin = %v, want an error asking for -recover", err)
+	}
+}
+
+func TestJournalOutcomes(t *testing.T) {
+	journalDir, root := t.TempDir(), t.TempDir()
+	recovery := &journalRecovery{
+		roots:  []string{root},
+		stderr: io.Discard,
+		now:    time.Now,
+	}
+
+	// An interrupted run whose intent failed needs no recovery.
+	journalWriter := crashedRun(t, journalDir, root)
+	err := journalWriter.fail(time.Now(), filepath.Join(root, "a.jpg"), filepath.Join(root, "2024", "b.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journalWriter.close(time.Now(), newRunSummary([]string{root}, false), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recovery.recoverJournals(context.Background(), journalDir)
+	if err != nil {
+		t.Fatalf("recoverJournals() = %v for a run with every outcome recorded", err)
+	}
+
+	// A run that failed with an intent left open has no end.
+	journalWriter = crashedRun(t, t.TempDir(), root)
+	err = journalWriter.close(time.Now(), newRunSummary([]string{root}, false), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runJournal, err := readJournal(filepath.Join(journalWriter.dir, journalWriter.run.ID+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runJournal.End != nil {
+		t.Fatalf("End = %+v, want none with an intent left open", runJournal.End)
+	}
+}
+
+func TestRecoverBeforeRename(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	journalDir, err := defaultJournalDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	crashedRun(t, journalDir, root).file.Close()
+
+	// Without -recover, the files are asked about before any are shifted.
+	err = recoverBeforeRename(context.Background(), []string{filepath.Join(root, "c.jpg")}, "", strings.NewReader(""), io.Discard)
+	if err == nil {
+		t.Fatal("recoverBeforeRename with nothing on stdin succeeded, want an error before shifting")
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.jpg")); err != nil {
+		t.Fatalf("the run was recovered without an answer: %v", err)
+	}
+
+	err = recoverBeforeRename(context.Background(), []string{filepath.Join(root, "c.jpg")}, recoverBack, nil, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.jpg")); err != nil {
+		t.Fatalf("the run was not rolled back: %v", err)
+	}
+	err = recoverBeforeRename(context.Background(), []string{filepath.Join(root, "c.jpg")}, "", nil, io.Discard)
+	if err != nil {
+		t.Fatalf("recoverBeforeRename() = %v once the run was recovered", err)
+	}
+}
+
+func TestRollBackIncomplete(t *testing.T) {
+	journalDir, root := t.TempDir(), t.TempDir()
+	// A directory can't be moved back into itself, so the roll back fails.
+	newPath := filepath.Join(root, "d")
+	oldPath := filepath.Join(newPath, "sub", "a.jpg")
+	err := os.Mkdir(newPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalWriter := newJournalWriter(journalDir, time.Now(), []string{root}, nil)
+	err = journalWriter.intend(time.Now(), oldPath, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalWriter.file.Close()
+	recovery := &journalRecovery{
+		action: recoverBack,
+		roots:  []string{root},
+		stderr: io.Discard,
+		now:    time.Now,
+	}
+	err = recovery.recoverJournals(context.Background(), journalDir)
+	if err == nil {
+		t.Fatal("recoverJournals() succeeded with a file that could not be moved back")
+	}
+	runJournal, err := readJournal(filepath.Join(journalDir, journalWriter.run.ID+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runJournal.Recovered != nil {
+		t.Fatalf("Recovered = %+v, want none for an incomplete roll back", runJournal.Recovered)
+	}
+}
+
+func TestJournalFinished(t *testing.T) {
+	journalDir, root := t.TempDir(), t.TempDir()
+	summary := newRunSummary([]string{root}, false)
+
+	ended := crashedRun(t, journalDir, root)
+	err := ended.rename(time.Now(), filepath.Join(root, "a.jpg"), filepath.Join(root, "2024", "b.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ended.close(time.Now(), summary, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := crashedRun(t, journalDir, root)
+	crashed.file.Close()
+	torn := crashedRun(t, journalDir, root)
+	torn.file.Close()
+	err = appendJournal(journalDir, torn.run.ID, journalRecord{Type: "end", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tornName := filepath.Join(journalDir, torn.run.ID+".jsonl")
+	info, err := os.Stat(tornName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the end record short, as a crash while writing it would.
+	err = os.Truncate(tornName, info.Size()-5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"ended", ended.run.ID, true},
+		{"crashed", crashed.run.ID, false},
+		{"torn end record", torn.run.ID, false},
+	}
+	for _, tt := range tests {
+		finished, err := journalFinished(filepath.Join(journalDir, tt.id+".jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished != tt.want {
+			t.Errorf("%s: journalFinished() = %v, want %v", tt.name, finished, tt.want)
+		}
+	}
+	journals, err := readJournals(journalDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journals) != 2 {
+		t.Fatalf("readJournals() read %d unfinished journals, want 2", len(journals))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// reportEntry is a single row of the HTML report.
+type reportEntry struct {
+	FilePath    string
+	NewFilePath string
+	Status      string
+	Error       string
+	Warning     string
+	Thumbnail   template.URL
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>jpegid report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.5em; text-align: left; vertical-align: middle; }
+td.thumbnail { width: 160px; }
+img { max-width: 160px; max-height: 160px; }
+tr.error { background: #fdd; }
+tr.skipped { background: #ffd; }
+.warning { color: #a60; }
+.path { font-family: monospace; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>jpegid report</h1>
+<p>Generated {{ .Time.Format "2006-01-02 15:04:05 -0700" }}{{ if .DryRun }} (dry run, no files were renamed){{ end }}.
+{{ .Renamed }} renamed, {{ .Skipped }} skipped, {{ .Errors }} errors.</p>
+<table>
+<tr><th></th><th>Old name</th><th>New name</th><th>Status</th></tr>
+{{- range .Entries }}
+<tr class="{{ .Status }}">
+<td class="thumbnail">{{ if .Thumbnail }}<img src="{{ .Thumbnail }}" alt="">{{ end }}</td>
+<td class="path">{{ .FilePath }}</td>
+<td class="path">{{ .NewFilePath }}</td>
+<td>{{ .Status }}{{ if .Error }}: {{ .Error }}{{ end }}{{ if .Warning }}<br><span class="warning">{{ .Warning }}</span>{{ end }}</td>
+</tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+// writeHTMLReport writes a self-contained HTML report of entries to name,
+// with their paths shown with displayPath. The thumbnails of entries are
+// kept in them, so that writing the report again as more entries come in
+// only makes those of the new ones.
+func writeHTMLReport(name string, entries []reportEntry, dryRun bool, numWorkers int, now time.Time, displayPath func(string) string) error {
+	var waitGroup sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < max(numWorkers, 1); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				if entries[i].Thumbnail != "" {
+					continue
+				}
+				filePath := entries[i].FilePath
+				if entries[i].Status == "renamed" {
+					filePath = entries[i].NewFilePath
+				}
+				thumbnail, err := makeThumbnail(filePath, 160)
+				if err == nil {
+					entries[i].Thumbnail = thumbnail
+				}
+			}
+		}()
+	}
+	for i := range entries {
+		indexes <- i
+	}
+	close(indexes)
+	waitGroup.Wait()
+	entries = slices.Clone(entries)
+	for i := range entries {
+		entries[i].FilePath = displayPath(entries[i].FilePath)
+		entries[i].NewFilePath = displayPath(entries[i].NewFilePath)
+	}
+	data := struct {
+		Time    time.Time
+		DryRun  bool
+		Renamed int
+		Skipped int
+		Errors  int
+		Entries []reportEntry
+	}{
+		Time:    now,
+		DryRun:  dryRun,
+		Entries: entries,
+	}
+	for _, entry := range entries {
+		switch entry.Status {
+		case "renamed":
+			data.Renamed++
+		case "skipped":
+			data.Skipped++
+		case "error":
+			data.Errors++
+		}
+	}
+	var buf bytes.Buffer
+	err := reportTemplate.Execute(&buf, data)
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so that a report being viewed
+	// while -chunk-size rewrites it is never cut short.
+	err = os.WriteFile(name+".tmp", buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// makeThumbnail returns a JPEG data URL of the EXIF thumbnail of an image,
+// or if it doesn't have one, of the decoded image scaled down to fit within
+// size×size pixels.
+func makeThumbnail(filePath string, size int) (template.URL, error) {
+	thumbnail, err := exifThumbnail(filePath)
+	if err == nil {
+		return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(thumbnail)), nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return "", err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width > height {
+			width, height = size, max(height*size/width, 1)
+		} else {
+			width, height = max(width*size/height, 1), size
+		}
+	}
+	// Nearest-neighbour sampling is crude, but good enough for a preview.
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 75})
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
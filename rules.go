@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// extKinds are the names that stand for every extension of a kind of file in
+// an -ext-rule.
+var extKinds = map[string][]string{
+	"video": {".3gp", ".avi", ".m2ts", ".m4v", ".mkv", ".mov", ".mp4", ".mts", ".webm", ".wmv"},
+	"image": {".arw", ".avif", ".cr2", ".cr3", ".dng", ".gif", ".heic", ".heif", ".jpeg", ".jpg", ".nef", ".orf", ".png", ".raf", ".rw2", ".tif", ".tiff", ".webp"},
+}
+
+// extRule is a naming scheme and collision policy for the files with one of
+// a set of extensions.
+type extRule struct {
+	// exts are the lowercase extensions the rule applies to, with the dot.
+	exts []string
+	// tmpl names the files instead of -name-template and -route, or nil to
+	// leave their naming as it is.
+	tmpl *template.Template
+	// onCollision is the collision policy of the files instead of
+	// OnCollision, or empty to leave it as it is.
+	onCollision string
+}
+
+// parseExtRule parses an -ext-rule value, EXTS[:POLICY]=TEMPLATE, where EXTS
+// is a comma-separated list of extensions and kinds (see extKinds).
+func parseExtRule(value string) (extRule, error) {
+	var rule extRule
+	key, text, ok := strings.Cut(value, "=")
+	if !ok {
+		return rule, fmt.Errorf("invalid extension rule %q (want EXTS[:POLICY]=TEMPLATE)", value)
+	}
+	key, policy, hasPolicy := strings.Cut(key, ":")
+	for ext := range strings.SplitSeq(key, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if exts, ok := extKinds[ext]; ok {
+			rule.exts = append(rule.exts, exts...)
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		rule.exts = append(rule.exts, ext)
+	}
+	if len(rule.exts) == 0 {
+		return rule, fmt.Errorf("no extensions in %q", value)
+	}
+	if hasPolicy {
+		var err error
+		rule.onCollision, err = parseCollisionPolicy(strings.TrimSpace(policy))
+		if err != nil {
+			return rule, err
+		}
+	}
+	if strings.TrimSpace(text) != "" {
+		var err error
+		rule.tmpl, err = newNameTemplate(text)
+		if err != nil {
+			return rule, err
+		}
+	} else if rule.onCollision == "" {
+		return rule, fmt.Errorf("extension rule %q has neither a template nor a policy", value)
+	}
+	return rule, nil
+}
+
+// extRule returns the rule for filePath, the last -ext-rule naming its
+// extension, or false if there is none.
+func (jpegidCmd *JpegIDCmd) extRule(filePath string) (extRule, bool) {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	for _, rule := range slices.Backward(jpegidCmd.ExtRules) {
+		if slices.Contains(rule.exts, ext) {
+			return rule, true
+		}
+	}
+	return extRule{}, false
+}
+
+// collisionPolicy returns the collision policy of filePath.
+func (jpegidCmd *JpegIDCmd) collisionPolicy(filePath string) string {
+	if rule, ok := jpegidCmd.extRule(filePath); ok && rule.onCollision != "" {
+		return rule.onCollision
+	}
+	return jpegidCmd.OnCollision
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ShiftExifCmd struct {
+	Files []string
+	// By is how much the dates in the files are shifted, in whole seconds.
+	By         time.Duration
+	NumWorkers int
+	DryRun     bool
+	// KeepBackup keeps the copy of each file before it was changed that
+	// exiftool makes, named with an _original suffix.
+	KeepBackup bool
+	// Rename renames the files after their new dates once shifted.
+	Rename bool
+	// Recover is how a run that crashed in the middle of renaming the same
+	// files is dealt with before shifting them, as with JpegIDCmd.Recover.
+	Recover string
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+}
+
+func ShiftExifCommand(args []string) (*ShiftExifCmd, error) {
+	shiftExifCmd := &ShiftExifCmd{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	flagset := flag.NewFlagSet("shift-exif", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: jpegid shift-exif -by duration [flags] [-files] file...")
+		flagset.PrintDefaults()
+	}
+	flagset.DurationVar(&shiftExifCmd.By, "by", 0, "Shift DateTimeOriginal and CreateDate by this much, e.g. 2h or -1h30m.")
+	flagset.IntVar(&shiftExifCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.BoolVar(&shiftExifCmd.DryRun, "dry-run", false, "Print the new dates without changing the files.")
+	flagset.BoolVar(&shiftExifCmd.KeepBackup, "keep-backup", false, "Keep the original of each file next to it, with an _original suffix.")
+	flagset.BoolVar(&shiftExifCmd.Rename, "rename", true, "Rename the files after their new dates.")
+	flagset.Func("recover", "What to do with a previous run that crashed in the middle of renaming the files: forward (finish its renames) or back (undo it). Asked on stdin if not set.", func(value string) error {
+		action, err := parseRecoverAction(value)
+		if err != nil {
+			return err
+		}
+		shiftExifCmd.Recover = action
+		return nil
+	})
+	flagset.Func("files", "The files to shift, followed by any more files.", func(value string) error {
+		shiftExifCmd.Files = append(shiftExifCmd.Files, value)
+		return nil
+	})
+	err := flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	shiftExifCmd.Files = append(shiftExifCmd.Files, flagset.Args()...)
+	if shiftExifCmd.By == 0 {
+		flagset.Usage()
+		return nil, errors.New("shift-exif needs -by")
+	}
+	if shiftExifCmd.By%time.Second != 0 {
+		return nil, fmt.Errorf("invalid -by %s (want whole seconds)", shiftExifCmd.By)
+	}
+	if len(shiftExifCmd.Files) == 0 {
+		flagset.Usage()
+		return nil, errors.New("shift-exif needs files")
+	}
+	for i, file := range shiftExifCmd.Files {
+		shiftExifCmd.Files[i], err = filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shiftExifCmd, nil
+}
+
+// shiftDateTags are the tags shifted by shift-exif. SubSecDateTimeOriginal
+// is made up of DateTimeOriginal, so it is shifted too.
+var shiftDateTags = []string{"DateTimeOriginal", "CreateDate"}
+
+// exifToolShift returns d as an exiftool date/time shift, Y:M:D H:M:S.
+func exifToolShift(d time.Duration) string {
+	d = d.Abs()
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	return fmt.Sprintf("0:0:%d %d:%d:%d", days, d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second)
+}
+
+func (shiftExifCmd *ShiftExifCmd) Run(ctx context.Context) error {
+	version, err := GetExifToolVersion()
+	if err != nil {
+		return err
+	}
+	commonArgs := version.CommonArgs()
+	if shiftExifCmd.Rename && !shiftExifCmd.DryRun {
+		// Recover before shifting rather than when renaming, so that an
+		// interrupted run never leaves the dates shifted but the files
+		// not renamed.
+		err := recoverBeforeRename(ctx, shiftExifCmd.Files, shiftExifCmd.Recover, shiftExifCmd.Stdin, shiftExifCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	var args []string
+	operator := "+="
+	if shiftExifCmd.By < 0 {
+		operator = "-="
+	}
+	for _, tag := range shiftDateTags {
+		args = append(args, "-"+tag+operator+exifToolShift(shiftExifCmd.By))
+	}
+	// -P keeps the modification time of the files.
+	args = append(args, "-P")
+	if !shiftExifCmd.KeepBackup {
+		args = append(args, "-overwrite_original")
+	}
+	var mutex sync.Mutex
+	var shifted []string
+	failed := 0
+	var waitGroup sync.WaitGroup
+	files := make(chan string)
+	for i := 0; i < max(min(shiftExifCmd.NumWorkers, len(shiftExifCmd.Files)), 1); i++ {
+		client, err := NewExifToolClient(shiftExifCmd.Stderr, commonArgs...)
+		if err != nil {
+			close(files)
+			waitGroup.Wait()
+			return err
+		}
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer client.Close()
+			for filePath := range files {
+				var err error
+				if shiftExifCmd.DryRun {
+					err = shiftExifCmd.printShift(client, filePath)
+				} else {
+					err = writeTags(client, filePath, args)
+				}
+				mutex.Lock()
+				if err != nil {
+					fmt.Fprintf(shiftExifCmd.Stderr, "%s: %v\n", filePath, err)
+					failed++
+				} else {
+					shifted = append(shifted, filePath)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, filePath := range shiftExifCmd.Files {
+		if ctx.Err() != nil {
+			break
+		}
+		files <- filePath
+	}
+	close(files)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if !shiftExifCmd.DryRun {
+		fmt.Fprintf(shiftExifCmd.Stderr, "%d files shifted by %s, %d errors\n", len(shifted), shiftExifCmd.By, failed)
+	}
+	if shiftExifCmd.Rename && !shiftExifCmd.DryRun && len(shifted) > 0 {
+		err := renameFiles(ctx, shifted, shiftExifCmd.NumWorkers, shiftExifCmd.Recover, shiftExifCmd.Stdout, shiftExifCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be shifted", failed)
+	}
+	return nil
+}
+
+// renameFiles renames files after their dates once they have been written,
+// as jpegid -files-from would, whether or not they were already named. A
+// run that crashed in the middle of renaming them is recovered according to
+// recoverAction, which must be set if there is one, as stdin is the list of
+// files.
+func renameFiles(ctx context.Context, filePaths []string, numWorkers int, recoverAction string, stdout, stderr io.Writer) error {
+	args := []string{"jpegid", "-files-from", "-", "-reprocess", "-num-workers", strconv.Itoa(numWorkers)}
+	if recoverAction != "" {
+		args = append(args, "-recover", recoverAction)
+	}
+	jpegidCmd, err := JpegIDCommand(args)
+	if err != nil {
+		return err
+	}
+	var list bytes.Buffer
+	for _, filePath := range filePaths {
+		list.WriteString(filePath)
+		list.WriteByte('\n')
+	}
+	jpegidCmd.Stdin = &list
+	jpegidCmd.Stdout = stdout
+	jpegidCmd.Stderr = stderr
+	return jpegidCmd.Run(ctx)
+}
+
+// recoverBeforeRename recovers the runs in the default journal directory
+// that crashed in the middle of renaming files in the directories of
+// filePaths, or in the working directory, which are the roots renameFiles
+// will check. They are rolled according to action, or as asked on stdin if
+// it is empty.
+func recoverBeforeRename(ctx context.Context, filePaths []string, action string, stdin io.Reader, stderr io.Writer) error {
+	journalDir, err := defaultJournalDir()
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	roots := []string{cwd}
+	for _, filePath := range filePaths {
+		if dir := filepath.Dir(filePath); !slices.Contains(roots, dir) {
+			roots = append(roots, dir)
+		}
+	}
+	recovery := &journalRecovery{
+		action: action,
+		roots:  roots,
+		stdin:  stdin,
+		stderr: stderr,
+		now:    time.Now,
+	}
+	return recovery.recoverJournals(ctx, journalDir)
+}
+
+// printShift prints the dates of a file before and after shifting.
+func (shiftExifCmd *ShiftExifCmd) printShift(client ExifToolClient, filePath string) error {
+	args := append([]string{"-s2"}, prefixAll("-", shiftDateTags)...)
+	output, err := client.Execute(append(args, filePath)...)
+	if err != nil {
+		return err
+	}
+	var changes []string
+	for _, line := range strings.Split(string(output), "\n") {
+		tag, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		const layout = "2006:01:02 15:04:05"
+		if len(value) < len(layout) {
+			continue
+		}
+		date, err := time.Parse(layout, value[:len(layout)])
+		if err != nil {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s %s => %s", tag, value[:len(layout)], date.Add(shiftExifCmd.By).Format(layout)))
+	}
+	if len(changes) == 0 {
+		return errors.New("no dates to shift")
+	}
+	fmt.Fprintf(shiftExifCmd.Stdout, "%s: %s\n", filePath, strings.Join(changes, ", "))
+	return nil
+}
+
+// prefixAll returns each of s with prefix.
+func prefixAll(prefix string, s []string) []string {
+	prefixed := make([]string, len(s))
+	for i := range s {
+		prefixed[i] = prefix + s[i]
+	}
+	return prefixed
+}
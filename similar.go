@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+type SimilarCmd struct {
+	Roots       []string
+	FileRegexps []*regexp.Regexp
+	NumWorkers  int
+	Recursive   bool
+	// Threshold is the most bits the perceptual hashes of two images may
+	// differ by for them to be similar, out of 64.
+	Threshold int
+	JSON      bool
+	Stdout    io.Writer
+	Stderr    io.Writer
+}
+
+func SimilarCommand(args []string) (*SimilarCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	similarCmd := &SimilarCmd{
+		Roots:  []string{cwd},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	flagset := flag.NewFlagSet("similar", flag.ContinueOnError)
+	flagset.IntVar(&similarCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.BoolVar(&similarCmd.Recursive, "recursive", false, "Walk the roots recursively.")
+	flagset.IntVar(&similarCmd.Threshold, "threshold", 10, "Group images whose perceptual hashes differ by at most this many bits (0-64).")
+	flagset.BoolVar(&similarCmd.JSON, "json", false, "Print the groups as JSON.")
+	flagset.Func("root", "Specify an additional root directory. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		similarCmd.Roots = append(similarCmd.Roots, root)
+		return nil
+	})
+	var filePatterns []string
+	flagset.Func("file", "Include file regex. Can be repeated. If omitted, every file is included.", func(value string) error {
+		_, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		filePatterns = append(filePatterns, value)
+		return nil
+	})
+	ignoreCase := flagset.Bool("ignore-case", false, "Match -file patterns case-insensitively.")
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if similarCmd.Threshold < 0 || similarCmd.Threshold > 64 {
+		return nil, fmt.Errorf("invalid -threshold %d (want 0-64)", similarCmd.Threshold)
+	}
+	similarCmd.FileRegexps, err = compileRegexps(filePatterns, *ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	return similarCmd, nil
+}
+
+// SimilarImage is an image in a group of similar images.
+type SimilarImage struct {
+	FilePath string `json:"filePath"`
+	// Distance is how many bits its perceptual hash differs from that of
+	// the first image in the group by.
+	Distance int `json:"distance"`
+}
+
+func (similarCmd *SimilarCmd) Run(ctx context.Context) error {
+	var filePaths []string
+	seen := make(map[string]bool)
+	for _, root := range similarCmd.Roots {
+		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dirEntry.IsDir() {
+				if path != "." && (!similarCmd.Recursive || isNASMetadataDir(dirEntry.Name())) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !dirEntry.Type().IsRegular() {
+				return nil
+			}
+			if len(similarCmd.FileRegexps) > 0 && !slices.ContainsFunc(similarCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+				return fileRegexp.MatchString(dirEntry.Name())
+			}) {
+				return nil
+			}
+			filePath := filepath.Join(root, path)
+			if seen[filePath] {
+				// Overlapping roots.
+				return nil
+			}
+			seen[filePath] = true
+			filePaths = append(filePaths, filePath)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	slices.Sort(filePaths)
+	// Files that can't be decoded as images (including those that aren't
+	// images at all) are left with no hash.
+	hashes := make([]uint64, len(filePaths))
+	hashed := make([]bool, len(filePaths))
+	var waitGroup sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < max(similarCmd.NumWorkers, 1); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				hash, err := perceptualHash(filePaths[i])
+				if err != nil {
+					continue
+				}
+				hashes[i], hashed[i] = hash, true
+			}
+		}()
+	}
+	for i := range filePaths {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// Similarity isn't transitive, so a group is every image that can be
+	// reached from every other one through similar pairs.
+	groupOf := newUnionFind(len(filePaths))
+	for i := range filePaths {
+		for j := i + 1; j < len(filePaths); j++ {
+			if hashed[i] && hashed[j] && bits.OnesCount64(hashes[i]^hashes[j]) <= similarCmd.Threshold {
+				groupOf.union(i, j)
+			}
+		}
+	}
+	members := make(map[int][]int)
+	for i := range filePaths {
+		if hashed[i] {
+			root := groupOf.find(i)
+			members[root] = append(members[root], i)
+		}
+	}
+	groups := [][]SimilarImage{}
+	for i := range filePaths {
+		indexes := members[i]
+		if len(indexes) < 2 {
+			continue
+		}
+		// indexes are in path order, so the first image in the group is the
+		// first by path.
+		group := make([]SimilarImage, len(indexes))
+		for k, index := range indexes {
+			group[k] = SimilarImage{FilePath: filePaths[index], Distance: bits.OnesCount64(hashes[indexes[0]] ^ hashes[index])}
+		}
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b []SimilarImage) int {
+		return cmp.Compare(a[0].FilePath, b[0].FilePath)
+	})
+	if similarCmd.JSON {
+		encoder := json.NewEncoder(similarCmd.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(groups)
+	}
+	for _, group := range groups {
+		fmt.Fprintln(similarCmd.Stdout, group[0].FilePath)
+		for _, similarImage := range group[1:] {
+			fmt.Fprintf(similarCmd.Stdout, "  %s (distance %d)\n", similarImage.FilePath, similarImage.Distance)
+		}
+	}
+	return nil
+}
+
+// perceptualHash returns the difference hash (dHash) of an image: the image
+// is shrunk to 9×8 grey cells and each bit says whether a cell is brighter
+// than the one to its right. Resized, recompressed and lightly edited copies
+// of an image get hashes that differ in only a few bits. The EXIF thumbnail
+// is hashed if there is one, which is far faster than decoding the image.
+func perceptualHash(filePath string) (uint64, error) {
+	var src image.Image
+	thumbnail, err := exifThumbnail(filePath)
+	if err == nil {
+		src, _, err = image.Decode(bytes.NewReader(thumbnail))
+	}
+	if err != nil {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		src, _, err = image.Decode(file)
+		if err != nil {
+			return 0, err
+		}
+	}
+	const width, height = 9, 8
+	// samples is how many points of each cell are averaged along each axis,
+	// which is enough to be stable without reading every pixel.
+	const samples = 8
+	bounds := src.Bounds()
+	if bounds.Dx() < width || bounds.Dy() < height {
+		return 0, fmt.Errorf("%s: image too small to hash", filePath)
+	}
+	var cells [height][width]int
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sum := 0
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := bounds.Min.X + ((x*samples+sx)*bounds.Dx()+bounds.Dx()/2)/(width*samples)
+					py := bounds.Min.Y + ((y*samples+sy)*bounds.Dy()+bounds.Dy()/2)/(height*samples)
+					sum += int(color.GrayModel.Convert(src.At(px, py)).(color.Gray).Y)
+				}
+			}
+			cells[y][x] = sum
+		}
+	}
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// unionFind is a disjoint-set forest over the integers 0 to n-1.
+type unionFind struct {
+	parent []int
+	rank   []int
+}
+
+func newUnionFind(n int) *unionFind {
+	groupOf := &unionFind{parent: make([]int, n), rank: make([]int, n)}
+	for i := range groupOf.parent {
+		groupOf.parent[i] = i
+	}
+	return groupOf
+}
+
+// find returns the representative of the set containing i.
+func (groupOf *unionFind) find(i int) int {
+	for groupOf.parent[i] != i {
+		// Path halving.
+		groupOf.parent[i] = groupOf.parent[groupOf.parent[i]]
+		i = groupOf.parent[i]
+	}
+	return i
+}
+
+// union merges the sets containing i and j.
+func (groupOf *unionFind) union(i, j int) {
+	i, j = groupOf.find(i), groupOf.find(j)
+	if i == j {
+		return
+	}
+	if groupOf.rank[i] < groupOf.rank[j] {
+		i, j = j, i
+	}
+	groupOf.parent[j] = i
+	if groupOf.rank[i] == groupOf.rank[j] {
+		groupOf.rank[i]++
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// virtualTree is an in-memory model of the roots as a run leaves them: the
+// files on disk, less the ones moved away and plus the ones moved in so far.
+type virtualTree struct {
+	added   map[string]bool
+	removed map[string]bool
+}
+
+// exists reports whether path exists in the tree.
+func (tree *virtualTree) exists(path string) bool {
+	if tree.added[path] {
+		return true
+	}
+	if tree.removed[path] {
+		return false
+	}
+	_, err := os.Lstat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// move moves oldPath to newPath in the tree, or copies it there if keep is
+// set.
+func (tree *virtualTree) move(oldPath, newPath string, keep bool) {
+	if !keep {
+		delete(tree.added, oldPath)
+		tree.removed[oldPath] = true
+	}
+	if newPath != "" {
+		delete(tree.removed, newPath)
+		tree.added[newPath] = true
+	}
+}
+
+// availablePath is availablePath against the tree.
+func (tree *virtualTree) availablePath(path, oldPath string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := base + "-" + strconv.Itoa(i) + ext
+		if candidate == oldPath || !tree.exists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// rename carries out the rename of oldPath to newPath in the tree under a
+// collision policy, like collisionResolver.rename. pending are the files
+// renamed later in the run.
+func (tree *virtualTree) rename(oldPath, newPath, policy string, pending map[string]bool, keep bool) (string, string, error) {
+	if !tree.exists(newPath) {
+		tree.move(oldPath, newPath, keep)
+		return newPath, "", nil
+	}
+	if !tree.added[newPath] && !tree.removed[oldPath] {
+		// newPath may be the file itself, as for collisionResolver.
+		oldInfo, oldErr := os.Lstat(oldPath)
+		newInfo, newErr := os.Lstat(newPath)
+		if oldErr == nil && newErr == nil && os.SameFile(oldInfo, newInfo) {
+			tree.move(oldPath, newPath, keep)
+			return newPath, "", nil
+		}
+	}
+	var warning string
+	if pending[newPath] {
+		warning = fmt.Sprintf("%s is only renamed later in the run, so whether this collides depends on which is renamed first", newPath)
+	}
+	switch policy {
+	case collisionReplace:
+		if pending[newPath] {
+			return newPath, "", ErrReplacesPending
+		}
+		tree.move(oldPath, newPath, keep)
+		return newPath, strings.TrimPrefix(warning+"; replaces an existing file", "; "), nil
+	case collisionSuffix:
+		newPath = tree.availablePath(newPath, oldPath)
+		if newPath == oldPath {
+			return newPath, warning, ErrAlreadyNamed
+		}
+		tree.move(oldPath, newPath, keep)
+		return newPath, warning, nil
+	case collisionAsk:
+		return newPath, strings.TrimPrefix(warning+"; would ask what to do", "; "), ErrCollision
+	}
+	return newPath, warning, ErrCollision
+}
+
+// simulate carries out the renames worked out by a dry run of Renames
+// against a virtualTree, in the order they are reported, so that conflicts
+// between files of the run show up: two files given the same name, or a
+// file given the name of one that is only renamed later in the run, which
+// only succeeds if the later one happens to be renamed first. The results
+// are collected before the first is yielded, as a file can collide with any
+// that comes after it.
+func (jpegidCmd *JpegIDCmd) simulate(renames iter.Seq2[RenameResult, error]) iter.Seq2[RenameResult, error] {
+	return func(yield func(RenameResult, error) bool) {
+		type entry struct {
+			result RenameResult
+			err    error
+		}
+		var entries []entry
+		var fatalErr error
+		for result, err := range renames {
+			if err != nil && result.FilePath == "" {
+				fatalErr = err
+				break
+			}
+			entries = append(entries, entry{result, err})
+		}
+		// pending are the files that are yet to be renamed.
+		pending := make(map[string]bool)
+		for _, entry := range entries {
+			if entry.err == nil {
+				pending[entry.result.FilePath] = true
+			}
+		}
+		tree := &virtualTree{added: make(map[string]bool), removed: make(map[string]bool)}
+		keep := jpegidCmd.CopyTo != ""
+		for _, entry := range entries {
+			result, err := entry.result, entry.err
+			if err == nil {
+				delete(pending, result.FilePath)
+				var warning string
+				result.NewFilePath, warning, err = tree.rename(result.FilePath, result.NewFilePath, jpegidCmd.collisionPolicy(result.FilePath), pending, keep)
+				if warning != "" {
+					result.Warning = strings.TrimPrefix(result.Warning+"; "+warning, "; ")
+				}
+			}
+			if err == nil {
+				for _, sidecar := range result.Sidecars {
+					tree.move(sidecar.FilePath, sidecar.NewFilePath, keep)
+				}
+			}
+			if !yield(result, err) {
+				return
+			}
+		}
+		if fatalErr != nil {
+			yield(RenameResult{}, fatalErr)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fsSnapshot is a filesystem snapshot taken with SnapshotCmd before a run,
+// such as a btrfs snapshot of each root:
+//
+//	-snapshot-cmd 'btrfs subvolume snapshot -r {root} {root}/.snapshots/{name}'
+//
+// or a single ZFS snapshot of the dataset holding the library:
+//
+//	-snapshot-cmd 'zfs snapshot tank/photos@{name}' -rollback-cmd 'zfs rollback -r tank/photos@{name}'
+type fsSnapshot struct {
+	// name is the name the snapshot was taken with, jpegid- followed by
+	// the start of the run.
+	name string
+	// dirs are the directories the command was run for, or a single
+	// empty one if it has no {root} placeholder.
+	dirs []string
+}
+
+// takeSnapshot runs SnapshotCmd for every directory the run may change: the
+// roots and the -copy-to or -into directory. A command without the {root}
+// placeholder is run once, for snapshots of a whole filesystem.
+func (jpegidCmd *JpegIDCmd) takeSnapshot(ctx context.Context) (*fsSnapshot, error) {
+	snapshot := &fsSnapshot{name: "jpegid-" + jpegidCmd.Now().UTC().Format("20060102T150405Z")}
+	if slices.ContainsFunc(jpegidCmd.SnapshotCmd, func(arg string) bool { return strings.Contains(arg, "{root}") }) {
+		for _, dir := range append(slices.Clone(jpegidCmd.Roots), jpegidCmd.CopyTo, jpegidCmd.MergeInto) {
+			dir = filepath.Clean(dir)
+			if dir != "." && !slices.Contains(snapshot.dirs, dir) {
+				snapshot.dirs = append(snapshot.dirs, dir)
+			}
+		}
+	} else {
+		snapshot.dirs = []string{""}
+	}
+	for _, dir := range snapshot.dirs {
+		err := runSnapshotCommand(ctx, jpegidCmd.SnapshotCmd, dir, snapshot.name)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot: %w", err)
+		}
+	}
+	return snapshot, nil
+}
+
+// rollback runs RollbackCmd for every directory the snapshot was taken for.
+// It is not cancelled along with the run, as it is what undoes a run that
+// was interrupted.
+func (jpegidCmd *JpegIDCmd) rollback(snapshot *fsSnapshot) error {
+	for _, dir := range snapshot.dirs {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		err := runSnapshotCommand(ctx, jpegidCmd.RollbackCmd, dir, snapshot.name)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("rollback: %w", err)
+		}
+	}
+	return nil
+}
+
+// runSnapshotCommand runs a snapshot or rollback command, with the {root}
+// and {name} placeholders in its arguments replaced with dir and name.
+func runSnapshotCommand(ctx context.Context, args []string, dir, name string) error {
+	replacer := strings.NewReplacer("{root}", dir, "{name}", name)
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = replacer.Replace(arg)
+	}
+	output, err := exec.CommandContext(ctx, expanded[0], expanded[1:]...).CombinedOutput()
+	if err != nil {
+		if output := strings.TrimSpace(string(output)); output != "" {
+			return fmt.Errorf("%s: %w: %s", strings.Join(expanded, " "), err, output)
+		}
+		return fmt.Errorf("%s: %w", strings.Join(expanded, " "), err)
+	}
+	return nil
+}
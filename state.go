@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// scanEntry is what is remembered about a file between runs.
+type scanEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// scanStateFile is the on-disk format of the scan state of a single root.
+type scanStateFile struct {
+	Root  string               `json:"root"`
+	Files map[string]scanEntry `json:"files"`
+}
+
+// scanState records the files that were already processed by a previous
+// run, so that unchanged files can be skipped.
+type scanState struct {
+	dir      string
+	mutex    sync.Mutex
+	previous map[string]map[string]scanEntry
+	next     map[string]map[string]scanEntry
+}
+
+// loadScanState loads the scan state of each root from dir. Roots without a
+// state file start out empty.
+func loadScanState(dir string, roots []string) (*scanState, error) {
+	state := &scanState{
+		dir:      dir,
+		previous: make(map[string]map[string]scanEntry),
+		next:     make(map[string]map[string]scanEntry),
+	}
+	for _, root := range roots {
+		state.previous[root] = make(map[string]scanEntry)
+		state.next[root] = make(map[string]scanEntry)
+		b, err := os.ReadFile(state.fileName(root))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		var stateFile scanStateFile
+		err = json.Unmarshal(b, &stateFile)
+		if err != nil {
+			return nil, err
+		}
+		for path, entry := range stateFile.Files {
+			state.previous[root][decodePath(path)] = entry
+		}
+	}
+	return state, nil
+}
+
+// defaultStateDir returns the directory where scan state is stored when
+// StateDir is empty.
+func defaultStateDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "jpegid", "state"), nil
+}
+
+func (state *scanState) fileName(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(state.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// unchanged reports whether the file at path (relative to root) was
+// processed by a previous run and has not changed since. Unchanged files are
+// carried over into the next state. Files outside the roots, as listed by
+// -files-from, have no state and are never unchanged.
+func (state *scanState) unchanged(root, path string, fileInfo fs.FileInfo) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	entry, ok := state.previous[root][path]
+	if !ok || entry.Size != fileInfo.Size() || !entry.ModTime.Equal(fileInfo.ModTime()) {
+		return false
+	}
+	state.next[root][path] = entry
+	return true
+}
+
+// record remembers the outcome of processing a file. Files that failed for
+// reasons that might not happen again are not recorded, so that they are
+// retried next run. Nor are files outside the roots loaded.
+func (state *scanState) record(result RenameResult, err error) {
+	if result.Root == "" {
+		return
+	}
+
+	if err != nil && !errors.Is(err, ErrNoMetadata) && !errors.Is(err, ErrUnsupportedFormat) && !errors.Is(err, ErrAlreadyNamed) {
+		return
+	}
+	filePath := result.FilePath
+	if err == nil && result.NewFilePath != "" {
+		filePath = result.NewFilePath
+	}
+	fileInfo, statErr := os.Stat(filePath)
+	if statErr != nil {
+		return
+	}
+	path, relErr := filepath.Rel(result.Root, filePath)
+	if relErr != nil {
+		return
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	files, ok := state.next[result.Root]
+	if !ok {
+		return
+	}
+	files[filepath.ToSlash(path)] = scanEntry{
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}
+}
+
+// save writes the next state of every root to disk. If the run didn't
+// finish, such as when it was stopped by a signal, the files it didn't get to
+// keep their previous state, so that the next run picks up where this one
+// stopped instead of starting over.
+func (state *scanState) save(finished bool) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	err := os.MkdirAll(state.dir, 0755)
+	if err != nil {
+		return err
+	}
+	for root, files := range state.next {
+		encoded := make(map[string]scanEntry, len(files))
+		for path, entry := range files {
+			encoded[encodePath(path)] = entry
+		}
+		if !finished {
+			// Saved in the middle of the run, by an interrupted run or
+			// -chunk-size: the files not seen yet are kept as they were.
+			for path, entry := range state.previous[root] {
+				if _, ok := files[path]; !ok {
+					encoded[encodePath(path)] = entry
+				}
+			}
+		}
+		b, err := json.Marshal(scanStateFile{Root: encodePath(root), Files: encoded})
+		if err != nil {
+			return err
+		}
+		fileName := state.fileName(root)
+		err = os.WriteFile(fileName+".tmp", b, 0644)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(fileName+".tmp", fileName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
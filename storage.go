@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// Storage kinds, as told apart by probeStorage.
+const (
+	storageSSD     = "ssd"
+	storageHDD     = "hdd"
+	storageNetwork = "network"
+)
+
+// storageWorkers returns the number of workers suited to a kind of storage.
+// Solid state storage keeps up with as many workers as there are CPUs to
+// run exiftool on; spinning disks thrash when asked to seek for more than a
+// couple of readers at once; network storage is limited by latency rather
+// than throughput, so more requests in flight hide it.
+func storageWorkers(kind string) int {
+	switch kind {
+	case storageHDD:
+		return 2
+	case storageNetwork:
+		return 16
+	}
+	return max(runtime.NumCPU(), 4)
+}
+
+// probeStorage tells what kind of storage root is on from how long reads
+// from a few of the files the run will look at take: a random read from
+// solid state storage takes well under a millisecond, one from a spinning
+// disk a seek of several milliseconds, and one over a network longer still.
+// Reads are made at random offsets spread across each file, so that a second
+// run is unlikely to find them in the page cache. It returns the median read
+// time, and false if root has too few files large enough to probe or the
+// reads were served from the cache.
+func (jpegidCmd *JpegIDCmd) probeStorage(ctx context.Context, root string) (kind string, latency time.Duration, ok bool) {
+	const (
+		maxFiles     = 8
+		maxEntries   = 1000
+		readsPerFile = 4
+	)
+	var filePaths []string
+	entries := 0
+	_ = jpegidCmd.walkRoot(ctx, root, nil, nil, func(filePath string, dirEntry fs.DirEntry, skip error) error {
+		entries++
+		if entries > maxEntries || len(filePaths) == maxFiles {
+			return fs.SkipAll
+		}
+		if skip != nil {
+			return nil
+		}
+		fileInfo, err := dirEntry.Info()
+		if err == nil && fileInfo.Mode().IsRegular() && fileInfo.Size() >= 16*probeReadSize {
+			filePaths = append(filePaths, filePath)
+		}
+		return nil
+	})
+	var latencies []time.Duration
+	b := make([]byte, probeReadSize)
+	for _, filePath := range filePaths {
+		file, err := os.Open(filePath)
+		if err != nil {
+			continue
+		}
+		fileInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+		blocks := fileInfo.Size() / probeReadSize
+		for i := range int64(readsPerFile) {
+			// A random block of each quarter of the file.
+			block := i*blocks/readsPerFile + rand.Int64N(max(blocks/readsPerFile, 1))
+			start := time.Now()
+			_, err = file.ReadAt(b, block*probeReadSize)
+			if err != nil && !errors.Is(err, io.EOF) {
+				break
+			}
+			latencies = append(latencies, time.Since(start))
+		}
+		file.Close()
+	}
+	return classifyStorage(latencies)
+}
+
+// probeReadSize is the size of each read made by probeStorage.
+const probeReadSize = 4096
+
+// classifyStorage tells what kind of storage reads that took latencies were
+// made from. Reads fast enough to have been served from the page cache say
+// nothing about the storage and are left out; if too few remain, the kind is
+// unclear and ok is false.
+func classifyStorage(latencies []time.Duration) (kind string, latency time.Duration, ok bool) {
+	const (
+		cacheHit   = 10 * time.Microsecond
+		minSamples = 4
+	)
+	latencies = slices.DeleteFunc(slices.Clone(latencies), func(latency time.Duration) bool {
+		return latency < cacheHit
+	})
+	if len(latencies) < minSamples {
+		return "", 0, false
+	}
+	slices.Sort(latencies)
+	latency = latencies[len(latencies)/2]
+	switch {
+	case latency < time.Millisecond:
+		return storageSSD, latency, true
+	case latency < 20*time.Millisecond:
+		return storageHDD, latency, true
+	}
+	return storageNetwork, latency, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClassifyStorage(t *testing.T) {
+	const µs, ms = time.Microsecond, time.Millisecond
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		wantKind  string
+		wantOK    bool
+	}{
+		{"ssd", []time.Duration{80 * µs, 120 * µs, 90 * µs, 100 * µs}, storageSSD, true},
+		{"hdd", []time.Duration{8 * ms, 12 * ms, 9 * ms, 15 * ms}, storageHDD, true},
+		{"network", []time.Duration{30 * ms, 45 * ms, 25 * ms, 60 * ms}, storageNetwork, true},
+		{"hdd with a few cache hits", []time.Duration{2 * µs, 8 * ms, 1 * µs, 12 * ms, 9 * ms, 15 * ms}, storageHDD, true},
+		{"cached", []time.Duration{2 * µs, 3 * µs, 1 * µs, 2 * µs, 9 * ms}, "", false},
+		{"too few files", []time.Duration{8 * ms}, "", false},
+		{"none", nil, "", false},
+		{"just under a millisecond", []time.Duration{999 * µs, 999 * µs, 999 * µs, 999 * µs}, storageSSD, true},
+		{"just under 20ms", []time.Duration{19 * ms, 19 * ms, 19 * ms, 19 * ms}, storageHDD, true},
+		{"20ms", []time.Duration{20 * ms, 20 * ms, 20 * ms, 20 * ms}, storageNetwork, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, _, ok := classifyStorage(tt.latencies)
+			if kind != tt.wantKind || ok != tt.wantOK {
+				t.Fatalf("classifyStorage(%v) = %q, %v, want %q, %v", tt.latencies, kind, ok, tt.wantKind, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestStorageWorkers(t *testing.T) {
+	tests := []struct {
+		kind string
+		want int
+	}{
+		{storageSSD, max(runtime.NumCPU(), 4)},
+		{storageHDD, 2},
+		{storageNetwork, 16},
+	}
+	for _, tt := range tests {
+		if got := storageWorkers(tt.kind); got != tt.want {
+			t.Errorf("storageWorkers(%q) = %d, want %d", tt.kind, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// skipReasons are the reasons a file can be skipped for, in the order they
+// are listed in the summary.
+var skipReasons = []struct {
+	err   error
+	key   string
+	label string
+}{
+	{ErrExcluded, "excluded", "excluded by pattern"},
+	{ErrUnchanged, "unchanged", "unchanged"},
+	{ErrTooNew, "tooNew", "too new"},
+	{ErrNoMetadata, "noMetadata", "without metadata"},
+	{ErrImplausibleDate, "implausibleDate", "implausible date"},
+	{ErrCorrupt, "corrupt", "corrupt"},
+	{ErrDuplicate, "duplicate", "already in the library"},
+	{ErrPaired, "paired", "renamed with their pair"},
+	{ErrVanished, "vanished", "vanished"},
+	{ErrChanged, "changed", "changed since the plan"},
+	{ErrAlreadyNamed, "alreadyNamed", "already named"},
+	{ErrCollision, "collision", "target exists"},
+	{ErrVetoed, "vetoed", "vetoed"},
+}
+
+// skipReason returns the summary key of the reason err skipped a file for,
+// or false if err is an error rather than a reason to skip.
+func skipReason(err error) (key string, ok bool) {
+	for _, reason := range skipReasons {
+		if errors.Is(err, reason.err) {
+			return reason.key, true
+		}
+	}
+	return "", false
+}
+
+// runSummary counts the outcomes of a run.
+type runSummary struct {
+	DryRun      bool           `json:"dryRun,omitempty"`
+	Renamed     int            `json:"renamed"`
+	Skipped     int            `json:"skipped"`
+	Errors      int            `json:"errors"`
+	SkipReasons map[string]int `json:"skipReasons,omitempty"`
+	Roots       []*rootSummary `json:"roots"`
+}
+
+// rootSummary counts the outcomes of the files in a single root.
+type rootSummary struct {
+	Root    string `json:"root"`
+	Scanned int    `json:"scanned"`
+	Renamed int    `json:"renamed"`
+	Skipped int    `json:"skipped"`
+	Errors  int    `json:"errors"`
+}
+
+func newRunSummary(roots []string, dryRun bool) *runSummary {
+	summary := &runSummary{DryRun: dryRun}
+	for _, root := range roots {
+		summary.Roots = append(summary.Roots, &rootSummary{Root: root})
+	}
+	return summary
+}
+
+// add counts the outcome of a single file in root.
+func (summary *runSummary) add(root string, err error) {
+	i := slices.IndexFunc(summary.Roots, func(rootSummary *rootSummary) bool {
+		return rootSummary.Root == root
+	})
+	if i < 0 {
+		i = len(summary.Roots)
+		summary.Roots = append(summary.Roots, &rootSummary{Root: root})
+	}
+	rootSummary := summary.Roots[i]
+	rootSummary.Scanned++
+	if err == nil {
+		summary.Renamed++
+		rootSummary.Renamed++
+		return
+	}
+	key, ok := skipReason(err)
+	if !ok {
+		summary.Errors++
+		rootSummary.Errors++
+		return
+	}
+	summary.Skipped++
+	rootSummary.Skipped++
+	if summary.SkipReasons == nil {
+		summary.SkipReasons = make(map[string]int)
+	}
+	summary.SkipReasons[key]++
+}
+
+// writeText writes the summary as a single line, e.g.
+//
+//	2 renamed, 4 skipped (3 excluded by pattern, 1 target exists), 1 error
+//
+// followed by a line per root if there is more than one, shown with
+// displayPath.
+func (summary *runSummary) writeText(w io.Writer, displayPath func(string) string) error {
+	var b strings.Builder
+	if summary.DryRun {
+		fmt.Fprintf(&b, "%d to rename", summary.Renamed)
+	} else {
+		fmt.Fprintf(&b, "%d renamed", summary.Renamed)
+	}
+	fmt.Fprintf(&b, ", %d skipped", summary.Skipped)
+	var reasons []string
+	for _, reason := range skipReasons {
+		if n := summary.SkipReasons[reason.key]; n > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d %s", n, reason.label))
+		}
+	}
+	if len(reasons) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(reasons, ", "))
+	}
+	if summary.Errors == 1 {
+		b.WriteString(", 1 error")
+	} else {
+		fmt.Fprintf(&b, ", %d errors", summary.Errors)
+	}
+	b.WriteString("\n")
+	if len(summary.Roots) > 1 {
+		renamed := "renamed"
+		if summary.DryRun {
+			renamed = "to rename"
+		}
+		for _, rootSummary := range summary.Roots {
+			fmt.Fprintf(&b, "  %s: %d scanned, %d %s, %d skipped, %d errors\n", displayPath(rootSummary.Root), rootSummary.Scanned, rootSummary.Renamed, renamed, rootSummary.Skipped, rootSummary.Errors)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeJSON writes the summary as JSON to name, or stdout if name is "-".
+func (summary *runSummary) writeJSON(name string, stdout io.Writer) error {
+	encoded := *summary
+	encoded.Roots = make([]*rootSummary, len(summary.Roots))
+	for i, rootSummary := range summary.Roots {
+		rootSummary := *rootSummary
+		rootSummary.Root = encodePath(rootSummary.Root)
+		encoded.Roots[i] = &rootSummary
+	}
+	b, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if name == "-" {
+		_, err = stdout.Write(b)
+		return err
+	}
+	err = os.WriteFile(name+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
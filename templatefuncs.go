@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// nameFuncs are the functions available to -name-template and -route
+// templates. The value they work on comes last so that they can be used in
+// pipelines, e.g. {{.Metadata.Model | slugify}} or {{.Name | padseq 5}}.
+var nameFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"slugify": slugify,
+	"substr":  substr,
+	"padseq":  padseq,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+// slugify lowercases s, drops the accents from its letters and turns every
+// run of characters other than letters and digits into a single dash, e.g.
+// "Canon EOS 5D Mark IV" into "canon-eos-5d-mark-iv".
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range normalize(s, normalizeNFD) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// The accent of a decomposed letter.
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			dash = true
+		}
+	}
+	return normalize(b.String(), normalizeNFC)
+}
+
+// substr returns length characters (not bytes) of s starting at start, or
+// the rest of s if length is negative. A negative start counts from the end
+// of s. Out of range bounds are clamped rather than an error, so that short
+// values don't fail the template.
+func substr(start, length int, s string) string {
+	runes := []rune(s)
+	if start < 0 {
+		start = max(len(runes)+start, 0)
+	}
+	start = min(start, len(runes))
+	end := len(runes)
+	if length >= 0 {
+		end = min(start+length, end)
+	}
+	return string(runes[start:end])
+}
+
+// lastNumberRegexp matches the last run of digits of a string.
+var lastNumberRegexp = regexp.MustCompile(`(\d+)\D*$`)
+
+// padseq returns a number zero-padded to width digits. value is an integer
+// or a string whose last run of digits is the number, such as the counter of
+// a camera name, so that {{.Name | padseq 6}} is 001234 for IMG_1234.
+// Numbers with more digits than width are kept whole.
+func padseq(width int, value any) (string, error) {
+	var n string
+	switch value := value.(type) {
+	case int:
+		n = strconv.Itoa(value)
+	case string:
+		match := lastNumberRegexp.FindStringSubmatch(value)
+		if match == nil {
+			return "", fmt.Errorf("padseq: no number in %q", value)
+		}
+		n = match[1]
+	default:
+		return "", fmt.Errorf("padseq: %v is not a number or a string", value)
+	}
+	negative := strings.HasPrefix(n, "-")
+	n = strings.TrimPrefix(n, "-")
+	if len(n) < width {
+		n = strings.Repeat("0", width-len(n)) + n
+	}
+	if negative {
+		n = "-" + n
+	}
+	return n, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// errNoThumbnail is returned by exifThumbnail for files without an EXIF
+// thumbnail.
+var errNoThumbnail = errors.New("no EXIF thumbnail")
+
+// exifThumbnail returns the JPEG thumbnail cameras store in the EXIF data
+// (IFD1) of a JPEG. Only the segments before the image data are read, which
+// is a few kilobytes rather than the whole file, so this is fast even over
+// network storage.
+func exifThumbnail(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var soi [2]byte
+	_, err = io.ReadFull(r, soi[:])
+	if err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, errNoThumbnail
+	}
+	for {
+		var header [4]byte
+		_, err := io.ReadFull(r, header[:])
+		if err != nil || header[0] != 0xFF {
+			return nil, errNoThumbnail
+		}
+		marker, length := header[1], int(binary.BigEndian.Uint16(header[2:]))-2
+		if marker == 0xDA || marker == 0xD9 || length < 0 {
+			// The image data starts, without an EXIF segment before it.
+			return nil, errNoThumbnail
+		}
+		if marker != 0xE1 {
+			_, err = r.Discard(length)
+			if err != nil {
+				return nil, errNoThumbnail
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return nil, errNoThumbnail
+		}
+		tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00"))
+		if !ok {
+			// XMP, which also lives in APP1.
+			continue
+		}
+		return tiffThumbnail(tiff)
+	}
+}
+
+// tiffThumbnail returns the thumbnail pointed to by IFD1 of the TIFF
+// structure at the start of EXIF data.
+func tiffThumbnail(tiff []byte) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, errNoThumbnail
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errNoThumbnail
+	}
+	// IFD0 describes the image and links to IFD1, which describes the
+	// thumbnail.
+	ifd0 := int(order.Uint32(tiff[4:]))
+	if ifd0 < 8 || ifd0+2 > len(tiff) {
+		return nil, errNoThumbnail
+	}
+	next := ifd0 + 2 + 12*int(order.Uint16(tiff[ifd0:]))
+	if next+4 > len(tiff) {
+		return nil, errNoThumbnail
+	}
+	ifd1 := int(order.Uint32(tiff[next:]))
+	if ifd1 < 8 || ifd1+2 > len(tiff) {
+		return nil, errNoThumbnail
+	}
+	var offset, length int
+	count := int(order.Uint16(tiff[ifd1:]))
+	for i := 0; i < count; i++ {
+		entry := ifd1 + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return nil, errNoThumbnail
+		}
+		// JPEGInterchangeFormat and JPEGInterchangeFormatLength are LONGs,
+		// stored in the value field itself.
+		switch order.Uint16(tiff[entry:]) {
+		case 0x0201:
+			offset = int(order.Uint32(tiff[entry+8:]))
+		case 0x0202:
+			length = int(order.Uint32(tiff[entry+8:]))
+		}
+	}
+	if offset <= 0 || length <= 2 || offset+length > len(tiff) || tiff[offset] != 0xFF || tiff[offset+1] != 0xD8 {
+		return nil, errNoThumbnail
+	}
+	return tiff[offset : offset+length], nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+)
+
+type TimelineCmd struct {
+	Roots       []string
+	FileRegexps []*regexp.Regexp
+	NumWorkers  int
+	Recursive   bool
+	// Output is the file the timeline is written to, or "-" for stdout.
+	Output string
+	// Gap is the shortest time without any photos that is reported as a
+	// gap.
+	Gap time.Duration
+	// ClusterSize is how many files must have the very same creation time
+	// for it to be reported as suspicious, as happens when a batch of
+	// files was given a date by a bad EXIF edit.
+	ClusterSize int
+	// MetadataCache reads creation times through the metadata cache shared
+	// with the other subcommands.
+	MetadataCache bool
+	Stdout        io.Writer
+	Stderr        io.Writer
+	Now           func() time.Time
+}
+
+func TimelineCommand(args []string) (*TimelineCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	timelineCmd := &TimelineCmd{
+		Roots:  []string{cwd},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Now:    time.Now,
+	}
+	flagset := flag.NewFlagSet("timeline", flag.ContinueOnError)
+	flagset.IntVar(&timelineCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
+	flagset.BoolVar(&timelineCmd.Recursive, "recursive", true, "Walk the roots recursively.")
+	flagset.StringVar(&timelineCmd.Output, "o", "-", "Write the timeline as JSON to this file (- for stdout).")
+	flagset.DurationVar(&timelineCmd.Gap, "gap", 30*24*time.Hour, "Report stretches of at least this long without photos as gaps.")
+	flagset.IntVar(&timelineCmd.ClusterSize, "cluster-size", 10, "Report times shared by at least this many files as suspicious.")
+	flagset.BoolVar(&timelineCmd.MetadataCache, "metadata-cache", false, "Reuse the metadata read from unchanged files by earlier runs of any subcommand, and cache what is read.")
+	flagset.Func("root", "Specify an additional root directory. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		timelineCmd.Roots = append(timelineCmd.Roots, root)
+		return nil
+	})
+	var filePatterns []string
+	flagset.Func("file", "Include file regex. Can be repeated. If omitted, every file is included.", func(value string) error {
+		_, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		filePatterns = append(filePatterns, value)
+		return nil
+	})
+	ignoreCase := flagset.Bool("ignore-case", false, "Match -file patterns case-insensitively.")
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	timelineCmd.FileRegexps, err = compileRegexps(filePatterns, *ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	return timelineCmd, nil
+}
+
+// Timeline is how many photos were taken when. Days and hours are those of
+// the wall clock where each photo was taken.
+type Timeline struct {
+	Files int `json:"files"`
+	// Undated is the number of files without a creation time.
+	Undated    int               `json:"undated"`
+	Days       []TimelineDay     `json:"days"`
+	Gaps       []TimelineGap     `json:"gaps"`
+	Suspicious []TimelineCluster `json:"suspicious"`
+}
+
+// TimelineDay is the number of photos taken on a day, in total and in each
+// hour of it.
+type TimelineDay struct {
+	Date  string  `json:"date"`
+	Count int     `json:"count"`
+	Hours [24]int `json:"hours"`
+}
+
+// TimelineGap is a stretch of time without photos between two photos.
+type TimelineGap struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Days int       `json:"days"`
+}
+
+// TimelineCluster is a creation time that is likely to be wrong, and the
+// files (up to 10 of them, as an example) that have it.
+type TimelineCluster struct {
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+	Reason string    `json:"reason"`
+	Files  []string  `json:"files"`
+}
+
+func (timelineCmd *TimelineCmd) Run(ctx context.Context) error {
+	var files []*compareFile
+	seen := make(map[string]bool)
+	for _, root := range timelineCmd.Roots {
+		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dirEntry.IsDir() {
+				if path != "." && (!timelineCmd.Recursive || isNASMetadataDir(dirEntry.Name())) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !dirEntry.Type().IsRegular() {
+				return nil
+			}
+			if len(timelineCmd.FileRegexps) > 0 && !slices.ContainsFunc(timelineCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+				return fileRegexp.MatchString(dirEntry.Name())
+			}) {
+				return nil
+			}
+			filePath := filepath.Join(root, path)
+			if seen[filePath] {
+				// Overlapping roots.
+				return nil
+			}
+			seen[filePath] = true
+			files = append(files, &compareFile{path: filePath})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var cache *metadataCache
+	if timelineCmd.MetadataCache {
+		var err error
+		cache, err = openMetadataCache("")
+		if err != nil {
+			return err
+		}
+	}
+	err := readCreationTimes(ctx, files, timelineCmd.NumWorkers, cache, timelineCmd.Stderr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(timelineCmd.Stderr, "warning: only files named by jpegid are dated: %v\n", err)
+	}
+	timeline := timelineCmd.timeline(files)
+	b, err := json.MarshalIndent(timeline, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if timelineCmd.Output == "-" {
+		_, err = timelineCmd.Stdout.Write(b)
+	} else {
+		err = os.WriteFile(timelineCmd.Output, b, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(timelineCmd.Stderr, "%d files over %d days (%d undated), %d gaps, %d suspicious times\n", timeline.Files, len(timeline.Days), timeline.Undated, len(timeline.Gaps), len(timeline.Suspicious))
+	return nil
+}
+
+// timeline counts files by their creation time.
+func (timelineCmd *TimelineCmd) timeline(files []*compareFile) Timeline {
+	timeline := Timeline{
+		Files:      len(files),
+		Days:       []TimelineDay{},
+		Gaps:       []TimelineGap{},
+		Suspicious: []TimelineCluster{},
+	}
+	var dated []*compareFile
+	for _, file := range files {
+		if file.creationTime.IsZero() {
+			timeline.Undated++
+			continue
+		}
+		dated = append(dated, file)
+	}
+	slices.SortStableFunc(dated, func(a, b *compareFile) int {
+		return a.creationTime.Compare(b.creationTime)
+	})
+	days := make(map[string]*TimelineDay)
+	// clusters are the files with each creation time, to the second and
+	// including the offset.
+	clusters := make(map[string][]*compareFile)
+	for i, file := range dated {
+		date := file.creationTime.Format("2006-01-02")
+		day := days[date]
+		if day == nil {
+			day = &TimelineDay{Date: date}
+			days[date] = day
+		}
+		day.Count++
+		day.Hours[file.creationTime.Hour()]++
+		key := file.creationTime.Format(time.RFC3339)
+		clusters[key] = append(clusters[key], file)
+		if i > 0 {
+			previous := dated[i-1].creationTime
+			if gap := file.creationTime.Sub(previous); gap >= timelineCmd.Gap {
+				timeline.Gaps = append(timeline.Gaps, TimelineGap{From: previous, To: file.creationTime, Days: int(gap / (24 * time.Hour))})
+			}
+		}
+	}
+	for _, day := range days {
+		timeline.Days = append(timeline.Days, *day)
+	}
+	slices.SortFunc(timeline.Days, func(a, b TimelineDay) int {
+		return cmp.Compare(a.Date, b.Date)
+	})
+	now := timelineCmd.Now()
+	for _, cluster := range clusters {
+		creationTime := cluster[0].creationTime
+		reason := implausibleDate(creationTime, now)
+		if reason == "" && len(cluster) >= max(timelineCmd.ClusterSize, 2) {
+			reason = "shared by many files"
+		}
+		if reason == "" {
+			continue
+		}
+		suspicious := TimelineCluster{Time: creationTime, Count: len(cluster), Reason: reason}
+		for _, file := range cluster[:min(len(cluster), 10)] {
+			suspicious.Files = append(suspicious.Files, file.path)
+		}
+		timeline.Suspicious = append(timeline.Suspicious, suspicious)
+	}
+	slices.SortFunc(timeline.Suspicious, func(a, b TimelineCluster) int {
+		return a.Time.Compare(b.Time)
+	})
+	return timeline
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceBatchSize is the number of files a worker handles under a single
+// batch span.
+const traceBatchSize = 100
+
+// tracer records OpenTelemetry spans for a run, a span for the run with a
+// span per stage of each pipeline and per batch of files handled by a
+// worker, and exports them to an OTLP/HTTP collector (in the JSON encoding)
+// at the end of the run. A nil tracer records nothing.
+type tracer struct {
+	endpoint string
+	traceID  [16]byte
+	// root is the span of the run, which every other span is under.
+	root *span
+
+	mutex sync.Mutex
+	spans []otlpSpan
+}
+
+// span is a span being recorded. A nil span records nothing.
+type span struct {
+	tracer     *tracer
+	id         [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	attributes []otlpKeyValue
+}
+
+// newTracer returns a tracer exporting to endpoint, an OTLP/HTTP collector
+// such as http://localhost:4318, and starts the span of the run. The run
+// joins the trace of the process that started it if TRACEPARENT holds a W3C
+// trace context, as set by otel-cli and CI systems.
+func newTracer(endpoint string, attributes ...otlpKeyValue) *tracer {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	tracer := &tracer{endpoint: endpoint}
+	var parentID [8]byte
+	traceID, spanID, ok := parseTraceparent(os.Getenv("TRACEPARENT"))
+	if ok {
+		tracer.traceID, parentID = traceID, spanID
+	} else {
+		_, _ = rand.Read(tracer.traceID[:])
+	}
+	tracer.root = &span{tracer: tracer, parentID: parentID, name: "jpegid", start: time.Now(), attributes: attributes}
+	_, _ = rand.Read(tracer.root.id[:])
+	return tracer
+}
+
+// parseTraceparent parses a W3C traceparent header value, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(value string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	_, traceErr := hex.Decode(traceID[:], []byte(parts[1]))
+	_, spanErr := hex.Decode(spanID[:], []byte(parts[2]))
+	return traceID, spanID, traceErr == nil && spanErr == nil && traceID != [16]byte{} && spanID != [8]byte{}
+}
+
+// start starts a span under parent, or the span of the run if parent is
+// nil.
+func (tracer *tracer) start(parent *span, name string, attributes ...otlpKeyValue) *span {
+	if tracer == nil {
+		return nil
+	}
+	if parent == nil {
+		parent = tracer.root
+	}
+	span := &span{tracer: tracer, parentID: parent.id, name: name, start: time.Now(), attributes: attributes}
+	_, _ = rand.Read(span.id[:])
+	return span
+}
+
+// end ends span, as failed with err if it is not nil.
+func (span *span) end(err error, attributes ...otlpKeyValue) {
+	if span == nil {
+		return
+	}
+	recorded := otlpSpan{
+		TraceID:           hex.EncodeToString(span.tracer.traceID[:]),
+		SpanID:            hex.EncodeToString(span.id[:]),
+		Name:              span.name,
+		Kind:              1, // SPAN_KIND_INTERNAL
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        append(span.attributes, attributes...),
+	}
+	if span.parentID != [8]byte{} {
+		recorded.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	if err != nil {
+		recorded.Status = &otlpStatus{Code: 2, Message: err.Error()} // STATUS_CODE_ERROR
+	}
+	span.tracer.mutex.Lock()
+	span.tracer.spans = append(span.tracer.spans, recorded)
+	span.tracer.mutex.Unlock()
+}
+
+// finish ends the span of the run and exports every span recorded.
+func (tracer *tracer) finish(err error, attributes ...otlpKeyValue) error {
+	if tracer == nil {
+		return nil
+	}
+	tracer.root.end(err, attributes...)
+	tracer.mutex.Lock()
+	spans := tracer.spans
+	tracer.spans = nil
+	tracer.mutex.Unlock()
+	b, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{stringAttribute("service.name", "jpegid")}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/bokwoon95/jpegid"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, tracer.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", tracer.endpoint, response.Status)
+	}
+	return nil
+}
+
+// stageTrace is the span of a stage of a pipeline, with the batch spans of
+// its workers under it.
+type stageTrace struct {
+	span    *span
+	batches []*spanBatch
+}
+
+// stage starts the span of a stage of the pipeline of root group group.
+func (tracer *tracer) stage(name string, group int) *stageTrace {
+	if tracer == nil {
+		return nil
+	}
+	return &stageTrace{span: tracer.start(nil, name, intAttribute("jpegid.group", int64(group+1)))}
+}
+
+// batch returns the batch spans of a worker of the stage.
+func (stage *stageTrace) batch() *spanBatch {
+	if stage == nil {
+		return nil
+	}
+	batch := &spanBatch{parent: stage.span, name: stage.span.name + " batch"}
+	stage.batches = append(stage.batches, batch)
+	return batch
+}
+
+// end ends the stage, once every worker of it has returned.
+func (stage *stageTrace) end() {
+	if stage == nil {
+		return
+	}
+	var files int64
+	for _, batch := range stage.batches {
+		files += batch.total
+		batch.end()
+	}
+	stage.span.end(nil, intAttribute("jpegid.files", files))
+}
+
+// spanBatch records the files handled by a single worker in spans of
+// traceBatchSize files. It is only used by its worker.
+type spanBatch struct {
+	parent *span
+	name   string
+	span   *span
+	files  int64
+	total  int64
+}
+
+// begin records that the worker started on a file.
+func (batch *spanBatch) begin() {
+	if batch == nil || batch.span != nil {
+		return
+	}
+	batch.span = batch.parent.tracer.start(batch.parent, batch.name)
+}
+
+// done records that the worker is done with a file.
+func (batch *spanBatch) done() {
+	if batch == nil {
+		return
+	}
+	batch.files++
+	batch.total++
+	if batch.files == traceBatchSize {
+		batch.end()
+	}
+}
+
+// end ends the current batch span, if any.
+func (batch *spanBatch) end() {
+	if batch == nil || batch.span == nil {
+		return
+	}
+	batch.span.end(nil, intAttribute("jpegid.files", batch.files))
+	batch.span, batch.files = nil, 0
+}
+
+// The OTLP/HTTP JSON encoding of spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	// IntValue is a decimal string, as 64-bit integers are in JSON
+	// protobuf.
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func boolAttribute(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{BoolValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpValue{IntValue: &s}}
+}
@@ -3,10 +3,19 @@
 package main
 
 import (
+	"fmt"
+	"io/fs"
+	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
 	"syscall"
 )
 
+// statusSignals are the signals that make a run dump the state of its
+// workers to stderr.
+var statusSignals = []os.Signal{syscall.SIGUSR1}
+
 func stop(cmd *exec.Cmd) {
 	pgid := -cmd.Process.Pid
 	_ = syscall.Kill(pgid, syscall.SIGTERM)
@@ -17,3 +26,99 @@ func setpgid(cmd *exec.Cmd) {
 		Setpgid: true,
 	}
 }
+
+// checkWritable reports whether files can be renamed inside dir. access(2)
+// fails with EROFS on read-only mounts and EACCES without write permission.
+func checkWritable(dir string) error {
+	return syscall.Access(dir, 0x2 /* W_OK */)
+}
+
+// deviceID identifies the device that path lives on.
+func deviceID(path string) (string, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("%s: unable to determine device", path)
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10), nil
+}
+
+// maxNameLength and maxPathLength are the longest file name and path, in
+// bytes, that can be renamed to. macOS has a shorter PATH_MAX than Linux.
+const maxNameLength = 255
+
+func maxPathLength() int {
+	if runtime.GOOS == "darwin" {
+		return 1024
+	}
+	return 4096
+}
+
+// pathLength returns the length of path as counted by maxNameLength and
+// maxPathLength.
+func pathLength(path string) int {
+	return len(path)
+}
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem dir is on.
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// copyOwnership gives name the owner and group of fileInfo. Only root may
+// change the owner of a file, so for other users it does nothing.
+func copyOwnership(name string, fileInfo fs.FileInfo) error {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(name, int(stat.Uid), int(stat.Gid))
+}
+
+// inheritGroup gives dir, just created in the directory described by
+// parent, the group and setgid bit of parent if it has the setgid bit set.
+// Linux does so by itself, BSDs and macOS only give new directories the
+// group.
+func inheritGroup(dir string, parent fs.FileInfo) error {
+	parentStat, ok := parent.Sys().(*syscall.Stat_t)
+	if !ok || parent.Mode()&fs.ModeSetgid == 0 {
+		return nil
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Gid != parentStat.Gid {
+		err = os.Lchown(dir, -1, int(parentStat.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	if info.Mode()&fs.ModeSetgid == 0 {
+		return os.Chmod(dir, info.Mode()&(fs.ModePerm|fs.ModeSticky)|fs.ModeSetgid)
+	}
+	return nil
+}
+
+// tryLockFile takes an exclusive lock on file without waiting, reporting
+// false if another process holds it. The lock is released when file is
+// closed.
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, &os.PathError{Op: "flock", Path: file.Name(), Err: err}
+	}
+	return true, nil
+}
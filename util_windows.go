@@ -3,13 +3,118 @@
 package main
 
 import (
+	"io/fs"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	// Windows has no timezone database of its own for -trip timezone
+	// names.
+	_ "time/tzdata"
 )
 
+// statusSignals are the signals that make a run dump the state of its
+// workers to stderr. Windows has no signal to spare.
+var statusSignals []os.Signal
+
 func stop(cmd *exec.Cmd) {
 	killCmd := exec.Command("taskkill.exe", "/t", "/f", "/pid", strconv.Itoa(cmd.Process.Pid))
 	_ = killCmd.Run()
 }
 
 func setpgid(cmd *exec.Cmd) {}
+
+// checkWritable reports whether files can be renamed inside dir. Windows ACLs
+// can't be checked reliably without trying, so a temporary file is created
+// and removed.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".jpegid-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// deviceID identifies the device that path lives on. Drive letters and UNC
+// shares each count as a separate device.
+func deviceID(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(filepath.VolumeName(path)), nil
+}
+
+// maxNameLength and maxPathLength are the longest file name and path, in
+// UTF-16 code units, that can be renamed to. Go itself copes with longer
+// paths, but Explorer and most other programs are still limited to MAX_PATH
+// (260 including the terminating NUL).
+const maxNameLength = 255
+
+func maxPathLength() int {
+	return 259
+}
+
+// pathLength returns the length of path as counted by maxNameLength and
+// maxPathLength.
+func pathLength(path string) int {
+	return len(utf16.Encode([]rune(path)))
+}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the number of bytes available to the current user on the
+// volume dir is on.
+func freeSpace(dir string) (uint64, error) {
+	pathp, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathp)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if r == 0 {
+		return 0, &os.PathError{Op: "GetDiskFreeSpaceEx", Path: dir, Err: err}
+	}
+	return free, nil
+}
+
+// copyOwnership does nothing, as files on Windows are owned through their
+// ACLs.
+func copyOwnership(name string, fileInfo fs.FileInfo) error {
+	return nil
+}
+
+// inheritGroup does nothing, as Windows has no setgid directories.
+func inheritGroup(dir string, parent fs.FileInfo) error {
+	return nil
+}
+
+var lockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// tryLockFile takes an exclusive lock on file without waiting, reporting
+// false if another process holds it. The lock is released when file is
+// closed. Windows locks keep other processes from reading what they cover,
+// so a single byte far past the end of the file is locked instead of its
+// contents, leaving the journal readable by jpegid history.
+func tryLockFile(file *os.File) (bool, error) {
+	const (
+		lockfileFailImmediately = 0x1
+		lockfileExclusiveLock   = 0x2
+		errorLockViolation      = syscall.Errno(33)
+	)
+	overlapped := syscall.Overlapped{OffsetHigh: 0x7fffffff}
+	r, _, err := lockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		if err == errorLockViolation {
+			return false, nil
+		}
+		return false, &os.PathError{Op: "LockFileEx", Path: file.Name(), Err: err}
+	}
+	return true, nil
+}
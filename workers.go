@@ -0,0 +1,138 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// publishedWorkers is the workerMonitor of the current run, published as the
+// "workers" expvar so that it can be read from /debug/vars while -pprof is
+// being served.
+var publishedWorkers atomic.Pointer[workerMonitor]
+
+func init() {
+	expvar.Publish("workers", expvar.Func(func() any {
+		monitor := publishedWorkers.Load()
+		if monitor == nil {
+			return []workerSnapshot{}
+		}
+		return monitor.snapshot(time.Now())
+	}))
+}
+
+// workerStats are the statistics of a single worker of a renamePipeline.
+type workerStats struct {
+	stage string
+	group int
+	index int
+	// handled is the number of files the worker has finished with, busy
+	// the total time it spent on them and restarts the number of times
+	// its resources had to be replaced.
+	handled  atomic.Int64
+	busy     atomic.Int64
+	restarts atomic.Int64
+	// batch records the files the worker handles in batch spans, if the
+	// run is traced.
+	batch *spanBatch
+
+	mu       sync.Mutex
+	filePath string
+	started  time.Time
+}
+
+// begin records that the worker started on filePath. The returned function
+// records that it is done with it.
+func (stats *workerStats) begin(filePath string) (end func()) {
+	started := time.Now()
+	stats.mu.Lock()
+	stats.filePath, stats.started = filePath, started
+	stats.mu.Unlock()
+	stats.batch.begin()
+	return func() {
+		stats.batch.done()
+		stats.busy.Add(int64(time.Since(started)))
+		stats.handled.Add(1)
+		stats.mu.Lock()
+		stats.filePath, stats.started = "", time.Time{}
+		stats.mu.Unlock()
+	}
+}
+
+// workerSnapshot is the state of a worker at a point in time.
+type workerSnapshot struct {
+	Stage    string `json:"stage"`
+	Group    int    `json:"group"`
+	Worker   int    `json:"worker"`
+	Handled  int64  `json:"handled"`
+	Restarts int64  `json:"restarts"`
+	// AvgLatency is the average time the worker spent on a file.
+	AvgLatency time.Duration `json:"avgLatencyNs"`
+	// FilePath is the file the worker is on, if any, and BusyFor how long
+	// it has been on it.
+	FilePath string        `json:"filePath,omitempty"`
+	BusyFor  time.Duration `json:"busyForNs,omitempty"`
+}
+
+// workerMonitor keeps the statistics of the workers of every pipeline of a
+// run.
+type workerMonitor struct {
+	mu      sync.Mutex
+	workers []*workerStats
+}
+
+// add registers a worker of stage in the pipeline of root group group.
+func (monitor *workerMonitor) add(stage string, group, index int) *workerStats {
+	stats := &workerStats{stage: stage, group: group, index: index}
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	monitor.workers = append(monitor.workers, stats)
+	return stats
+}
+
+// snapshot returns the state of every worker at now, in the order they were
+// added.
+func (monitor *workerMonitor) snapshot(now time.Time) []workerSnapshot {
+	monitor.mu.Lock()
+	workers := monitor.workers
+	monitor.mu.Unlock()
+	snapshots := make([]workerSnapshot, 0, len(workers))
+	for _, stats := range workers {
+		snapshot := workerSnapshot{
+			Stage:    stats.stage,
+			Group:    stats.group + 1,
+			Worker:   stats.index + 1,
+			Handled:  stats.handled.Load(),
+			Restarts: stats.restarts.Load(),
+		}
+		if snapshot.Handled > 0 {
+			snapshot.AvgLatency = time.Duration(stats.busy.Load() / snapshot.Handled)
+		}
+		stats.mu.Lock()
+		if stats.filePath != "" {
+			snapshot.FilePath, snapshot.BusyFor = stats.filePath, now.Sub(stats.started)
+		}
+		stats.mu.Unlock()
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+// writeText writes the state of every worker to w as a table, one line per
+// worker, with the files they are on shown with displayPath.
+func (monitor *workerMonitor) writeText(w io.Writer, displayPath func(string) string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tGROUP\tWORKER\tFILES\tAVG\tRESTARTS\tBUSY ON")
+	for _, snapshot := range monitor.snapshot(time.Now()) {
+		busyOn := "-"
+		if snapshot.FilePath != "" {
+			busyOn = fmt.Sprintf("%s (%s)", displayPath(snapshot.FilePath), snapshot.BusyFor.Round(time.Millisecond))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%d\t%s\n", snapshot.Stage, snapshot.Group, snapshot.Worker, snapshot.Handled, snapshot.AvgLatency.Round(time.Microsecond), snapshot.Restarts, busyOn)
+	}
+	return tw.Flush()
+}